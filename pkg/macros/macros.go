@@ -49,6 +49,28 @@ func contextFrom(q *sqlutil.Query) macropro.QueryContext[struct{}] {
 	}
 }
 
+// AlignTimeRange widens tr to whole multiples of interval since the Unix
+// epoch, the same grid toStartOfInterval buckets on: From is rounded down and
+// To rounded up. Successive refreshes of a dashboard then expand the time
+// macros to the same SQL until the range moves into the next interval. An
+// interval under a millisecond leaves tr unchanged.
+func AlignTimeRange(tr backend.TimeRange, interval time.Duration) backend.TimeRange {
+	step := interval.Milliseconds()
+	if step <= 0 {
+		return tr
+	}
+	from := tr.From.UnixMilli()
+	from -= from % step
+	to := tr.To.UnixMilli()
+	if rem := to % step; rem != 0 {
+		to += step - rem
+	}
+	return backend.TimeRange{
+		From: time.UnixMilli(from).In(tr.From.Location()),
+		To:   time.UnixMilli(to).In(tr.To.Location()),
+	}
+}
+
 // FromTimeFilter returns toDateTime(<from_unix>) for the query time range start.
 func FromTimeFilter(ctx macropro.QueryContext[struct{}], args []string) (string, error) {
 	return timeToDateTime(ctx.TimeRange.From), nil
@@ -55,6 +55,42 @@ func TestTimeToDateTime64(t *testing.T) {
 	}
 }
 
+func TestAlignTimeRange(t *testing.T) {
+	tr := backend.TimeRange{
+		From: time.Date(2024, 3, 1, 10, 7, 42, 0, time.UTC),
+		To:   time.Date(2024, 3, 1, 16, 7, 42, 0, time.UTC),
+	}
+	tests := []struct {
+		name     string
+		interval time.Duration
+		expected backend.TimeRange
+	}{
+		{name: "minute", interval: time.Minute, expected: backend.TimeRange{
+			From: time.Date(2024, 3, 1, 10, 7, 0, 0, time.UTC),
+			To:   time.Date(2024, 3, 1, 16, 8, 0, 0, time.UTC),
+		}},
+		{name: "hour", interval: time.Hour, expected: backend.TimeRange{
+			From: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+			To:   time.Date(2024, 3, 1, 17, 0, 0, 0, time.UTC),
+		}},
+		{name: "odd interval on the epoch grid", interval: 7 * time.Second, expected: backend.TimeRange{
+			From: time.Unix(tr.From.Unix()-tr.From.Unix()%7, 0).UTC(),
+			To:   time.Unix(tr.To.Unix()+7-tr.To.Unix()%7, 0).UTC(),
+		}},
+		{name: "no interval", interval: 0, expected: tr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AlignTimeRange(tr, tt.interval)
+			assert.True(t, tt.expected.From.Equal(got.From), "from: %s", got.From)
+			assert.True(t, tt.expected.To.Equal(got.To), "to: %s", got.To)
+		})
+	}
+
+	aligned := AlignTimeRange(tr, time.Minute)
+	assert.Equal(t, aligned, AlignTimeRange(aligned, time.Minute), "aligned ranges stay put")
+}
+
 func TestMacroFromTimeFilter(t *testing.T) {
 	from, _ := time.Parse("2006-01-02T15:04:05.000Z", "2014-11-12T11:45:26.371Z")
 	to, _ := time.Parse("2006-01-02T15:04:05.000Z", "2015-11-12T11:45:26.371Z")
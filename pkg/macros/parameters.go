@@ -0,0 +1,79 @@
+package macros
+
+import (
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/macropro"
+)
+
+// Names of the query parameters that InterpolateParameters references for
+// the start and end of the query time range.
+const (
+	FromParameter = "__from"
+	ToParameter   = "__to"
+)
+
+// timeParameterType is the ClickHouse type of the time range parameters.
+const timeParameterType = "DateTime64(3, 'UTC')"
+
+// parameterMacros is ClickHouseMacros with the time range referenced as the
+// FromParameter and ToParameter query parameters rather than as literals.
+var parameterMacros = func() macropro.MacroMap[struct{}] {
+	m := macropro.MacroMap[struct{}]{}
+	for name, macro := range ClickHouseMacros {
+		m[name] = referenceTimeParameters(macro)
+	}
+	return m
+}()
+
+// referenceTimeParameters wraps macro so that the time range literals it
+// emits are replaced by references to the time range parameters. Macros only
+// emit the literals of timeToDate, timeToDateTime and timeToDateTime64 for
+// the time range, so replacing them in the expansion of a single macro
+// cannot touch the rest of the query. Where both bounds have the same
+// literal, as the dates of a range within a day, both reference
+// FromParameter, which has the same value at that precision.
+func referenceTimeParameters(macro macropro.MacroFunc[struct{}]) macropro.MacroFunc[struct{}] {
+	return func(ctx macropro.QueryContext[struct{}], args []string) (string, error) {
+		sql, err := macro(ctx, args)
+		if err != nil {
+			return sql, err
+		}
+		from := "{" + FromParameter + ":" + timeParameterType + "}"
+		to := "{" + ToParameter + ":" + timeParameterType + "}"
+		return strings.NewReplacer(
+			timeToDateTime64(ctx.TimeRange.From), from,
+			timeToDateTime64(ctx.TimeRange.To), to,
+			timeToDateTime(ctx.TimeRange.From), "toDateTime("+from+")",
+			timeToDateTime(ctx.TimeRange.To), "toDateTime("+to+")",
+			timeToDate(ctx.TimeRange.From), "toDate("+from+")",
+			timeToDate(ctx.TimeRange.To), "toDate("+to+")",
+		).Replace(sql), nil
+	}
+}
+
+// InterpolateParameters expands the macros of rawSQL as Interpolate does,
+// except that the time range macros reference the FromParameter and
+// ToParameter query parameters instead of embedding the time range, so that
+// the SQL stays the same as the time range moves. The caller binds the
+// parameters to the values of TimeRangeParameters.
+func InterpolateParameters(rawSQL string, q *sqlutil.Query) (string, error) {
+	sql, err := expandStatementMacros(rawSQL, q)
+	if err != nil {
+		return rawSQL, err
+	}
+	return macropro.Interpolate(sql, parameterMacros, contextFrom(q), macropro.WithComments(clickHouseComments))
+}
+
+// TimeRangeParameters returns the values of the time range parameters of
+// InterpolateParameters for tr, in the text form of ClickHouse query
+// parameters.
+func TimeRangeParameters(tr backend.TimeRange) map[string]string {
+	const layout = "2006-01-02 15:04:05.000"
+	return map[string]string{
+		FromParameter: tr.From.UTC().Format(layout),
+		ToParameter:   tr.To.UTC().Format(layout),
+	}
+}
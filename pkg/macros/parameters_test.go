@@ -0,0 +1,55 @@
+package macros
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterpolateParameters(t *testing.T) {
+	from := time.Date(2024, 3, 1, 10, 7, 42, 123e6, time.UTC)
+	to := from.Add(36 * time.Hour)
+	q := &sqlutil.Query{TimeRange: backend.TimeRange{From: from, To: to}, Interval: time.Minute}
+
+	const (
+		fromRef = "{__from:DateTime64(3, 'UTC')}"
+		toRef   = "{__to:DateTime64(3, 'UTC')}"
+	)
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			input: "SELECT * FROM t WHERE $__timeFilter(ts)",
+			want:  "SELECT * FROM t WHERE ts >= toDateTime(" + fromRef + ") AND ts <= toDateTime(" + toRef + ")",
+		},
+		{
+			input: "SELECT * FROM t WHERE $__timeFilter_ms(ts) AND d >= $__fromTime",
+			want:  "SELECT * FROM t WHERE ts >= " + fromRef + " AND ts <= " + toRef + " AND d >= toDateTime(" + fromRef + ")",
+		},
+		{
+			input: "SELECT * FROM t WHERE $__dateFilter(d) AND ts < $__toTime_ms",
+			want:  "SELECT * FROM t WHERE d >= toDate(" + fromRef + ") AND d <= toDate(" + toRef + ") AND ts < " + toRef,
+		},
+		{
+			input: "SELECT $__timeInterval(ts) AS t FROM t WHERE $__timeFrom(ts) AND x = 'toDateTime(1709287662)'",
+			want:  "SELECT toStartOfInterval(toDateTime(ts), INTERVAL 60 second) AS t FROM t WHERE ts >= toDateTime(" + fromRef + ") AND x = 'toDateTime(1709287662)'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := InterpolateParameters(tt.input, q)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	assert.Equal(t, map[string]string{
+		FromParameter: "2024-03-01 10:07:42.123",
+		ToParameter:   "2024-03-02 22:07:42.123",
+	}, TimeRangeParameters(backend.TimeRange{From: from.In(time.FixedZone("CET", 3600)), To: to}))
+}
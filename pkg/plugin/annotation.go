@@ -0,0 +1,260 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// annotationQueryType is the query type of annotation queries.
+const annotationQueryType = "annotation"
+
+// annotationTagsString is the annotationOptions.TagsFormat of tags held in a
+// comma-separated string rather than an Array(String).
+const annotationTagsString = "string"
+
+// annotationColumns maps the annotation roles to the columns of the query
+// result. A role left empty uses the column named after it, if any.
+type annotationColumns struct {
+	Time    string `json:"time"`
+	TimeEnd string `json:"timeEnd"`
+	Title   string `json:"title"`
+	Text    string `json:"text"`
+	Tags    string `json:"tags"`
+	ID      string `json:"id"`
+}
+
+// annotationOptions are the options of an annotation query, under the
+// annotation key of the query JSON. Tags keeps only the annotations with
+// every one of them, or any of them with MatchAny. TagsFormat is "string"
+// when the tags column is a comma-separated string; it is an Array(String)
+// otherwise.
+type annotationOptions struct {
+	Columns    annotationColumns `json:"columns"`
+	TagsFormat string            `json:"tagsFormat"`
+	Tags       []string          `json:"tags"`
+	MatchAny   bool              `json:"matchAny"`
+}
+
+// runAnnotationQuery runs the annotation query q through execute, as a table
+// query, and returns its result as a frame of Grafana's annotation contract:
+// time, and if the result has them timeEnd, title, text, tags and id fields.
+// Annotations with a timeEnd after their time are regions. Filtering by tags
+// is done by ClickHouse, by wrapping the query in one keeping the rows with
+// the tags, so that a query only returns the annotations shown.
+func runAnnotationQuery(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model map[string]json.RawMessage
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("annotation", err)
+	}
+	var opts annotationOptions
+	if raw, ok := model["annotation"]; ok {
+		if err := json.Unmarshal(raw, &opts); err != nil {
+			return invalidQuery("annotation", err)
+		}
+	}
+	var rawSQL string
+	if raw, ok := model["rawSql"]; ok {
+		if err := json.Unmarshal(raw, &rawSQL); err != nil {
+			return invalidQuery("annotation", err)
+		}
+	}
+
+	sql, err := opts.filterSQL(rawSQL)
+	if err != nil {
+		return invalidQuery("annotation", err)
+	}
+	model["rawSql"], _ = json.Marshal(sql)
+	model["format"] = json.RawMessage("1")
+	sqlQuery := q
+	sqlQuery.QueryType = ""
+	sqlQuery.JSON, _ = json.Marshal(model)
+	res := execute(ctx, sqlQuery)
+	if failed(res) {
+		return res
+	}
+
+	var source *data.Frame
+	if len(res.Frames) > 0 {
+		source = res.Frames[0]
+	}
+	frame, err := annotationFrame(source, opts.Columns)
+	if err != nil {
+		return invalidQuery("annotation", err)
+	}
+	frame.RefID = q.RefID
+	res.Frames = data.Frames{frame}
+	return res
+}
+
+// filterSQL returns rawSQL restricted to the annotations with the tags of o.
+func (o annotationOptions) filterSQL(rawSQL string) (string, error) {
+	if len(o.Tags) == 0 {
+		return rawSQL, nil
+	}
+	column := o.Columns.Tags
+	if column == "" {
+		column = "tags"
+	}
+	tags := quoteSQLIdentifier(column)
+	if o.TagsFormat == annotationTagsString {
+		tags = "arrayMap(t -> trim(t), splitByChar(',', " + tags + "))"
+	}
+	quoted := make([]string, len(o.Tags))
+	for i, tag := range o.Tags {
+		quoted[i] = quoteSQLString(tag)
+	}
+	match := "hasAll"
+	if o.MatchAny {
+		match = "hasAny"
+	}
+	return wrapSQL(rawSQL, func(subquery string) string {
+		return fmt.Sprintf("SELECT * FROM (\n%s\n) WHERE %s(%s, [%s])", subquery, match, tags, strings.Join(quoted, ", "))
+	})
+}
+
+// annotationFrame returns the annotations in frame, whose columns have the
+// roles of columns.
+func annotationFrame(frame *data.Frame, columns annotationColumns) (*data.Frame, error) {
+	out := data.NewFrame("annotations")
+	if frame == nil {
+		out.Fields = append(out.Fields, data.NewField("time", nil, []time.Time{}))
+		return out, nil
+	}
+	if frame.Meta != nil {
+		out.Meta = frame.Meta
+	}
+	find := func(column, role string) (*data.Field, error) {
+		name := column
+		if name == "" {
+			name = role
+		}
+		idx, ok := fieldIndex(frame, name)
+		if !ok {
+			if column != "" {
+				return nil, fmt.Errorf("the query returns no column %s for the annotation %s", column, role)
+			}
+			return nil, nil
+		}
+		return frame.Fields[idx], nil
+	}
+
+	timeField, err := find(columns.Time, "time")
+	if err != nil {
+		return nil, err
+	}
+	if timeField == nil {
+		return nil, errors.New("the query returns no time column; alias one as time or map the time column")
+	}
+	times, err := annotationTimes(timeField)
+	if err != nil {
+		return nil, err
+	}
+	out.Fields = append(out.Fields, data.NewField("time", nil, times))
+
+	if f, err := find(columns.TimeEnd, "timeEnd"); err != nil {
+		return nil, err
+	} else if f != nil {
+		ends, err := annotationTimes(f)
+		if err != nil {
+			return nil, err
+		}
+		out.Fields = append(out.Fields, data.NewField("timeEnd", nil, ends))
+	}
+	for _, role := range []struct{ column, name string }{{columns.Title, "title"}, {columns.Text, "text"}} {
+		f, err := find(role.column, role.name)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			values := make([]string, f.Len())
+			for row := range values {
+				values[row] = valueString(f, row)
+			}
+			out.Fields = append(out.Fields, data.NewField(role.name, nil, values))
+		}
+	}
+	if f, err := find(columns.Tags, "tags"); err != nil {
+		return nil, err
+	} else if f != nil {
+		tags := make([]json.RawMessage, f.Len())
+		for row := range tags {
+			tags[row], _ = json.Marshal(annotationTags(f, row))
+		}
+		out.Fields = append(out.Fields, data.NewField("tags", nil, tags))
+	}
+	if f, err := find(columns.ID, "id"); err != nil {
+		return nil, err
+	} else if f != nil {
+		ids := make([]string, f.Len())
+		for row := range ids {
+			ids[row] = valueString(f, row)
+		}
+		out.Fields = append(out.Fields, data.NewField("id", nil, ids))
+	}
+	return out, nil
+}
+
+// annotationTimes returns the values of a time field, or of a number field
+// holding Unix milliseconds. Null times are nil.
+func annotationTimes(f *data.Field) ([]*time.Time, error) {
+	times := make([]*time.Time, f.Len())
+	for row := range times {
+		v, ok := f.ConcreteAt(row)
+		if !ok {
+			continue
+		}
+		switch v := v.(type) {
+		case time.Time:
+			times[row] = &v
+		default:
+			if !f.Type().Numeric() {
+				return nil, fmt.Errorf("annotation column %s is a %s, not a time", f.Name, f.Type().ItemTypeString())
+			}
+			ms, err := f.FloatAt(row)
+			if err != nil {
+				return nil, err
+			}
+			t := time.UnixMilli(int64(ms)).UTC()
+			times[row] = &t
+		}
+	}
+	return times, nil
+}
+
+// annotationTags returns the tags of a row: the strings of an Array(String),
+// which the converters return as JSON, or the comma-separated parts of a
+// string.
+func annotationTags(f *data.Field, row int) []string {
+	tags := []string{}
+	v, ok := f.ConcreteAt(row)
+	if !ok {
+		return tags
+	}
+	// Arrays may also arrive as the string of their JSON, once MutateResponse
+	// has converted JSON fields.
+	var parts []string
+	switch v := v.(type) {
+	case json.RawMessage:
+		if err := json.Unmarshal(v, &parts); err != nil {
+			parts = []string{string(v)}
+		}
+	default:
+		s := fmt.Sprint(v)
+		if !strings.HasPrefix(s, "[") || json.Unmarshal([]byte(s), &parts) != nil {
+			parts = strings.Split(s, ",")
+		}
+	}
+	for _, tag := range parts {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
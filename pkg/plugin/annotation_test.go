@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotationFilterSQL(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts annotationOptions
+		sql  string
+		want string
+		err  string
+	}{
+		{name: "no tags", sql: "SELECT 1 FORMAT JSON", want: "SELECT 1 FORMAT JSON"},
+		{
+			name: "all tags",
+			opts: annotationOptions{Columns: annotationColumns{Tags: "labels"}, Tags: []string{"deploy", "it's"}},
+			sql:  "SELECT ts AS time, labels FROM events; -- deploys\n",
+			want: "SELECT * FROM (\nSELECT ts AS time, labels FROM events\n) WHERE hasAll(`labels`, ['deploy', 'it\\'s'])",
+		},
+		{
+			name: "any tag of a string",
+			opts: annotationOptions{TagsFormat: "string", Tags: []string{"a"}, MatchAny: true},
+			sql:  "SELECT 1",
+			want: "SELECT * FROM (\nSELECT 1\n) WHERE hasAny(arrayMap(t -> trim(t), splitByChar(',', `tags`)), ['a'])",
+		},
+		{
+			name: "settings",
+			opts: annotationOptions{Tags: []string{"a"}},
+			sql:  "SELECT ts AS time, tags FROM events SETTINGS max_threads = 2",
+			want: "SELECT * FROM (\nSELECT ts AS time, tags FROM events\n) WHERE hasAll(`tags`, ['a']) SETTINGS max_threads = 2",
+		},
+		{name: "format", opts: annotationOptions{Tags: []string{"a"}}, sql: "SELECT 1 FORMAT TSV", err: "the query must not set a FORMAT"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opts.filterSQL(tt.sql)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAnnotationFrame(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	tags := json.RawMessage(`["deploy","prod"]`)
+	frame := data.NewFrame("",
+		data.NewField("ts", nil, []time.Time{start}),
+		data.NewField("finished", nil, []*time.Time{&end}),
+		data.NewField("title", nil, []string{"Deploy"}),
+		data.NewField("message", nil, []string{"v1.2"}),
+		data.NewField("labels", nil, []*json.RawMessage{&tags}),
+		data.NewField("id", nil, []uint64{7}),
+	)
+
+	got, err := annotationFrame(frame, annotationColumns{Time: "ts", TimeEnd: "finished", Text: "message", Tags: "labels"})
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range got.Fields {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"time", "timeEnd", "title", "text", "tags", "id"}, names)
+	assert.Equal(t, start, *got.Fields[0].At(0).(*time.Time))
+	assert.Equal(t, end, *got.Fields[1].At(0).(*time.Time))
+	assert.Equal(t, "Deploy", got.Fields[2].At(0))
+	assert.Equal(t, "v1.2", got.Fields[3].At(0))
+	assert.JSONEq(t, `["deploy","prod"]`, string(got.Fields[4].At(0).(json.RawMessage)))
+	assert.Equal(t, "7", got.Fields[5].At(0))
+
+	t.Run("epoch milliseconds and comma-separated tags", func(t *testing.T) {
+		got, err := annotationFrame(data.NewFrame("",
+			data.NewField("time", nil, []int64{start.UnixMilli()}),
+			data.NewField("tags", nil, []string{"a, b,,"}),
+		), annotationColumns{})
+		require.NoError(t, err)
+		assert.Equal(t, start, *got.Fields[0].At(0).(*time.Time))
+		assert.JSONEq(t, `["a","b"]`, string(got.Fields[1].At(0).(json.RawMessage)))
+	})
+
+	t.Run("missing columns", func(t *testing.T) {
+		_, err := annotationFrame(data.NewFrame("", data.NewField("text", nil, []string{"x"})), annotationColumns{})
+		assert.ErrorContains(t, err, "no time column")
+		_, err = annotationFrame(frame, annotationColumns{Time: "ts", Title: "headline"})
+		assert.ErrorContains(t, err, "no column headline for the annotation title")
+		_, err = annotationFrame(frame, annotationColumns{Time: "title"})
+		assert.ErrorContains(t, err, "not a time")
+	})
+}
+
+func TestRunAnnotationQuery(t *testing.T) {
+	q := backend.DataQuery{
+		RefID:     "Anno",
+		QueryType: "annotation",
+		JSON:      []byte(`{"rawSql": "SELECT ts AS time, msg AS text, tags FROM events WHERE $__timeFilter(ts)", "annotation": {"tags": ["deploy"]}}`),
+	}
+	var got backend.DataQuery
+	res := runAnnotationQuery(context.Background(), q, func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		got = q
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("",
+			data.NewField("time", nil, []time.Time{time.Unix(0, 0)}),
+			data.NewField("text", nil, []string{"x"}),
+		)}}
+	})
+	require.NoError(t, res.Error)
+	assert.Empty(t, got.QueryType)
+	var model map[string]any
+	require.NoError(t, json.Unmarshal(got.JSON, &model))
+	assert.Contains(t, model["rawSql"], "WHERE hasAll(`tags`, ['deploy'])")
+	assert.Equal(t, 1.0, model["format"])
+
+	require.Len(t, res.Frames, 1)
+	assert.Equal(t, "Anno", res.Frames[0].RefID)
+	assert.Len(t, res.Frames[0].Fields, 2)
+
+	q.JSON = []byte(`{"rawSql": "SELECT 1", "annotation": {"columns": {"time": 5}}}`)
+	res = runAnnotationQuery(context.Background(), q, nil)
+	assert.True(t, backend.IsDownstreamError(res.Error))
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+}
@@ -0,0 +1,263 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// SQL representations for the audit log, see Settings.AuditLogSQLMode.
+const (
+	auditSQLFull     = "full"
+	auditSQLRedacted = "redacted"
+	auditSQLHashed   = "hashed"
+)
+
+// auditLogger writes the query audit log and the slow-query log. Both share
+// one structured line format so that reviewers can filter either by the
+// Grafana user, dashboard, panel or alert rule a query ran for, without
+// access to ClickHouse's system.query_log. Each query requested is logged
+// once, with what it executed, so that queries served by the result cache
+// or by another query's execution are logged for whoever requested them.
+type auditLogger struct {
+	enabled       bool
+	sampleRate    float64
+	sqlMode       string
+	slowThreshold time.Duration
+}
+
+// auditRecord is what the audit log knows about one requested query.
+type auditRecord struct {
+	refID    string
+	duration time.Duration
+	res      backend.DataResponse
+	trail    *auditTrail
+}
+
+type auditTrailKeyType struct{}
+
+var auditTrailKey = auditTrailKeyType{}
+
+// auditTrail collects the executions of one requested query, its retries,
+// chunks and statements, and whether its result came from the result cache
+// or from the execution of an identical query. Chunks run concurrently.
+type auditTrail struct {
+	mu         sync.Mutex
+	executions []auditExecution
+	cached     bool
+	shared     bool
+}
+
+// auditExecution is what the audit log knows about one query execution.
+type auditExecution struct {
+	queryID   string
+	statement string
+	queueWait time.Duration
+	rowsRead  uint64
+	bytesRead uint64
+}
+
+// withAuditTrail starts the audit trail of the query run with ctx.
+func withAuditTrail(ctx context.Context) (context.Context, *auditTrail) {
+	trail := &auditTrail{}
+	return context.WithValue(ctx, auditTrailKey, trail), trail
+}
+
+// auditTrailFromContext returns the audit trail started by withAuditTrail,
+// or nil. The methods of a nil trail do nothing.
+func auditTrailFromContext(ctx context.Context) *auditTrail {
+	trail, _ := ctx.Value(auditTrailKey).(*auditTrail)
+	return trail
+}
+
+// addExecution records the execution queryID, once its stats are final.
+func (t *auditTrail) addExecution(queryID string, stats *queryStats) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.executions = append(t.executions, auditExecution{
+		queryID:   queryID,
+		statement: stats.statement,
+		queueWait: stats.queueWait,
+		rowsRead:  stats.rowsRead.Load(),
+		bytesRead: stats.bytesRead.Load(),
+	})
+}
+
+// markCached records that the result came from the result cache.
+func (t *auditTrail) markCached() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cached = true
+}
+
+// markShared records that the result came from the execution of an
+// identical query.
+func (t *auditTrail) markShared() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.shared = true
+}
+
+// newAuditLogger builds the audit logger configured on the datasource.
+func newAuditLogger(settings Settings) auditLogger {
+	a := auditLogger{
+		enabled:       settings.EnableAuditLog,
+		sampleRate:    settings.AuditLogSampleRate,
+		sqlMode:       settings.AuditLogSQLMode,
+		slowThreshold: time.Duration(settings.SlowQueryThresholdMs) * time.Millisecond,
+	}
+	if a.sampleRate <= 0 || a.sampleRate > 1 {
+		a.sampleRate = 1
+	}
+	switch a.sqlMode {
+	case auditSQLRedacted, auditSQLHashed:
+	default:
+		a.sqlMode = auditSQLFull
+	}
+	return a
+}
+
+// log records r. Slow queries are logged at warning level whether or not
+// the audit log is enabled; other queries are logged at info level when the
+// audit log is enabled and r falls in the sample.
+func (a auditLogger) log(ctx context.Context, r auditRecord) {
+	logged, slow := a.decide(r.duration)
+	if !logged {
+		return
+	}
+
+	logger := backend.Logger.FromContext(ctx)
+	args := a.fields(ctx, r, slow)
+	if slow {
+		logger.Warn("Slow ClickHouse query", args...)
+		return
+	}
+	logger.Info("ClickHouse query audit", args...)
+}
+
+// decide reports whether a query that ran for d is logged, and whether it is
+// logged as slow.
+func (a auditLogger) decide(d time.Duration) (logged, slow bool) {
+	if a.slowThreshold > 0 && d >= a.slowThreshold {
+		return true, true
+	}
+	if !a.enabled {
+		return false, false
+	}
+	return a.sampleRate >= 1 || rand.Float64() < a.sampleRate, false
+}
+
+// fields renders r as structured log key/value pairs.
+func (a auditLogger) fields(ctx context.Context, r auditRecord, slow bool) []any {
+	status := "ok"
+	errorCategory := ""
+	if r.res.Error != nil {
+		status = "error"
+		errorCategory = string(CategorizeConnectionError(r.res.Error))
+	}
+
+	user := ""
+	if u := backend.UserFromContext(ctx); u != nil {
+		user = u.Login
+	}
+	gh, _ := ctx.Value(grafanaHeadersKey).(grafanaHeaders)
+
+	var (
+		queryIDs, statements []string
+		queueWait            time.Duration
+		rowsRead, bytesRead  uint64
+		cached, shared       bool
+	)
+	if r.trail != nil {
+		r.trail.mu.Lock()
+		for _, e := range r.trail.executions {
+			queryIDs = append(queryIDs, e.queryID)
+			if statement := a.formatSQL(e.statement); !slices.Contains(statements, statement) {
+				statements = append(statements, statement)
+			}
+			queueWait += e.queueWait
+			rowsRead += e.rowsRead
+			bytesRead += e.bytesRead
+		}
+		cached, shared = r.trail.cached, r.trail.shared
+		r.trail.mu.Unlock()
+	}
+
+	return []any{
+		"refID", r.refID,
+		"queryIDs", queryIDs,
+		"sql", strings.Join(statements, "; "),
+		"durationMs", r.duration.Milliseconds(),
+		"queueWaitMs", queueWait.Milliseconds(),
+		"rowsReturned", frameRows(r.res.Frames),
+		"rowsRead", rowsRead,
+		"bytesRead", bytesRead,
+		"user", user,
+		"dashboardUID", gh.DashboardUID,
+		"panelID", gh.PanelID,
+		"ruleUID", gh.RuleUID,
+		"status", status,
+		"errorCategory", errorCategory,
+		"slow", slow,
+		"cached", cached,
+		"shared", shared,
+	}
+}
+
+// formatSQL renders sql according to the configured SQL mode.
+func (a auditLogger) formatSQL(sql string) string {
+	switch a.sqlMode {
+	case auditSQLHashed:
+		sum := sha256.Sum256([]byte(sql))
+		return hex.EncodeToString(sum[:])
+	case auditSQLRedacted:
+		return redactSQL(sql)
+	default:
+		return sql
+	}
+}
+
+// redactSQL replaces string and numeric literals in sql with ?, keeping the
+// shape of the statement reviewable while dropping the values users filtered
+// on. Quoted identifiers ("..." and `...`) are kept, and digits that are part
+// of an identifier such as t1 are not literals. Comments are dropped, since
+// they may hold anything, and the space around a comment becomes one space.
+func redactSQL(sql string) string {
+	var b strings.Builder
+	b.Grow(len(sql))
+	gap := func(from, to int) {
+		if s := sql[from:to]; strings.TrimSpace(s) == "" {
+			b.WriteString(s)
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	prev := 0
+	for _, t := range tokenizeSQL(sql) {
+		gap(prev, t.pos)
+		if t.kind == sqlString || t.kind == sqlNumber {
+			b.WriteByte('?')
+		} else {
+			b.WriteString(sql[t.pos:t.end])
+		}
+		prev = t.end
+	}
+	gap(prev, len(sql))
+	return b.String()
+}
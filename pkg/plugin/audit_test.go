@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected string
+	}{
+		{name: "no literals", sql: "SELECT a FROM t", expected: "SELECT a FROM t"},
+		{name: "string literal", sql: "SELECT * FROM t WHERE user = 'alice'", expected: "SELECT * FROM t WHERE user = ?"},
+		{name: "escaped quote", sql: `SELECT * FROM t WHERE s = 'it\'s' AND v = 'a''b'`, expected: "SELECT * FROM t WHERE s = ? AND v = ?"},
+		{name: "numbers", sql: "SELECT * FROM t WHERE id = 42 AND ratio > 0.5 LIMIT 10", expected: "SELECT * FROM t WHERE id = ? AND ratio > ? LIMIT ?"},
+		{name: "identifiers with digits", sql: "SELECT col1 FROM t2", expected: "SELECT col1 FROM t2"},
+		{name: "quoted identifiers", sql: "SELECT \"user 1\", `x'y` FROM t WHERE a IN (1, 2)", expected: "SELECT \"user 1\", `x'y` FROM t WHERE a IN (?, ?)"},
+		{name: "unterminated string", sql: "SELECT 'abc", expected: "SELECT ?"},
+		{name: "line comment", sql: "SELECT a -- isn't a string\nFROM t WHERE b = 'x'", expected: "SELECT a FROM t WHERE b = ?"},
+		{name: "block comment", sql: "SELECT a/* it's 42 */FROM t WHERE b = 1", expected: "SELECT a FROM t WHERE b = ?"},
+		{name: "comment in string", sql: "SELECT '-- /*' AS s, 1", expected: "SELECT ? AS s, ?"},
+		{name: "comment in identifier", sql: "SELECT `a--b`, \"c\"\"/*\" FROM t -- 1\n", expected: "SELECT `a--b`, \"c\"\"/*\" FROM t "},
+		{name: "unterminated comment", sql: "SELECT 1 /* 'x", expected: "SELECT ? "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, redactSQL(tt.sql))
+		})
+	}
+}
+
+func TestNewAuditLogger(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		a := newAuditLogger(Settings{})
+		assert.False(t, a.enabled)
+		assert.Equal(t, 1.0, a.sampleRate)
+		assert.Equal(t, auditSQLFull, a.sqlMode)
+		assert.Zero(t, a.slowThreshold)
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		a := newAuditLogger(Settings{EnableAuditLog: true, AuditLogSampleRate: 0.1, AuditLogSQLMode: "redacted", SlowQueryThresholdMs: 2000})
+		assert.True(t, a.enabled)
+		assert.Equal(t, 0.1, a.sampleRate)
+		assert.Equal(t, auditSQLRedacted, a.sqlMode)
+		assert.Equal(t, 2*time.Second, a.slowThreshold)
+	})
+
+	t.Run("unknown SQL mode falls back to full", func(t *testing.T) {
+		assert.Equal(t, auditSQLFull, newAuditLogger(Settings{AuditLogSQLMode: "obfuscated"}).sqlMode)
+	})
+}
+
+func TestAuditLoggerDecide(t *testing.T) {
+	tests := []struct {
+		name       string
+		logger     auditLogger
+		duration   time.Duration
+		wantLogged bool
+		wantSlow   bool
+	}{
+		{name: "disabled", logger: auditLogger{sampleRate: 1}, duration: time.Second},
+		{name: "enabled", logger: auditLogger{enabled: true, sampleRate: 1}, duration: time.Second, wantLogged: true},
+		{name: "slow while disabled", logger: auditLogger{sampleRate: 1, slowThreshold: time.Second}, duration: time.Second, wantLogged: true, wantSlow: true},
+		{name: "fast while disabled", logger: auditLogger{sampleRate: 1, slowThreshold: time.Second}, duration: time.Millisecond},
+		{name: "slow ignores sampling", logger: auditLogger{enabled: true, sampleRate: 0.0000001, slowThreshold: time.Second}, duration: time.Minute, wantLogged: true, wantSlow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged, slow := tt.logger.decide(tt.duration)
+			assert.Equal(t, tt.wantLogged, logged)
+			assert.Equal(t, tt.wantSlow, slow)
+		})
+	}
+}
+
+func TestAuditLoggerFormatSQL(t *testing.T) {
+	sql := "SELECT * FROM t WHERE user = 'alice'"
+	assert.Equal(t, sql, auditLogger{sqlMode: auditSQLFull}.formatSQL(sql))
+	assert.Equal(t, "SELECT * FROM t WHERE user = ?", auditLogger{sqlMode: auditSQLRedacted}.formatSQL(sql))
+
+	hashed := auditLogger{sqlMode: auditSQLHashed}.formatSQL(sql)
+	assert.Len(t, hashed, 64)
+	assert.Equal(t, hashed, auditLogger{sqlMode: auditSQLHashed}.formatSQL(sql))
+	assert.NotEqual(t, hashed, auditLogger{sqlMode: auditSQLHashed}.formatSQL(sql+" "))
+}
+
+func TestAuditLoggerFields(t *testing.T) {
+	ctx := backend.WithUser(context.Background(), &backend.User{Login: "alice"})
+	ctx = context.WithValue(ctx, grafanaHeadersKey, grafanaHeaders{DashboardUID: "dash", PanelID: "3", RuleUID: "rule"})
+	ctx, trail := withAuditTrail(ctx)
+	for _, queryID := range []string{"q1", "q2"} {
+		stats := &queryStats{statement: "SELECT 1", queueWait: time.Second}
+		stats.rowsRead.Store(100)
+		stats.bytesRead.Store(800)
+		auditTrailFromContext(ctx).addExecution(queryID, stats)
+	}
+
+	fields := auditLogger{sqlMode: auditSQLFull}.fields(ctx, auditRecord{
+		refID:    "A",
+		duration: 1500 * time.Millisecond,
+		res:      backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("v", nil, []int64{1, 2}))}},
+		trail:    trail,
+	}, false)
+	got := auditFields(fields)
+
+	assert.Equal(t, "A", got["refID"])
+	assert.Equal(t, []string{"q1", "q2"}, got["queryIDs"])
+	assert.Equal(t, "SELECT 1", got["sql"], "identical statements are logged once")
+	assert.Equal(t, int64(1500), got["durationMs"])
+	assert.Equal(t, int64(2000), got["queueWaitMs"])
+	assert.Equal(t, int64(2), got["rowsReturned"])
+	assert.Equal(t, uint64(200), got["rowsRead"])
+	assert.Equal(t, uint64(1600), got["bytesRead"])
+	assert.Equal(t, "alice", got["user"])
+	assert.Equal(t, "dash", got["dashboardUID"])
+	assert.Equal(t, "3", got["panelID"])
+	assert.Equal(t, "rule", got["ruleUID"])
+	assert.Equal(t, "ok", got["status"])
+	assert.Equal(t, "", got["errorCategory"])
+	assert.Equal(t, false, got["cached"])
+	assert.Equal(t, false, got["shared"])
+
+	fields = auditLogger{}.fields(context.Background(), auditRecord{
+		res: backend.DataResponse{Error: errors.New("dial tcp: connection refused")},
+	}, true)
+	got = auditFields(fields)
+	assert.Equal(t, "error", got["status"])
+	assert.NotEmpty(t, got["errorCategory"])
+	assert.Equal(t, true, got["slow"])
+	assert.Equal(t, "", got["user"])
+	assert.Empty(t, got["queryIDs"])
+}
+
+func TestAuditTrail(t *testing.T) {
+	var none *auditTrail
+	assert.NotPanics(t, func() {
+		none.addExecution("q", &queryStats{})
+		none.markCached()
+		none.markShared()
+	})
+	assert.Nil(t, auditTrailFromContext(context.Background()))
+
+	ctx, trail := withAuditTrail(context.Background())
+	auditTrailFromContext(ctx).markCached()
+	auditTrailFromContext(ctx).markShared()
+	got := auditFields(auditLogger{}.fields(ctx, auditRecord{trail: trail}, false))
+	assert.Equal(t, true, got["cached"])
+	assert.Equal(t, true, got["shared"])
+}
+
+func auditFields(fields []any) map[string]any {
+	got := map[string]any{}
+	for i := 0; i < len(fields); i += 2 {
+		got[fields[i].(string)] = fields[i+1]
+	}
+	return got
+}
@@ -0,0 +1,505 @@
+package plugin
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/clickhouse-datasource/pkg/macros"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+const (
+	defaultChunkedQueryMinRange    = 24 * time.Hour
+	defaultChunkedQueryChunks      = 4
+	defaultChunkedQueryParallelism = 2
+)
+
+// rangeTimeMacros bound a time column on both sides, and lowerTimeMacros and
+// upperTimeMacros on one side each. A chunk only reads its own sub-range when
+// the query is bounded on both sides.
+var (
+	rangeTimeMacros = map[string]bool{"$__timeFilter": true, "$__timeFilter_ms": true, "$__dateTimeFilter": true, "$__dt": true}
+	lowerTimeMacros = map[string]bool{"$__fromTime": true, "$__fromTime_ms": true, "$__timeFrom": true}
+	upperTimeMacros = map[string]bool{"$__toTime": true, "$__toTime_ms": true, "$__timeTo": true}
+)
+
+// statementMacros rewrite the whole query, computing rates or downsampling
+// across buckets, which a chunk boundary would break.
+var statementMacros = map[string]bool{
+	"$__columns": true, "$__rateColumns": true, "$__perSecondColumns": true, "$__increaseColumns": true, "$__lttb": true,
+}
+
+// scalarFunctionPrefixes are the prefixes of the functions a query that is
+// not grouped by time bucket may call: conversions, conditionals and string
+// and arithmetic functions, which compute each row on its own. Any other
+// function, an aggregate such as skewPop() among them, keeps the query
+// whole.
+var scalarFunctionPrefixes = []string{
+	"todate", "tostartof", "tounixtimestamp", "totimezone", "tostring", "tofloat", "toint", "touint", "todecimal",
+	"cast", "if", "multiif", "coalesce", "nullif", "assumenotnull", "tuple",
+	"concat", "lower", "upper", "substring", "replace", "trim", "length", "format", "jsonextract",
+	"plus", "minus", "multiply", "divide", "intdiv", "modulo", "abs", "round", "floor", "ceil",
+}
+
+// orderedClauseEnds are the keywords ending a GROUP BY or ORDER BY clause.
+var orderedClauseEnds = map[string]bool{"HAVING": true, "ORDER": true, "LIMIT": true, "SETTINGS": true, "FORMAT": true}
+
+// statefulFunctions carry state from one row of a block to the next, so
+// their values depend on the rows before them in the time range.
+var statefulFunctions = map[string]bool{
+	"runningdifference": true, "runningdifferencestartingwithfirstvalue": true, "runningaccumulate": true,
+	"neighbor": true, "rownumberinblock": true, "rownumberinallblocks": true,
+}
+
+// chunkedQueries splits queries over long time ranges into chunks of the
+// range that run as separate queries, a few at a time, so that no single
+// query has to scan the whole range within the execution time and memory
+// limits. Chunk boundaries are multiples of the query interval, so the
+// buckets of $__timeInterval never straddle two chunks.
+//
+// Only queries whose result over the whole range is the concatenation of
+// their results over the chunks are split: a single SELECT without
+// subqueries that filters on the time range with the time macros, and either
+// groups by $__timeInterval bucket or returns rows computed each on its own.
+// It must not have a LIMIT, UNION, window functions, functions carrying state
+// across rows, such as runningDifference, totals, rollups or fills, and when
+// it is ordered it is by time first.
+type chunkedQueries struct {
+	enabled     bool
+	minRange    time.Duration
+	chunks      int
+	parallelism int
+}
+
+// newChunkedQueries builds the chunking configured on the datasource.
+func newChunkedQueries(settings Settings) chunkedQueries {
+	c := chunkedQueries{
+		enabled:     settings.EnableChunkedQueries,
+		minRange:    defaultChunkedQueryMinRange,
+		chunks:      defaultChunkedQueryChunks,
+		parallelism: defaultChunkedQueryParallelism,
+	}
+	if settings.ChunkedQueryMinRangeHours > 0 {
+		c.minRange = time.Duration(settings.ChunkedQueryMinRangeHours) * time.Hour
+	}
+	if settings.ChunkedQueryChunks > 1 {
+		c.chunks = int(settings.ChunkedQueryChunks)
+	}
+	if settings.ChunkedQueryParallelism > 0 {
+		c.parallelism = int(settings.ChunkedQueryParallelism)
+	}
+	return c
+}
+
+// run runs q through execute, in chunks when it qualifies. The frames of the
+// chunks are merged in time order and carry the metadata of the first
+// chunk, with the notices of every chunk. When the frames of the chunks
+// cannot be merged, the query runs again over the whole range.
+func (c chunkedQueries) run(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	ranges := c.split(q)
+	if len(ranges) < 2 {
+		return execute(ctx, q)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]backend.DataResponse, len(ranges))
+	sem := make(chan struct{}, c.parallelism)
+	var (
+		wg     sync.WaitGroup
+		once   sync.Once
+		failed backend.DataResponse
+	)
+	for i, tr := range ranges {
+		wg.Add(1)
+		go func(i int, tr backend.TimeRange) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = backend.DataResponse{Error: backend.DownstreamError(ctx.Err())}
+				return
+			}
+			defer func() { <-sem }()
+			chunk := q
+			chunk.TimeRange = tr
+			results[i] = execute(ctx, chunk)
+			if results[i].Error != nil {
+				// The query fails as a whole, so the other chunks are moot.
+				// Their errors only say they were canceled, so the first
+				// one is returned.
+				once.Do(func() {
+					failed = results[i]
+					cancel()
+				})
+			}
+		}(i, tr)
+	}
+	wg.Wait()
+	if failed.Error != nil {
+		return failed
+	}
+	for _, res := range results {
+		if res.Error != nil {
+			return res
+		}
+	}
+
+	frames, ok := mergeChunks(results, ranges)
+	if !ok {
+		backend.Logger.FromContext(ctx).Debug("Time range chunks returned different frames, querying the whole range", "refID", q.RefID)
+		return execute(ctx, q)
+	}
+	res := results[0]
+	res.Frames = appendQueryStats(frames, q.RefID, data.QueryStat{
+		FieldConfig: data.FieldConfig{DisplayName: "Time range chunks"},
+		Value:       float64(len(ranges)),
+	})
+	return res
+}
+
+// split returns the sub-ranges q runs over, or nil when it runs as a whole.
+// Boundaries are rounded down to multiples of the query interval, or of a
+// second, since the time macros expand to whole seconds.
+func (c chunkedQueries) split(q backend.DataQuery) []backend.TimeRange {
+	span := q.TimeRange.To.Sub(q.TimeRange.From)
+	if !c.enabled || span < c.minRange {
+		return nil
+	}
+	query, err := sqlutil.GetQuery(q)
+	if err != nil || !isChunkable(query.RawSQL) {
+		return nil
+	}
+
+	step := max(q.Interval, time.Second)
+	var ranges []backend.TimeRange
+	from := q.TimeRange.From
+	for i := 1; i <= c.chunks; i++ {
+		to := q.TimeRange.To
+		if i < c.chunks {
+			boundary := q.TimeRange.From.Add(span * time.Duration(i) / time.Duration(c.chunks))
+			to = macros.AlignTimeRange(backend.TimeRange{From: boundary, To: boundary}, step).From
+		}
+		if !to.After(from) {
+			continue
+		}
+		ranges = append(ranges, backend.TimeRange{From: from, To: to})
+		from = to
+	}
+	return ranges
+}
+
+// isChunkable reports whether the result of rawSQL over a time range is the
+// concatenation of its results over consecutive sub-ranges. Rather than
+// recognizing what breaks that, it accepts the shapes known to keep it; see
+// chunkedQueries.
+func isChunkable(rawSQL string) bool {
+	if !strings.EqualFold(leadingKeyword(rawSQL), "SELECT") {
+		return false
+	}
+	tokens := tokenizeSQL(rawSQL)
+
+	// timeKeys are the time columns the macros filter or bucket on, and the
+	// aliases of the buckets.
+	timeKeys := map[string]bool{}
+	var ranged, lower, upper, bucketed, grouped, distinct bool
+	selects := 0
+	for i, token := range tokens {
+		if token.isPunct(';') && i < len(tokens)-1 {
+			return false
+		}
+		if token.kind != sqlIdent {
+			continue
+		}
+		switch {
+		case statementMacros[token.text]:
+			return false
+		case rangeTimeMacros[token.text]:
+			ranged = true
+			for _, arg := range macroArgs(tokens, i) {
+				if arg.isName() {
+					timeKeys[arg.text] = true
+				}
+			}
+		case lowerTimeMacros[token.text]:
+			lower = true
+		case upperTimeMacros[token.text]:
+			upper = true
+		case isBucketMacro(token):
+			bucketed = true
+			// The alias follows the closing parenthesis.
+			as := i + 3 + len(macroArgs(tokens, i))
+			if as+1 < len(tokens) && tokens[as].is("AS") && tokens[as+1].isName() {
+				timeKeys[tokens[as+1].text] = true
+			}
+		case token.is("SELECT"):
+			selects++
+		case token.is("GROUP"):
+			grouped = true
+		case token.is("DISTINCT"):
+			distinct = true
+		case token.is("LIMIT") || token.is("UNION") || token.is("INTERSECT") || token.is("EXCEPT") ||
+			token.is("OVER") || token.is("WINDOW") || token.is("TOTALS") || token.is("ROLLUP") || token.is("CUBE") ||
+			token.is("FILL"):
+			return false
+		}
+	}
+	if selects != 1 || !(ranged || (lower && upper)) || (distinct && !bucketed) {
+		return false
+	}
+
+	for i, token := range tokens {
+		if token.kind != sqlIdent || i+1 >= len(tokens) || !tokens[i+1].isPunct('(') || sqlKeywords[strings.ToUpper(token.text)] {
+			continue
+		}
+		name := strings.ToLower(token.text)
+		if strings.HasPrefix(name, "$__") {
+			continue
+		}
+		if statefulFunctions[name] || (!grouped && !isScalarFunction(name)) {
+			return false
+		}
+	}
+
+	for i := 0; i+2 < len(tokens); i++ {
+		if !tokens[i+1].is("BY") {
+			continue
+		}
+		switch {
+		case tokens[i].is("GROUP"):
+			// Every key may be grouped on as long as the bucket is one of
+			// them, so no group spans two chunks.
+			if !slices.ContainsFunc(clauseTokens(tokens, i+2), func(t sqlToken) bool {
+				return isBucketMacro(t) || (t.isName() && timeKeys[t.text])
+			}) {
+				return false
+			}
+		case tokens[i].is("ORDER"):
+			// Chunks are concatenated in time order, so the rows must be
+			// sorted by time first.
+			key := clauseTokens(tokens, i+2)
+			if isBucketMacro(key[0]) {
+				continue
+			}
+			if !key[0].isName() || !timeKeys[key[0].text] || (len(key) > 1 && !key[1].isPunct(',') && !key[1].is("ASC") && !key[1].is("DESC")) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isBucketMacro reports whether t is the $__timeInterval macro.
+func isBucketMacro(t sqlToken) bool {
+	return t.kind == sqlIdent && (t.text == "$__timeInterval" || t.text == "$__timeInterval_ms")
+}
+
+// macroArgs returns the tokens between the parentheses of the macro call at
+// tokens[i], or nil when the macro is not called.
+func macroArgs(tokens []sqlToken, i int) []sqlToken {
+	if i+1 >= len(tokens) || !tokens[i+1].isPunct('(') {
+		return nil
+	}
+	depth := 0
+	for j := i + 1; j < len(tokens); j++ {
+		switch {
+		case tokens[j].isPunct('('):
+			depth++
+		case tokens[j].isPunct(')'):
+			depth--
+			if depth == 0 {
+				return tokens[i+2 : j]
+			}
+		}
+	}
+	return tokens[i+2:]
+}
+
+// clauseTokens returns the tokens of the clause starting at tokens[i], up to
+// the keyword starting the next clause. It always holds at least one token.
+func clauseTokens(tokens []sqlToken, i int) []sqlToken {
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		switch {
+		case tokens[j].isPunct('('):
+			depth++
+		case tokens[j].isPunct(')'):
+			depth--
+		case depth == 0 && j > i && (tokens[j].isPunct(';') || tokens[j].is("WITH") ||
+			(tokens[j].kind == sqlIdent && orderedClauseEnds[strings.ToUpper(tokens[j].text)])):
+			return tokens[i:j]
+		}
+	}
+	if i == len(tokens) {
+		return []sqlToken{{}}
+	}
+	return tokens[i:]
+}
+
+// isScalarFunction reports whether name, in lower case, is a function known
+// to compute each row on its own.
+func isScalarFunction(name string) bool {
+	for _, prefix := range scalarFunctionPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeChunks concatenates the frames of the chunks, whose results are in
+// the order of ranges. Fields are matched by name and labels, so that a
+// series found in only some chunks, as a time series query returns, is null
+// in the others. Every chunk but the last drops the rows at its upper
+// boundary, since the time macros include both ends of a range and the next
+// chunk returns them as well. Chunks whose rows run backwards in time, as
+// for ORDER BY time DESC, are concatenated from the last. Each frame keeps
+// the metadata of the first chunk, with the notices of every chunk. ok is
+// false when the chunks have different frames, or fields of the same name
+// and labels but different types.
+func mergeChunks(results []backend.DataResponse, ranges []backend.TimeRange) (data.Frames, bool) {
+	first := results[0].Frames
+	for _, res := range results[1:] {
+		if len(res.Frames) != len(first) {
+			return nil, false
+		}
+	}
+
+	merged := make(data.Frames, len(first))
+	for i, template := range first {
+		frame := data.NewFrame(template.Name)
+		frame.RefID = template.RefID
+		frame.Meta = chunkMeta(results, i)
+		// sources maps, for each chunk, each field of the merged frame to
+		// the chunk's field of the same name and labels, or -1.
+		sources := make([][]int, len(results))
+		for n, res := range results {
+			for j, f := range res.Frames[i].Fields {
+				k := slices.IndexFunc(frame.Fields, func(m *data.Field) bool {
+					return m.Name == f.Name && m.Labels.Equals(f.Labels)
+				})
+				switch {
+				case k < 0:
+					field := data.NewFieldFromFieldType(f.Type(), 0)
+					field.Name = f.Name
+					field.Labels = f.Labels.Copy()
+					field.Config = f.Config
+					frame.Fields = append(frame.Fields, field)
+					k = len(frame.Fields) - 1
+				case frame.Fields[k].Type() == f.Type():
+				case frame.Fields[k].Type().NullableType() == f.Type().NullableType():
+					frame.Fields[k] = nullableField(frame.Fields[k])
+				default:
+					return nil, false
+				}
+				for len(sources[n]) < len(frame.Fields) {
+					sources[n] = append(sources[n], -1)
+				}
+				sources[n][k] = j
+			}
+		}
+		for k, field := range frame.Fields {
+			if slices.ContainsFunc(sources, func(s []int) bool { return k >= len(s) || s[k] < 0 }) {
+				frame.Fields[k] = nullableField(field)
+			}
+		}
+
+		order := make([]int, len(results))
+		for n := range order {
+			order[n] = n
+		}
+		if descending(results, i) {
+			for l, r := 0, len(order)-1; l < r; l, r = l+1, r-1 {
+				order[l], order[r] = order[r], order[l]
+			}
+		}
+		for _, n := range order {
+			chunk := results[n].Frames[i]
+			timeIdx := timeFieldIndex(chunk)
+			for row := 0; row < chunk.Rows(); row++ {
+				if timeIdx >= 0 && n < len(results)-1 {
+					if t, ok := rowTime(chunk.Fields[timeIdx], row); ok && !t.Before(ranges[n].To) {
+						continue
+					}
+				}
+				for k, field := range frame.Fields {
+					field.Extend(1)
+					if k >= len(sources[n]) || sources[n][k] < 0 {
+						continue
+					}
+					if v, ok := chunk.Fields[sources[n][k]].ConcreteAt(row); ok {
+						field.SetConcrete(field.Len()-1, v)
+					}
+				}
+			}
+		}
+		merged[i] = frame
+	}
+	return merged, true
+}
+
+// nullableField returns f, empty, as a field of the nullable version of its
+// type, for the rows of the chunks that do not have it.
+func nullableField(f *data.Field) *data.Field {
+	if f.Type().Nullable() {
+		return f
+	}
+	field := data.NewFieldFromFieldType(f.Type().NullableType(), 0)
+	field.Name = f.Name
+	field.Labels = f.Labels
+	field.Config = f.Config
+	return field
+}
+
+// chunkMeta returns the metadata of frame i of the first chunk, with the
+// notices of frame i of every chunk, each once.
+func chunkMeta(results []backend.DataResponse, i int) *data.FrameMeta {
+	var notices []data.Notice
+	for _, res := range results {
+		if meta := res.Frames[i].Meta; meta != nil {
+			for _, notice := range meta.Notices {
+				if !slices.ContainsFunc(notices, func(n data.Notice) bool {
+					return n.Severity == notice.Severity && n.Text == notice.Text
+				}) {
+					notices = append(notices, notice)
+				}
+			}
+		}
+	}
+	first := results[0].Frames[i].Meta
+	if first == nil && len(notices) == 0 {
+		return nil
+	}
+	meta := &data.FrameMeta{}
+	if first != nil {
+		*meta = *first
+	}
+	meta.Notices = notices
+	return meta
+}
+
+// descending reports whether the rows of frame i run backwards in time, as
+// seen in the first chunk with rows at two different times.
+func descending(results []backend.DataResponse, i int) bool {
+	for _, res := range results {
+		timeIdx := timeFieldIndex(res.Frames[i])
+		if timeIdx < 0 {
+			continue
+		}
+		field := res.Frames[i].Fields[timeIdx]
+		first, ok := rowTime(field, 0)
+		if field.Len() < 2 || !ok {
+			continue
+		}
+		last, ok := rowTime(field, field.Len()-1)
+		if ok && !last.Equal(first) {
+			return last.Before(first)
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chunkedQuery(from, to time.Time, sql string) backend.DataQuery {
+	q := incrementalQuery(from, to, sql)
+	q.Interval = time.Hour
+	return q
+}
+
+func TestIsChunkable(t *testing.T) {
+	for sql, want := range map[string]bool{
+		"SELECT ts, msg FROM logs WHERE $__timeFilter(ts) ORDER BY ts":                                     true,
+		"SELECT ts, msg FROM logs WHERE ts >= $__fromTime AND ts <= $__toTime;":                            true,
+		"SELECT $__timeInterval(ts) AS t, count() FROM logs WHERE $__timeFilter(ts) GROUP BY t ORDER BY t": true,
+		"SELECT $__timeInterval_ms(ts) AS t, sumIf(v, ok) FROM m WHERE $__timeFilter_ms(ts) GROUP BY t":    true,
+		"SELECT ts, msg FROM logs":                                                                                       false,
+		"SELECT ts, msg FROM logs WHERE ts >= $__fromTime":                                                               false,
+		"SELECT ts, msg FROM logs WHERE $__dateFilter(d)":                                                                false,
+		"SELECT count() FROM logs WHERE $__timeFilter(ts)":                                                               false,
+		"SELECT DISTINCT host FROM logs WHERE $__timeFilter(ts)":                                                         false,
+		"SELECT $__timeGroup(ts, '1h') AS t, count() FROM logs WHERE $__timeFilter(ts) GROUP BY t":                       false,
+		"SELECT ts, msg FROM logs WHERE $__timeFilter(ts) ORDER BY ts DESC LIMIT 100":                                    false,
+		"SELECT ts, msg FROM (SELECT * FROM logs LIMIT 10) WHERE $__timeFilter(ts)":                                      false,
+		"SELECT ts, v - lagInFrame(v) OVER (ORDER BY ts) FROM m WHERE $__timeFilter(ts)":                                 false,
+		"SELECT ts, runningDifference(v) FROM m WHERE $__timeFilter(ts) ORDER BY ts":                                     false,
+		"SELECT ts, neighbor(v, -1) FROM m WHERE $__timeFilter(ts) ORDER BY ts":                                          false,
+		"SELECT ts FROM a WHERE $__timeFilter(ts) UNION ALL SELECT ts FROM b WHERE $__timeFilter(ts)":                    false,
+		"SELECT ts FROM a WHERE $__timeFilter(ts); SELECT ts FROM b WHERE $__timeFilter(ts)":                             false,
+		"SELECT $__rateColumns(ts, count()) FROM logs WHERE $__timeFilter(ts)":                                           false,
+		"INSERT INTO t SELECT ts FROM logs WHERE $__timeFilter(ts)":                                                      false,
+		"SELECT ts, msg FROM logs WHERE $__timeFilter(ts) AND msg = 'count(*) LIMIT 1' -- GROUP BY":                      true,
+		"SELECT ts, toFloat64(v) * 2, if(ok, 'y', 'n') FROM m WHERE $__timeFilter(ts) ORDER BY ts DESC, host":            true,
+		"SELECT $__timeInterval(ts) AS t, host, skewPop(v) FROM m WHERE $__timeFilter(ts) GROUP BY t, host":              true,
+		"SELECT skewPop(v), kurtSamp(v) FROM m WHERE $__timeFilter(ts)":                                                  false,
+		"SELECT deltaSum(v) FROM m WHERE $__timeFilter(ts)":                                                              false,
+		"SELECT simpleLinearRegression(x, y), rankCorr(x, y) FROM m WHERE $__timeFilter(ts)":                             false,
+		"SELECT exponentialMovingAverage(1)(v, toUInt64(ts)) FROM m WHERE $__timeFilter(ts)":                             false,
+		"SELECT sparkbar(10)(ts, v) FROM m WHERE $__timeFilter(ts)":                                                      false,
+		"SELECT studentTTest(v, g) FROM m WHERE $__timeFilter(ts)":                                                       false,
+		"SELECT largestTriangleThreeBuckets(100)(ts, v) FROM m WHERE $__timeFilter(ts)":                                  false,
+		"SELECT $__timeInterval(ts) AS t, count() FROM m WHERE $__timeFilter(ts) GROUP BY t WITH TOTALS":                 false,
+		"SELECT $__timeInterval(ts) AS t, host, count() FROM m WHERE $__timeFilter(ts) GROUP BY ROLLUP(t, host)":         false,
+		"SELECT $__timeInterval(ts) AS t, count() FROM m WHERE $__timeFilter(ts) GROUP BY host":                          false,
+		"SELECT $__timeInterval(ts) AS t, count() FROM m WHERE $__timeFilter(ts) GROUP BY t ORDER BY t WITH FILL":        false,
+		"SELECT ts, v FROM m WHERE $__timeFilter(ts) ORDER BY v DESC":                                                    false,
+		"SELECT $__timeInterval(ts) AS t, host, count() AS c FROM m WHERE $__timeFilter(ts) GROUP BY t, host ORDER BY c": false,
+		"SELECT ts, v FROM m WHERE $__timeFilter(ts) AND host IN (SELECT host FROM hosts)":                               false,
+	} {
+		t.Run(sql, func(t *testing.T) {
+			assert.Equal(t, want, isChunkable(sql))
+		})
+	}
+}
+
+func TestChunkedQueriesSplit(t *testing.T) {
+	c := newChunkedQueries(Settings{EnableChunkedQueries: true})
+	from := time.Date(2024, 1, 1, 0, 20, 0, 0, time.UTC)
+	sql := "SELECT $__timeInterval(ts) AS t, count() FROM logs WHERE $__timeFilter(ts) GROUP BY t"
+
+	ranges := c.split(chunkedQuery(from, from.Add(90*24*time.Hour), sql))
+	require.Len(t, ranges, 4)
+	assert.Equal(t, from, ranges[0].From)
+	assert.Equal(t, from.Add(90*24*time.Hour), ranges[3].To)
+	for i, tr := range ranges {
+		assert.True(t, tr.To.After(tr.From))
+		if i > 0 {
+			assert.Equal(t, ranges[i-1].To, tr.From, "chunks are contiguous")
+			assert.Equal(t, tr.From.Truncate(time.Hour), tr.From, "boundaries are aligned to the interval")
+		}
+	}
+
+	short := newChunkedQueries(Settings{EnableChunkedQueries: true, ChunkedQueryChunks: 10})
+	ranges = short.split(chunkedQuery(from, from.Add(25*time.Hour), sql))
+	assert.LessOrEqual(t, len(ranges), 10)
+	for i := 1; i < len(ranges); i++ {
+		assert.True(t, ranges[i].From.After(ranges[i-1].From), "boundaries that round to the same time are merged")
+	}
+
+	assert.Empty(t, c.split(chunkedQuery(from, from.Add(23*time.Hour), sql)), "short ranges run whole")
+	assert.Empty(t, c.split(chunkedQuery(from, from.Add(90*24*time.Hour), "SELECT count() FROM logs WHERE $__timeFilter(ts)")))
+	assert.Empty(t, newChunkedQueries(Settings{}).split(chunkedQuery(from, from.Add(90*24*time.Hour), sql)))
+}
+
+func TestChunkedQueriesRun(t *testing.T) {
+	c := newChunkedQueries(Settings{EnableChunkedQueries: true, ChunkedQueryChunks: 3})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(72 * time.Hour)
+
+	var (
+		mu       sync.Mutex
+		executed []backend.TimeRange
+	)
+	// Every chunk returns a point per hour over its range, both ends
+	// included, as $__timeFilter does.
+	res := c.run(context.Background(), chunkedQuery(from, to, "SELECT ts, v FROM m WHERE $__timeFilter(ts)"), func(ctx context.Context, q backend.DataQuery) backend.DataResponse {
+		mu.Lock()
+		executed = append(executed, q.TimeRange)
+		mu.Unlock()
+		var times []time.Time
+		for t := q.TimeRange.From; !t.After(q.TimeRange.To); t = t.Add(time.Hour) {
+			times = append(times, t)
+		}
+		frame := data.NewFrame("", data.NewField("time", nil, times))
+		frame.Meta = &data.FrameMeta{ExecutedQueryString: "chunk"}
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	})
+	require.NoError(t, res.Error)
+	assert.Len(t, executed, 3)
+
+	frame := res.Frames[0]
+	require.Equal(t, 73, frame.Rows(), "rows on a boundary are kept once")
+	for row := 0; row < frame.Rows(); row++ {
+		tm, _ := frame.Fields[0].ConcreteAt(row)
+		assert.True(t, from.Add(time.Duration(row)*time.Hour).Equal(tm.(time.Time)))
+	}
+	require.NotNil(t, frame.Meta)
+	assert.Equal(t, "chunk", frame.Meta.ExecutedQueryString)
+	assert.Equal(t, "Time range chunks", frame.Meta.Stats[0].DisplayName)
+	assert.Equal(t, 3.0, frame.Meta.Stats[0].Value)
+}
+
+func TestMergeChunksNotices(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ranges := []backend.TimeRange{{From: from, To: from.Add(time.Hour)}, {From: from.Add(time.Hour), To: from.Add(2 * time.Hour)}}
+	retried := data.Notice{Severity: data.NoticeSeverityWarning, Text: "retried"}
+	sampled := data.Notice{Severity: data.NoticeSeverityInfo, Text: "sampled"}
+	chunk := func(notices ...data.Notice) backend.DataResponse {
+		frame := data.NewFrame("", data.NewField("time", nil, []time.Time{from}))
+		if len(notices) > 0 {
+			frame.Meta = &data.FrameMeta{ExecutedQueryString: "chunk", Notices: notices}
+		}
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	}
+
+	merged, ok := mergeChunks([]backend.DataResponse{chunk(sampled), chunk(sampled, retried)}, ranges)
+	require.True(t, ok)
+	require.NotNil(t, merged[0].Meta)
+	assert.Equal(t, "chunk", merged[0].Meta.ExecutedQueryString)
+	assert.Equal(t, []data.Notice{sampled, retried}, merged[0].Meta.Notices, "each notice is kept once")
+
+	merged, ok = mergeChunks([]backend.DataResponse{chunk(), chunk(retried)}, ranges)
+	require.True(t, ok)
+	require.NotNil(t, merged[0].Meta)
+	assert.Equal(t, []data.Notice{retried}, merged[0].Meta.Notices)
+
+	merged, ok = mergeChunks([]backend.DataResponse{chunk(), chunk()}, ranges)
+	require.True(t, ok)
+	assert.Nil(t, merged[0].Meta)
+}
+
+func TestMergeChunksDescending(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ranges := []backend.TimeRange{{From: from, To: from.Add(time.Hour)}, {From: from.Add(time.Hour), To: from.Add(2 * time.Hour)}}
+	chunk := func(times ...time.Time) backend.DataResponse {
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("time", nil, times))}}
+	}
+	merged, ok := mergeChunks([]backend.DataResponse{
+		chunk(from.Add(time.Hour), from.Add(30*time.Minute), from),
+		chunk(from.Add(2*time.Hour), from.Add(90*time.Minute), from.Add(time.Hour)),
+	}, ranges)
+	require.True(t, ok)
+	require.Equal(t, 5, merged[0].Rows())
+	for row, want := range []time.Duration{120, 90, 60, 30, 0} {
+		tm, _ := merged[0].Fields[0].ConcreteAt(row)
+		assert.True(t, from.Add(want*time.Minute).Equal(tm.(time.Time)))
+	}
+}
+
+func TestMergeChunksSeries(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ranges := []backend.TimeRange{{From: from, To: from.Add(time.Hour)}, {From: from.Add(time.Hour), To: from.Add(2 * time.Hour)}}
+	chunk := func(t time.Time, hosts ...string) backend.DataResponse {
+		frame := data.NewFrame("", data.NewField("time", nil, []time.Time{t}))
+		for _, host := range hosts {
+			frame.Fields = append(frame.Fields, data.NewField("value", data.Labels{"host": host}, []float64{1}))
+		}
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	}
+
+	merged, ok := mergeChunks([]backend.DataResponse{chunk(from, "a"), chunk(from.Add(90*time.Minute), "b", "a")}, ranges)
+	require.True(t, ok)
+	frame := merged[0]
+	require.Len(t, frame.Fields, 3)
+	require.Equal(t, 2, frame.Rows())
+	assert.Equal(t, data.Labels{"host": "a"}, frame.Fields[1].Labels)
+	assert.Equal(t, data.FieldTypeFloat64, frame.Fields[1].Type(), "a series found in every chunk keeps its type")
+	assert.Equal(t, data.Labels{"host": "b"}, frame.Fields[2].Labels)
+	assert.Equal(t, data.FieldTypeNullableFloat64, frame.Fields[2].Type())
+	assert.Nil(t, frame.Fields[2].At(0), "a series is null in the chunks without it")
+	v, ok := frame.Fields[2].ConcreteAt(1)
+	require.True(t, ok)
+	assert.Equal(t, 1.0, v)
+
+	_, ok = mergeChunks([]backend.DataResponse{chunk(from, "a"), {Frames: data.Frames{}}}, ranges)
+	assert.False(t, ok, "chunks with other frames")
+}
+
+func TestChunkedQueriesFallback(t *testing.T) {
+	c := newChunkedQueries(Settings{EnableChunkedQueries: true})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := chunkedQuery(from, from.Add(96*time.Hour), "SELECT ts, v FROM m WHERE $__timeFilter(ts)")
+
+	t.Run("chunks with fields of other types", func(t *testing.T) {
+		var mu sync.Mutex
+		var executed []backend.TimeRange
+		res := c.run(context.Background(), q, func(ctx context.Context, q backend.DataQuery) backend.DataResponse {
+			mu.Lock()
+			executed = append(executed, q.TimeRange)
+			n := len(executed)
+			mu.Unlock()
+			frame := seriesFrame(q.TimeRange.From, q.TimeRange.From.Add(time.Minute), 0)
+			if n == 2 {
+				frame.Fields[1] = data.NewField("value", nil, []string{"a"})
+			}
+			return backend.DataResponse{Frames: data.Frames{frame}}
+		})
+		require.NoError(t, res.Error)
+		require.Len(t, executed, 5)
+		assert.Equal(t, q.TimeRange, executed[4], "the whole range is queried instead")
+		assert.Equal(t, 1, res.Frames[0].Rows())
+	})
+
+	t.Run("first error is returned", func(t *testing.T) {
+		// Every chunk runs at once, since the others only end once canceled.
+		c := newChunkedQueries(Settings{EnableChunkedQueries: true, ChunkedQueryParallelism: 4})
+		res := c.run(context.Background(), q, func(ctx context.Context, chunk backend.DataQuery) backend.DataResponse {
+			if chunk.TimeRange.From.Equal(from) {
+				return backend.DataResponse{Error: assert.AnError}
+			}
+			<-ctx.Done()
+			return backend.DataResponse{Error: ctx.Err()}
+		})
+		assert.ErrorIs(t, res.Error, assert.AnError)
+	})
+
+	t.Run("unchunked", func(t *testing.T) {
+		var calls int
+		short := q
+		short.TimeRange.To = from.Add(time.Hour)
+		c.run(context.Background(), short, func(ctx context.Context, got backend.DataQuery) backend.DataResponse {
+			calls++
+			assert.Equal(t, short, got)
+			return backend.DataResponse{}
+		})
+		assert.Equal(t, 1, calls)
+	})
+}
@@ -0,0 +1,266 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const defaultQueryQueueTimeout = 30 * time.Second
+
+var (
+	queryQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "clickhouse",
+		Name:      "query_queue_wait_seconds",
+		Help:      "Time queries waited for a concurrency slot, by query tier and outcome (admitted, timeout or canceled).",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"tier", "outcome"})
+	queriesQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "grafana_plugin",
+		Subsystem: "clickhouse",
+		Name:      "queries_queued",
+		Help:      "Queries currently waiting for a concurrency slot.",
+	})
+)
+
+// queryLimiter bounds the queries of a datasource that run at once, overall
+// and per Grafana user, so that one user opening a large dashboard cannot
+// take every connection of the pool. Queries over a cap wait in a queue.
+// When a slot frees up, queued alert rules are admitted first, since a late
+// alert is worse than a slow panel; other queries are admitted round-robin
+// across users, in arrival order for each user. Alert rules are exempt from
+// the per-user cap. A limiter without caps admits every query at once.
+type queryLimiter struct {
+	maxQueries int
+	maxPerUser int
+	timeout    time.Duration
+
+	mu      sync.Mutex
+	running int
+	// perUser counts the running queries of each user, alerts excluded.
+	perUser map[string]int
+	alerts  []*queryWaiter
+	// queued holds the waiting queries of each user, and users the order in
+	// which users with waiting queries take turns.
+	queued map[string][]*queryWaiter
+	users  []string
+}
+
+// queryWaiter is a query waiting in the queue. admitted is closed once it
+// holds a slot.
+type queryWaiter struct {
+	user     string
+	alert    bool
+	admitted chan struct{}
+}
+
+// newQueryLimiter builds the limiter configured on the datasource.
+func newQueryLimiter(settings Settings) *queryLimiter {
+	l := &queryLimiter{
+		maxQueries: int(settings.MaxConcurrentQueries),
+		maxPerUser: int(settings.MaxConcurrentQueriesPerUser),
+		timeout:    defaultQueryQueueTimeout,
+		perUser:    map[string]int{},
+		queued:     map[string][]*queryWaiter{},
+	}
+	if settings.QueryQueueTimeoutMs > 0 {
+		l.timeout = time.Duration(settings.QueryQueueTimeoutMs) * time.Millisecond
+	}
+	return l
+}
+
+func (l *queryLimiter) enabled() bool {
+	return l.maxQueries > 0 || l.maxPerUser > 0
+}
+
+// acquire waits for a slot for a query of the user behind ctx, and returns
+// the function that gives it back along with the time spent waiting. It
+// fails with a *queueTimeoutError when the queue timeout passes first, or
+// with the context error when ctx ends first.
+func (l *queryLimiter) acquire(ctx context.Context, tier queryTier) (func(), time.Duration, error) {
+	if !l.enabled() {
+		return func() {}, 0, nil
+	}
+	w := &queryWaiter{alert: tier == queryTierAlert, admitted: make(chan struct{})}
+	if u := backend.UserFromContext(ctx); u != nil {
+		w.user = u.Login
+	}
+	release := func() { l.release(w) }
+	start := time.Now()
+
+	l.mu.Lock()
+	// Every change of state admits what it can, so no queued query could
+	// take a slot that is free for this one.
+	if l.admissible(w) {
+		l.admit(w)
+		l.mu.Unlock()
+		queryQueueWait.WithLabelValues(string(tier), "admitted").Observe(0)
+		return release, 0, nil
+	}
+	l.enqueue(w)
+	l.mu.Unlock()
+	queriesQueued.Inc()
+	defer queriesQueued.Dec()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.admitted:
+	case <-timer.C:
+		err = &queueTimeoutError{timeout: l.timeout}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	wait := time.Since(start)
+
+	if err != nil {
+		l.mu.Lock()
+		admitted := l.dequeue(w)
+		l.mu.Unlock()
+		if !admitted {
+			outcome := "canceled"
+			var timeoutErr *queueTimeoutError
+			if errors.As(err, &timeoutErr) {
+				outcome = "timeout"
+			}
+			queryQueueWait.WithLabelValues(string(tier), outcome).Observe(wait.Seconds())
+			return nil, wait, err
+		}
+	}
+	queryQueueWait.WithLabelValues(string(tier), "admitted").Observe(wait.Seconds())
+	return release, wait, nil
+}
+
+// release gives back the slot held by w and admits the queries it frees.
+func (l *queryLimiter) release(w *queryWaiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	if !w.alert {
+		if l.perUser[w.user]--; l.perUser[w.user] == 0 {
+			delete(l.perUser, w.user)
+		}
+	}
+	l.dispatch()
+}
+
+// admissible reports whether w fits under the caps. Must hold l.mu.
+func (l *queryLimiter) admissible(w *queryWaiter) bool {
+	if l.maxQueries > 0 && l.running >= l.maxQueries {
+		return false
+	}
+	return w.alert || l.maxPerUser <= 0 || l.perUser[w.user] < l.maxPerUser
+}
+
+// admit gives w a slot. Must hold l.mu.
+func (l *queryLimiter) admit(w *queryWaiter) {
+	l.running++
+	if !w.alert {
+		l.perUser[w.user]++
+	}
+	close(w.admitted)
+}
+
+// enqueue adds w to the back of its queue. Must hold l.mu.
+func (l *queryLimiter) enqueue(w *queryWaiter) {
+	if w.alert {
+		l.alerts = append(l.alerts, w)
+		return
+	}
+	if len(l.queued[w.user]) == 0 {
+		l.users = append(l.users, w.user)
+	}
+	l.queued[w.user] = append(l.queued[w.user], w)
+}
+
+// dequeue removes w from its queue after it gave up waiting, and reports
+// whether it was admitted in the meantime, in which case it holds a slot.
+// Must hold l.mu.
+func (l *queryLimiter) dequeue(w *queryWaiter) bool {
+	select {
+	case <-w.admitted:
+		return true
+	default:
+	}
+	if w.alert {
+		l.alerts = slices.DeleteFunc(l.alerts, func(q *queryWaiter) bool { return q == w })
+		return false
+	}
+	l.queued[w.user] = slices.DeleteFunc(l.queued[w.user], func(q *queryWaiter) bool { return q == w })
+	if len(l.queued[w.user]) == 0 {
+		delete(l.queued, w.user)
+		l.users = slices.DeleteFunc(l.users, func(u string) bool { return u == w.user })
+	}
+	return false
+}
+
+// dispatch admits queued queries while slots are free: alert rules first,
+// then one query per user in turn. A user whose turn is taken goes to the
+// back of the rotation. Must hold l.mu.
+func (l *queryLimiter) dispatch() {
+	for len(l.alerts) > 0 && l.admissible(l.alerts[0]) {
+		l.admit(l.alerts[0])
+		l.alerts = l.alerts[1:]
+	}
+	for {
+		turn := slices.IndexFunc(l.users, func(u string) bool { return l.admissible(l.queued[u][0]) })
+		if turn < 0 {
+			return
+		}
+		user := l.users[turn]
+		l.admit(l.queued[user][0])
+		l.queued[user] = l.queued[user][1:]
+		l.users = slices.Delete(l.users, turn, turn+1)
+		if len(l.queued[user]) > 0 {
+			l.users = append(l.users, user)
+		} else {
+			delete(l.queued, user)
+		}
+	}
+}
+
+// withQueueWait reports how long the query waited for a slot in the stats of
+// its frames. Nothing is added when the limiter is disabled.
+func (l *queryLimiter) withQueueWait(res backend.DataResponse, refID string, wait time.Duration) backend.DataResponse {
+	if !l.enabled() {
+		return res
+	}
+	res.Frames = appendQueryStats(res.Frames, refID, data.QueryStat{
+		FieldConfig: data.FieldConfig{DisplayName: "Queue wait", Unit: "ms"},
+		Value:       float64(wait.Microseconds()) / 1000,
+	})
+	return res
+}
+
+// queueErrorResponse is the response of a query that gave up waiting for a
+// slot. A queue timeout means the datasource is saturated, which Grafana
+// should treat like any other rate limit.
+func queueErrorResponse(err error) backend.DataResponse {
+	res := backend.DataResponse{Error: backend.DownstreamError(err)}
+	var timeoutErr *queueTimeoutError
+	if errors.As(err, &timeoutErr) {
+		res.Status = backend.StatusTooManyRequests
+	}
+	return res
+}
+
+// queueTimeoutError reports a query that found no free slot within the queue
+// timeout.
+type queueTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *queueTimeoutError) Error() string {
+	return fmt.Sprintf("query waited %s for a free slot: this data source limits how many queries run at once; "+
+		"try again later or reduce the number of panels refreshing together", e.timeout)
+}
@@ -0,0 +1,172 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func userContext(login string) context.Context {
+	return backend.WithUser(context.Background(), &backend.User{Login: login})
+}
+
+// acquireAsync starts acquiring a slot and returns the channel its release
+// function is sent on once admitted.
+func acquireAsync(t *testing.T, l *queryLimiter, ctx context.Context, tier queryTier) <-chan func() {
+	t.Helper()
+	queued := func() int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return queuedCount(l)
+	}
+	before := queued()
+	admitted := make(chan func(), 1)
+	go func() {
+		release, _, err := l.acquire(ctx, tier)
+		if err == nil {
+			admitted <- release
+		}
+	}()
+	// Wait until the query is queued, so that arrival order is deterministic.
+	require.Eventually(t, func() bool {
+		return len(admitted) > 0 || queued() > before
+	}, time.Second, time.Millisecond)
+	return admitted
+}
+
+func queuedCount(l *queryLimiter) int {
+	n := len(l.alerts)
+	for _, q := range l.queued {
+		n += len(q)
+	}
+	return n
+}
+
+func requireAdmitted(t *testing.T, admitted <-chan func()) func() {
+	t.Helper()
+	select {
+	case release := <-admitted:
+		return release
+	case <-time.After(time.Second):
+		t.Fatal("query was not admitted")
+		return nil
+	}
+}
+
+func requireWaiting(t *testing.T, admitted <-chan func()) {
+	t.Helper()
+	select {
+	case <-admitted:
+		t.Fatal("query was admitted over the cap")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestQueryLimiterDisabled(t *testing.T) {
+	l := newQueryLimiter(Settings{})
+	for i := 0; i < 10; i++ {
+		release, wait, err := l.acquire(context.Background(), queryTierDashboard)
+		require.NoError(t, err)
+		assert.Zero(t, wait)
+		defer release()
+	}
+	assert.Equal(t, backend.DataResponse{}, l.withQueueWait(backend.DataResponse{}, "A", time.Second))
+}
+
+func TestQueryLimiterGlobalCap(t *testing.T) {
+	l := newQueryLimiter(Settings{MaxConcurrentQueries: 2})
+	first, _, err := l.acquire(userContext("alice"), queryTierDashboard)
+	require.NoError(t, err)
+	_, _, err = l.acquire(userContext("bob"), queryTierDashboard)
+	require.NoError(t, err)
+
+	third := acquireAsync(t, l, userContext("carol"), queryTierDashboard)
+	requireWaiting(t, third)
+	first()
+	requireAdmitted(t, third)
+}
+
+func TestQueryLimiterPerUserCap(t *testing.T) {
+	l := newQueryLimiter(Settings{MaxConcurrentQueries: 10, MaxConcurrentQueriesPerUser: 1})
+	release, _, err := l.acquire(userContext("alice"), queryTierDashboard)
+	require.NoError(t, err)
+
+	alice := acquireAsync(t, l, userContext("alice"), queryTierDashboard)
+	requireWaiting(t, alice)
+
+	_, wait, err := l.acquire(userContext("bob"), queryTierDashboard)
+	require.NoError(t, err, "another user is not held up")
+	assert.Zero(t, wait)
+
+	_, _, err = l.acquire(userContext("alice"), queryTierAlert)
+	require.NoError(t, err, "alert rules are exempt from the per-user cap")
+
+	release()
+	requireAdmitted(t, alice)
+}
+
+func TestQueryLimiterFairness(t *testing.T) {
+	l := newQueryLimiter(Settings{MaxConcurrentQueries: 1})
+	release, _, err := l.acquire(userContext("alice"), queryTierDashboard)
+	require.NoError(t, err)
+
+	alice1 := acquireAsync(t, l, userContext("alice"), queryTierDashboard)
+	alice2 := acquireAsync(t, l, userContext("alice"), queryTierDashboard)
+	bob := acquireAsync(t, l, userContext("bob"), queryTierDashboard)
+	alert := acquireAsync(t, l, userContext(""), queryTierAlert)
+
+	release()
+	release = requireAdmitted(t, alert)
+	requireWaiting(t, alice1)
+	release()
+	release = requireAdmitted(t, alice1)
+	release()
+	release = requireAdmitted(t, bob)
+	requireWaiting(t, alice2)
+	release()
+	requireAdmitted(t, alice2)
+}
+
+func TestQueryLimiterQueueTimeout(t *testing.T) {
+	l := newQueryLimiter(Settings{MaxConcurrentQueries: 1, QueryQueueTimeoutMs: 20})
+	_, _, err := l.acquire(userContext("alice"), queryTierDashboard)
+	require.NoError(t, err)
+
+	release, wait, err := l.acquire(userContext("bob"), queryTierDashboard)
+	var timeoutErr *queueTimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.Nil(t, release)
+	assert.GreaterOrEqual(t, wait, 20*time.Millisecond)
+	assert.Zero(t, queuedCount(l))
+	assert.Empty(t, l.users)
+
+	res := queueErrorResponse(err)
+	assert.Equal(t, backend.StatusTooManyRequests, res.Status)
+	assert.True(t, backend.IsDownstreamError(res.Error))
+}
+
+func TestQueryLimiterContextCanceled(t *testing.T) {
+	l := newQueryLimiter(Settings{MaxConcurrentQueriesPerUser: 1})
+	_, _, err := l.acquire(userContext("alice"), queryTierExplore)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(userContext("alice"), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = l.acquire(ctx, queryTierExplore)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Zero(t, queuedCount(l))
+	assert.Equal(t, backend.Status(0), queueErrorResponse(err).Status)
+}
+
+func TestQueryLimiterWithQueueWait(t *testing.T) {
+	l := newQueryLimiter(Settings{MaxConcurrentQueries: 1})
+	res := l.withQueueWait(backend.DataResponse{}, "A", 1500*time.Microsecond)
+	require.Len(t, res.Frames, 1)
+	require.Len(t, res.Frames[0].Meta.Stats, 1)
+	assert.Equal(t, "Queue wait", res.Frames[0].Meta.Stats[0].DisplayName)
+	assert.Equal(t, 1.5, res.Frames[0].Meta.Stats[0].Value)
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"errors"
 	"net"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -61,6 +62,29 @@ func httpStatusCode(errStr string) int {
 	return code
 }
 
+// exceptionCodeRe matches the exception header ClickHouse writes into HTTP
+// response bodies, e.g. "Code: 202. DB::Exception: Too many simultaneous queries".
+var exceptionCodeRe = regexp.MustCompile(`Code: (\d+)\. DB::Exception`)
+
+// exceptionCode extracts the ClickHouse exception code from err. Native
+// protocol errors carry a typed *clickhouse.Exception; the HTTP transport only
+// surfaces the server's response body, so the code is parsed from the text.
+func exceptionCode(err error) (int32, bool) {
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return exception.Code, true
+	}
+	m := exceptionCodeRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	code, parseErr := strconv.ParseInt(m[1], 10, 32)
+	if parseErr != nil {
+		return 0, false
+	}
+	return int32(code), true
+}
+
 // authErrorHint returns human-readable guidance for an authentication failure,
 // distinguishing "who are you" (expired/invalid credentials — sign out and back
 // in to refresh a forwarded token) from "you may not do that" (missing role or
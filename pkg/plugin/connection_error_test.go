@@ -320,3 +320,25 @@ func TestAuthErrorHint(t *testing.T) {
 		})
 	}
 }
+
+func TestExceptionCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int32
+		wantOK   bool
+	}{
+		{name: "native exception", err: &clickhouse.Exception{Code: 202}, wantCode: 202, wantOK: true},
+		{name: "wrapped native exception", err: fmt.Errorf("query: %w", &clickhouse.Exception{Code: 159}), wantCode: 159, wantOK: true},
+		{name: "HTTP response body", err: errors.New(`[HTTP 500] response body: "Code: 241. DB::Exception: Memory limit exceeded"`), wantCode: 241, wantOK: true},
+		{name: "no exception", err: errors.New("dial tcp: connection refused"), wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, ok := exceptionCode(tt.err)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantCode, code)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+// costActionReject is the Settings.CostEstimateAction that fails queries over
+// a threshold; any other value only warns.
+const costActionReject = "reject"
+
+type costEstimatorKeyType struct{}
+
+var costEstimatorKey = costEstimatorKeyType{}
+
+// costEstimate is what EXPLAIN ESTIMATE reports a query will read, summed
+// over every table it touches.
+type costEstimate struct {
+	parts uint64
+	rows  uint64
+	marks uint64
+}
+
+// costEstimator runs EXPLAIN ESTIMATE on a query before it executes, and
+// holds it against the thresholds configured on the datasource. Zero
+// thresholds are not enforced.
+type costEstimator struct {
+	enabled  bool
+	maxRows  uint64
+	maxParts uint64
+	maxMarks uint64
+	reject   bool
+	// db returns the connection the query will run on.
+	db func(context.Context, *sqlutil.Query) (*sql.DB, error)
+}
+
+// newCostEstimator builds the cost estimator configured on the datasource.
+func newCostEstimator(settings Settings, db func(context.Context, *sqlutil.Query) (*sql.DB, error)) costEstimator {
+	return costEstimator{
+		enabled:  settings.EnableCostEstimation,
+		maxRows:  uint64(settings.CostEstimateMaxRows),
+		maxParts: uint64(settings.CostEstimateMaxParts),
+		maxMarks: uint64(settings.CostEstimateMaxMarks),
+		reject:   settings.CostEstimateAction == costActionReject,
+		db:       db,
+	}
+}
+
+// attach arranges for interpolateMacros to estimate the cost of the query
+// run with ctx. Only dashboard queries are estimated: Explore queries are
+// ad hoc, and would pay for an extra round trip each, and rejecting alert
+// rules would silence the alert rather than protect the cluster from a user.
+func (c costEstimator) attach(ctx context.Context, tier queryTier) context.Context {
+	if !c.enabled || tier != queryTierDashboard {
+		return ctx
+	}
+	return context.WithValue(ctx, costEstimatorKey, c)
+}
+
+// estimateQueryCost is called by interpolateMacros with the interpolated SQL.
+// It records the estimate on the query stats, and fails when the estimate is
+// over a threshold and the datasource rejects such queries. A query that
+// cannot be estimated runs as usual.
+func estimateQueryCost(ctx context.Context, query *sqlutil.Query, sql string) error {
+	c, ok := ctx.Value(costEstimatorKey).(costEstimator)
+	if !ok || !isEstimable(sql) {
+		return nil
+	}
+	estimate, err := c.estimate(ctx, query, sql)
+	if err != nil {
+		backend.Logger.FromContext(ctx).Debug("Could not estimate query cost", "error", err)
+		return nil
+	}
+	if stats := queryStatsFromContext(ctx); stats != nil {
+		stats.estimate = &estimate
+	}
+	if exceeded := c.exceeded(estimate); exceeded != nil && c.reject {
+		return exceeded
+	}
+	return nil
+}
+
+// isEstimable reports whether EXPLAIN ESTIMATE accepts sql: only SELECT
+// queries, optionally with a WITH clause, are estimated.
+func isEstimable(sql string) bool {
+	switch strings.ToUpper(leadingKeyword(sql)) {
+	case "SELECT", "WITH":
+		return true
+	default:
+		return false
+	}
+}
+
+// estimate runs EXPLAIN ESTIMATE for sql on the connection of query.
+func (c costEstimator) estimate(ctx context.Context, query *sqlutil.Query, sql string) (costEstimate, error) {
+	db, err := c.db(ctx, query)
+	if err != nil {
+		return costEstimate{}, err
+	}
+	return explainEstimate(ctx, db, sql)
+}
+
+// auxiliaryQueryContext returns the context for a query the plugin runs on
+// behalf of a user query: it runs under its own query_id and without the
+// progress callback of the user query, so that system.query_log and the
+// query stats only describe the user query itself.
+func auxiliaryQueryContext(ctx context.Context) context.Context {
+	return clickhouse.Context(ctx,
+		clickhouse.WithQueryID(uuid.NewString()),
+		clickhouse.WithProgress(func(*clickhouse.Progress) {}),
+	)
+}
+
+// explainEstimate runs EXPLAIN ESTIMATE for sql on db.
+func explainEstimate(ctx context.Context, db *sql.DB, sql string) (costEstimate, error) {
+	rows, err := db.QueryContext(auxiliaryQueryContext(ctx), "EXPLAIN ESTIMATE "+sql)
+	if err != nil {
+		return costEstimate{}, err
+	}
+	defer rows.Close()
+
+	var total costEstimate
+	for rows.Next() {
+		var (
+			database, table     string
+			parts, count, marks uint64
+		)
+		if err := rows.Scan(&database, &table, &parts, &count, &marks); err != nil {
+			return costEstimate{}, err
+		}
+		total.parts += parts
+		total.rows += count
+		total.marks += marks
+	}
+	return total, rows.Err()
+}
+
+// exceeded returns the error describing the first threshold e is over, or
+// nil if it is within all of them.
+func (c costEstimator) exceeded(e costEstimate) *costLimitError {
+	switch {
+	case c.maxRows > 0 && e.rows > c.maxRows:
+		return &costLimitError{unit: "rows", estimated: e.rows, limit: c.maxRows}
+	case c.maxParts > 0 && e.parts > c.maxParts:
+		return &costLimitError{unit: "parts", estimated: e.parts, limit: c.maxParts}
+	case c.maxMarks > 0 && e.marks > c.maxMarks:
+		return &costLimitError{unit: "marks", estimated: e.marks, limit: c.maxMarks}
+	}
+	return nil
+}
+
+// withCostEstimate attaches the estimate recorded for a query to its frames,
+// and warns when it is over a threshold. sqlds reports the rejection of a
+// query as a macro error; it is unwrapped so the user sees why it was
+// rejected.
+func (c costEstimator) withCostEstimate(res backend.DataResponse, refID string, stats *queryStats) backend.DataResponse {
+	var limitErr *costLimitError
+	if errors.As(res.Error, &limitErr) {
+		res.Error = backend.DownstreamError(limitErr)
+		res.Status = backend.StatusBadRequest
+	}
+	if stats.estimate == nil {
+		return res
+	}
+
+	e := stats.estimate
+	res.Frames = appendQueryStats(res.Frames, refID,
+		data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Estimated rows to read"}, Value: float64(e.rows)},
+		data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Estimated parts to read"}, Value: float64(e.parts)},
+		data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: "Estimated marks to read"}, Value: float64(e.marks)},
+	)
+	if exceeded := c.exceeded(*e); exceeded != nil && res.Error == nil {
+		res.Frames = appendNotice(res.Frames, refID, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     exceeded.Error(),
+		})
+	}
+	return res
+}
+
+// costLimitError reports a query whose estimate is over a threshold.
+type costLimitError struct {
+	unit      string
+	estimated uint64
+	limit     uint64
+}
+
+func (e *costLimitError) Error() string {
+	return fmt.Sprintf("query is estimated to read %d %s, above the limit of %d set on this data source; "+
+		"narrow the time range or add filters", e.estimated, e.unit, e.limit)
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsEstimable(t *testing.T) {
+	assert.True(t, isEstimable("SELECT 1"))
+	assert.True(t, isEstimable("  with x AS (SELECT 1) SELECT * FROM x"))
+	assert.True(t, isEstimable("/* panel */ SELECT 1"))
+	assert.False(t, isEstimable("SHOW TABLES"))
+	assert.False(t, isEstimable("EXPLAIN SELECT 1"))
+	assert.False(t, isEstimable(""))
+}
+
+func TestNewCostEstimator(t *testing.T) {
+	c := newCostEstimator(Settings{EnableCostEstimation: true, CostEstimateMaxRows: 10, CostEstimateMaxParts: 20, CostEstimateMaxMarks: 30}, nil)
+	assert.True(t, c.enabled)
+	assert.Equal(t, uint64(10), c.maxRows)
+	assert.Equal(t, uint64(20), c.maxParts)
+	assert.Equal(t, uint64(30), c.maxMarks)
+	assert.False(t, c.reject)
+
+	assert.True(t, newCostEstimator(Settings{CostEstimateAction: "reject"}, nil).reject)
+}
+
+func TestCostEstimatorExceeded(t *testing.T) {
+	c := costEstimator{maxRows: 1000, maxMarks: 10}
+
+	assert.Nil(t, c.exceeded(costEstimate{rows: 1000, parts: 500, marks: 10}))
+
+	err := c.exceeded(costEstimate{rows: 1001, marks: 11})
+	require.NotNil(t, err)
+	assert.Equal(t, "query is estimated to read 1001 rows, above the limit of 1000 set on this data source; narrow the time range or add filters", err.Error())
+
+	err = c.exceeded(costEstimate{rows: 5, marks: 11})
+	require.NotNil(t, err)
+	assert.Equal(t, "marks", err.unit)
+
+	assert.Nil(t, costEstimator{}.exceeded(costEstimate{rows: 1 << 40}))
+}
+
+func TestCostEstimatorAttach(t *testing.T) {
+	c := costEstimator{enabled: true}
+	_, ok := c.attach(context.Background(), queryTierDashboard).Value(costEstimatorKey).(costEstimator)
+	assert.True(t, ok)
+	assert.Nil(t, c.attach(context.Background(), queryTierExplore).Value(costEstimatorKey))
+	assert.Nil(t, c.attach(context.Background(), queryTierAlert).Value(costEstimatorKey))
+	assert.Nil(t, costEstimator{}.attach(context.Background(), queryTierDashboard).Value(costEstimatorKey))
+}
+
+func TestEstimateQueryCost(t *testing.T) {
+	t.Run("query without estimator", func(t *testing.T) {
+		assert.NoError(t, estimateQueryCost(context.Background(), &sqlutil.Query{}, "SELECT 1"))
+	})
+
+	t.Run("estimate failure does not fail the query", func(t *testing.T) {
+		calls := 0
+		c := costEstimator{enabled: true, reject: true, maxRows: 1, db: func(context.Context, *sqlutil.Query) (*sql.DB, error) {
+			calls++
+			return nil, errors.New("no connection")
+		}}
+		ctx, stats := withQueryStats(c.attach(context.Background(), queryTierDashboard))
+
+		assert.NoError(t, estimateQueryCost(ctx, &sqlutil.Query{}, "SELECT 1"))
+		assert.Equal(t, 1, calls)
+		assert.Nil(t, stats.estimate)
+
+		assert.NoError(t, estimateQueryCost(ctx, &sqlutil.Query{}, "SHOW DATABASES"))
+		assert.Equal(t, 1, calls, "statements EXPLAIN ESTIMATE rejects are not estimated")
+	})
+}
+
+func TestCostEstimatorWithCostEstimate(t *testing.T) {
+	c := costEstimator{maxRows: 100}
+
+	t.Run("no estimate", func(t *testing.T) {
+		res := c.withCostEstimate(backend.DataResponse{}, "A", &queryStats{})
+		assert.Empty(t, res.Frames)
+	})
+
+	t.Run("estimate within the thresholds", func(t *testing.T) {
+		res := c.withCostEstimate(backend.DataResponse{}, "A", &queryStats{estimate: &costEstimate{parts: 2, rows: 50, marks: 7}})
+		require.Len(t, res.Frames, 1)
+		meta := res.Frames[0].Meta
+		assert.Equal(t, []data.QueryStat{
+			{FieldConfig: data.FieldConfig{DisplayName: "Estimated rows to read"}, Value: 50},
+			{FieldConfig: data.FieldConfig{DisplayName: "Estimated parts to read"}, Value: 2},
+			{FieldConfig: data.FieldConfig{DisplayName: "Estimated marks to read"}, Value: 7},
+		}, meta.Stats)
+		assert.Empty(t, meta.Notices)
+	})
+
+	t.Run("estimate over a threshold warns", func(t *testing.T) {
+		res := c.withCostEstimate(backend.DataResponse{}, "A", &queryStats{estimate: &costEstimate{rows: 500}})
+		require.Len(t, res.Frames[0].Meta.Notices, 1)
+		assert.Equal(t, data.NoticeSeverityWarning, res.Frames[0].Meta.Notices[0].Severity)
+		assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "estimated to read 500 rows")
+	})
+
+	t.Run("rejected query", func(t *testing.T) {
+		limitErr := &costLimitError{unit: "rows", estimated: 500, limit: 100}
+		res := c.withCostEstimate(backend.DataResponse{
+			Error: fmt.Errorf("Could not apply macros: %w", backend.DownstreamError(limitErr)),
+		}, "A", &queryStats{estimate: &costEstimate{rows: 500}})
+		assert.Equal(t, limitErr.Error(), res.Error.Error())
+		assert.True(t, backend.IsDownstreamError(res.Error))
+		assert.Equal(t, backend.StatusBadRequest, res.Status)
+		assert.Empty(t, res.Frames[0].Meta.Notices)
+	})
+}
@@ -2,12 +2,47 @@ package plugin
 
 import (
 	"context"
+	"fmt"
+	"maps"
+	"runtime/debug"
+	"sync"
+	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/google/uuid"
+	"github.com/grafana/clickhouse-datasource/pkg/macros"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 	"github.com/grafana/sqlds/v5"
 )
 
+// Datasource wraps the sqlds datasource so that every query passes through
+// the ClickHouse-specific query pipeline (retries and friends) before sqlds
+// interpolates, executes and converts it. Health checks and resource calls
+// are served by the embedded sqlds datasource unchanged.
+type Datasource struct {
+	*sqlds.SQLDatasource
+
+	settings    Settings
+	retry       retryPolicy
+	audit       auditLogger
+	guardrails  guardrails
+	cost        costEstimator
+	sampler     querySampler
+	tables      tablePolicy
+	limiter     *queryLimiter
+	dedupe      *queryDeduplicator
+	cache       *resultCache
+	incremental *incrementalQueries
+	chunks      chunkedQueries
+	schema      schemaQueries
+	variables   variableQueries
+	logPatterns logPatternQueries
+	serviceMap  serviceMapQueries
+	spanMetrics spanMetricsQueries
+}
+
 func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 	clickhousePlugin := Clickhouse{}
 	ds := sqlds.NewDatasource(&clickhousePlugin)
@@ -19,5 +54,235 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 		ds.EnableMultipleConnections = true
 	}
 
-	return ds.NewDatasource(ctx, settings)
+	if _, err := ds.NewDatasource(ctx, settings); err != nil {
+		return nil, err
+	}
+
+	// sqlds only creates the instance after Connect has loaded and validated
+	// the settings, so this cannot fail where it did not fail before.
+	s, err := LoadSettings(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := newQueryLimiter(s)
+	return &Datasource{
+		SQLDatasource: ds,
+		settings:      s,
+		retry:         newRetryPolicy(s),
+		audit:         newAuditLogger(s),
+		guardrails:    newGuardrails(s),
+		cost:          newCostEstimator(s, ds.GetDBFromQuery),
+		sampler:       newQuerySampler(s, ds.GetDBFromQuery, limiter),
+		tables:        newTablePolicy(s),
+		limiter:       limiter,
+		dedupe:        newQueryDeduplicator(s),
+		cache:         newResultCache(s),
+		incremental:   newIncrementalQueries(s),
+		chunks:        newChunkedQueries(s),
+		schema:        newSchemaQueries(s),
+		variables:     newVariableQueries(s),
+		logPatterns:   newLogPatternQueries(s),
+		serviceMap:    newServiceMapQueries(s),
+		spanMetrics:   newSpanMetricsQueries(s),
+	}, nil
+}
+
+// QueryData runs each query of the request concurrently through
+// handleQuery, mirroring the fan-out sqlds performs itself. As in sqlds, a
+// panic while handling a query fails that query alone.
+func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	ctx = withGrafanaHeaders(ctx, req)
+	response := backend.NewQueryDataResponse()
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, q := range req.Queries {
+		wg.Add(1)
+		go func(q backend.DataQuery) {
+			defer wg.Done()
+			res := d.handleQueryRecovered(ctx, req, q)
+			mu.Lock()
+			response.Responses[q.RefID] = res
+			mu.Unlock()
+		}(q)
+	}
+	wg.Wait()
+	return response, nil
+}
+
+// handleQueryRecovered runs handleQuery, turning a panic into an error
+// response for q. The query itself is not logged, since it may hold
+// sensitive values.
+func (d *Datasource) handleQueryRecovered(ctx context.Context, req *backend.QueryDataRequest, q backend.DataQuery) (res backend.DataResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger := backend.Logger.FromContext(ctx)
+			logger.Error("Query panicked", "panic", r, "refID", q.RefID, "queryType", q.QueryType)
+			logger.Debug("Query panic stack trace", "stack", string(debug.Stack()))
+			res = withQueryStatus(backend.DataResponse{Error: backend.PluginError(fmt.Errorf("query panicked: %v", r))})
+		}
+	}()
+	return d.handleQuery(ctx, req, q)
+}
+
+// handleQuery is the per-query pipeline. The query timeout configured on the
+// datasource bounds the whole pipeline, retries included, rather than each
+// attempt on its own, and so do the guardrails of the query's tier. A query
+// identical to one already running waits for that one instead of running,
+// retries included, and a dashboard query may be served from the result
+// cache, or only query what is new since the panel last refreshed. A long
+// time range may run as several chunks, each on its own through the rest of
+// the pipeline, and a query of several statements runs them one by one.
+// Queries of a query type, such as schema queries, are answered by that
+// type's run function instead. Other queries may come with exemplars, picked
+// from the rows they aggregate. The response status reflects the final
+// outcome, and the query is audited once, with every execution it took.
+func (d *Datasource) handleQuery(ctx context.Context, req *backend.QueryDataRequest, q backend.DataQuery) (res backend.DataResponse) {
+	ctx, trail := withAuditTrail(ctx)
+	start := time.Now()
+	defer func(ctx context.Context) {
+		d.audit.log(ctx, auditRecord{refID: q.RefID, duration: time.Since(start), res: res, trail: trail})
+	}(ctx)
+
+	if timeout := d.DriverSettings().Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tier := queryTierFromContext(ctx)
+	if d.settings.AlignTimeRangeToInterval && tier == queryTierDashboard {
+		// Only dashboard queries are cached, and the others expect the
+		// time range they asked for, up to now.
+		q.TimeRange = macros.AlignTimeRange(q.TimeRange, q.Interval)
+	}
+	ctx, cancel := d.guardrails.apply(ctx, tier)
+	defer cancel()
+	ctx = d.cost.attach(ctx, tier)
+	ctx = d.tables.attach(ctx)
+	ctx, err := bindQueryParameters(ctx, q)
+	if err != nil {
+		return withQueryStatus(backend.DataResponse{Error: backend.DownstreamError(err), Status: backend.StatusBadRequest})
+	}
+
+	execute := func(ctx context.Context, q backend.DataQuery) backend.DataResponse {
+		return d.executeQuery(ctx, req, tier, q)
+	}
+	switch q.QueryType {
+	case schemaQueryType:
+		res = d.schema.run(ctx, q, execute)
+	case variableQueryType:
+		// Variable and annotation queries are not sampled, which would drop
+		// options and events.
+		res = d.variables.run(ctx, q, execute)
+	case annotationQueryType:
+		res = runAnnotationQuery(ctx, q, execute)
+	case queryAnalysisQueryType:
+		res = runQueryAnalysisQuery(ctx, q, execute)
+	case explainQueryType:
+		// The plan explained is that of the SQL as written, unsampled.
+		res = runExplainQuery(ctx, q, execute)
+	case logPatternsQueryType:
+		// Sampling would drop the rare patterns, which are those of interest.
+		res = d.logPatterns.run(ctx, q, execute)
+	case serviceMapQueryType:
+		res = d.serviceMap.run(ctx, q, execute)
+	case spanMetricsQueryType:
+		// Sampling would skew the rates and percentiles.
+		res = d.spanMetrics.run(ctx, q, execute)
+	case flameGraphQueryType:
+		res = runFlameGraphQuery(ctx, q, execute)
+	default:
+		// Exemplars are picked from all the rows, not a sample of them,
+		// since the largest value of an interval may not be sampled.
+		exemplarCtx := ctx
+		ctx, sample := d.sampler.decide(ctx, tier, q)
+		if statements := querySQLStatements(q); len(statements) > 1 {
+			// The statements share the panel of the query, so they are
+			// not refreshed incrementally.
+			res = runStatements(ctx, q, statements, func(ctx context.Context, q backend.DataQuery) backend.DataResponse {
+				return d.chunks.run(ctx, q, execute)
+			})
+			res = withExemplars(exemplarCtx, q, res, execute)
+		} else {
+			// The exemplars are picked over the range the refresh queries,
+			// and kept with the series for the next one.
+			res = d.incremental.run(ctx, tier, q, func(q backend.DataQuery) backend.DataResponse {
+				return withExemplars(exemplarCtx, q, d.chunks.run(ctx, q, execute), execute)
+			})
+		}
+		res = withSampleNotice(res, q.RefID, sample)
+	}
+	return withQueryStatus(d.guardrails.explain(ctx, tier, res))
+}
+
+// executeQuery runs a query over its time range, which the incremental mode
+// may have narrowed, through the result cache, deduplication and retries.
+func (d *Datasource) executeQuery(ctx context.Context, req *backend.QueryDataRequest, tier queryTier, q backend.DataQuery) backend.DataResponse {
+	if len(queryParametersFromContext(ctx)) > 0 {
+		// The time macros of a query with parameters reference the time
+		// range as parameters too; see interpolateMacros.
+		ctx = withQueryParameters(ctx, macros.TimeRangeParameters(q.TimeRange))
+	}
+	// An unparsable query is reported by sqlds on the first attempt, so a
+	// parse failure here only means there is no SQL to inspect.
+	var rawSQL string
+	query, err := sqlutil.GetQuery(q)
+	if err == nil {
+		rawSQL = query.RawSQL
+	}
+
+	execute := func(ctx context.Context) backend.DataResponse {
+		return d.retry.run(ctx, q.RefID, rawSQL, func(ctx context.Context) backend.DataResponse {
+			return d.runQuery(ctx, req, q)
+		})
+	}
+	return d.cache.run(ctx, d.cache.key(ctx, tier, q, query), tier, q, func(ctx context.Context) backend.DataResponse {
+		return d.dedupe.run(ctx, d.dedupe.key(ctx, tier, q, query), q.RefID, execute)
+	})
+}
+
+// runQuery executes one attempt of a query through sqlds, inside its own
+// trace span and under a fresh query_id so that every attempt can be found in
+// system.query_log, and adds it to the audit trail of the query. The attempt
+// waits for a concurrency slot first and holds it only while sqlds runs it,
+// so a query backing off between retries leaves its slot to others. The
+// request is copied
+// with its own header map because the driver's MutateQueryData may add
+// headers, and queries of the same request run concurrently.
+func (d *Datasource) runQuery(ctx context.Context, req *backend.QueryDataRequest, q backend.DataQuery) backend.DataResponse {
+	queryID := uuid.NewString()
+	ctx, span := startQuerySpan(ctx, q.RefID, queryID)
+	defer span.End()
+	ctx, stats := withQueryStats(clickhouse.Context(ctx, clickhouse.WithQueryID(queryID)))
+
+	release, wait, err := d.limiter.acquire(ctx, queryTierFromContext(ctx))
+	stats.queueWait = wait
+	var res backend.DataResponse
+	if err != nil {
+		res = queueErrorResponse(err)
+	} else {
+		res = d.execute(ctx, req, q)
+		release()
+	}
+	res = d.cost.withCostEstimate(res, q.RefID, stats)
+	res = d.tables.filterSchema(withTablePolicy(res), stats.statement)
+	res = d.limiter.withQueueWait(res, q.RefID, wait)
+	endQuerySpan(span, res, stats)
+	auditTrailFromContext(ctx).addExecution(queryID, stats)
+	return res
+}
+
+// execute hands a single query to sqlds.
+func (d *Datasource) execute(ctx context.Context, req *backend.QueryDataRequest, q backend.DataQuery) backend.DataResponse {
+	single := *req
+	single.Headers = maps.Clone(req.Headers)
+	single.Queries = []backend.DataQuery{q}
+
+	res, err := d.SQLDatasource.QueryData(ctx, &single)
+	if err != nil {
+		return backend.ErrorResponseWithErrorSource(err)
+	}
+	return res.Responses[q.RefID]
 }
@@ -0,0 +1,27 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryDataRecoversPanics(t *testing.T) {
+	// A datasource without its sqlds datasource panics on every query.
+	d := &Datasource{}
+	res, err := d.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A"}, {RefID: "B"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Responses, 2)
+	for _, refID := range []string{"A", "B"} {
+		r := res.Responses[refID]
+		require.Error(t, r.Error, refID)
+		assert.True(t, backend.IsPluginError(r.Error))
+		assert.ErrorContains(t, r.Error, "query panicked")
+		assert.Equal(t, backend.StatusInternal, r.Status)
+	}
+}
@@ -0,0 +1,231 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/grafana/clickhouse-datasource/pkg/macros"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var queriesDeduplicated = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "grafana_plugin",
+	Subsystem: "clickhouse",
+	Name:      "queries_deduplicated_total",
+	Help:      "Queries served by an identical query already running, instead of running themselves.",
+})
+
+// queryDeduplicator coalesces identical queries running at the same time, as
+// issued by repeated panels or by many viewers of the same dashboard, so
+// that they share one ClickHouse execution. Queries are identical when they
+// have the same queryResultKey. Every Datasource has its own deduplicator,
+// so queries of different datasources never meet.
+type queryDeduplicator struct {
+	enabled bool
+	// perUser keeps the queries of different Grafana users apart, for
+	// datasources that send the user's identity to ClickHouse.
+	perUser bool
+
+	mu       sync.Mutex
+	inflight map[string]*sharedQuery
+}
+
+// sharedQuery is an execution shared by the queries waiting on it. done is
+// closed once res is set. joined records whether any query joined the one
+// that started the execution.
+type sharedQuery struct {
+	done    chan struct{}
+	res     backend.DataResponse
+	waiters int
+	joined  bool
+	cancel  context.CancelFunc
+}
+
+// newQueryDeduplicator builds the deduplicator configured on the datasource.
+func newQueryDeduplicator(settings Settings) *queryDeduplicator {
+	return &queryDeduplicator{
+		enabled:  settings.EnableQueryDeduplication,
+		perUser:  isolatesUsers(settings),
+		inflight: map[string]*sharedQuery{},
+	}
+}
+
+// resultKey holds what determines the result of a query.
+type resultKey struct {
+	User        string                    `json:"user,omitempty"`
+	Tier        queryTier                 `json:"tier"`
+	SQL         string                    `json:"sql"`
+	Format      sqlutil.FormatQueryOption `json:"format"`
+	FillMissing *data.FillMissing         `json:"fillMissing,omitempty"`
+	TimeZone    string                    `json:"timeZone,omitempty"`
+	Parameters  map[string]string         `json:"parameters,omitempty"`
+	Settings    map[string]any            `json:"settings,omitempty"`
+	Sample      uint64                    `json:"sample,omitempty"`
+}
+
+// queryResultKey returns a key that is the same for queries with the same
+// result, for deduplication and the result cache, or "" when the result of
+// the query must not be shared: when it may modify data, or its macros do
+// not expand. The query tier stands for the ClickHouse settings of the
+// guardrails, which only vary with it; those of the SET statements before
+// the query in a multi-statement query are part of the key. With perUser,
+// queries of different Grafana users get different keys; see
+// isolatesUsers.
+func queryResultKey(ctx context.Context, perUser bool, tier queryTier, q backend.DataQuery, query *sqlutil.Query) string {
+	if query == nil || !isReadOnlyStatement(query.RawSQL) {
+		return ""
+	}
+	sql, err := macros.Interpolate(query.RawSQL, query)
+	if err != nil {
+		return ""
+	}
+	k := resultKey{
+		Tier:        tier,
+		SQL:         sql,
+		Format:      query.Format,
+		FillMissing: query.FillMissing,
+		Parameters:  queryParametersFromContext(ctx),
+		Settings:    statementSettingsFromContext(ctx),
+	}
+	if factor := sampleFactorFromContext(ctx); factor > 1 {
+		k.Sample = factor
+	}
+	if perUser {
+		// A query without a user never shares with one that has a user.
+		k.User = "\x00"
+		if u := backend.UserFromContext(ctx); u != nil {
+			k.User = u.Login
+		}
+	}
+	var model struct {
+		Meta struct {
+			TimeZone string `json:"timezone"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err == nil {
+		k.TimeZone = model.Meta.TimeZone
+	}
+	encoded, err := json.Marshal(k)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// key returns the key of a query, or "" when it must run on its own: when
+// deduplication is disabled, or queryResultKey has no key for it.
+func (d *queryDeduplicator) key(ctx context.Context, tier queryTier, q backend.DataQuery, query *sqlutil.Query) string {
+	if !d.enabled {
+		return ""
+	}
+	return queryResultKey(ctx, d.perUser, tier, q, query)
+}
+
+// isolatesUsers reports whether the datasource sends the identity of the
+// Grafana user to ClickHouse, with OAuth pass-through or forwarded Grafana
+// headers, so that the result of a query may depend on who runs it.
+func isolatesUsers(settings Settings) bool {
+	return settings.OAuthPassThru || settings.ForwardGrafanaHeaders
+}
+
+// run runs the query with the given key through execute, unless an identical
+// query is running already, in which case it waits for that execution and
+// returns a copy of its frames under refID. Without deduplication or a key,
+// the query always runs.
+//
+// The shared execution outlives the query that started it: it runs on a
+// context that keeps the values and deadline of ctx but is only canceled
+// once every query waiting on it is gone.
+func (d *queryDeduplicator) run(ctx context.Context, key, refID string, execute func(context.Context) backend.DataResponse) backend.DataResponse {
+	if !d.enabled || key == "" {
+		return execute(ctx)
+	}
+
+	d.mu.Lock()
+	call, running := d.inflight[key]
+	if running {
+		queriesDeduplicated.Inc()
+		call.joined = true
+		auditTrailFromContext(ctx).markShared()
+	} else {
+		call = d.start(ctx, key, execute)
+	}
+	call.waiters++
+	d.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		d.mu.Lock()
+		if call.waiters--; call.waiters == 0 {
+			call.cancel()
+			if d.inflight[key] == call {
+				delete(d.inflight, key)
+			}
+		}
+		d.mu.Unlock()
+		return backend.DataResponse{Error: backend.DownstreamError(ctx.Err())}
+	}
+	// No query joins once done is closed. The frames of an execution that
+	// was joined are copied for every query, including the one that started
+	// it, since later stages of the pipeline add to them.
+	if !call.joined {
+		return call.res
+	}
+	return sharedResponse(call.res, refID)
+}
+
+// start begins the shared execution for key. Must hold d.mu.
+func (d *queryDeduplicator) start(ctx context.Context, key string, execute func(context.Context) backend.DataResponse) *sharedQuery {
+	base, stop := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+	if deadline, ok := ctx.Deadline(); ok {
+		base, stop = context.WithDeadline(base, deadline)
+	}
+	runCtx, cancelRun := context.WithCancel(base)
+	cancel := func() {
+		cancelRun()
+		stop()
+	}
+	call := &sharedQuery{done: make(chan struct{}), cancel: cancel}
+	d.inflight[key] = call
+	go func() {
+		defer cancel()
+		call.res = execute(runCtx)
+		d.mu.Lock()
+		if d.inflight[key] == call {
+			delete(d.inflight, key)
+		}
+		d.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// sharedResponse copies the response of a shared execution for the query
+// with refID, so that no two responses share frames.
+func sharedResponse(res backend.DataResponse, refID string) backend.DataResponse {
+	if len(res.Frames) == 0 {
+		return res
+	}
+	encoded, err := res.Frames.MarshalArrow()
+	if err != nil {
+		return backend.DataResponse{Error: err}
+	}
+	frames, err := data.UnmarshalArrowFrames(encoded)
+	if err != nil {
+		return backend.DataResponse{Error: err}
+	}
+	for _, frame := range frames {
+		frame.RefID = refID
+	}
+	res.Frames = frames
+	return res
+}
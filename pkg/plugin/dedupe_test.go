@@ -0,0 +1,204 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dedupeQuery(t *testing.T, refID, rawSQL string, from time.Time) (backend.DataQuery, *sqlutil.Query) {
+	t.Helper()
+	model, err := json.Marshal(map[string]any{"rawSql": rawSQL, "format": 1, "meta": map[string]any{"timezone": "UTC"}})
+	require.NoError(t, err)
+	q := backend.DataQuery{
+		RefID:     refID,
+		JSON:      model,
+		TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+	}
+	query, err := sqlutil.GetQuery(q)
+	require.NoError(t, err)
+	return q, query
+}
+
+func TestQueryResultKey(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sql := "SELECT count() FROM logs WHERE $__timeFilter(ts)"
+
+	a, queryA := dedupeQuery(t, "A", sql, from)
+	b, queryB := dedupeQuery(t, "B", sql, from)
+	key := queryResultKey(userContext("alice"), false, queryTierDashboard, a, queryA)
+	require.NotEmpty(t, key)
+	assert.Equal(t, key, queryResultKey(userContext("bob"), false, queryTierDashboard, b, queryB), "ref IDs and users do not matter")
+
+	assert.NotEqual(t, key, queryResultKey(userContext("alice"), false, queryTierExplore, a, queryA), "tiers run with different settings")
+
+	later, queryLater := dedupeQuery(t, "A", sql, from.Add(time.Minute))
+	assert.NotEqual(t, key, queryResultKey(userContext("alice"), false, queryTierDashboard, later, queryLater))
+
+	insert, queryInsert := dedupeQuery(t, "A", "INSERT INTO t VALUES (1)", from)
+	assert.Empty(t, queryResultKey(userContext("alice"), false, queryTierDashboard, insert, queryInsert))
+	assert.Empty(t, queryResultKey(userContext("alice"), false, queryTierDashboard, a, nil))
+
+	assert.NotEqual(t,
+		queryResultKey(userContext("alice"), true, queryTierDashboard, a, queryA),
+		queryResultKey(userContext("bob"), true, queryTierDashboard, b, queryB))
+	assert.Equal(t,
+		queryResultKey(userContext("alice"), true, queryTierDashboard, a, queryA),
+		queryResultKey(userContext("alice"), true, queryTierDashboard, b, queryB))
+	assert.NotEqual(t,
+		queryResultKey(context.Background(), true, queryTierDashboard, a, queryA),
+		queryResultKey(userContext(""), true, queryTierDashboard, a, queryA))
+
+	withParams := withQueryParameters(userContext("alice"), map[string]string{"db": "prod"})
+	assert.NotEqual(t, key, queryResultKey(withParams, false, queryTierDashboard, a, queryA), "parameters change the result")
+
+	withSettings := withStatementSettings(context.Background(), clickhouse.Settings{"max_threads": "1"})
+	assert.NotEqual(t, key, queryResultKey(withSettings, false, queryTierDashboard, a, queryA), "SET statements change the result")
+
+	sampled := context.WithValue(userContext("alice"), querySampleKey, querySample{factor: 10})
+	assert.NotEqual(t, key, queryResultKey(sampled, false, queryTierDashboard, a, queryA), "the sample changes the result")
+
+	assert.Empty(t, newQueryDeduplicator(Settings{}).key(userContext("alice"), queryTierDashboard, a, queryA), "deduplication disabled")
+	perUser := newQueryDeduplicator(Settings{EnableQueryDeduplication: true, OAuthPassThru: true})
+	assert.Equal(t, queryResultKey(userContext("alice"), true, queryTierDashboard, a, queryA), perUser.key(userContext("alice"), queryTierDashboard, a, queryA))
+
+	assert.True(t, isolatesUsers(Settings{OAuthPassThru: true}))
+	assert.True(t, isolatesUsers(Settings{ForwardGrafanaHeaders: true}))
+	assert.False(t, isolatesUsers(Settings{}))
+}
+
+func TestQueryDeduplicatorRun(t *testing.T) {
+	d := newQueryDeduplicator(Settings{EnableQueryDeduplication: true})
+	var executions atomic.Int32
+	release := make(chan struct{})
+	execute := func(ctx context.Context) backend.DataResponse {
+		executions.Add(1)
+		<-release
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("count", nil, []int64{42}))}}
+	}
+
+	results := make(chan backend.DataResponse, 3)
+	trails := map[string]*auditTrail{}
+	for _, refID := range []string{"A", "B", "C"} {
+		ctx, trail := withAuditTrail(context.Background())
+		trails[refID] = trail
+		go func(refID string) {
+			results <- d.run(ctx, "key", refID, execute)
+		}(refID)
+	}
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.inflight["key"] != nil && d.inflight["key"].waiters == 3
+	}, time.Second, time.Millisecond)
+	close(release)
+
+	frames := map[*data.Frame]bool{}
+	refIDs := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		res := <-results
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		frames[res.Frames[0]] = true
+		refIDs[res.Frames[0].RefID] = true
+		v, _ := res.Frames[0].Fields[0].ConcreteAt(0)
+		assert.Equal(t, int64(42), v)
+	}
+	assert.Equal(t, int32(1), executions.Load())
+	shared := 0
+	for _, trail := range trails {
+		if trail.shared {
+			shared++
+		}
+	}
+	assert.Equal(t, 2, shared, "the queries that joined are audited as shared")
+	assert.Len(t, frames, 3, "every query gets its own frames")
+	assert.Equal(t, map[string]bool{"A": true, "B": true, "C": true}, refIDs)
+	assert.Empty(t, d.inflight)
+
+	d.run(context.Background(), "key", "A", func(context.Context) backend.DataResponse {
+		executions.Add(1)
+		return backend.DataResponse{}
+	})
+	assert.Equal(t, int32(2), executions.Load(), "finished executions are not reused")
+}
+
+func TestQueryDeduplicatorCancellation(t *testing.T) {
+	d := newQueryDeduplicator(Settings{EnableQueryDeduplication: true})
+	canceled := make(chan struct{})
+	release := make(chan struct{})
+	execute := func(ctx context.Context) backend.DataResponse {
+		select {
+		case <-ctx.Done():
+			close(canceled)
+			return backend.DataResponse{Error: ctx.Err()}
+		case <-release:
+			return backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("v", nil, []int64{1}))}}
+		}
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan backend.DataResponse, 1)
+	go func() { leader <- d.run(leaderCtx, "key", "A", execute) }()
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.inflight["key"] != nil
+	}, time.Second, time.Millisecond)
+
+	followerCtx, cancelFollower := context.WithCancel(context.Background())
+	follower := make(chan backend.DataResponse, 1)
+	go func() { follower <- d.run(followerCtx, "key", "B", execute) }()
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.inflight["key"].waiters == 2
+	}, time.Second, time.Millisecond)
+
+	cancelLeader()
+	assert.ErrorIs(t, (<-leader).Error, context.Canceled)
+	select {
+	case <-canceled:
+		t.Fatal("execution was canceled while a query still waits on it")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancelFollower()
+	assert.ErrorIs(t, (<-follower).Error, context.Canceled)
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("execution was not canceled after every query left")
+	}
+	d.mu.Lock()
+	assert.Empty(t, d.inflight)
+	d.mu.Unlock()
+}
+
+func TestQueryDeduplicatorRunsAlone(t *testing.T) {
+	ctx := context.WithValue(context.Background(), grafanaHeadersKey, grafanaHeaders{RuleUID: "rule"})
+	for name, tt := range map[string]struct {
+		settings Settings
+		key      string
+	}{
+		"no key":   {settings: Settings{EnableQueryDeduplication: true}},
+		"disabled": {key: "key"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := newQueryDeduplicator(tt.settings).run(ctx, tt.key, "A", func(got context.Context) backend.DataResponse {
+				assert.Equal(t, ctx, got, "the query runs on the caller's context")
+				return backend.DataResponse{Status: backend.StatusOK}
+			})
+			assert.Equal(t, backend.StatusOK, res.Status)
+		})
+	}
+}
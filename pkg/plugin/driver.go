@@ -214,6 +214,14 @@ func buildClickHouseOptions(ctx context.Context, settings Settings, message json
 		customSettings["limit"] = settings.RowLimit
 	}
 
+	// Per-query guardrails need the tier of the query, which only the query
+	// context knows. The dashboard tier is applied to the connection so it
+	// also covers the schema lookups of the query editor; queries of the
+	// other tiers override it, see guardrails.apply.
+	for k, v := range settings.DashboardGuardrails.clickhouseSettings() {
+		customSettings[k] = v
+	}
+
 	httpHeaders, err := extractForwardedHeadersFromMessage(message)
 	if err != nil {
 		return nil, err
@@ -448,6 +456,16 @@ func (h *Clickhouse) MutateQueryData(
 	ctx context.Context,
 	req *backend.QueryDataRequest,
 ) (context.Context, *backend.QueryDataRequest) {
+	ctx = withGrafanaHeaders(ctx, req)
+
+	injectGrafanaUserHeader(ctx, req)
+
+	return ctx, req
+}
+
+// withGrafanaHeaders stores the dashboard, panel and alert rule the request
+// originates from in ctx, if Grafana sent any of them.
+func withGrafanaHeaders(ctx context.Context, req *backend.QueryDataRequest) context.Context {
 	headers := req.GetHTTPHeaders()
 	gh := grafanaHeaders{
 		DashboardUID: headers.Get("X-Dashboard-Uid"),
@@ -457,10 +475,7 @@ func (h *Clickhouse) MutateQueryData(
 	if gh.DashboardUID != "" || gh.PanelID != "" || gh.RuleUID != "" {
 		ctx = context.WithValue(ctx, grafanaHeadersKey, gh)
 	}
-
-	injectGrafanaUserHeader(ctx, req)
-
-	return ctx, req
+	return ctx
 }
 
 // injectGrafanaUserHeader populates X-Grafana-User from the request's user
@@ -493,7 +508,9 @@ func injectGrafanaUserHeader(ctx context.Context, req *backend.QueryDataRequest)
 // parsed query — including Table and Column, which the previous
 // MutateQueryData pre-expansion never carried. Expansion errors return
 // straight to the query response rather than being smuggled through a
-// throwIf() rewrite that failed at execution time.
+// throwIf() rewrite that failed at execution time. When the query binds
+// server-side parameters, executeQuery binds the time range as parameters
+// too, and the time macros reference them instead of embedding literals.
 //
 // Every error is wrapped as a downstream error: interpolation failures
 // originate from the user's query text (bad macro arguments, missing
@@ -502,21 +519,50 @@ func injectGrafanaUserHeader(ctx context.Context, req *backend.QueryDataRequest)
 // handlers ($__table, $__column) return plain errors, and sqlds only
 // downstream-classifies bad-argument-count and bracket errors on its own —
 // so without this wrap those would be miscounted as plugin errors.
-func interpolateMacros(_ context.Context, query *sqlutil.Query, _ json.RawMessage) (string, error) {
-	sql, err := macros.Interpolate(query.RawSQL, query)
+//
+// The interpolated SQL is recorded as db.statement on the query span started
+// by Datasource.runQuery, and on its query stats for the audit log, since this
+// is the first point where it is known. For the same reason this is where the
+// tables it reads are checked, the sample decided for it is applied and its
+// cost is estimated, when the datasource asks for it.
+func interpolateMacros(ctx context.Context, query *sqlutil.Query, _ json.RawMessage) (string, error) {
+	interpolate := macros.Interpolate
+	if _, ok := queryParametersFromContext(ctx)[macros.FromParameter]; ok {
+		interpolate = macros.InterpolateParameters
+	}
+	sql, err := interpolate(withSampleFactor(query.RawSQL, sampleFactorFromContext(ctx)), query)
 	if err != nil {
 		return "", backend.DownstreamError(err)
 	}
+	if err := checkQueryTables(ctx, sql); err != nil {
+		return "", backend.DownstreamError(err)
+	}
+	sql = sampleQuery(ctx, sql)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("db.statement", sql))
+	if stats := queryStatsFromContext(ctx); stats != nil {
+		stats.statement = sql
+	}
+	if err := estimateQueryCost(ctx, query, sql); err != nil {
+		return "", backend.DownstreamError(err)
+	}
 	return sql, nil
 }
 
 func (h *Clickhouse) MutateQuery(ctx context.Context, req backend.DataQuery) (context.Context, backend.DataQuery) {
-	ctx, span := tracing.DefaultTracer().Start(ctx, "clickhouse mutate_query", trace.WithAttributes(
+	// The span context is deliberately not kept: the returned context must
+	// carry the caller's span, which outlives this short-lived one.
+	_, span := tracing.DefaultTracer().Start(ctx, "clickhouse mutate_query", trace.WithAttributes(
 		attribute.String("db.system", "clickhouse"),
 	))
 
 	defer span.End()
 
+	// Hand the current span to ClickHouse so the server records its spans for
+	// this query in system.opentelemetry_span_log as part of the same trace.
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSpan(sc))
+	}
+
 	comments := make([]string, 0, 4)
 
 	if user := backend.UserFromContext(ctx); user != nil {
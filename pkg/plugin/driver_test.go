@@ -9,12 +9,14 @@ import (
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/clickhouse-datasource/pkg/macros"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 	"github.com/grafana/sqlds/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestMergeOpenTelemetryLabels(t *testing.T) {
@@ -428,6 +430,21 @@ func TestMutateQuery_GrafanaMetadata(t *testing.T) {
 
 		assert.NotEqual(t, ctx, newCtx)
 	})
+
+	t.Run("keeps the caller's span current", func(t *testing.T) {
+		sc := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{2},
+			TraceFlags: trace.FlagsSampled,
+		})
+		ctx := trace.ContextWithSpanContext(t.Context(), sc)
+
+		newCtx, _ := h.MutateQuery(ctx, backend.DataQuery{
+			JSON: []byte(`{}`),
+		})
+
+		assert.Equal(t, sc, trace.SpanContextFromContext(newCtx))
+	})
 }
 
 func TestMutateQueryData_XGrafanaUserForwarding(t *testing.T) {
@@ -793,6 +810,14 @@ func TestInterpolateMacros(t *testing.T) {
 		assert.Contains(t, err.Error(), "timeFilter")
 	})
 
+	t.Run("references the time range as parameters when the query binds them", func(t *testing.T) {
+		ctx := withQueryParameters(t.Context(), macros.TimeRangeParameters(timeRange))
+		q := &sqlutil.Query{RawSQL: "SELECT $__fromTime", TimeRange: timeRange}
+		got, err := interpolateMacros(ctx, q, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "SELECT toDateTime({__from:DateTime64(3, 'UTC')})", got)
+	})
+
 	t.Run("returns SQL unchanged when there are no macros", func(t *testing.T) {
 		q := &sqlutil.Query{RawSQL: "SELECT 1", TimeRange: timeRange}
 		got, err := interpolateMacros(t.Context(), q, nil)
@@ -832,3 +857,26 @@ func TestMissingTableMacroIsDownstream(t *testing.T) {
 	require.Error(t, got.Error)
 	assert.Equal(t, backend.ErrorSourceDownstream, got.ErrorSource)
 }
+
+func TestBuildClickHouseOptionsDashboardGuardrails(t *testing.T) {
+	settings := Settings{
+		Host:           "localhost",
+		Port:           9000,
+		DialTimeout:    "5",
+		QueryTimeout:   "30",
+		CustomSettings: []CustomSetting{{Setting: "max_rows_to_read", Value: "5"}, {Setting: "join_use_nulls", Value: "1"}},
+		DashboardGuardrails: QueryGuardrails{
+			MaxRowsToRead: 1000,
+			OverflowMode:  "break",
+		},
+	}
+
+	opts, err := buildClickHouseOptions(t.Context(), settings, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, clickhouse.Settings{
+		"max_rows_to_read":     1000,
+		"read_overflow_mode":   "break",
+		"result_overflow_mode": "break",
+		"join_use_nulls":       "1",
+	}, opts.Settings)
+}
@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Exemplar selection modes.
+const (
+	exemplarModeMax = "max"
+	exemplarModeAny = "any"
+)
+
+// exemplarFrameName is the name Grafana's time series panel draws
+// annotation frames under as exemplars.
+const exemplarFrameName = "exemplar"
+
+// exemplarOptions are the options of the exemplars of a query, under the
+// exemplars key of the query JSON. The rows exemplars are picked from are
+// those of RawSQL, when set, or else those of the table over the time range.
+// Mode is max, the default, to pick the row with the largest value of each
+// interval, or any. DatasourceUID is the traces data source the trace IDs
+// link to.
+type exemplarOptions struct {
+	Database       string `json:"database"`
+	Table          string `json:"table"`
+	RawSQL         string `json:"rawSql"`
+	TimeColumn     string `json:"timeColumn"`
+	ValueColumn    string `json:"valueColumn"`
+	TraceIDColumn  string `json:"traceIdColumn"`
+	Mode           string `json:"mode"`
+	DatasourceUID  string `json:"datasourceUid"`
+	DatasourceName string `json:"datasourceName"`
+}
+
+// queryExemplarOptions returns the exemplar options of q, or nil when it has
+// none.
+func queryExemplarOptions(q backend.DataQuery) (*exemplarOptions, error) {
+	var model struct {
+		Exemplars *exemplarOptions `json:"exemplars"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		// An unparsable query is reported when it runs.
+		return nil, nil
+	}
+	opts := model.Exemplars
+	if opts == nil {
+		return nil, nil
+	}
+	if opts.Mode == "" {
+		opts.Mode = exemplarModeMax
+	}
+	if opts.Mode != exemplarModeMax && opts.Mode != exemplarModeAny {
+		return nil, fmt.Errorf("mode must be %s or %s", exemplarModeMax, exemplarModeAny)
+	}
+	if opts.TimeColumn == "" || opts.ValueColumn == "" || opts.TraceIDColumn == "" {
+		return nil, errors.New("timeColumn, valueColumn and traceIdColumn are required")
+	}
+	return opts, nil
+}
+
+// withExemplars adds the exemplars of the time series query q to res, its
+// response: a row per interval of the time range of q, with the time, value
+// and trace ID of a row of that interval, which Grafana draws over the series
+// and links to the trace. An incremental refresh narrows q to the range it
+// queries, and merges the exemplar frame with the previous one like the
+// series. The exemplars are picked by ClickHouse, through
+// execute, from the raw rows the series aggregates. Exemplars are an aid
+// rather than the data asked for, so failing to pick them is reported as a
+// notice on the series.
+func withExemplars(ctx context.Context, q backend.DataQuery, res backend.DataResponse, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	opts, err := queryExemplarOptions(q)
+	if err != nil {
+		return invalidQuery("exemplars", err)
+	}
+	if opts == nil || failed(res) {
+		return res
+	}
+	sql, err := opts.sql()
+	if err != nil {
+		return invalidQuery("exemplars", err)
+	}
+
+	exemplars := execute(ctx, tableQuery(q, sql))
+	if exemplars.Error == nil && len(exemplars.Frames) > 0 {
+		var frame *data.Frame
+		if frame, err = opts.frame(exemplars.Frames[0]); err == nil {
+			frame.RefID = q.RefID
+			res.Frames = append(res.Frames, frame)
+			return res
+		}
+	} else {
+		err = exemplars.Error
+	}
+	if err == nil {
+		err = errors.New("no result")
+	}
+	res.Frames = appendNotice(res.Frames, q.RefID, data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("Could not pick exemplars: %s", err),
+	})
+	return res
+}
+
+// sql returns the query picking a row per interval of the time range, as
+// time, value and traceID. The time, value and trace ID are picked as one
+// tuple, so that they are those of the same row.
+func (o exemplarOptions) sql() (string, error) {
+	timeColumn := quoteSQLIdentifier(o.TimeColumn)
+	var source string
+	if statements := splitStatements(o.RawSQL); len(statements) > 0 {
+		if len(statements) > 1 {
+			return "", errors.New("rawSql must hold a single statement")
+		}
+		source = "(\n" + statements[0] + "\n)"
+	} else {
+		if o.Table == "" {
+			return "", errors.New("a table or rawSql is required")
+		}
+		source = quoteSQLIdentifier(o.Table)
+		if o.Database != "" {
+			source = quoteSQLIdentifier(o.Database) + "." + source
+		}
+		source += " WHERE $__timeFilter(" + timeColumn + ")"
+	}
+
+	row := fmt.Sprintf("(%s, toFloat64(%s), toString(%s))", timeColumn, quoteSQLIdentifier(o.ValueColumn), quoteSQLIdentifier(o.TraceIDColumn))
+	pick := "any(" + row + ")"
+	if o.Mode == exemplarModeMax {
+		pick = fmt.Sprintf("argMax(%s, %s)", row, quoteSQLIdentifier(o.ValueColumn))
+	}
+	return "SELECT tupleElement(exemplar, 1) AS time, tupleElement(exemplar, 2) AS value, tupleElement(exemplar, 3) AS traceID FROM (\n" +
+		"SELECT " + pick + " AS exemplar FROM " + source + " GROUP BY $__timeInterval(" + timeColumn + ")\n" +
+		") ORDER BY time", nil
+}
+
+// frame returns the exemplar frame of the result of exemplarOptions.sql,
+// its trace IDs linked to the traces data source.
+func (o exemplarOptions) frame(result *data.Frame) (*data.Frame, error) {
+	indexes := map[string]int{}
+	for _, name := range []string{"time", "value", "traceID"} {
+		idx, ok := fieldIndex(result, name)
+		if !ok {
+			return nil, fmt.Errorf("no %s column", name)
+		}
+		indexes[name] = idx
+	}
+	frame := data.NewFrame(exemplarFrameName,
+		data.NewField("Time", nil, []time.Time{}),
+		data.NewField("Value", nil, []float64{}),
+		data.NewField(o.TraceIDColumn, nil, []string{}),
+	)
+	for row := 0; row < result.Rows(); row++ {
+		t, ok := rowTime(result.Fields[indexes["time"]], row)
+		if !ok {
+			continue
+		}
+		value, err := result.Fields[indexes["value"]].FloatAt(row)
+		if err != nil {
+			continue
+		}
+		frame.AppendRow(t, value, valueString(result.Fields[indexes["traceID"]], row))
+	}
+	if o.DatasourceUID != "" {
+		frame.Fields[2].Config = &data.FieldConfig{Links: []data.DataLink{{
+			Title: "View trace",
+			Internal: &data.InternalDataLink{
+				DatasourceUID:  o.DatasourceUID,
+				DatasourceName: o.DatasourceName,
+				Query:          map[string]any{"query": "${__value.raw}"},
+			},
+		}}}
+	}
+	frame.Meta = &data.FrameMeta{DataTopic: data.DataTopicAnnotations}
+	return frame, nil
+}
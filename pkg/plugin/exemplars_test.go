@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryExemplarOptions(t *testing.T) {
+	opts, err := queryExemplarOptions(backend.DataQuery{JSON: []byte(`{"rawSql": "SELECT 1"}`)})
+	require.NoError(t, err)
+	assert.Nil(t, opts)
+
+	opts, err = queryExemplarOptions(backend.DataQuery{JSON: []byte(`{"exemplars": {"table": "spans", "timeColumn": "ts", "valueColumn": "duration", "traceIdColumn": "TraceId"}}`)})
+	require.NoError(t, err)
+	assert.Equal(t, "max", opts.Mode)
+
+	_, err = queryExemplarOptions(backend.DataQuery{JSON: []byte(`{"exemplars": {"timeColumn": "ts", "valueColumn": "duration", "traceIdColumn": "TraceId", "mode": "min"}}`)})
+	assert.Error(t, err)
+	_, err = queryExemplarOptions(backend.DataQuery{JSON: []byte(`{"exemplars": {"timeColumn": "ts", "valueColumn": "duration"}}`)})
+	assert.Error(t, err)
+}
+
+func TestExemplarSQL(t *testing.T) {
+	opts := exemplarOptions{Database: "otel", Table: "otel_traces", TimeColumn: "Timestamp", ValueColumn: "Duration", TraceIDColumn: "TraceId", Mode: "max"}
+	sql, err := opts.sql()
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT tupleElement(exemplar, 1) AS time, tupleElement(exemplar, 2) AS value, tupleElement(exemplar, 3) AS traceID FROM (\n"+
+		"SELECT argMax((`Timestamp`, toFloat64(`Duration`), toString(`TraceId`)), `Duration`) AS exemplar "+
+		"FROM `otel`.`otel_traces` WHERE $__timeFilter(`Timestamp`) GROUP BY $__timeInterval(`Timestamp`)\n"+
+		") ORDER BY time", sql)
+
+	opts.Mode = "any"
+	opts.RawSQL = "SELECT * FROM otel.otel_traces WHERE $__timeFilter(Timestamp) AND ServiceName = 'api'"
+	sql, err = opts.sql()
+	require.NoError(t, err)
+	assert.Contains(t, sql, "SELECT any((`Timestamp`, toFloat64(`Duration`), toString(`TraceId`))) AS exemplar FROM (\n"+
+		"SELECT * FROM otel.otel_traces WHERE $__timeFilter(Timestamp) AND ServiceName = 'api'\n)")
+
+	_, err = exemplarOptions{TimeColumn: "ts", ValueColumn: "v", TraceIDColumn: "id"}.sql()
+	assert.Error(t, err)
+	_, err = exemplarOptions{RawSQL: "SELECT 1; SELECT 2", TimeColumn: "ts", ValueColumn: "v", TraceIDColumn: "id"}.sql()
+	assert.Error(t, err)
+}
+
+func TestWithExemplars(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	series := backend.DataResponse{Frames: data.Frames{data.NewFrame("A",
+		data.NewField("time", nil, []time.Time{t0}),
+		data.NewField("value", nil, []float64{1}),
+	)}}
+	q := backend.DataQuery{
+		RefID: "A",
+		JSON: []byte(`{"rawSql": "SELECT ...", "exemplars": {"table": "spans", "timeColumn": "ts", "valueColumn": "duration",
+			"traceIdColumn": "TraceId", "datasourceUid": "tempo", "datasourceName": "Tempo"}}`),
+	}
+
+	var got backend.DataQuery
+	res := withExemplars(context.Background(), q, series, func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		got = q
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("A",
+			data.NewField("time", nil, []time.Time{t0, t0.Add(time.Minute)}),
+			data.NewField("value", nil, []float64{250, 300}),
+			data.NewField("traceID", nil, []string{"abc", "def"}),
+		)}}
+	})
+	require.NoError(t, res.Error)
+	assert.Contains(t, executedSQL(t, got), "FROM `spans` WHERE $__timeFilter(`ts`)")
+
+	require.Len(t, res.Frames, 2)
+	exemplars := res.Frames[1]
+	assert.Equal(t, "exemplar", exemplars.Name)
+	assert.Equal(t, "A", exemplars.RefID)
+	assert.Equal(t, data.DataTopicAnnotations, exemplars.Meta.DataTopic)
+	require.Equal(t, 2, exemplars.Rows())
+	assert.Equal(t, []any{t0.Add(time.Minute), 300.0, "def"}, exemplars.RowCopy(1))
+	assert.Equal(t, "TraceId", exemplars.Fields[2].Name)
+	link := exemplars.Fields[2].Config.Links[0]
+	assert.Equal(t, "tempo", link.Internal.DatasourceUID)
+	assert.Equal(t, map[string]any{"query": "${__value.raw}"}, link.Internal.Query)
+
+	series.Frames = series.Frames[:1]
+	res = withExemplars(context.Background(), q, series, func(context.Context, backend.DataQuery) backend.DataResponse {
+		return backend.DataResponse{Error: errors.New("unknown column duration")}
+	})
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 1)
+	require.Len(t, res.Frames[0].Meta.Notices, 1)
+	assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "unknown column duration")
+
+	failed := backend.DataResponse{Error: errors.New("boom")}
+	assert.Equal(t, failed, withExemplars(context.Background(), q, failed, nil))
+
+	res = withExemplars(context.Background(), backend.DataQuery{JSON: []byte(`{"exemplars": {"mode": "min"}}`)}, series, nil)
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+}
@@ -0,0 +1,300 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// explainQueryType is the query type of explain queries.
+const explainQueryType = "explain"
+
+// Explain query kinds.
+const (
+	explainKindPlan      = "plan"
+	explainKindPipeline  = "pipeline"
+	explainKindSyntax    = "syntax"
+	explainKindQueryTree = "queryTree"
+)
+
+// explainPrefixes are the EXPLAIN statements explain queries prefix the SQL
+// with, by kind. Plans are explained as JSON, to be turned into frames.
+var explainPrefixes = map[string]string{
+	explainKindPlan:      "EXPLAIN PLAN json = 1, indexes = 1, actions = 1",
+	explainKindPipeline:  "EXPLAIN PIPELINE",
+	explainKindSyntax:    "EXPLAIN SYNTAX",
+	explainKindQueryTree: "EXPLAIN QUERY TREE",
+}
+
+// explainOptions are the options of an explain query, under the explain key
+// of the query JSON. Kind is plan, pipeline, syntax or queryTree, and
+// defaults to plan. NodeGraph adds the plan as node graph frames.
+type explainOptions struct {
+	Kind      string `json:"kind"`
+	NodeGraph bool   `json:"nodeGraph"`
+}
+
+// runExplainQuery explains the SQL of q instead of running it, so that users
+// can see how ClickHouse runs the SQL of a panel, and which primary key and
+// skip indexes it uses. The SQL is prefixed with the EXPLAIN statement of the
+// kind and runs through execute as a table query, so it is interpolated and
+// checked as the query itself would be. A plan comes back as a plan frame
+// with a row per step, parents before their children, and an indexes frame
+// with a row per index a step reading a table uses; other kinds come back
+// as the text ClickHouse returns, a line per row.
+func runExplainQuery(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model map[string]json.RawMessage
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("explain", err)
+	}
+	var opts explainOptions
+	if raw, ok := model["explain"]; ok {
+		if err := json.Unmarshal(raw, &opts); err != nil {
+			return invalidQuery("explain", err)
+		}
+	}
+	if opts.Kind == "" {
+		opts.Kind = explainKindPlan
+	}
+	prefix, ok := explainPrefixes[opts.Kind]
+	if !ok {
+		return invalidQuery("explain", fmt.Errorf("kind must be %s, %s, %s or %s", explainKindPlan, explainKindPipeline, explainKindSyntax, explainKindQueryTree))
+	}
+	var rawSQL string
+	if raw, ok := model["rawSql"]; ok {
+		if err := json.Unmarshal(raw, &rawSQL); err != nil {
+			return invalidQuery("explain", err)
+		}
+	}
+	statements := splitStatements(rawSQL)
+	if len(statements) != 1 {
+		return invalidQuery("explain", errors.New("the query must hold a single statement"))
+	}
+
+	model["rawSql"], _ = json.Marshal(prefix + "\n" + statements[0])
+	model["format"] = json.RawMessage("1")
+	sqlQuery := q
+	sqlQuery.QueryType = ""
+	sqlQuery.JSON, _ = json.Marshal(model)
+	res := execute(ctx, sqlQuery)
+	if failed(res) {
+		return res
+	}
+	if len(res.Frames) == 0 {
+		return res
+	}
+	source := res.Frames[0]
+	if opts.Kind != explainKindPlan {
+		source.Name = opts.Kind
+		res.Frames = data.Frames{source}
+		return res
+	}
+
+	plan, err := parseExplainPlan(explainText(source))
+	if err != nil {
+		return backend.DataResponse{Error: fmt.Errorf("could not parse the query plan: %w", err)}
+	}
+	frames := plan.frames()
+	if opts.NodeGraph {
+		frames = append(frames, plan.nodeGraph()...)
+	}
+	if source.Meta != nil {
+		meta := *source.Meta
+		meta.PreferredVisualization = data.VisTypeTable
+		frames[0].Meta = &meta
+	}
+	for _, frame := range frames {
+		frame.RefID = q.RefID
+	}
+	res.Frames = frames
+	return res
+}
+
+// explainText returns the output of an EXPLAIN statement, whose rows are
+// the lines of its only column.
+func explainText(frame *data.Frame) string {
+	if len(frame.Fields) == 0 {
+		return ""
+	}
+	lines := make([]string, frame.Rows())
+	for row := range lines {
+		lines[row] = valueString(frame.Fields[0], row)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// explainIndex is an index a plan step reading a MergeTree table uses, as
+// EXPLAIN PLAN indexes = 1 describes it.
+type explainIndex struct {
+	Type             string   `json:"Type"`
+	Name             string   `json:"Name"`
+	Description      string   `json:"Description"`
+	Keys             []string `json:"Keys"`
+	Condition        string   `json:"Condition"`
+	InitialParts     *uint64  `json:"Initial Parts"`
+	SelectedParts    *uint64  `json:"Selected Parts"`
+	InitialGranules  *uint64  `json:"Initial Granules"`
+	SelectedGranules *uint64  `json:"Selected Granules"`
+}
+
+// summary returns the index and the granules it kept, as in
+// "PrimaryKey: 12/100 granules".
+func (i explainIndex) summary() string {
+	name := i.Type
+	if i.Name != "" {
+		name += " " + i.Name
+	}
+	if i.InitialGranules == nil || i.SelectedGranules == nil {
+		return name
+	}
+	return fmt.Sprintf("%s: %d/%d granules", name, *i.SelectedGranules, *i.InitialGranules)
+}
+
+// explainStep is a step of a query plan. id is its path in the plan, as
+// "1.2" for the second child of the root, and parent the id of its parent.
+type explainStep struct {
+	id, parent  string
+	level       int
+	nodeType    string
+	description string
+	indexes     []explainIndex
+	details     json.RawMessage
+}
+
+// explainPlan is a query plan, its steps in depth-first order.
+type explainPlan []explainStep
+
+// parseExplainPlan parses the output of EXPLAIN PLAN json = 1: an array of
+// objects whose Plan is the root step, each step holding its children under
+// Plans.
+func parseExplainPlan(text string) (explainPlan, error) {
+	var roots []struct {
+		Plan json.RawMessage `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(text), &roots); err != nil {
+		return nil, err
+	}
+	var plan explainPlan
+	for i, root := range roots {
+		if err := plan.add(root.Plan, strconv.Itoa(i+1), "", 0); err != nil {
+			return nil, err
+		}
+	}
+	if len(plan) == 0 {
+		return nil, errors.New("the plan has no steps")
+	}
+	return plan, nil
+}
+
+// add adds the step raw, and its children, to the plan.
+func (p *explainPlan) add(raw json.RawMessage, id, parent string, level int) error {
+	var node map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &node); err != nil {
+		return err
+	}
+	step := explainStep{id: id, parent: parent, level: level}
+	_ = json.Unmarshal(node["Node Type"], &step.nodeType)
+	_ = json.Unmarshal(node["Description"], &step.description)
+	if indexes, ok := node["Indexes"]; ok {
+		if err := json.Unmarshal(indexes, &step.indexes); err != nil {
+			return err
+		}
+	}
+	children := node["Plans"]
+	delete(node, "Plans")
+	delete(node, "Node Type")
+	delete(node, "Description")
+	delete(node, "Indexes")
+	step.details, _ = json.Marshal(node)
+	*p = append(*p, step)
+
+	var plans []json.RawMessage
+	if len(children) > 0 {
+		if err := json.Unmarshal(children, &plans); err != nil {
+			return err
+		}
+	}
+	for i, child := range plans {
+		if err := p.add(child, id+"."+strconv.Itoa(i+1), id, level+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// frames returns the plan frame and the indexes frame of p.
+func (p explainPlan) frames() data.Frames {
+	planFrame := data.NewFrame("plan",
+		data.NewField("id", nil, []string{}),
+		data.NewField("parentId", nil, []string{}),
+		data.NewField("level", nil, []int64{}),
+		data.NewField("node", nil, []string{}),
+		data.NewField("description", nil, []string{}),
+		data.NewField("indexes", nil, []string{}),
+		data.NewField("details", nil, []json.RawMessage{}),
+	)
+	indexFrame := data.NewFrame("indexes",
+		data.NewField("step", nil, []string{}),
+		data.NewField("description", nil, []string{}),
+		data.NewField("type", nil, []string{}),
+		data.NewField("name", nil, []string{}),
+		data.NewField("keys", nil, []string{}),
+		data.NewField("condition", nil, []string{}),
+		data.NewField("initialParts", nil, []*uint64{}),
+		data.NewField("selectedParts", nil, []*uint64{}),
+		data.NewField("initialGranules", nil, []*uint64{}),
+		data.NewField("selectedGranules", nil, []*uint64{}),
+	)
+	for _, step := range p {
+		summaries := make([]string, len(step.indexes))
+		for i, index := range step.indexes {
+			summaries[i] = index.summary()
+			name := index.Name
+			if name == "" {
+				name = index.Description
+			}
+			indexFrame.AppendRow(step.id, step.description, index.Type, name, strings.Join(index.Keys, ", "), index.Condition,
+				index.InitialParts, index.SelectedParts, index.InitialGranules, index.SelectedGranules)
+		}
+		planFrame.AppendRow(step.id, step.parent, int64(step.level), step.nodeType, step.description,
+			strings.Join(summaries, "; "), step.details)
+	}
+	planFrame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTable}
+	return data.Frames{planFrame, indexFrame}
+}
+
+// nodeGraph returns the nodes and edges frames of p for the node graph
+// panel, with an edge from every step to the step it feeds.
+func (p explainPlan) nodeGraph() data.Frames {
+	nodes := data.NewFrame("nodes",
+		data.NewField("id", nil, []string{}),
+		data.NewField("title", nil, []string{}),
+		data.NewField("subtitle", nil, []string{}),
+		data.NewField("mainstat", nil, []string{}),
+	)
+	edges := data.NewFrame("edges",
+		data.NewField("id", nil, []string{}),
+		data.NewField("source", nil, []string{}),
+		data.NewField("target", nil, []string{}),
+	)
+	for _, step := range p {
+		var mainstat string
+		if len(step.indexes) > 0 {
+			mainstat = step.indexes[len(step.indexes)-1].summary()
+		}
+		nodes.AppendRow(step.id, step.nodeType, step.description, mainstat)
+		if step.parent != "" {
+			edges.AppendRow(step.id+"-"+step.parent, step.id, step.parent)
+		}
+	}
+	for _, frame := range []*data.Frame{nodes, edges} {
+		frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeNodeGraph}
+	}
+	return data.Frames{nodes, edges}
+}
@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const explainPlanJSON = `[
+  {
+    "Plan": {
+      "Node Type": "Expression",
+      "Description": "(Project names + Projection)",
+      "Expression": {"Inputs": []},
+      "Plans": [
+        {
+          "Node Type": "ReadFromMergeTree",
+          "Description": "default.logs",
+          "Indexes": [
+            {"Type": "PrimaryKey", "Keys": ["service", "ts"], "Condition": "(service in ['api', 'api'])",
+             "Initial Parts": 5, "Selected Parts": 2, "Initial Granules": 100, "Selected Granules": 12},
+            {"Type": "Skip", "Name": "idx_level", "Description": "set GRANULARITY 4",
+             "Initial Parts": 2, "Selected Parts": 1, "Initial Granules": 12, "Selected Granules": 3}
+          ]
+        }
+      ]
+    }
+  }
+]`
+
+func explainFrame(text string) *data.Frame {
+	return data.NewFrame("", data.NewField("explain", nil, strings.Split(text, "\n")))
+}
+
+func TestRunExplainQuery(t *testing.T) {
+	q := backend.DataQuery{
+		RefID:     "A",
+		QueryType: "explain",
+		JSON:      []byte(`{"rawSql": "SELECT * FROM logs WHERE $__timeFilter(ts);", "format": 2, "explain": {"nodeGraph": true}}`),
+	}
+	var got backend.DataQuery
+	res := runExplainQuery(context.Background(), q, func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		got = q
+		frame := explainFrame(explainPlanJSON)
+		frame.Meta = &data.FrameMeta{ExecutedQueryString: "EXPLAIN ..."}
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	})
+	require.NoError(t, res.Error)
+
+	assert.Empty(t, got.QueryType)
+	var model map[string]any
+	require.NoError(t, json.Unmarshal(got.JSON, &model))
+	assert.Equal(t, "EXPLAIN PLAN json = 1, indexes = 1, actions = 1\nSELECT * FROM logs WHERE $__timeFilter(ts)", model["rawSql"])
+	assert.Equal(t, 1.0, model["format"])
+
+	require.Len(t, res.Frames, 4)
+	plan, indexes, nodes, edges := res.Frames[0], res.Frames[1], res.Frames[2], res.Frames[3]
+	assert.Equal(t, "plan", plan.Name)
+	assert.Equal(t, "EXPLAIN ...", plan.Meta.ExecutedQueryString)
+	assert.Equal(t, data.VisTypeTable, string(plan.Meta.PreferredVisualization))
+	require.Equal(t, 2, plan.Rows())
+	assert.Equal(t, []any{"1", "", int64(0), "Expression", "(Project names + Projection)", ""}, plan.RowCopy(0)[:6])
+	assert.JSONEq(t, `{"Expression": {"Inputs": []}}`, string(plan.Fields[6].At(0).(json.RawMessage)))
+	assert.Equal(t, []any{"1.1", "1", int64(1), "ReadFromMergeTree", "default.logs",
+		"PrimaryKey: 12/100 granules; Skip idx_level: 3/12 granules"}, plan.RowCopy(1)[:6])
+
+	require.Equal(t, 2, indexes.Rows())
+	assert.Equal(t, "1.1", indexes.Fields[0].At(0))
+	assert.Equal(t, "description", indexes.Fields[1].Name)
+	assert.Equal(t, "default.logs", indexes.Fields[1].At(0))
+	assert.Equal(t, "PrimaryKey", indexes.Fields[2].At(0))
+	assert.Equal(t, "service, ts", indexes.Fields[4].At(0))
+	assert.Equal(t, uint64(12), *indexes.Fields[9].At(0).(*uint64))
+	assert.Equal(t, "idx_level", indexes.Fields[3].At(1))
+
+	assert.Equal(t, 2, nodes.Rows())
+	assert.Equal(t, "Skip idx_level: 3/12 granules", nodes.Fields[3].At(1))
+	assert.Equal(t, data.VisTypeNodeGraph, string(nodes.Meta.PreferredVisualization))
+	require.Equal(t, 1, edges.Rows())
+	assert.Equal(t, []any{"1.1-1", "1.1", "1"}, edges.RowCopy(0))
+	for _, frame := range res.Frames {
+		assert.Equal(t, "A", frame.RefID)
+	}
+}
+
+func TestRunExplainQueryKinds(t *testing.T) {
+	var sql string
+	execute := func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		var model struct {
+			RawSQL string `json:"rawSql"`
+		}
+		_ = json.Unmarshal(q.JSON, &model)
+		sql = model.RawSQL
+		return backend.DataResponse{Frames: data.Frames{explainFrame("SELECT 1\nFROM t")}}
+	}
+	for kind, prefix := range map[string]string{
+		"pipeline":  "EXPLAIN PIPELINE",
+		"syntax":    "EXPLAIN SYNTAX",
+		"queryTree": "EXPLAIN QUERY TREE",
+	} {
+		t.Run(kind, func(t *testing.T) {
+			res := runExplainQuery(context.Background(), backend.DataQuery{
+				JSON: []byte(`{"rawSql": "SELECT 1 FROM t", "explain": {"kind": "` + kind + `"}}`),
+			}, execute)
+			require.NoError(t, res.Error)
+			assert.Equal(t, prefix+"\nSELECT 1 FROM t", sql)
+			require.Len(t, res.Frames, 1)
+			assert.Equal(t, kind, res.Frames[0].Name)
+			assert.Equal(t, 2, res.Frames[0].Rows())
+		})
+	}
+
+	for _, query := range []string{
+		`{"rawSql": "SELECT 1", "explain": {"kind": "estimate"}}`,
+		`{"rawSql": "SELECT 1; SELECT 2"}`,
+		`{"rawSql": ""}`,
+	} {
+		res := runExplainQuery(context.Background(), backend.DataQuery{JSON: []byte(query)}, execute)
+		assert.True(t, backend.IsDownstreamError(res.Error), query)
+		assert.Equal(t, backend.StatusBadRequest, res.Status, query)
+	}
+
+	res := runExplainQuery(context.Background(), backend.DataQuery{JSON: []byte(`{"rawSql": "SELECT 1"}`)}, execute)
+	assert.ErrorContains(t, res.Error, "could not parse the query plan")
+}
@@ -0,0 +1,218 @@
+package plugin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// flameGraphQueryType is the query type of flame graph queries.
+const flameGraphQueryType = "flameGraph"
+
+const (
+	defaultFlameGraphLimit = 10_000
+	maxFlameGraphLimit     = 100_000
+)
+
+// flameGraphValues are the trace types of system.trace_log flame graph
+// queries profile, and what a stack is worth in each: the samples of the
+// sampling profilers, and the bytes allocated for memory. Memory rows of
+// negative size are deallocations, which flameGraphOptions.sql leaves out.
+var flameGraphValues = map[string]string{
+	"CPU":          "count()",
+	"Real":         "count()",
+	"Memory":       "sum(size)",
+	"MemorySample": "sum(size)",
+}
+
+// unknownSymbol is the label of the frames addressToSymbol cannot resolve.
+const unknownSymbol = "[unknown]"
+
+// flameGraphOptions are the options of a flame graph query, under the
+// flameGraph key of the query JSON. QueryID, when set, profiles that query
+// alone, otherwise every query of the time range. TraceType is the
+// system.trace_log trace type, CPU by default. Limit bounds the distinct
+// stacks read, those worth the most, 10000 by default.
+type flameGraphOptions struct {
+	QueryID   string `json:"queryId"`
+	TraceType string `json:"traceType"`
+	Limit     int    `json:"limit"`
+}
+
+// runFlameGraphQuery answers a flame graph query: the stacks ClickHouse's
+// profilers sampled over the time range, from system.trace_log, as a flame
+// graph. The stacks are symbolized by ClickHouse, through execute, which
+// needs the introspection functions, and merged into a tree here. A notice
+// tells when there were more stacks than the limit.
+func runFlameGraphQuery(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model struct {
+		FlameGraph flameGraphOptions `json:"flameGraph"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("flame graph", err)
+	}
+	sql, err := model.FlameGraph.sql()
+	if err != nil {
+		return invalidQuery("flame graph", err)
+	}
+
+	res := execute(withQuerySettings(ctx, clickhouse.Settings{"allow_introspection_functions": 1}), tableQuery(q, sql))
+	if failed(res) || len(res.Frames) == 0 {
+		return res
+	}
+	// The query reads a stack past the limit, to tell whether there are
+	// more.
+	stacks, limit := res.Frames[0], model.FlameGraph.limit()
+	root, err := readFlameGraph(stacks, limit)
+	if err != nil {
+		return backend.DataResponse{Error: fmt.Errorf("could not read the stacks: %w", err)}
+	}
+	frame := root.frame()
+	frame.RefID = q.RefID
+	if stacks.Meta != nil {
+		frame.Meta.ExecutedQueryString = stacks.Meta.ExecutedQueryString
+	}
+	res.Frames = data.Frames{frame}
+	if stacks.Rows() > limit {
+		res.Frames = appendNotice(res.Frames, q.RefID, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text: fmt.Sprintf("Only the %d stacks worth the most are shown; the others are left out of the totals. "+
+				"Raise the limit, up to %d, or narrow the time range to see them.", limit, maxFlameGraphLimit),
+		})
+	}
+	return res
+}
+
+// sql returns the query over system.trace_log of the symbolized stacks,
+// leaf first, and what they are worth.
+func (o flameGraphOptions) sql() (string, error) {
+	traceType := o.TraceType
+	if traceType == "" {
+		traceType = "CPU"
+	}
+	value, ok := flameGraphValues[traceType]
+	if !ok {
+		types := make([]string, 0, len(flameGraphValues))
+		for t := range flameGraphValues {
+			types = append(types, t)
+		}
+		slices.Sort(types)
+		return "", fmt.Errorf("traceType must be one of %s", strings.Join(types, ", "))
+	}
+
+	filters := []string{"$__dateFilter(event_date)", "$__timeFilter(event_time)", "trace_type = " + quoteSQLString(traceType)}
+	if value == "sum(size)" {
+		filters = append(filters, "size > 0")
+	}
+	if o.QueryID != "" {
+		filters = append(filters, "query_id = "+quoteSQLString(o.QueryID))
+	}
+	return "SELECT arrayMap(x -> demangle(addressToSymbol(x)), trace) AS stack, " + value + " AS value " +
+		"FROM system.trace_log WHERE " + strings.Join(filters, " AND ") +
+		fmt.Sprintf(" GROUP BY trace ORDER BY value DESC LIMIT %d", o.limit()+1), nil
+}
+
+// limit returns the number of distinct stacks the flame graph keeps.
+func (o flameGraphOptions) limit() int {
+	if o.Limit <= 0 {
+		return defaultFlameGraphLimit
+	}
+	return min(o.Limit, maxFlameGraphLimit)
+}
+
+// flameNode is a function of a flame graph, called by its parent. value is
+// what the stacks through it are worth, and self what those ending in it
+// are.
+type flameNode struct {
+	label       string
+	value, self int64
+	children    map[string]*flameNode
+}
+
+// add adds a stack, root first, worth value under n.
+func (n *flameNode) add(stack []string, value int64) {
+	n.value += value
+	if len(stack) == 0 {
+		n.self += value
+		return
+	}
+	if n.children == nil {
+		n.children = map[string]*flameNode{}
+	}
+	child, ok := n.children[stack[0]]
+	if !ok {
+		child = &flameNode{label: stack[0]}
+		n.children[stack[0]] = child
+	}
+	child.add(stack[1:], value)
+}
+
+// readFlameGraph merges the first limit stacks of the result of
+// flameGraphOptions.sql into a tree under a total node.
+func readFlameGraph(frame *data.Frame, limit int) (*flameNode, error) {
+	stackIdx, ok := fieldIndex(frame, "stack")
+	if !ok {
+		return nil, fmt.Errorf("no stack column")
+	}
+	valueIdx, ok := fieldIndex(frame, "value")
+	if !ok {
+		return nil, fmt.Errorf("no value column")
+	}
+	root := &flameNode{label: "total"}
+	for row := 0; row < min(frame.Rows(), limit); row++ {
+		var stack []string
+		if err := json.Unmarshal(rawJSONAt(frame.Fields[stackIdx], row), &stack); err != nil {
+			return nil, fmt.Errorf("stack: %w", err)
+		}
+		value, err := frame.Fields[valueIdx].FloatAt(row)
+		if err != nil {
+			return nil, err
+		}
+		// system.trace_log has the innermost frame first.
+		slices.Reverse(stack)
+		for i, symbol := range stack {
+			if symbol == "" {
+				stack[i] = unknownSymbol
+			}
+		}
+		root.add(stack, int64(value))
+	}
+	return root, nil
+}
+
+// frame returns the flame graph frame of the tree under n: a row per node,
+// depth first, with its level, value, self value and label, which is how
+// Grafana's flame graph panel reads the tree. Children come in decreasing
+// value.
+func (n *flameNode) frame() *data.Frame {
+	frame := data.NewFrame("flamegraph",
+		data.NewField("level", nil, []int64{}),
+		data.NewField("value", nil, []int64{}),
+		data.NewField("self", nil, []int64{}),
+		data.NewField("label", nil, []string{}),
+	)
+	var walk func(n *flameNode, level int64)
+	walk = func(n *flameNode, level int64) {
+		frame.AppendRow(level, n.value, n.self, n.label)
+		children := make([]*flameNode, 0, len(n.children))
+		for _, child := range n.children {
+			children = append(children, child)
+		}
+		slices.SortFunc(children, func(a, b *flameNode) int {
+			return cmp.Or(cmp.Compare(b.value, a.value), cmp.Compare(a.label, b.label))
+		})
+		for _, child := range children {
+			walk(child, level+1)
+		}
+	}
+	walk(n, 0)
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeFlameGraph}
+	return frame
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlameGraphSQL(t *testing.T) {
+	sql, err := flameGraphOptions{QueryID: "abc'1"}.sql()
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT arrayMap(x -> demangle(addressToSymbol(x)), trace) AS stack, count() AS value FROM system.trace_log "+
+		"WHERE $__dateFilter(event_date) AND $__timeFilter(event_time) AND trace_type = 'CPU' AND query_id = 'abc\\'1' "+
+		"GROUP BY trace ORDER BY value DESC LIMIT 10001", sql)
+
+	sql, err = flameGraphOptions{TraceType: "Memory", Limit: 1_000_000}.sql()
+	require.NoError(t, err)
+	assert.Contains(t, sql, "sum(size) AS value")
+	assert.Contains(t, sql, "trace_type = 'Memory' AND size > 0 GROUP BY", "deallocations are left out")
+	assert.Contains(t, sql, "LIMIT 100001")
+
+	_, err = flameGraphOptions{TraceType: "Instrumentation"}.sql()
+	assert.EqualError(t, err, "traceType must be one of CPU, Memory, MemorySample, Real")
+}
+
+func TestRunFlameGraphQuery(t *testing.T) {
+	result := data.NewFrame("A",
+		data.NewField("stack", nil, []json.RawMessage{
+			json.RawMessage(`["DB::sort","DB::execute","main"]`),
+			json.RawMessage(`["DB::read","DB::execute","main"]`),
+			json.RawMessage(`["","DB::execute","main"]`),
+			json.RawMessage(`["DB::execute","main"]`),
+		}),
+		data.NewField("value", nil, []uint64{5, 3, 1, 2}),
+	)
+	result.Meta = &data.FrameMeta{ExecutedQueryString: "SELECT ..."}
+
+	var gotCtx context.Context
+	res := runFlameGraphQuery(context.Background(), backend.DataQuery{
+		RefID:     "A",
+		QueryType: "flameGraph",
+		JSON:      []byte(`{"flameGraph": {"queryId": "q1"}}`),
+	}, func(ctx context.Context, q backend.DataQuery) backend.DataResponse {
+		gotCtx = ctx
+		return backend.DataResponse{Frames: data.Frames{result}}
+	})
+	require.NoError(t, res.Error)
+	settings, _ := gotCtx.Value(querySettingsKey).(clickhouse.Settings)
+	assert.Equal(t, 1, settings["allow_introspection_functions"])
+
+	require.Len(t, res.Frames, 1)
+	frame := res.Frames[0]
+	assert.Equal(t, "A", frame.RefID)
+	assert.Equal(t, data.VisTypeFlameGraph, string(frame.Meta.PreferredVisualization))
+	assert.Equal(t, "SELECT ...", frame.Meta.ExecutedQueryString)
+	var rows [][]any
+	for row := 0; row < frame.Rows(); row++ {
+		rows = append(rows, frame.RowCopy(row))
+	}
+	assert.Equal(t, [][]any{
+		{int64(0), int64(11), int64(0), "total"},
+		{int64(1), int64(11), int64(0), "main"},
+		{int64(2), int64(11), int64(2), "DB::execute"},
+		{int64(3), int64(5), int64(5), "DB::sort"},
+		{int64(3), int64(3), int64(3), "DB::read"},
+		{int64(3), int64(1), int64(1), "[unknown]"},
+	}, rows)
+	assert.Empty(t, frame.Meta.Notices)
+
+	// The query reads a stack past the limit, which is dropped.
+	res = runFlameGraphQuery(context.Background(), backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"flameGraph": {"limit": 3}}`),
+	}, func(context.Context, backend.DataQuery) backend.DataResponse {
+		return backend.DataResponse{Frames: data.Frames{result}}
+	})
+	require.NoError(t, res.Error)
+	frame = res.Frames[0]
+	assert.Equal(t, []any{int64(0), int64(9), int64(0), "total"}, frame.RowCopy(0))
+	require.Len(t, frame.Meta.Notices, 1)
+	assert.Contains(t, frame.Meta.Notices[0].Text, "Only the 3 stacks worth the most are shown")
+
+	res = runFlameGraphQuery(context.Background(), backend.DataQuery{JSON: []byte(`{"flameGraph": {"traceType": "nope"}}`)}, nil)
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+}
@@ -0,0 +1,37 @@
+package plugin
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// appendNotice attaches notice to the first frame of a query response so it
+// is shown once per panel. A response without frames gets an empty frame to
+// carry the notice, keyed by refID like the frames sqlds produces.
+func appendNotice(frames data.Frames, refID string, notice data.Notice) data.Frames {
+	frames, meta := firstFrameMeta(frames, refID)
+	meta.Notices = append(meta.Notices, notice)
+	return frames
+}
+
+// appendQueryStats attaches stats to the first frame of a query response, where
+// the query inspector shows them. Frames are created as for appendNotice.
+func appendQueryStats(frames data.Frames, refID string, stats ...data.QueryStat) data.Frames {
+	frames, meta := firstFrameMeta(frames, refID)
+	meta.Stats = append(meta.Stats, stats...)
+	return frames
+}
+
+// firstFrameMeta returns the metadata of the first frame, creating the frame
+// and its metadata as needed.
+func firstFrameMeta(frames data.Frames, refID string) (data.Frames, *data.FrameMeta) {
+	if len(frames) == 0 {
+		frame := data.NewFrame("")
+		frame.RefID = refID
+		frames = data.Frames{frame}
+	}
+	frame := frames[0]
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	return frames, frame.Meta
+}
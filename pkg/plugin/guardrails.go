@@ -0,0 +1,198 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// queryTier is the context a query runs in, which decides the guardrails
+// that apply to it.
+type queryTier string
+
+const (
+	queryTierDashboard queryTier = "dashboard"
+	queryTierExplore   queryTier = "explore"
+	queryTierAlert     queryTier = "alert"
+)
+
+// queryTierFromContext tells the tiers apart by the Grafana headers
+// withGrafanaHeaders stored in ctx: alert rules send X-Rule-Uid, dashboard
+// panels send X-Dashboard-Uid, and everything else is treated as Explore.
+func queryTierFromContext(ctx context.Context) queryTier {
+	gh, _ := ctx.Value(grafanaHeadersKey).(grafanaHeaders)
+	switch {
+	case gh.RuleUID != "":
+		return queryTierAlert
+	case gh.DashboardUID != "":
+		return queryTierDashboard
+	default:
+		return queryTierExplore
+	}
+}
+
+// The ClickHouse settings behind QueryGuardrails.
+const (
+	settingMaxRowsToRead      = "max_rows_to_read"
+	settingMaxBytesToRead     = "max_bytes_to_read"
+	settingMaxResultRows      = "max_result_rows"
+	settingReadOverflowMode   = "read_overflow_mode"
+	settingResultOverflowMode = "result_overflow_mode"
+)
+
+// clickhouseSettings returns the ClickHouse settings enforcing g. The
+// execution time limit is not among them: clickhouse-go derives
+// max_execution_time from the context deadline of every query, which would
+// override it, so guardrails.apply enforces it as a deadline instead.
+func (g QueryGuardrails) clickhouseSettings() clickhouse.Settings {
+	settings := clickhouse.Settings{}
+	if g.MaxRowsToRead > 0 {
+		settings[settingMaxRowsToRead] = int(g.MaxRowsToRead)
+	}
+	if g.MaxBytesToRead > 0 {
+		settings[settingMaxBytesToRead] = int(g.MaxBytesToRead)
+	}
+	if g.MaxResultRows > 0 {
+		settings[settingMaxResultRows] = int(g.MaxResultRows)
+	}
+	if g.OverflowMode != "" {
+		settings[settingReadOverflowMode] = g.OverflowMode
+		settings[settingResultOverflowMode] = g.OverflowMode
+	}
+	return settings
+}
+
+// guardrails applies the per-tier guardrails configured on the datasource.
+type guardrails struct {
+	tiers map[queryTier]QueryGuardrails
+	// connection holds the settings of the connection that a tier without a
+	// limit of its own must restore: the dashboard guardrails are part of
+	// the connection options (see buildClickHouseOptions), falling back to
+	// the custom settings they replaced or the ClickHouse default.
+	connection clickhouse.Settings
+}
+
+// newGuardrails builds the guardrails configured on the datasource.
+func newGuardrails(settings Settings) guardrails {
+	g := guardrails{
+		tiers: map[queryTier]QueryGuardrails{
+			queryTierDashboard: settings.DashboardGuardrails,
+			queryTierExplore:   settings.ExploreGuardrails,
+			queryTierAlert:     settings.AlertGuardrails,
+		},
+		connection: clickhouse.Settings{},
+	}
+
+	custom := map[string]string{}
+	for _, setting := range settings.CustomSettings {
+		custom[setting.Setting] = setting.Value
+	}
+	for key := range settings.DashboardGuardrails.clickhouseSettings() {
+		switch {
+		case custom[key] != "":
+			g.connection[key] = custom[key]
+		case key == settingReadOverflowMode || key == settingResultOverflowMode:
+			g.connection[key] = "throw"
+		default:
+			g.connection[key] = 0
+		}
+	}
+	return g
+}
+
+// apply sets up ctx for a query of the given tier. The returned cancel
+// function must be called once the query is done.
+func (g guardrails) apply(ctx context.Context, tier queryTier) (context.Context, context.CancelFunc) {
+	limits := g.tiers[tier]
+	cancel := context.CancelFunc(func() {})
+	if limits.MaxExecutionTime > 0 {
+		limit := time.Duration(limits.MaxExecutionTime) * time.Second
+		ctx, cancel = context.WithTimeoutCause(ctx, limit, &guardrailError{
+			tier:  tier,
+			limit: "max execution time",
+			value: limit.String(),
+			err:   context.DeadlineExceeded,
+		})
+	}
+
+	if tier == queryTierDashboard {
+		// Already part of the connection options.
+		return ctx, cancel
+	}
+	settings := limits.clickhouseSettings()
+	for key, value := range g.connection {
+		if _, ok := settings[key]; !ok {
+			settings[key] = value
+		}
+	}
+	return withQuerySettings(ctx, settings), cancel
+}
+
+// explain replaces the error of a query stopped by a guardrail with one that
+// names the limit. ctx must be the context returned by apply.
+func (g guardrails) explain(ctx context.Context, tier queryTier, res backend.DataResponse) backend.DataResponse {
+	if res.Error == nil {
+		return res
+	}
+
+	var gerr *guardrailError
+	if errors.As(context.Cause(ctx), &gerr) {
+		res.Status = backend.StatusTimeout
+		res.Error = backend.DownstreamError(gerr)
+		return res
+	}
+
+	code, ok := exceptionCode(res.Error)
+	if !ok {
+		return res
+	}
+	limits := g.tiers[tier]
+	var limit string
+	var value int64
+	switch code {
+	case 158: // TOO_MANY_ROWS
+		limit, value = "max rows to read", limits.MaxRowsToRead
+	case 307: // TOO_MANY_BYTES
+		limit, value = "max bytes to read", limits.MaxBytesToRead
+	case 396: // TOO_MANY_ROWS_OR_BYTES, raised for the result
+		limit, value = "max result rows", limits.MaxResultRows
+	case 159: // TIMEOUT_EXCEEDED
+		limit, value = "max execution time", limits.MaxExecutionTime
+	}
+	if value == 0 {
+		// Not a guardrail, or a limit set some other way.
+		return res
+	}
+	formatted := strconv.FormatInt(value, 10)
+	if code == 159 {
+		formatted = (time.Duration(value) * time.Second).String()
+	}
+	// The friendly message hides the exception text the status is derived
+	// from, so the status is settled first.
+	res.Status = queryErrorStatus(res.Error)
+	res.Error = backend.DownstreamError(&guardrailError{tier: tier, limit: limit, value: formatted, err: res.Error})
+	return res
+}
+
+// guardrailError reports a query stopped by a guardrail. It wraps the error
+// the query failed with.
+type guardrailError struct {
+	tier  queryTier
+	limit string
+	value string
+	err   error
+}
+
+func (e *guardrailError) Error() string {
+	return fmt.Sprintf("query exceeded the %s limit of %s set for %s queries on this data source; "+
+		"narrow the time range or add filters, or ask an administrator to raise the limit", e.limit, e.value, e.tier)
+}
+
+func (e *guardrailError) Unwrap() error {
+	return e.err
+}
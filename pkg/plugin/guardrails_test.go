@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryTierFromContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  *grafanaHeaders
+		expected queryTier
+	}{
+		{name: "no headers", expected: queryTierExplore},
+		{name: "panel without dashboard", headers: &grafanaHeaders{PanelID: "2"}, expected: queryTierExplore},
+		{name: "dashboard", headers: &grafanaHeaders{DashboardUID: "dash", PanelID: "2"}, expected: queryTierDashboard},
+		{name: "alert rule", headers: &grafanaHeaders{RuleUID: "rule"}, expected: queryTierAlert},
+		{name: "alert rule linked to a dashboard", headers: &grafanaHeaders{DashboardUID: "dash", RuleUID: "rule"}, expected: queryTierAlert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.headers != nil {
+				ctx = context.WithValue(ctx, grafanaHeadersKey, *tt.headers)
+			}
+			assert.Equal(t, tt.expected, queryTierFromContext(ctx))
+		})
+	}
+}
+
+func TestQueryGuardrailsClickhouseSettings(t *testing.T) {
+	assert.Empty(t, QueryGuardrails{MaxExecutionTime: 30}.clickhouseSettings())
+	assert.Equal(t, clickhouse.Settings{
+		"max_rows_to_read":     100,
+		"max_bytes_to_read":    200,
+		"max_result_rows":      300,
+		"read_overflow_mode":   "throw",
+		"result_overflow_mode": "throw",
+	}, QueryGuardrails{MaxRowsToRead: 100, MaxBytesToRead: 200, MaxResultRows: 300, OverflowMode: "throw"}.clickhouseSettings())
+}
+
+func TestGuardrailsApply(t *testing.T) {
+	g := newGuardrails(Settings{
+		CustomSettings:      []CustomSetting{{Setting: "max_bytes_to_read", Value: "999"}},
+		DashboardGuardrails: QueryGuardrails{MaxRowsToRead: 1000, MaxBytesToRead: 2000, OverflowMode: "break"},
+		ExploreGuardrails:   QueryGuardrails{MaxRowsToRead: 10, MaxExecutionTime: 30},
+	})
+
+	t.Run("dashboard queries use the connection settings", func(t *testing.T) {
+		ctx, cancel := g.apply(context.Background(), queryTierDashboard)
+		defer cancel()
+		assert.Nil(t, ctx.Value(querySettingsKey))
+		_, ok := ctx.Deadline()
+		assert.False(t, ok)
+	})
+
+	t.Run("other tiers override the connection settings", func(t *testing.T) {
+		ctx, cancel := g.apply(context.Background(), queryTierExplore)
+		defer cancel()
+		assert.Equal(t, clickhouse.Settings{
+			"max_rows_to_read":     10,
+			"max_bytes_to_read":    "999",
+			"read_overflow_mode":   "throw",
+			"result_overflow_mode": "throw",
+		}, ctx.Value(querySettingsKey))
+		deadline, ok := ctx.Deadline()
+		require.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(30*time.Second), deadline, time.Second)
+	})
+
+	t.Run("tier without guardrails restores the defaults", func(t *testing.T) {
+		ctx, cancel := g.apply(context.Background(), queryTierAlert)
+		defer cancel()
+		assert.Equal(t, clickhouse.Settings{
+			"max_rows_to_read":     0,
+			"max_bytes_to_read":    "999",
+			"read_overflow_mode":   "throw",
+			"result_overflow_mode": "throw",
+		}, ctx.Value(querySettingsKey))
+	})
+
+	t.Run("no guardrails configured", func(t *testing.T) {
+		ctx, cancel := newGuardrails(Settings{}).apply(context.Background(), queryTierExplore)
+		defer cancel()
+		assert.Nil(t, ctx.Value(querySettingsKey))
+	})
+}
+
+func TestGuardrailsExplain(t *testing.T) {
+	g := newGuardrails(Settings{
+		DashboardGuardrails: QueryGuardrails{MaxRowsToRead: 1000, MaxBytesToRead: 2048, MaxResultRows: 50, MaxExecutionTime: 30},
+	})
+
+	tests := []struct {
+		name    string
+		tier    queryTier
+		err     error
+		message string
+		status  backend.Status
+	}{
+		{name: "rows to read", tier: queryTierDashboard, err: &clickhouse.Exception{Code: 158}, message: "max rows to read limit of 1000 set for dashboard queries", status: backend.StatusBadRequest},
+		{name: "bytes to read over HTTP", tier: queryTierDashboard, err: errors.New(`[HTTP 500] response body: "Code: 307. DB::Exception: Limit for rows or bytes to read exceeded"`), message: "max bytes to read limit of 2048 set for dashboard queries", status: backend.StatusBadRequest},
+		{name: "result rows", tier: queryTierDashboard, err: fmt.Errorf("query: %w", &clickhouse.Exception{Code: 396}), message: "max result rows limit of 50 set for dashboard queries", status: backend.StatusBadRequest},
+		{name: "execution time", tier: queryTierDashboard, err: &clickhouse.Exception{Code: 159}, message: "max execution time limit of 30s set for dashboard queries", status: backend.StatusTimeout},
+		{name: "limit not set for the tier", tier: queryTierExplore, err: &clickhouse.Exception{Code: 158}},
+		{name: "unrelated error", tier: queryTierDashboard, err: &clickhouse.Exception{Code: 62}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := g.explain(context.Background(), tt.tier, backend.DataResponse{Error: tt.err})
+			if tt.message == "" {
+				assert.Equal(t, tt.err, res.Error)
+				return
+			}
+			assert.ErrorContains(t, res.Error, tt.message)
+			assert.True(t, backend.IsDownstreamError(res.Error))
+			assert.Equal(t, tt.status, res.Status)
+		})
+	}
+
+	t.Run("execution time deadline", func(t *testing.T) {
+		g := newGuardrails(Settings{AlertGuardrails: QueryGuardrails{MaxExecutionTime: 1}})
+		ctx, cancel := g.apply(context.Background(), queryTierAlert)
+		defer cancel()
+		<-ctx.Done()
+
+		res := g.explain(ctx, queryTierAlert, backend.DataResponse{Error: fmt.Errorf("read: %w", ctx.Err())})
+		assert.ErrorContains(t, res.Error, "max execution time limit of 1s set for alert queries")
+		assert.Equal(t, backend.StatusTimeout, res.Status)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		res := g.explain(context.Background(), queryTierDashboard, backend.DataResponse{})
+		assert.NoError(t, res.Error)
+	})
+}
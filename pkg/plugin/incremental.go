@@ -0,0 +1,354 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/clickhouse-datasource/pkg/macros"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+const (
+	// incrementalOverlapBuckets is how many of the latest buckets of the
+	// previous result are queried again, since they may still be filling up.
+	incrementalOverlapBuckets = 2
+	// incrementalMaxSize bounds the size of the last results kept, in bytes.
+	incrementalMaxSize = 64 << 20
+	// incrementalIdleTTL drops the result of a panel that was not refreshed
+	// for this long.
+	incrementalIdleTTL = 15 * time.Minute
+)
+
+// incrementalQueries keeps the last result of every refreshing dashboard
+// panel with a time series query, so that the next refresh only queries the
+// tail of the time range that is new since, plus the last buckets of the
+// previous result. The delta is queried by narrowing the time range of the
+// query, which is what every time macro expands from, and merged with the
+// rows of the previous result still in range.
+//
+// Only queries whose rows are independent time buckets are refreshed
+// incrementally, the same queries chunkedQueries splits, and only when they
+// are unchanged, interval included, and their time range starts no earlier
+// than the previous one and ends no earlier. Otherwise, or when the delta
+// does not line up with the previous result, the whole range is queried
+// again. Results are stored Arrow-encoded, and the least recently refreshed
+// ones are evicted to keep them under incrementalMaxSize.
+type incrementalQueries struct {
+	enabled bool
+	perUser bool
+	maxSize int
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// incrementalResult is the last result of a panel.
+type incrementalResult struct {
+	key       string
+	query     string
+	timeRange backend.TimeRange
+	frames    [][]byte
+	size      int
+	used      time.Time
+}
+
+// newIncrementalQueries builds the incremental query state configured on
+// the datasource.
+func newIncrementalQueries(settings Settings) *incrementalQueries {
+	return &incrementalQueries{
+		enabled: settings.EnableIncrementalQueries,
+		perUser: isolatesUsers(settings),
+		maxSize: incrementalMaxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// keys returns the key of the panel q belongs to and a signature of q and
+// its sample, without its time range, or "" when q is not refreshed
+// incrementally: only time series queries of dashboard panels whose result
+// over a time range is the concatenation of their results over its parts
+// are.
+func (inc *incrementalQueries) keys(ctx context.Context, tier queryTier, q backend.DataQuery) (string, string) {
+	if !inc.enabled || tier != queryTierDashboard || q.Interval <= 0 {
+		return "", ""
+	}
+	gh, _ := ctx.Value(grafanaHeadersKey).(grafanaHeaders)
+	if gh.DashboardUID == "" || gh.PanelID == "" {
+		return "", ""
+	}
+	query, err := sqlutil.GetQuery(q)
+	if err != nil || query.Format != sqlutil.FormatOptionTimeSeries || !isChunkable(query.RawSQL) {
+		return "", ""
+	}
+	var user string
+	if inc.perUser {
+		if u := backend.UserFromContext(ctx); u != nil {
+			user = u.Login
+		}
+	}
+	// A result sampled differently cannot be merged with the delta.
+	sample := strconv.FormatUint(sampleFactorFromContext(ctx), 10)
+	return hashKey(user, gh.DashboardUID, gh.PanelID, q.RefID), hashKey(string(q.JSON), q.Interval.String(), sample)
+}
+
+// hashKey joins parts into a fixed-size key.
+func hashKey(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// run runs q through execute, only querying the new tail of its time range
+// when the previous result of the panel allows it.
+func (inc *incrementalQueries) run(ctx context.Context, tier queryTier, q backend.DataQuery, execute func(backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	key, signature := inc.keys(ctx, tier, q)
+	if key == "" {
+		return execute(q)
+	}
+
+	if prev, frames := inc.lookup(key, signature); prev != nil {
+		if deltaFrom, ok := prev.delta(q); ok {
+			delta := q
+			delta.TimeRange.From = deltaFrom
+			res := execute(delta)
+			if res.Error != nil {
+				return res
+			}
+			if merged, reused, ok := mergeFrames(frames, res.Frames, q.TimeRange.From, deltaFrom); ok {
+				res.Frames = merged
+				inc.store(key, signature, q.TimeRange, merged)
+				res.Frames = appendQueryStats(res.Frames, q.RefID, data.QueryStat{
+					FieldConfig: data.FieldConfig{DisplayName: "Rows reused from previous refresh"},
+					Value:       float64(reused),
+				})
+				return res
+			}
+			backend.Logger.FromContext(ctx).Debug("Incremental result does not match the previous one, querying the whole range", "refID", q.RefID)
+		}
+	}
+
+	res := execute(q)
+	if res.Error == nil {
+		inc.store(key, signature, q.TimeRange, res.Frames)
+	}
+	return res
+}
+
+// delta returns where the query for the new tail of q starts: the previous
+// result is trusted up to its last incrementalOverlapBuckets buckets.
+func (r *incrementalResult) delta(q backend.DataQuery) (time.Time, bool) {
+	if q.TimeRange.From.Before(r.timeRange.From) || q.TimeRange.To.Before(r.timeRange.To) {
+		return time.Time{}, false
+	}
+	start := r.timeRange.To.Add(-incrementalOverlapBuckets * q.Interval)
+	deltaFrom := macros.AlignTimeRange(backend.TimeRange{From: start, To: start}, q.Interval).From
+	if !deltaFrom.After(q.TimeRange.From) {
+		return time.Time{}, false
+	}
+	return deltaFrom, true
+}
+
+// lookup returns the previous result of the panel with key, and a copy of
+// its frames, if it ran the same query.
+func (inc *incrementalQueries) lookup(key, signature string) (*incrementalResult, data.Frames) {
+	inc.mu.Lock()
+	elem, ok := inc.entries[key]
+	if !ok {
+		inc.mu.Unlock()
+		return nil, nil
+	}
+	r := elem.Value.(*incrementalResult)
+	inc.mu.Unlock()
+	if r.query != signature || time.Since(r.used) > incrementalIdleTTL {
+		return nil, nil
+	}
+	frames, err := data.UnmarshalArrowFrames(r.frames)
+	if err != nil {
+		return nil, nil
+	}
+	return r, frames
+}
+
+// store records the result of the panel with key, evicting the least
+// recently refreshed panels to make room. A result larger than the whole
+// store is dropped.
+func (inc *incrementalQueries) store(key, signature string, timeRange backend.TimeRange, frames data.Frames) {
+	encoded, err := frames.MarshalArrow()
+	if err != nil {
+		return
+	}
+	size := len(key) + len(signature)
+	for _, b := range encoded {
+		size += len(b)
+	}
+
+	inc.mu.Lock()
+	defer inc.mu.Unlock()
+	if elem, ok := inc.entries[key]; ok {
+		inc.remove(elem)
+	}
+	if size > inc.maxSize {
+		return
+	}
+	for inc.size+size > inc.maxSize {
+		inc.remove(inc.lru.Back())
+	}
+	inc.entries[key] = inc.lru.PushFront(&incrementalResult{
+		key:       key,
+		query:     signature,
+		timeRange: timeRange,
+		frames:    encoded,
+		size:      size,
+		used:      time.Now(),
+	})
+	inc.size += size
+}
+
+// remove drops a result. Must hold inc.mu.
+func (inc *incrementalQueries) remove(elem *list.Element) {
+	r := inc.lru.Remove(elem).(*incrementalResult)
+	delete(inc.entries, r.key)
+	inc.size -= r.size
+}
+
+// mergeFrames builds the frames of the whole time range from the previous
+// frames and those of the delta query starting at deltaFrom: the previous
+// rows from from up to deltaFrom, and every row of the delta, after them
+// when the rows run forward in time and before them when they run backwards.
+// The frames must have the same fields, in the same order, and rows sorted
+// by their first time field; otherwise ok is false. The metadata of the
+// delta frames is kept. reused counts the previous rows kept.
+func mergeFrames(prev, delta data.Frames, from, deltaFrom time.Time) (merged data.Frames, reused int, ok bool) {
+	if len(prev) != len(delta) {
+		return nil, 0, false
+	}
+	merged = make(data.Frames, len(delta))
+	for i, d := range delta {
+		p := prev[i]
+		if !sameFields(p, d) {
+			return nil, 0, false
+		}
+		timeIdx := timeFieldIndex(p)
+		if timeIdx < 0 {
+			return nil, 0, false
+		}
+		prevOrder, prevSorted := timeOrder(p.Fields[timeIdx])
+		deltaOrder, deltaSorted := timeOrder(d.Fields[timeIdx])
+		if !prevSorted || !deltaSorted || prevOrder*deltaOrder < 0 {
+			return nil, 0, false
+		}
+		backwards := prevOrder+deltaOrder < 0
+
+		frame := data.NewFrame(d.Name)
+		frame.RefID = d.RefID
+		frame.Meta = d.Meta
+		for _, f := range d.Fields {
+			field := data.NewFieldFromFieldType(f.Type(), 0)
+			field.Name = f.Name
+			field.Labels = f.Labels.Copy()
+			field.Config = f.Config
+			frame.Fields = append(frame.Fields, field)
+		}
+		appendDelta := func() {
+			for row := 0; row < d.Rows(); row++ {
+				for j, f := range d.Fields {
+					frame.Fields[j].Append(f.CopyAt(row))
+				}
+			}
+		}
+		if backwards {
+			appendDelta()
+		}
+		for row := 0; row < p.Rows(); row++ {
+			t, ok := rowTime(p.Fields[timeIdx], row)
+			if !ok || t.Before(from) || !t.Before(deltaFrom) {
+				continue
+			}
+			for j, f := range p.Fields {
+				frame.Fields[j].Append(f.CopyAt(row))
+			}
+			reused++
+		}
+		if !backwards {
+			appendDelta()
+		}
+		merged[i] = frame
+	}
+	return merged, reused, true
+}
+
+// sameFields reports whether a and b have fields of the same names, types
+// and labels, in the same order.
+func sameFields(a, b *data.Frame) bool {
+	if len(a.Fields) != len(b.Fields) {
+		return false
+	}
+	for i := range a.Fields {
+		fa, fb := a.Fields[i], b.Fields[i]
+		if fa.Name != fb.Name || fa.Type() != fb.Type() || !fa.Labels.Equals(fb.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// timeOrder returns 1 when the rows of the time field f run forward in time,
+// -1 when they run backwards and 0 when they do not tell, with fewer than
+// two distinct times. sorted is false when they go both ways, or are null.
+func timeOrder(f *data.Field) (order int, sorted bool) {
+	var prev time.Time
+	for row := 0; row < f.Len(); row++ {
+		t, ok := rowTime(f, row)
+		if !ok {
+			return 0, false
+		}
+		if row > 0 && !t.Equal(prev) {
+			step := 1
+			if t.Before(prev) {
+				step = -1
+			}
+			if order != 0 && order != step {
+				return 0, false
+			}
+			order = step
+		}
+		prev = t
+	}
+	return order, true
+}
+
+// timeFieldIndex returns the index of the first time field of frame, or -1.
+func timeFieldIndex(frame *data.Frame) int {
+	for i, f := range frame.Fields {
+		if f.Type().Time() {
+			return i
+		}
+	}
+	return -1
+}
+
+// rowTime returns the time of a row of a time field, unless it is null.
+func rowTime(f *data.Field, row int) (time.Time, bool) {
+	switch v := f.At(row).(type) {
+	case time.Time:
+		return v, true
+	case *time.Time:
+		if v != nil {
+			return *v, true
+		}
+	}
+	return time.Time{}, false
+}
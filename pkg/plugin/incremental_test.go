@@ -0,0 +1,289 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seriesFrame is a time series with one point per minute over [from, to),
+// whose values are the minute of the hour plus offset.
+func seriesFrame(from, to time.Time, offset float64) *data.Frame {
+	var times []time.Time
+	var values []float64
+	for t := from; t.Before(to); t = t.Add(time.Minute) {
+		times = append(times, t)
+		values = append(values, float64(t.Minute())+offset)
+	}
+	return data.NewFrame("", data.NewField("time", nil, times), data.NewField("value", nil, values))
+}
+
+// bucketedSQL is a query whose rows are independent time buckets.
+const bucketedSQL = "SELECT $__timeInterval(ts) AS time, count() FROM t WHERE $__timeFilter(ts) GROUP BY time ORDER BY time"
+
+func panelContext() context.Context {
+	return context.WithValue(context.Background(), grafanaHeadersKey, grafanaHeaders{DashboardUID: "dash", PanelID: "1"})
+}
+
+func incrementalQuery(from, to time.Time, sql string) backend.DataQuery {
+	return backend.DataQuery{
+		RefID:     "A",
+		JSON:      []byte(`{"rawSql": "` + sql + `", "format": 0}`),
+		Interval:  time.Minute,
+		TimeRange: backend.TimeRange{From: from, To: to},
+	}
+}
+
+func TestIncrementalQueriesKeys(t *testing.T) {
+	inc := newIncrementalQueries(Settings{EnableIncrementalQueries: true})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := incrementalQuery(from, from.Add(time.Hour), bucketedSQL)
+
+	key, signature := inc.keys(panelContext(), queryTierDashboard, q)
+	assert.NotEmpty(t, key)
+	assert.NotEmpty(t, signature)
+
+	later := incrementalQuery(from.Add(time.Minute), from.Add(time.Hour+time.Minute), bucketedSQL)
+	laterKey, laterSignature := inc.keys(panelContext(), queryTierDashboard, later)
+	assert.Equal(t, key, laterKey)
+	assert.Equal(t, signature, laterSignature, "the time range is not part of the signature")
+
+	table := q
+	table.JSON = []byte(`{"rawSql": "` + bucketedSQL + `", "format": 1}`)
+	noInterval := q
+	noInterval.Interval = 0
+	for name, tt := range map[string]struct {
+		ctx  context.Context
+		tier queryTier
+		q    backend.DataQuery
+	}{
+		"explore":         {ctx: panelContext(), tier: queryTierExplore, q: q},
+		"no panel":        {ctx: context.Background(), tier: queryTierDashboard, q: q},
+		"table format":    {ctx: panelContext(), tier: queryTierDashboard, q: table},
+		"no interval":     {ctx: panelContext(), tier: queryTierDashboard, q: noInterval},
+		"not read-only":   {ctx: panelContext(), tier: queryTierDashboard, q: incrementalQuery(from, from.Add(time.Hour), "INSERT INTO t VALUES (1)")},
+		"whole range":     {ctx: panelContext(), tier: queryTierDashboard, q: incrementalQuery(from, from.Add(time.Hour), "SELECT max(ts), count() FROM t WHERE $__timeFilter(ts)")},
+		"running":         {ctx: panelContext(), tier: queryTierDashboard, q: incrementalQuery(from, from.Add(time.Hour), "SELECT ts, runningDifference(v) FROM t WHERE $__timeFilter(ts)")},
+		"disabled":        {ctx: panelContext(), tier: queryTierDashboard, q: q},
+		"unparsable JSON": {ctx: panelContext(), tier: queryTierDashboard, q: backend.DataQuery{Interval: time.Minute, JSON: []byte(`{`)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			keys := inc
+			if name == "disabled" {
+				keys = newIncrementalQueries(Settings{})
+			}
+			key, _ := keys.keys(tt.ctx, tt.tier, tt.q)
+			assert.Empty(t, key)
+		})
+	}
+}
+
+func TestIncrementalQueriesRun(t *testing.T) {
+	inc := newIncrementalQueries(Settings{EnableIncrementalQueries: true})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var executed []backend.TimeRange
+	// The delta query reports values offset by 100, to tell them apart.
+	execute := func(q backend.DataQuery) backend.DataResponse {
+		executed = append(executed, q.TimeRange)
+		offset := 0.0
+		if len(executed) > 1 {
+			offset = 100
+		}
+		return backend.DataResponse{Frames: data.Frames{seriesFrame(q.TimeRange.From, q.TimeRange.To, offset)}}
+	}
+
+	res := inc.run(panelContext(), queryTierDashboard, incrementalQuery(from, from.Add(time.Hour), bucketedSQL), execute)
+	require.NoError(t, res.Error)
+	assert.Equal(t, 60, res.Frames[0].Rows())
+
+	// Five minutes later: only the last two minutes of the previous result
+	// and the five new ones are queried.
+	res = inc.run(panelContext(), queryTierDashboard, incrementalQuery(from.Add(5*time.Minute), from.Add(65*time.Minute), bucketedSQL), execute)
+	require.NoError(t, res.Error)
+	require.Len(t, executed, 2)
+	assert.Equal(t, backend.TimeRange{From: from.Add(58 * time.Minute), To: from.Add(65 * time.Minute)}, executed[1])
+
+	frame := res.Frames[0]
+	require.Equal(t, 60, frame.Rows())
+	first, _ := frame.Fields[0].ConcreteAt(0)
+	assert.True(t, from.Add(5*time.Minute).Equal(first.(time.Time)), "rows before the new start are dropped")
+	reused, _ := frame.Fields[1].ConcreteAt(52)
+	assert.Equal(t, 57.0, reused, "rows before the overlap come from the previous result")
+	requeried, _ := frame.Fields[1].ConcreteAt(53)
+	assert.Equal(t, 158.0, requeried, "the overlap comes from the delta query")
+	require.NotNil(t, frame.Meta)
+	assert.Equal(t, "Rows reused from previous refresh", frame.Meta.Stats[0].DisplayName)
+	assert.Equal(t, 53.0, frame.Meta.Stats[0].Value)
+
+	// A changed query runs over the whole range.
+	inc.run(panelContext(), queryTierDashboard, incrementalQuery(from.Add(6*time.Minute), from.Add(66*time.Minute), strings.Replace(bucketedSQL, "count()", "sum(v)", 1)), execute)
+	require.Len(t, executed, 3)
+	assert.Equal(t, from.Add(6*time.Minute), executed[2].From)
+}
+
+func TestIncrementalQueriesRunExemplars(t *testing.T) {
+	inc := newIncrementalQueries(Settings{EnableIncrementalQueries: true})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := func(from, to time.Time) backend.DataQuery {
+		q := incrementalQuery(from, to, bucketedSQL)
+		q.JSON = []byte(`{"rawSql": "` + bucketedSQL + `", "format": 0, "exemplars": {"table": "spans", "timeColumn": "ts", "valueColumn": "duration", "traceIdColumn": "TraceId"}}`)
+		return q
+	}
+
+	var picked []backend.TimeRange
+	pick := func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		picked = append(picked, q.TimeRange)
+		series := seriesFrame(q.TimeRange.From, q.TimeRange.To, 0)
+		traceIDs := make([]string, series.Rows())
+		for i := range traceIDs {
+			traceIDs[i] = "trace"
+		}
+		series.Fields = append(series.Fields, data.NewField("traceID", nil, traceIDs))
+		return backend.DataResponse{Frames: data.Frames{series}}
+	}
+	execute := func(q backend.DataQuery) backend.DataResponse {
+		res := backend.DataResponse{Frames: data.Frames{seriesFrame(q.TimeRange.From, q.TimeRange.To, 0)}}
+		return withExemplars(context.Background(), q, res, pick)
+	}
+
+	res := inc.run(panelContext(), queryTierDashboard, query(from, from.Add(time.Hour)), execute)
+	require.NoError(t, res.Error)
+	res = inc.run(panelContext(), queryTierDashboard, query(from.Add(5*time.Minute), from.Add(65*time.Minute)), execute)
+	require.NoError(t, res.Error)
+
+	require.Len(t, picked, 2)
+	assert.Equal(t, backend.TimeRange{From: from.Add(58 * time.Minute), To: from.Add(65 * time.Minute)}, picked[1], "exemplars are only picked for the delta")
+	require.Len(t, res.Frames, 2)
+	exemplars := res.Frames[1]
+	assert.Equal(t, exemplarFrameName, exemplars.Name)
+	require.Equal(t, 60, exemplars.Rows(), "the previous exemplars are kept")
+	first, _ := exemplars.Fields[0].ConcreteAt(0)
+	assert.True(t, from.Add(5*time.Minute).Equal(first.(time.Time)))
+}
+
+func TestIncrementalQueriesFallback(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("delta with other fields", func(t *testing.T) {
+		inc := newIncrementalQueries(Settings{EnableIncrementalQueries: true})
+		var executed []backend.TimeRange
+		execute := func(q backend.DataQuery) backend.DataResponse {
+			executed = append(executed, q.TimeRange)
+			frame := seriesFrame(q.TimeRange.From, q.TimeRange.To, 0)
+			if len(executed) == 2 {
+				frame.Fields[1].Labels = data.Labels{"host": "new"}
+			}
+			return backend.DataResponse{Frames: data.Frames{frame}}
+		}
+		inc.run(panelContext(), queryTierDashboard, incrementalQuery(from, from.Add(time.Hour), bucketedSQL), execute)
+		res := inc.run(panelContext(), queryTierDashboard, incrementalQuery(from.Add(time.Minute), from.Add(61*time.Minute), bucketedSQL), execute)
+		require.Len(t, executed, 3)
+		assert.Equal(t, backend.TimeRange{From: from.Add(time.Minute), To: from.Add(61 * time.Minute)}, executed[2])
+		assert.Equal(t, 60, res.Frames[0].Rows())
+	})
+
+	t.Run("range moved backwards", func(t *testing.T) {
+		inc := newIncrementalQueries(Settings{EnableIncrementalQueries: true})
+		var executed []backend.TimeRange
+		execute := func(q backend.DataQuery) backend.DataResponse {
+			executed = append(executed, q.TimeRange)
+			return backend.DataResponse{Frames: data.Frames{seriesFrame(q.TimeRange.From, q.TimeRange.To, 0)}}
+		}
+		inc.run(panelContext(), queryTierDashboard, incrementalQuery(from, from.Add(time.Hour), bucketedSQL), execute)
+		inc.run(panelContext(), queryTierDashboard, incrementalQuery(from.Add(-time.Minute), from.Add(59*time.Minute), bucketedSQL), execute)
+		require.Len(t, executed, 2)
+		assert.Equal(t, from.Add(-time.Minute), executed[1].From)
+	})
+
+	t.Run("failed query is not kept", func(t *testing.T) {
+		inc := newIncrementalQueries(Settings{EnableIncrementalQueries: true})
+		inc.run(panelContext(), queryTierDashboard, incrementalQuery(from, from.Add(time.Hour), bucketedSQL), func(backend.DataQuery) backend.DataResponse {
+			return backend.DataResponse{Error: assert.AnError}
+		})
+		assert.Empty(t, inc.entries)
+	})
+
+	t.Run("result larger than the store", func(t *testing.T) {
+		inc := newIncrementalQueries(Settings{EnableIncrementalQueries: true})
+		inc.maxSize = 1
+		inc.run(panelContext(), queryTierDashboard, incrementalQuery(from, from.Add(time.Hour), bucketedSQL), func(q backend.DataQuery) backend.DataResponse {
+			return backend.DataResponse{Frames: data.Frames{seriesFrame(q.TimeRange.From, q.TimeRange.To, 0)}}
+		})
+		assert.Empty(t, inc.entries)
+		assert.Zero(t, inc.size)
+	})
+}
+
+func TestIncrementalQueriesEviction(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	frames := data.Frames{seriesFrame(from, from.Add(time.Hour), 0)}
+	inc := newIncrementalQueries(Settings{EnableIncrementalQueries: true})
+	inc.store("a", "q", backend.TimeRange{}, frames)
+	inc.maxSize = inc.size * 2
+
+	inc.store("b", "q", backend.TimeRange{}, frames)
+	inc.store("c", "q", backend.TimeRange{}, frames)
+	assert.NotContains(t, inc.entries, "a", "the least recently refreshed result is evicted")
+	assert.Contains(t, inc.entries, "b")
+	assert.Contains(t, inc.entries, "c")
+	assert.LessOrEqual(t, inc.size, inc.maxSize)
+
+	prev, got := inc.lookup("c", "q")
+	require.NotNil(t, prev)
+	assert.Equal(t, 60, got[0].Rows())
+	prev, _ = inc.lookup("c", "other")
+	assert.Nil(t, prev)
+}
+
+func TestMergeFrames(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := data.Frames{seriesFrame(from, from.Add(10*time.Minute), 0)}
+	delta := data.Frames{seriesFrame(from.Add(8*time.Minute), from.Add(12*time.Minute), 100)}
+	delta[0].Meta = &data.FrameMeta{ExecutedQueryString: "delta"}
+
+	merged, reused, ok := mergeFrames(prev, delta, from.Add(2*time.Minute), from.Add(8*time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, 6, reused)
+	require.Len(t, merged, 1)
+	assert.Equal(t, 10, merged[0].Rows())
+	assert.Equal(t, "delta", merged[0].Meta.ExecutedQueryString)
+	assert.Equal(t, 10, prev[0].Rows(), "the previous frames are not modified")
+
+	_, _, ok = mergeFrames(prev, data.Frames{}, from, from.Add(8*time.Minute))
+	assert.False(t, ok)
+	backwards := func(frames data.Frames) data.Frames {
+		frame := frames[0]
+		reversed := frame.EmptyCopy()
+		for row := frame.Rows() - 1; row >= 0; row-- {
+			reversed.AppendRow(frame.RowCopy(row)...)
+		}
+		return data.Frames{reversed}
+	}
+	merged, reused, ok = mergeFrames(backwards(prev), backwards(delta), from.Add(2*time.Minute), from.Add(8*time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, 6, reused)
+	require.Equal(t, 10, merged[0].Rows())
+	first, _ := merged[0].Fields[1].ConcreteAt(0)
+	assert.Equal(t, 111.0, first, "rows running backwards start with the delta")
+	last, _ := merged[0].Fields[1].ConcreteAt(9)
+	assert.Equal(t, 2.0, last)
+
+	_, _, ok = mergeFrames(prev, backwards(delta), from, from.Add(8*time.Minute))
+	assert.False(t, ok, "the delta runs the other way")
+	unsorted := data.Frames{data.NewFrame("",
+		data.NewField("time", nil, []time.Time{from, from.Add(2 * time.Minute), from.Add(time.Minute)}),
+		data.NewField("value", nil, []float64{1, 2, 3}))}
+	_, _, ok = mergeFrames(unsorted, unsorted, from, from.Add(8*time.Minute))
+	assert.False(t, ok)
+
+	noTime := data.Frames{data.NewFrame("", data.NewField("value", nil, []float64{1}))}
+	_, _, ok = mergeFrames(noTime, noTime, from, from.Add(8*time.Minute))
+	assert.False(t, ok)
+}
@@ -0,0 +1,321 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// logPatternsQueryType is the query type of log pattern queries.
+const logPatternsQueryType = "logPatterns"
+
+const (
+	defaultLogPatternsLimit = 50
+	maxLogPatternsLimit     = 1000
+	// logPatternCandidates is how many more patterns than the limit are
+	// read, since patterns that only differ in what ClickHouse does not mask
+	// are merged afterwards.
+	logPatternCandidates = 4
+)
+
+// OpenTelemetry exporter columns of the logs table.
+const (
+	otelLogsTimeColumn    = "Timestamp"
+	otelLogsMessageColumn = "Body"
+)
+
+// logMasks are the variable parts of log messages, replaced by placeholders
+// in the order listed, so that a UUID is not taken for numbers. They are
+// RE2 expressions, which both ClickHouse and Go run.
+var logMasks = []struct {
+	expr, placeholder string
+}{
+	{`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`, "<uuid>"},
+	{`\b\d{1,3}(\.\d{1,3}){3}\b`, "<ip>"},
+	{`\b0[xX][0-9a-fA-F]+\b`, "<hex>"},
+	{`\b[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\d[0-9a-fA-F]*\b|\b[0-9a-fA-F]*\d[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*\b`, "<hex>"},
+	{`\b\d+(\.\d+)?\b`, "<num>"},
+}
+
+// digitRuns matches what refinePattern masks in the words ClickHouse left
+// alone: digits stuck to letters, as in 250ms or worker3.
+var digitRuns = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// logPatternsOptions are the options of a log pattern query, under the
+// logPatterns key of the query JSON. The database, table and columns
+// default to those of the logs configuration. Limit bounds the patterns
+// returned, 50 by default.
+type logPatternsOptions struct {
+	Database      string `json:"database"`
+	Table         string `json:"table"`
+	TimeColumn    string `json:"timeColumn"`
+	MessageColumn string `json:"messageColumn"`
+	Limit         int    `json:"limit"`
+}
+
+// logPatternQueries answers log pattern queries, which group the log
+// messages of the time range into templates by masking their variable parts,
+// as Loki's patterns do.
+type logPatternQueries struct {
+	logs LogsConfig
+}
+
+// newLogPatternQueries builds the log pattern queries configured on the
+// datasource.
+func newLogPatternQueries(settings Settings) logPatternQueries {
+	return logPatternQueries{logs: settings.Logs}
+}
+
+// logPattern is a log message template: how many messages had it, when the
+// first and last were logged, and how many in each interval of the time
+// range, by the Unix millisecond of the interval start.
+type logPattern struct {
+	pattern     string
+	count       uint64
+	first, last time.Time
+	buckets     map[int64]uint64
+}
+
+// run answers the log pattern query q. The messages are masked and grouped
+// by ClickHouse, through execute, and the patterns it returns are refined
+// and merged here. The result is a patterns frame with a row per pattern,
+// the most frequent first, followed by a frame per pattern with the count of
+// its messages per interval, for sparklines.
+func (l logPatternQueries) run(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model struct {
+		RawSQL   string             `json:"rawSql"`
+		Patterns logPatternsOptions `json:"logPatterns"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("log pattern", err)
+	}
+	opts := l.withDefaults(model.Patterns)
+	sql, err := opts.sql(model.RawSQL)
+	if err != nil {
+		return invalidQuery("log pattern", err)
+	}
+
+	res := execute(ctx, tableQuery(q, sql))
+	if failed(res) || len(res.Frames) == 0 {
+		return res
+	}
+	patterns, err := readLogPatterns(res.Frames[0])
+	if err != nil {
+		return backend.DataResponse{Error: fmt.Errorf("could not read log patterns: %w", err)}
+	}
+	patterns = mergeLogPatterns(patterns)
+	if len(patterns) > opts.Limit {
+		patterns = patterns[:opts.Limit]
+	}
+	frames := logPatternFrames(patterns)
+	frames[0].Meta = res.Frames[0].Meta
+	for _, frame := range frames {
+		frame.RefID = q.RefID
+	}
+	res.Frames = frames
+	return res
+}
+
+// withDefaults fills in the options left empty from the logs configuration.
+func (l logPatternQueries) withDefaults(opts logPatternsOptions) logPatternsOptions {
+	if opts.Database == "" && opts.Table == "" {
+		opts.Database, opts.Table = l.logs.DefaultDatabase, l.logs.DefaultTable
+	}
+	if opts.TimeColumn == "" {
+		opts.TimeColumn = l.logs.TimeColumn
+	}
+	if opts.MessageColumn == "" {
+		opts.MessageColumn = l.logs.MessageColumn
+	}
+	if l.logs.OtelEnabled {
+		if opts.TimeColumn == "" {
+			opts.TimeColumn = otelLogsTimeColumn
+		}
+		if opts.MessageColumn == "" {
+			opts.MessageColumn = otelLogsMessageColumn
+		}
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultLogPatternsLimit
+	}
+	opts.Limit = min(opts.Limit, maxLogPatternsLimit)
+	return opts
+}
+
+// sql returns the query grouping the masked messages by pattern and
+// interval. The messages are those of rawSQL, when set, or else those of the
+// table over the time range.
+func (o logPatternsOptions) sql(rawSQL string) (string, error) {
+	if o.TimeColumn == "" || o.MessageColumn == "" {
+		return "", errors.New("the time and message columns are required; set them on the query or in the logs configuration")
+	}
+	timeColumn, messageColumn := quoteSQLIdentifier(o.TimeColumn), quoteSQLIdentifier(o.MessageColumn)
+
+	var source string
+	if statements := splitStatements(rawSQL); len(statements) > 0 {
+		if len(statements) > 1 {
+			return "", errors.New("the query must hold a single statement")
+		}
+		source = "(\n" + statements[0] + "\n)"
+	} else {
+		if o.Table == "" {
+			return "", errors.New("a table is required; set it on the query or in the logs configuration")
+		}
+		source = quoteSQLIdentifier(o.Table)
+		if o.Database != "" {
+			source = quoteSQLIdentifier(o.Database) + "." + source
+		}
+		source += " WHERE $__timeFilter(" + timeColumn + ")"
+	}
+
+	pattern := "toString(" + messageColumn + ")"
+	for _, mask := range logMasks {
+		pattern = fmt.Sprintf("replaceRegexpAll(%s, %s, %s)", pattern, quoteSQLString(mask.expr), quoteSQLString(mask.placeholder))
+	}
+	return fmt.Sprintf("SELECT pattern, sum(c) AS count, min(first) AS first_seen, max(last) AS last_seen, "+
+		"groupArray(toUnixTimestamp(bucket) * 1000) AS bucket_times, groupArray(c) AS bucket_counts FROM (\n"+
+		"SELECT %s AS pattern, $__timeInterval(%s) AS bucket, count() AS c, min(%s) AS first, max(%s) AS last FROM %s GROUP BY pattern, bucket\n"+
+		") GROUP BY pattern ORDER BY count DESC LIMIT %d",
+		pattern, timeColumn, timeColumn, timeColumn, source, o.Limit*logPatternCandidates), nil
+}
+
+// readLogPatterns reads the patterns of the result of logPatternsOptions.sql.
+func readLogPatterns(frame *data.Frame) ([]logPattern, error) {
+	indexes := map[string]int{}
+	for _, name := range []string{"pattern", "count", "first_seen", "last_seen", "bucket_times", "bucket_counts"} {
+		idx, ok := fieldIndex(frame, name)
+		if !ok {
+			return nil, fmt.Errorf("no %s column", name)
+		}
+		indexes[name] = idx
+	}
+	patterns := make([]logPattern, frame.Rows())
+	for row := range patterns {
+		p := logPattern{
+			pattern: valueString(frame.Fields[indexes["pattern"]], row),
+			buckets: map[int64]uint64{},
+		}
+		if count, err := frame.Fields[indexes["count"]].FloatAt(row); err == nil {
+			p.count = uint64(count)
+		}
+		p.first, _ = rowTime(frame.Fields[indexes["first_seen"]], row)
+		p.last, _ = rowTime(frame.Fields[indexes["last_seen"]], row)
+		var times []int64
+		var counts []uint64
+		if err := json.Unmarshal(rawJSONAt(frame.Fields[indexes["bucket_times"]], row), &times); err != nil {
+			return nil, fmt.Errorf("bucket_times: %w", err)
+		}
+		if err := json.Unmarshal(rawJSONAt(frame.Fields[indexes["bucket_counts"]], row), &counts); err != nil {
+			return nil, fmt.Errorf("bucket_counts: %w", err)
+		}
+		for i := range min(len(times), len(counts)) {
+			p.buckets[times[i]] += counts[i]
+		}
+		patterns[row] = p
+	}
+	return patterns, nil
+}
+
+// rawJSONAt returns the value of field at row as JSON, as arrays are
+// converted.
+func rawJSONAt(field *data.Field, row int) []byte {
+	v, ok := field.ConcreteAt(row)
+	if !ok {
+		return []byte("null")
+	}
+	switch v := v.(type) {
+	case json.RawMessage:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		raw, _ := json.Marshal(v)
+		return raw
+	}
+}
+
+// refinePattern masks the digits ClickHouse left in pattern, those stuck to
+// letters, and collapses runs of spaces.
+func refinePattern(pattern string) string {
+	words := strings.Fields(pattern)
+	for i, word := range words {
+		words[i] = digitRuns.ReplaceAllString(word, "<num>")
+	}
+	return strings.Join(words, " ")
+}
+
+// mergeLogPatterns refines the patterns and merges those that become the
+// same, most frequent first.
+func mergeLogPatterns(patterns []logPattern) []logPattern {
+	var merged []logPattern
+	byPattern := map[string]int{}
+	for _, p := range patterns {
+		p.pattern = refinePattern(p.pattern)
+		i, ok := byPattern[p.pattern]
+		if !ok {
+			byPattern[p.pattern] = len(merged)
+			merged = append(merged, p)
+			continue
+		}
+		m := &merged[i]
+		m.count += p.count
+		if p.first.Before(m.first) {
+			m.first = p.first
+		}
+		if p.last.After(m.last) {
+			m.last = p.last
+		}
+		for bucket, count := range p.buckets {
+			m.buckets[bucket] += count
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].count > merged[j].count })
+	return merged
+}
+
+// logPatternFrames returns the patterns frame and the sparkline frame of
+// every pattern, whose series cover the same intervals, zero where the
+// pattern has no messages.
+func logPatternFrames(patterns []logPattern) data.Frames {
+	var buckets []int64
+	for _, p := range patterns {
+		for bucket := range p.buckets {
+			buckets = append(buckets, bucket)
+		}
+	}
+	slices.Sort(buckets)
+	buckets = slices.Compact(buckets)
+	times := make([]time.Time, len(buckets))
+	for i, bucket := range buckets {
+		times[i] = time.UnixMilli(bucket).UTC()
+	}
+
+	table := data.NewFrame("patterns",
+		data.NewField("pattern", nil, []string{}),
+		data.NewField("count", nil, []uint64{}),
+		data.NewField("first_seen", nil, []time.Time{}),
+		data.NewField("last_seen", nil, []time.Time{}),
+	)
+	frames := data.Frames{table}
+	for _, p := range patterns {
+		table.AppendRow(p.pattern, p.count, p.first, p.last)
+		counts := make([]uint64, len(buckets))
+		for i, bucket := range buckets {
+			counts[i] = p.buckets[bucket]
+		}
+		frames = append(frames, data.NewFrame(p.pattern,
+			data.NewField("time", nil, slices.Clone(times)),
+			data.NewField("count", data.Labels{"pattern": p.pattern}, counts),
+		))
+	}
+	return frames
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMasks(t *testing.T) {
+	// The masks run in ClickHouse, but RE2 masks the same in Go.
+	mask := func(message string) string {
+		for _, m := range logMasks {
+			message = regexp.MustCompile(m.expr).ReplaceAllString(message, m.placeholder)
+		}
+		return message
+	}
+	tests := []struct {
+		message, want string
+	}{
+		{"request 123e4567-e89b-12d3-a456-426614174000 done", "request <uuid> done"},
+		{"connection from 10.0.12.7 refused", "connection from <ip> refused"},
+		{"pointer 0x7ffd3a and hash deadbeef42", "pointer <hex> and hash <hex>"},
+		{"took 12.5 s, 3 retries", "took <num> s, <num> retries"},
+		{"user admin logged in", "user admin logged in"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			assert.Equal(t, tt.want, mask(tt.message))
+		})
+	}
+}
+
+func TestLogPatternsDefaults(t *testing.T) {
+	l := newLogPatternQueries(Settings{Logs: LogsConfig{DefaultDatabase: "otel", DefaultTable: "otel_logs", OtelEnabled: true}})
+	opts := l.withDefaults(logPatternsOptions{Limit: 5000})
+	assert.Equal(t, logPatternsOptions{Database: "otel", Table: "otel_logs", TimeColumn: "Timestamp", MessageColumn: "Body", Limit: 1000}, opts)
+
+	l = newLogPatternQueries(Settings{Logs: LogsConfig{DefaultDatabase: "default", DefaultTable: "logs", TimeColumn: "ts", MessageColumn: "msg"}})
+	opts = l.withDefaults(logPatternsOptions{Table: "app_logs", MessageColumn: "line"})
+	assert.Equal(t, logPatternsOptions{Table: "app_logs", TimeColumn: "ts", MessageColumn: "line", Limit: 50}, opts)
+}
+
+func TestLogPatternsSQL(t *testing.T) {
+	opts := logPatternsOptions{Database: "otel", Table: "otel_logs", TimeColumn: "Timestamp", MessageColumn: "Body", Limit: 10}
+	sql, err := opts.sql("")
+	require.NoError(t, err)
+	assert.Contains(t, sql, "FROM `otel`.`otel_logs` WHERE $__timeFilter(`Timestamp`) GROUP BY pattern, bucket")
+	assert.Contains(t, sql, "$__timeInterval(`Timestamp`) AS bucket")
+	assert.Contains(t, sql, "replaceRegexpAll(replaceRegexpAll(replaceRegexpAll(replaceRegexpAll(replaceRegexpAll(toString(`Body`), ")
+	assert.Contains(t, sql, "'<uuid>'")
+	assert.Contains(t, sql, "ORDER BY count DESC LIMIT 40")
+
+	sql, err = opts.sql("SELECT * FROM logs WHERE level = 'error';")
+	require.NoError(t, err)
+	assert.Contains(t, sql, "FROM (\nSELECT * FROM logs WHERE level = 'error'\n) GROUP BY pattern, bucket")
+
+	_, err = opts.sql("SELECT 1; SELECT 2")
+	assert.Error(t, err)
+	_, err = logPatternsOptions{Table: "logs", TimeColumn: "ts"}.sql("")
+	assert.Error(t, err)
+	_, err = logPatternsOptions{TimeColumn: "ts", MessageColumn: "msg"}.sql("")
+	assert.Error(t, err)
+}
+
+func TestRefinePattern(t *testing.T) {
+	assert.Equal(t, "worker<num> took <num> ms", refinePattern("worker3  took <num>\tms"))
+	assert.Equal(t, "timeout after <num>ms", refinePattern("timeout after 250ms"))
+}
+
+func TestRunLogPatternsQuery(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	frame := data.NewFrame("A",
+		data.NewField("pattern", nil, []string{"job <num> done", "worker1 failed", "worker2 failed"}),
+		data.NewField("count", nil, []uint64{10, 2, 3}),
+		data.NewField("first_seen", nil, []time.Time{t0, t0.Add(time.Minute), t0}),
+		data.NewField("last_seen", nil, []time.Time{t0.Add(2 * time.Minute), t0.Add(time.Minute), t0.Add(time.Minute)}),
+		data.NewField("bucket_times", nil, []json.RawMessage{
+			json.RawMessage(`[1704067200000,1704067260000,1704067320000]`),
+			json.RawMessage(`[1704067260000]`),
+			json.RawMessage(`[1704067200000,1704067260000]`),
+		}),
+		data.NewField("bucket_counts", nil, []json.RawMessage{
+			json.RawMessage(`[4,3,3]`),
+			json.RawMessage(`[2]`),
+			json.RawMessage(`[1,2]`),
+		}),
+	)
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: "SELECT ..."}
+
+	var got backend.DataQuery
+	l := newLogPatternQueries(Settings{Logs: LogsConfig{DefaultTable: "logs", TimeColumn: "ts", MessageColumn: "msg"}})
+	res := l.run(context.Background(), backend.DataQuery{
+		RefID:     "A",
+		QueryType: "logPatterns",
+		JSON:      []byte(`{"logPatterns": {"limit": 1}}`),
+	}, func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		got = q
+		return backend.DataResponse{Frames: data.Frames{frame}}
+	})
+	require.NoError(t, res.Error)
+	assert.Contains(t, executedSQL(t, got), "FROM `logs` WHERE $__timeFilter(`ts`)")
+
+	require.Len(t, res.Frames, 2)
+	patterns := res.Frames[0]
+	assert.Equal(t, "patterns", patterns.Name)
+	assert.Equal(t, "A", patterns.RefID)
+	assert.Equal(t, "SELECT ...", patterns.Meta.ExecutedQueryString)
+	require.Equal(t, 1, patterns.Rows())
+	assert.Equal(t, "job <num> done", patterns.Fields[0].At(0))
+
+	// Without the limit, the worker patterns merge into the second one.
+	res = l.run(context.Background(), backend.DataQuery{RefID: "A", JSON: []byte(`{}`)},
+		func(context.Context, backend.DataQuery) backend.DataResponse {
+			return backend.DataResponse{Frames: data.Frames{frame}}
+		})
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 3)
+	patterns = res.Frames[0]
+	require.Equal(t, 2, patterns.Rows())
+	assert.Equal(t, "worker<num> failed", patterns.Fields[0].At(1))
+	assert.Equal(t, uint64(5), patterns.Fields[1].At(1))
+	assert.Equal(t, t0, patterns.Fields[2].At(1))
+	assert.Equal(t, t0.Add(time.Minute), patterns.Fields[3].At(1))
+
+	series := res.Frames[2]
+	assert.Equal(t, "worker<num> failed", series.Name)
+	assert.Equal(t, data.Labels{"pattern": "worker<num> failed"}, series.Fields[1].Labels)
+	assert.Equal(t, []time.Time{t0, t0.Add(time.Minute), t0.Add(2 * time.Minute)},
+		[]time.Time{series.Fields[0].At(0).(time.Time), series.Fields[0].At(1).(time.Time), series.Fields[0].At(2).(time.Time)})
+	assert.Equal(t, []uint64{1, 4, 0}, []uint64{series.Fields[1].At(0).(uint64), series.Fields[1].At(1).(uint64), series.Fields[1].At(2).(uint64)})
+
+	res = newLogPatternQueries(Settings{}).run(context.Background(), backend.DataQuery{JSON: []byte(`{}`)}, nil)
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+}
@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// queryAnalysisQueryType is the query type of query analysis queries.
+const queryAnalysisQueryType = "queryAnalysis"
+
+const (
+	defaultQueryAnalysisLimit = 100
+	maxQueryAnalysisLimit     = 10_000
+)
+
+// queryAnalysis is the model of a query analysis query, under the
+// queryAnalysis key of the query JSON. It selects the queries of a
+// dashboard, a panel of a dashboard or an alert rule; a panel ID without a
+// dashboard UID selects that panel in every dashboard. Limit bounds the
+// executions returned, 100 by default.
+type queryAnalysis struct {
+	DashboardUID string          `json:"dashboardUid"`
+	PanelID      json.RawMessage `json:"panelId"`
+	RuleUID      string          `json:"ruleUid"`
+	Limit        int             `json:"limit"`
+}
+
+// runQueryAnalysisQuery answers a query analysis query: the executions of
+// the queries of a dashboard, panel or alert rule over the time range, from
+// system.query_log, with their duration, the rows and bytes they read, their
+// memory usage and exception. The queries are told apart by the Grafana
+// comments MutateQuery adds to the client info, which ClickHouse logs as the
+// client_name of native connections and the http_user_agent of HTTP ones.
+// The SQL runs through execute as a table query.
+func runQueryAnalysisQuery(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model struct {
+		Analysis queryAnalysis `json:"queryAnalysis"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("query analysis", err)
+	}
+	sql, err := model.Analysis.sql()
+	if err != nil {
+		return invalidQuery("query analysis", err)
+	}
+
+	res := execute(ctx, tableQuery(q, sql))
+	for _, frame := range res.Frames {
+		frame.Name = "queries"
+	}
+	return res
+}
+
+// sql returns the query over system.query_log that answers a.
+func (a queryAnalysis) sql() (string, error) {
+	var panelID string
+	if len(a.PanelID) > 0 && string(a.PanelID) != "null" {
+		// Panel IDs are numbers in dashboards and strings in headers.
+		if err := json.Unmarshal(a.PanelID, &panelID); err != nil {
+			panelID = string(a.PanelID)
+		}
+	}
+	var comments []string
+	if a.DashboardUID != "" {
+		comments = append(comments, "grafana_dashboard:"+a.DashboardUID)
+	}
+	if panelID != "" {
+		comments = append(comments, "grafana_panel:"+panelID)
+	}
+	if a.RuleUID != "" {
+		comments = append(comments, "grafana_rule:"+a.RuleUID)
+	}
+	if len(comments) == 0 {
+		return "", errors.New("one of dashboardUid, panelId or ruleUid is required")
+	}
+
+	limit := a.Limit
+	if limit <= 0 {
+		limit = defaultQueryAnalysisLimit
+	}
+	limit = min(limit, maxQueryAnalysisLimit)
+
+	filters := []string{"$__dateFilter(event_date)", "$__timeFilter(event_time)", "type != 'QueryStart'"}
+	for _, comment := range comments {
+		// Comments are followed by "; " and the client's own, so the ;
+		// keeps a dashboard from matching those whose UID it starts.
+		quoted := quoteSQLString(comment + ";")
+		filters = append(filters, fmt.Sprintf("(position(client_name, %s) > 0 OR position(http_user_agent, %s) > 0)", quoted, quoted))
+	}
+	return "SELECT event_time AS time, query_id, type, query_duration_ms, read_rows, read_bytes, result_rows, result_bytes, " +
+		"memory_usage, exception_code, exception, user, query FROM system.query_log WHERE " + strings.Join(filters, " AND ") +
+		fmt.Sprintf(" ORDER BY event_time DESC LIMIT %d", limit), nil
+}
@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryAnalysisSQL(t *testing.T) {
+	sql, err := queryAnalysis{DashboardUID: "abc'd", PanelID: json.RawMessage(`4`)}.sql()
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT event_time AS time, query_id, type, query_duration_ms, read_rows, read_bytes, result_rows, result_bytes, "+
+		"memory_usage, exception_code, exception, user, query FROM system.query_log "+
+		"WHERE $__dateFilter(event_date) AND $__timeFilter(event_time) AND type != 'QueryStart' "+
+		"AND (position(client_name, 'grafana_dashboard:abc\\'d;') > 0 OR position(http_user_agent, 'grafana_dashboard:abc\\'d;') > 0) "+
+		"AND (position(client_name, 'grafana_panel:4;') > 0 OR position(http_user_agent, 'grafana_panel:4;') > 0) "+
+		"ORDER BY event_time DESC LIMIT 100", sql)
+
+	sql, err = queryAnalysis{PanelID: json.RawMessage(`"12"`), RuleUID: "r1", Limit: 1_000_000}.sql()
+	require.NoError(t, err)
+	assert.Contains(t, sql, "'grafana_panel:12;'")
+	assert.Contains(t, sql, "'grafana_rule:r1;'")
+	assert.NotContains(t, sql, "grafana_dashboard")
+	assert.Contains(t, sql, "LIMIT 10000")
+
+	_, err = queryAnalysis{PanelID: json.RawMessage(`null`)}.sql()
+	assert.Error(t, err)
+}
+
+func TestRunQueryAnalysisQuery(t *testing.T) {
+	var got backend.DataQuery
+	res := runQueryAnalysisQuery(context.Background(), backend.DataQuery{
+		RefID:     "A",
+		QueryType: "queryAnalysis",
+		JSON:      []byte(`{"queryAnalysis": {"ruleUid": "r1", "limit": 5}}`),
+	}, func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		got = q
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("A")}}
+	})
+	require.NoError(t, res.Error)
+	assert.Contains(t, executedSQL(t, got), "LIMIT 5")
+	assert.Equal(t, "queries", res.Frames[0].Name)
+
+	res = runQueryAnalysisQuery(context.Background(), backend.DataQuery{JSON: []byte(`{"queryAnalysis": {}}`)}, nil)
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+}
@@ -0,0 +1,207 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/clickhouse-datasource/pkg/macros"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+type queryParametersKeyType struct{}
+
+var queryParametersKey = queryParametersKeyType{}
+
+// queryParameter is a server-side query parameter of a query, under the
+// parameters key of the query JSON, by name. Type is the ClickHouse type the
+// SQL references it with, as in {name:Type}. Value is a JSON string, number,
+// boolean or null, or an array of them for an Array type.
+type queryParameter struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// parameterName matches the names ClickHouse accepts for query parameters.
+var parameterName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// bindQueryParameters binds the parameters of the query q, if it has any,
+// as server-side query parameters of the queries run with ctx. Template
+// variables passed this way reach ClickHouse as values rather than as SQL,
+// so they need no quoting and cannot change the query. The tables named by
+// Identifier parameters are checked against the table policy like those
+// named in the SQL.
+func bindQueryParameters(ctx context.Context, q backend.DataQuery) (context.Context, error) {
+	var model struct {
+		Parameters map[string]queryParameter `json:"parameters"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil || len(model.Parameters) == 0 {
+		// An unparsable query is reported when it runs.
+		return ctx, nil
+	}
+	params := make(map[string]string, len(model.Parameters))
+	for name, p := range model.Parameters {
+		if !parameterName.MatchString(name) {
+			return ctx, fmt.Errorf("invalid query parameter name %q", name)
+		}
+		if name == macros.FromParameter || name == macros.ToParameter {
+			return ctx, fmt.Errorf("query parameter name %s is reserved for the time range", name)
+		}
+		if p.Type == "" {
+			return ctx, fmt.Errorf("query parameter %s has no type", name)
+		}
+		value, err := formatQueryParameter(p.Type, p.Value)
+		if err != nil {
+			return ctx, fmt.Errorf("query parameter %s: %w", name, err)
+		}
+		params[name] = value
+	}
+	return withQueryParameters(ctx, params), nil
+}
+
+// formatQueryParameter returns value, the JSON value of a parameter of the
+// ClickHouse type typ, in the text form ClickHouse parses parameters from:
+// a string as is, a null as \N, and an array as an array literal.
+func formatQueryParameter(typ string, value json.RawMessage) (string, error) {
+	v, err := decodeParameterValue(value)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case nil:
+		return `\N`, nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		elem, ok := arrayElementType(typ)
+		if !ok {
+			return "", fmt.Errorf("an array value needs an Array type, not %s", typ)
+		}
+		return formatArrayLiteral(elem, v)
+	default:
+		return "", fmt.Errorf("unsupported value %s", value)
+	}
+}
+
+func decodeParameterValue(value json.RawMessage) (any, error) {
+	if len(value) == 0 {
+		return nil, fmt.Errorf("no value")
+	}
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// formatArrayLiteral returns values as a ClickHouse array literal of
+// elements of type elem. Strings are quoted unless elem is numeric, since
+// template variables hold numbers as strings, and are then checked to be
+// numbers.
+func formatArrayLiteral(elem string, values []any) (string, error) {
+	numeric := isNumericType(elem)
+	parts := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+			parts[i] = "NULL"
+		case string:
+			if !numeric {
+				parts[i] = quoteSQLString(v)
+				continue
+			}
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return "", fmt.Errorf("%q is not a %s", v, elem)
+			}
+			parts[i] = v
+		case json.Number:
+			parts[i] = v.String()
+			if !numeric {
+				parts[i] = quoteSQLString(v.String())
+			}
+		case bool:
+			parts[i] = strconv.FormatBool(v)
+		case []any:
+			inner, ok := arrayElementType(elem)
+			if !ok {
+				return "", fmt.Errorf("an array value needs an Array type, not %s", elem)
+			}
+			literal, err := formatArrayLiteral(inner, v)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = literal
+		default:
+			return "", fmt.Errorf("unsupported array element %v", v)
+		}
+	}
+	return "[" + strings.Join(parts, ",") + "]", nil
+}
+
+// unwrapType returns typ without its Nullable and LowCardinality wrappers.
+func unwrapType(typ string) string {
+	typ = strings.TrimSpace(typ)
+	for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+		if strings.HasPrefix(typ, wrapper) && strings.HasSuffix(typ, ")") {
+			return unwrapType(typ[len(wrapper) : len(typ)-1])
+		}
+	}
+	return typ
+}
+
+// arrayElementType returns the element type of the Array type typ.
+func arrayElementType(typ string) (string, bool) {
+	typ = unwrapType(typ)
+	if !strings.HasPrefix(typ, "Array(") || !strings.HasSuffix(typ, ")") {
+		return "", false
+	}
+	return typ[len("Array(") : len(typ)-1], true
+}
+
+// isNumericType reports whether typ is a number or boolean type.
+func isNumericType(typ string) bool {
+	typ = unwrapType(typ)
+	for _, prefix := range []string{"Int", "UInt", "Float", "Decimal", "Bool"} {
+		if strings.HasPrefix(typ, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// withQueryParameters returns ctx with params bound as the server-side query
+// parameters of the queries run with it, which the SQL references as
+// {name:Type}, along with those bound already. They are also recorded on
+// ctx for queryResultKey, since queries with the same SQL but different
+// parameters have different results.
+func withQueryParameters(ctx context.Context, params map[string]string) context.Context {
+	if len(params) == 0 {
+		return ctx
+	}
+	merged := maps.Clone(queryParametersFromContext(ctx))
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	maps.Copy(merged, params)
+	ctx = context.WithValue(ctx, queryParametersKey, merged)
+	return clickhouse.Context(ctx, clickhouse.WithParameters(clickhouse.Parameters(merged)))
+}
+
+// queryParametersFromContext returns the parameters bound by
+// withQueryParameters, or nil.
+func queryParametersFromContext(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(queryParametersKey).(map[string]string)
+	return params
+}
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatQueryParameter(t *testing.T) {
+	for _, tt := range []struct {
+		typ, value, want string
+	}{
+		{"String", `"it's \\ a 'test'"`, `it's \ a 'test'`},
+		{"UInt64", `42`, "42"},
+		{"Float64", `1.5e3`, "1.5e3"},
+		{"Bool", `true`, "true"},
+		{"Nullable(String)", `null`, `\N`},
+		{"Array(UInt64)", `[1, 2, 3]`, "[1,2,3]"},
+		{"Array(UInt64)", `["1", "2"]`, "[1,2]"},
+		{"Array(String)", `["a", "it's", 3]`, `['a','it\'s','3']`},
+		{"LowCardinality(Nullable(Array(Nullable(String))))", `["a", null]`, `['a',NULL]`},
+		{"Array(Array(Int8))", `[[1], [-2, 3]]`, "[[1],[-2,3]]"},
+		{"Array(String)", `"['already', 'formatted']"`, "['already', 'formatted']"},
+	} {
+		t.Run(tt.typ+" "+tt.value, func(t *testing.T) {
+			got, err := formatQueryParameter(tt.typ, json.RawMessage(tt.value))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	for _, tt := range []struct{ typ, value string }{
+		{"String", `[1]`},
+		{"Array(UInt64)", `["1; DROP TABLE t"]`},
+		{"String", `{"a": 1}`},
+		{"String", ``},
+	} {
+		_, err := formatQueryParameter(tt.typ, json.RawMessage(tt.value))
+		assert.Error(t, err, tt.typ+" "+tt.value)
+	}
+}
+
+func TestBindQueryParameters(t *testing.T) {
+	q := backend.DataQuery{JSON: []byte(`{"rawSql": "SELECT 1", "parameters": {
+		"service": {"type": "String", "value": "api"},
+		"ids": {"type": "Array(UInt64)", "value": [1, 2]}
+	}}`)}
+	ctx, err := bindQueryParameters(withQueryParameters(context.Background(), map[string]string{"db": "prod"}), q)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"db": "prod", "service": "api", "ids": "[1,2]"}, queryParametersFromContext(ctx))
+
+	ctx, err = bindQueryParameters(context.Background(), backend.DataQuery{JSON: []byte(`{"rawSql": "SELECT 1"}`)})
+	require.NoError(t, err)
+	assert.Nil(t, queryParametersFromContext(ctx))
+
+	for _, parameters := range []string{
+		`{"__from": {"type": "String", "value": "x"}}`,
+		`{"a-b": {"type": "String", "value": "x"}}`,
+		`{"a": {"value": "x"}}`,
+		`{"a": {"type": "UInt8", "value": [1]}}`,
+	} {
+		_, err := bindQueryParameters(context.Background(), backend.DataQuery{JSON: []byte(`{"parameters": ` + parameters + `}`)})
+		assert.Error(t, err, parameters)
+	}
+}
+
+func TestIdentifierParametersTablePolicy(t *testing.T) {
+	policy := newTablePolicy(Settings{AllowedTables: []string{"team_x.*"}})
+	bind := func(value string) context.Context {
+		q := backend.DataQuery{JSON: []byte(`{"parameters": {"t": {"type": "Identifier", "value": "` + value + `"}}}`)}
+		ctx, err := bindQueryParameters(policy.attach(context.Background()), q)
+		require.NoError(t, err)
+		return ctx
+	}
+
+	err := checkQueryTables(bind("team_y.secrets"), "SELECT * FROM {t:Identifier}")
+	assert.EqualError(t, err, "table team_y.secrets is not allowed by the table restrictions of this data source")
+	err = checkQueryTables(bind("team_y.secrets"), "SELECT * FROM team_x.events WHERE id IN {t: Identifier}")
+	assert.Error(t, err, "a denied table on the right side of IN")
+	assert.NoError(t, checkQueryTables(bind("team_x.events"), "SELECT * FROM {t:Identifier}"))
+	assert.NoError(t, checkQueryTables(bind("ts"), "SELECT {t:Identifier} FROM team_x.events"), "an identifier naming a column")
+}
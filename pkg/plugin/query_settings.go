@@ -0,0 +1,29 @@
+package plugin
+
+import (
+	"context"
+	"maps"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+type querySettingsKeyType struct{}
+
+var querySettingsKey = querySettingsKeyType{}
+
+// withQuerySettings adds ClickHouse settings to the query run with ctx. They
+// take precedence over the settings of the connection. clickhouse.WithSettings
+// replaces whatever an earlier call set, so the settings added here are
+// accumulated under their own key and always handed over together.
+func withQuerySettings(ctx context.Context, settings clickhouse.Settings) context.Context {
+	if len(settings) == 0 {
+		return ctx
+	}
+	merged := clickhouse.Settings{}
+	if existing, ok := ctx.Value(querySettingsKey).(clickhouse.Settings); ok {
+		maps.Copy(merged, existing)
+	}
+	maps.Copy(merged, settings)
+	ctx = context.WithValue(ctx, querySettingsKey, merged)
+	return clickhouse.Context(ctx, clickhouse.WithSettings(merged))
+}
@@ -0,0 +1,25 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithQuerySettings(t *testing.T) {
+	ctx := withQuerySettings(context.Background(), clickhouse.Settings{"max_rows_to_read": 10, "read_overflow_mode": "throw"})
+	ctx = withQuerySettings(ctx, clickhouse.Settings{"read_overflow_mode": "break", "max_result_rows": 5})
+
+	assert.Equal(t, clickhouse.Settings{
+		"max_rows_to_read":   10,
+		"read_overflow_mode": "break",
+		"max_result_rows":    5,
+	}, ctx.Value(querySettingsKey))
+
+	t.Run("no settings leaves the context alone", func(t *testing.T) {
+		ctx := context.Background()
+		assert.Equal(t, ctx, withQuerySettings(ctx, nil))
+	})
+}
@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+type queryStatsKeyType struct{}
+
+var queryStatsKey = queryStatsKeyType{}
+
+// queryStats accumulates what is learned about one query execution while
+// sqlds runs it: the time it queued for a concurrency slot, the interpolated
+// statement, its cost estimate, and the read progress ClickHouse reports.
+// The server only sends progress packets over the native protocol, so over
+// HTTP the counters stay at zero.
+type queryStats struct {
+	queueWait time.Duration
+	// statement and estimate are written by interpolateMacros and read after
+	// sqlds returns, which orders the accesses.
+	statement string
+	estimate  *costEstimate
+	rowsRead  atomic.Uint64
+	bytesRead atomic.Uint64
+}
+
+// withQueryStats registers a progress callback on ctx and returns the stats
+// it fills in. Progress packets carry deltas, so they are summed.
+func withQueryStats(ctx context.Context) (context.Context, *queryStats) {
+	stats := &queryStats{}
+	ctx = context.WithValue(ctx, queryStatsKey, stats)
+	return clickhouse.Context(ctx, clickhouse.WithProgress(func(p *clickhouse.Progress) {
+		stats.rowsRead.Add(p.Rows)
+		stats.bytesRead.Add(p.Bytes)
+	})), stats
+}
+
+// queryStatsFromContext returns the stats registered by withQueryStats, or
+// nil when the query does not run through Datasource.
+func queryStatsFromContext(ctx context.Context) *queryStats {
+	stats, _ := ctx.Value(queryStatsKey).(*queryStats)
+	return stats
+}
+
+// frameRows returns the total number of rows across frames.
+func frameRows(frames data.Frames) int64 {
+	var rows int64
+	for _, frame := range frames {
+		if frame == nil {
+			continue
+		}
+		rows += int64(frame.Rows())
+	}
+	return rows
+}
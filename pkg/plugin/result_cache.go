@@ -0,0 +1,261 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultResultCacheTTL     = time.Minute
+	defaultResultCacheMaxSize = 64 << 20
+)
+
+var resultCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "grafana_plugin",
+	Subsystem: "clickhouse",
+	Name:      "result_cache_requests_total",
+	Help:      "Result cache lookups, by outcome (hit or miss).",
+}, []string{"outcome"})
+
+// resultCache keeps the frames of recent dashboard queries in memory, so that
+// dashboards refreshed by many viewers, or reloaded, do not query ClickHouse
+// again. Queries share an entry when they have the same queryResultKey.
+// Entries live for the TTL of the datasource, or of the query when its model
+// sets cacheTtlSeconds, and the least recently used ones are evicted to keep
+// the cache under its size. Frames are stored Arrow-encoded, which bounds
+// their size and gives every hit its own copy.
+//
+// Explore queries always run, since whoever is exploring expects to see the
+// latest data, and so do alert rules, which must not evaluate stale data.
+type resultCache struct {
+	enabled bool
+	perUser bool
+	ttl     time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// cachedResult is an entry of the result cache.
+type cachedResult struct {
+	key     string
+	frames  [][]byte
+	size    int
+	stored  time.Time
+	expires time.Time
+}
+
+// newResultCache builds the result cache configured on the datasource.
+func newResultCache(settings Settings) *resultCache {
+	c := &resultCache{
+		enabled: settings.EnableResultCache,
+		perUser: isolatesUsers(settings),
+		ttl:     defaultResultCacheTTL,
+		maxSize: defaultResultCacheMaxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+	if settings.ResultCacheTTLSeconds > 0 {
+		c.ttl = time.Duration(settings.ResultCacheTTLSeconds) * time.Second
+	}
+	if settings.ResultCacheMaxSizeMB > 0 {
+		c.maxSize = int(settings.ResultCacheMaxSizeMB) << 20
+	}
+	return c
+}
+
+// key returns the key q is cached under, or "" when it is not cached.
+func (c *resultCache) key(ctx context.Context, tier queryTier, q backend.DataQuery, query *sqlutil.Query) string {
+	if !c.enabled {
+		return ""
+	}
+	return queryResultKey(ctx, c.perUser, tier, q, query)
+}
+
+// queryTTL returns how long the result of q may be cached, or zero when it
+// must not be. A cacheTtlSeconds of zero in the query model opts the query
+// out of the cache.
+func (c *resultCache) queryTTL(tier queryTier, q backend.DataQuery) time.Duration {
+	if !c.enabled || tier != queryTierDashboard {
+		return 0
+	}
+	var model struct {
+		CacheTTLSeconds *int64 `json:"cacheTtlSeconds"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err == nil && model.CacheTTLSeconds != nil {
+		return time.Duration(max(*model.CacheTTLSeconds, 0)) * time.Second
+	}
+	return c.ttl
+}
+
+// run returns the cached result for key if there is one, and otherwise runs
+// the query through execute and caches its result if it succeeded. Either way
+// a successful response says whether it came from the cache.
+func (c *resultCache) run(ctx context.Context, key string, tier queryTier, q backend.DataQuery, execute func(context.Context) backend.DataResponse) backend.DataResponse {
+	ttl := c.queryTTL(tier, q)
+	if ttl <= 0 || key == "" {
+		return execute(ctx)
+	}
+
+	if frames, age, ok := c.get(key, q.RefID); ok {
+		resultCacheRequests.WithLabelValues("hit").Inc()
+		auditTrailFromContext(ctx).markCached()
+		res := backend.DataResponse{Frames: frames}
+		return withCacheStats(res, q.RefID, true, age)
+	}
+	resultCacheRequests.WithLabelValues("miss").Inc()
+
+	res := execute(ctx)
+	if failed(res) {
+		return res
+	}
+	if err := c.put(key, res.Frames, ttl); err != nil {
+		backend.Logger.FromContext(ctx).Debug("Could not cache query result", "error", err)
+	}
+	return withCacheStats(res, q.RefID, false, 0)
+}
+
+// get returns a copy of the frames cached for key, under refID, and the age
+// of the entry.
+func (c *resultCache) get(key, refID string) (data.Frames, time.Duration, bool) {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, 0, false
+	}
+	entry := elem.Value.(*cachedResult)
+	now := time.Now()
+	if now.After(entry.expires) {
+		c.remove(elem)
+		c.mu.Unlock()
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(elem)
+	c.mu.Unlock()
+
+	frames, err := data.UnmarshalArrowFrames(entry.frames)
+	if err != nil {
+		return nil, 0, false
+	}
+	for _, frame := range frames {
+		frame.RefID = refID
+	}
+	return frames, now.Sub(entry.stored), true
+}
+
+// put caches frames under key, evicting the least recently used entries to
+// make room. A result larger than the whole cache is not cached. The notices
+// and stats about the execution that produced the frames, its retries, queue
+// wait and cost estimate, are not cached, since they do not tell about the
+// result.
+func (c *resultCache) put(key string, frames data.Frames, ttl time.Duration) error {
+	encoded, err := withoutExecutionMeta(frames).MarshalArrow()
+	if err != nil {
+		return err
+	}
+	size := len(key)
+	for _, b := range encoded {
+		size += len(b)
+	}
+	if size > c.maxSize {
+		return nil
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.size+size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&cachedResult{
+		key:     key,
+		frames:  encoded,
+		size:    size,
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+	c.size += size
+	return nil
+}
+
+// executionStats are the display names of the stats added about one
+// execution of a query: its queue wait and its cost estimate.
+var executionStats = map[string]bool{
+	"Queue wait":              true,
+	"Estimated rows to read":  true,
+	"Estimated parts to read": true,
+	"Estimated marks to read": true,
+}
+
+// isExecutionNotice reports whether n tells about one execution of a query:
+// the retries it took or a cost estimate over a threshold.
+func isExecutionNotice(n data.Notice) bool {
+	return strings.HasPrefix(n.Text, "Query succeeded after ") || strings.HasPrefix(n.Text, "query is estimated to read ")
+}
+
+// withoutExecutionMeta returns shallow copies of frames without the notices
+// and stats about the execution that produced them. Those produced with the
+// data, such as the notice of a result cut at the row limit, are kept.
+func withoutExecutionMeta(frames data.Frames) data.Frames {
+	stripped := make(data.Frames, len(frames))
+	for i, frame := range frames {
+		if frame == nil || frame.Meta == nil {
+			stripped[i] = frame
+			continue
+		}
+		f, meta := *frame, *frame.Meta
+		meta.Notices, meta.Stats = nil, nil
+		for _, n := range frame.Meta.Notices {
+			if !isExecutionNotice(n) {
+				meta.Notices = append(meta.Notices, n)
+			}
+		}
+		for _, stat := range frame.Meta.Stats {
+			if !executionStats[stat.DisplayName] {
+				meta.Stats = append(meta.Stats, stat)
+			}
+		}
+		f.Meta = &meta
+		stripped[i] = &f
+	}
+	return stripped
+}
+
+// remove drops an entry. Must hold c.mu.
+func (c *resultCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedResult)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// withCacheStats records in the stats of the frames whether the result came
+// from the cache, and if so how old it is.
+func withCacheStats(res backend.DataResponse, refID string, hit bool, age time.Duration) backend.DataResponse {
+	stats := []data.QueryStat{{FieldConfig: data.FieldConfig{DisplayName: "Result cache hit"}}}
+	if hit {
+		stats[0].Value = 1
+		stats = append(stats, data.QueryStat{
+			FieldConfig: data.FieldConfig{DisplayName: "Result cache age", Unit: "ms"},
+			Value:       float64(age.Milliseconds()),
+		})
+	}
+	res.Frames = appendQueryStats(res.Frames, refID, stats...)
+	return res
+}
@@ -0,0 +1,176 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cacheStats(res backend.DataResponse) map[string]float64 {
+	stats := map[string]float64{}
+	if len(res.Frames) == 0 || res.Frames[0].Meta == nil {
+		return stats
+	}
+	for _, s := range res.Frames[0].Meta.Stats {
+		stats[s.DisplayName] = s.Value
+	}
+	return stats
+}
+
+func TestResultCacheRun(t *testing.T) {
+	c := newResultCache(Settings{EnableResultCache: true})
+	executions := 0
+	execute := func(context.Context) backend.DataResponse {
+		executions++
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("v", nil, []int64{int64(executions)}))}}
+	}
+	q := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "SELECT 1"}`)}
+
+	res := c.run(context.Background(), "key", queryTierDashboard, q, execute)
+	assert.Equal(t, map[string]float64{"Result cache hit": 0}, cacheStats(res))
+
+	q.RefID = "B"
+	ctx, trail := withAuditTrail(context.Background())
+	res = c.run(ctx, "key", queryTierDashboard, q, execute)
+	require.NoError(t, res.Error)
+	assert.Equal(t, 1, executions)
+	assert.True(t, trail.cached)
+	require.Len(t, res.Frames, 1)
+	assert.Equal(t, "B", res.Frames[0].RefID)
+	v, _ := res.Frames[0].Fields[0].ConcreteAt(0)
+	assert.Equal(t, int64(1), v)
+	assert.Equal(t, float64(1), cacheStats(res)["Result cache hit"])
+	assert.Contains(t, cacheStats(res), "Result cache age")
+
+	c.run(context.Background(), "other", queryTierDashboard, q, execute)
+	assert.Equal(t, 2, executions, "different keys do not share results")
+}
+
+func TestResultCacheBypass(t *testing.T) {
+	c := newResultCache(Settings{EnableResultCache: true})
+	executions := 0
+	execute := func(context.Context) backend.DataResponse {
+		executions++
+		return backend.DataResponse{}
+	}
+	q := backend.DataQuery{RefID: "A", JSON: []byte(`{}`)}
+
+	for _, tier := range []queryTier{queryTierExplore, queryTierAlert} {
+		for i := 0; i < 2; i++ {
+			res := c.run(context.Background(), "key", tier, q, execute)
+			assert.Empty(t, cacheStats(res))
+		}
+	}
+	assert.Equal(t, 4, executions)
+
+	c.run(context.Background(), "", queryTierDashboard, q, execute)
+	c.run(context.Background(), "", queryTierDashboard, q, execute)
+	assert.Equal(t, 6, executions, "queries without a key are not cached")
+
+	optOut := backend.DataQuery{RefID: "A", JSON: []byte(`{"cacheTtlSeconds": 0}`)}
+	c.run(context.Background(), "key", queryTierDashboard, optOut, execute)
+	c.run(context.Background(), "key", queryTierDashboard, optOut, execute)
+	assert.Equal(t, 8, executions)
+
+	disabled := newResultCache(Settings{})
+	disabled.run(context.Background(), "key", queryTierDashboard, q, execute)
+	disabled.run(context.Background(), "key", queryTierDashboard, q, execute)
+	assert.Equal(t, 10, executions)
+}
+
+func TestResultCacheSkipsFailures(t *testing.T) {
+	c := newResultCache(Settings{EnableResultCache: true})
+	executions := 0
+	execute := func(context.Context) backend.DataResponse {
+		executions++
+		return backend.DataResponse{Error: errors.New("boom")}
+	}
+	q := backend.DataQuery{RefID: "A", JSON: []byte(`{}`)}
+	res := c.run(context.Background(), "key", queryTierDashboard, q, execute)
+	assert.Empty(t, res.Frames)
+	c.run(context.Background(), "key", queryTierDashboard, q, execute)
+	assert.Equal(t, 2, executions)
+}
+
+func TestResultCacheTTL(t *testing.T) {
+	c := newResultCache(Settings{EnableResultCache: true, ResultCacheTTLSeconds: 30})
+	assert.Equal(t, 30*time.Second, c.queryTTL(queryTierDashboard, backend.DataQuery{JSON: []byte(`{}`)}))
+	assert.Equal(t, 5*time.Second, c.queryTTL(queryTierDashboard, backend.DataQuery{JSON: []byte(`{"cacheTtlSeconds": 5}`)}))
+	assert.Zero(t, c.queryTTL(queryTierDashboard, backend.DataQuery{JSON: []byte(`{"cacheTtlSeconds": -1}`)}))
+
+	frames := data.Frames{data.NewFrame("", data.NewField("v", nil, []int64{1}))}
+	require.NoError(t, c.put("key", frames, time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, _, ok := c.get("key", "A")
+	assert.False(t, ok, "expired entries are not served")
+	assert.Empty(t, c.entries)
+	assert.Zero(t, c.size)
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	frames := data.Frames{data.NewFrame("", data.NewField("v", nil, make([]int64, 1000)))}
+	encoded, err := frames.MarshalArrow()
+	require.NoError(t, err)
+	entrySize := len(encoded[0]) + len("key0")
+
+	c := newResultCache(Settings{EnableResultCache: true})
+	c.maxSize = 2*entrySize + entrySize/2
+	require.NoError(t, c.put("key0", frames, time.Minute))
+	require.NoError(t, c.put("key1", frames, time.Minute))
+	_, _, ok := c.get("key0", "A")
+	require.True(t, ok)
+
+	require.NoError(t, c.put("key2", frames, time.Minute))
+	_, _, ok = c.get("key1", "A")
+	assert.False(t, ok, "the least recently used entry is evicted")
+	_, _, ok = c.get("key0", "A")
+	assert.True(t, ok)
+	_, _, ok = c.get("key2", "A")
+	assert.True(t, ok)
+	assert.Equal(t, 2*entrySize, c.size)
+
+	c.maxSize = entrySize - 1
+	require.NoError(t, c.put("key3", frames, time.Minute))
+	assert.NotContains(t, c.entries, "key3", "results larger than the cache are not cached")
+}
+
+func TestResultCacheDropsExecutionMeta(t *testing.T) {
+	c := newResultCache(Settings{EnableResultCache: true})
+	q := backend.DataQuery{RefID: "A", JSON: []byte(`{}`)}
+	rowLimit := data.Notice{Severity: data.NoticeSeverityWarning, Text: "Results have been limited to 10 because the SQL row limit was reached"}
+	execute := func(context.Context) backend.DataResponse {
+		frame := data.NewFrame("", data.NewField("v", nil, []int64{1}))
+		frame.Meta = &data.FrameMeta{ExecutedQueryString: "SELECT 1", Notices: []data.Notice{rowLimit}}
+		res := backend.DataResponse{Frames: data.Frames{frame}}
+		res = withRetryNotice(res, "A", []string{"network error"})
+		res = newQueryLimiter(Settings{MaxConcurrentQueries: 1}).withQueueWait(res, "A", 5*time.Millisecond)
+		return costEstimator{maxRows: 100}.withCostEstimate(res, "A", &queryStats{estimate: &costEstimate{rows: 500}})
+	}
+
+	res := c.run(context.Background(), "key", queryTierDashboard, q, execute)
+	require.Len(t, res.Frames[0].Meta.Notices, 3, "the response of the execution keeps its notices")
+	assert.Contains(t, cacheStats(res), "Queue wait")
+	assert.Contains(t, cacheStats(res), "Estimated rows to read")
+
+	res = c.run(context.Background(), "key", queryTierDashboard, q, execute)
+	meta := res.Frames[0].Meta
+	assert.Equal(t, []data.Notice{rowLimit}, meta.Notices, "notices produced with the data are cached")
+	assert.Equal(t, map[string]float64{"Result cache hit": 1, "Result cache age": cacheStats(res)["Result cache age"]}, cacheStats(res))
+	assert.Equal(t, "SELECT 1", meta.ExecutedQueryString)
+}
+
+func TestResultCacheKey(t *testing.T) {
+	q, query := dedupeQuery(t, "A", "SELECT 1", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Empty(t, newResultCache(Settings{}).key(userContext("alice"), queryTierDashboard, q, query))
+
+	c := newResultCache(Settings{EnableResultCache: true})
+	assert.Equal(t, c.key(userContext("alice"), queryTierDashboard, q, query), c.key(userContext("bob"), queryTierDashboard, q, query))
+	c = newResultCache(Settings{EnableResultCache: true, ForwardGrafanaHeaders: true})
+	assert.NotEqual(t, c.key(userContext("alice"), queryTierDashboard, q, query), c.key(userContext("bob"), queryTierDashboard, q, query))
+}
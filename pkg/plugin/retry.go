@@ -0,0 +1,203 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 200 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+)
+
+// retryableExceptionCodes are ClickHouse exception codes that describe a
+// transient condition on the server or the network path to it, after which
+// the same query is expected to succeed.
+var retryableExceptionCodes = map[int32]bool{
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+}
+
+// readOnlyKeywords are the leading statement keywords that never modify
+// data, so running the statement a second time is harmless.
+var readOnlyKeywords = map[string]bool{
+	"SELECT":   true,
+	"WITH":     true,
+	"SHOW":     true,
+	"DESCRIBE": true,
+	"DESC":     true,
+	"EXPLAIN":  true,
+	"EXISTS":   true,
+}
+
+// retryPolicy retries a query after transient ClickHouse failures using
+// capped exponential backoff with jitter. A zero retryPolicy runs every query
+// exactly once.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// newRetryPolicy builds the retry policy configured on the datasource,
+// filling unset values with their defaults.
+func newRetryPolicy(settings Settings) retryPolicy {
+	if !settings.EnableQueryRetry {
+		return retryPolicy{}
+	}
+	p := retryPolicy{
+		maxAttempts:    defaultRetryMaxAttempts,
+		initialBackoff: defaultRetryInitialBackoff,
+		maxBackoff:     defaultRetryMaxBackoff,
+	}
+	if settings.QueryRetryMaxAttempts > 0 {
+		p.maxAttempts = int(settings.QueryRetryMaxAttempts)
+	}
+	if settings.QueryRetryInitialBackoffMs > 0 {
+		p.initialBackoff = time.Duration(settings.QueryRetryInitialBackoffMs) * time.Millisecond
+	}
+	if settings.QueryRetryMaxBackoffMs > 0 {
+		p.maxBackoff = time.Duration(settings.QueryRetryMaxBackoffMs) * time.Millisecond
+	}
+	if p.maxBackoff < p.initialBackoff {
+		p.maxBackoff = p.initialBackoff
+	}
+	return p
+}
+
+// run executes attempt and repeats it while it fails with a retryable error,
+// the policy has attempts left, and the backoff still fits in the time
+// remaining before the context deadline. Statements that may modify data are
+// never retried. Every retry is recorded as a notice on the returned frames,
+// so a panel that only succeeded on a later attempt says so.
+func (p retryPolicy) run(ctx context.Context, refID, rawSQL string, attempt func(context.Context) backend.DataResponse) backend.DataResponse {
+	res := attempt(ctx)
+	if p.maxAttempts <= 1 || res.Error == nil || !isReadOnlyStatement(rawSQL) {
+		return res
+	}
+
+	var reasons []string
+	for n := 1; n < p.maxAttempts && isRetryableQueryError(res.Error); n++ {
+		wait := p.backoff(n)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+			break
+		}
+
+		reason := retryReason(res.Error)
+		backend.Logger.Warn("Retrying ClickHouse query after transient failure", "refID", refID, "attempt", n+1, "reason", reason, "backoff", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return withRetryNotice(res, refID, reasons)
+		case <-timer.C:
+		}
+
+		reasons = append(reasons, reason)
+		res = attempt(ctx)
+	}
+	return withRetryNotice(res, refID, reasons)
+}
+
+// backoff returns the wait before retry n (starting at 1): the initial
+// backoff doubled for every earlier retry, capped at maxBackoff, with equal
+// jitter so that panels failing together do not retry in lockstep.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.initialBackoff
+	for i := 1; i < n && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxBackoff)
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half+1)
+}
+
+// withRetryNotice adds a notice listing the failures that triggered retries.
+func withRetryNotice(res backend.DataResponse, refID string, reasons []string) backend.DataResponse {
+	if len(reasons) == 0 {
+		return res
+	}
+	outcome, noun := "succeeded", "retries"
+	severity := data.NoticeSeverityInfo
+	if res.Error != nil {
+		outcome = "failed"
+		severity = data.NoticeSeverityWarning
+	}
+	if len(reasons) == 1 {
+		noun = "retry"
+	}
+	res.Frames = appendNotice(res.Frames, refID, data.Notice{
+		Severity: severity,
+		Text:     fmt.Sprintf("Query %s after %d %s (%s)", outcome, len(reasons), noun, strings.Join(reasons, ", ")),
+	})
+	return res
+}
+
+// isRetryableQueryError reports whether err is a transient failure worth
+// retrying: a retryable exception code, an HTTP 502/503/504 from a proxy or
+// load balancer in front of ClickHouse, or an error CategorizeConnectionError
+// classifies as a network failure. Cancellations and deadlines are final.
+func isRetryableQueryError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if code, ok := exceptionCode(err); ok {
+		return retryableExceptionCodes[code]
+	}
+	switch httpStatusCode(err.Error()) {
+	case 502, 503, 504:
+		return true
+	}
+	return CategorizeConnectionError(err) == ConnectionErrorCategoryNetwork
+}
+
+// retryReason is a short label for a retryable error, used in logs and
+// frame notices.
+func retryReason(err error) string {
+	if code, ok := exceptionCode(err); ok {
+		return fmt.Sprintf("exception code %d", code)
+	}
+	if code := httpStatusCode(err.Error()); code != 0 {
+		return fmt.Sprintf("HTTP %d", code)
+	}
+	return string(ConnectionErrorCategoryNetwork)
+}
+
+// isReadOnlyStatement reports whether rawSQL starts with a keyword that only
+// reads data. Leading whitespace, parentheses and comments are skipped. A
+// query that opens with a $__ statement macro is read-only as well, because
+// every statement macro expands to a SELECT.
+func isReadOnlyStatement(rawSQL string) bool {
+	keyword := leadingKeyword(rawSQL)
+	if strings.HasPrefix(keyword, "$__") {
+		return true
+	}
+	return readOnlyKeywords[strings.ToUpper(keyword)]
+}
+
+// leadingKeyword returns the first word of rawSQL, skipping opening
+// parentheses and comments, or "" when rawSQL does not start with a word.
+func leadingKeyword(rawSQL string) string {
+	for _, t := range tokenizeSQL(rawSQL) {
+		if t.isPunct('(') {
+			continue
+		}
+		if t.kind == sqlIdent {
+			return t.text
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryableQueryError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "too many simultaneous queries", err: &clickhouse.Exception{Code: 202}, expected: true},
+		{name: "socket timeout", err: &clickhouse.Exception{Code: 209}, expected: true},
+		{name: "network error exception", err: &clickhouse.Exception{Code: 210}, expected: true},
+		{name: "syntax error", err: &clickhouse.Exception{Code: 62}, expected: false},
+		{name: "wrapped exception", err: fmt.Errorf("error querying the database: %w", &clickhouse.Exception{Code: 202}), expected: true},
+		{name: "HTTP body exception", err: errors.New(`[HTTP 500] response body: "Code: 202. DB::Exception: Too many simultaneous queries. Maximum: 100"`), expected: true},
+		{name: "HTTP body non-retryable exception", err: errors.New(`[HTTP 404] response body: "Code: 60. DB::Exception: Table default.foo does not exist"`), expected: false},
+		{name: "HTTP 502", err: errors.New("[HTTP 502] response body: \"bad gateway\""), expected: true},
+		{name: "HTTP 503", err: errors.New("[HTTP 503] response body: \"unavailable\""), expected: true},
+		{name: "HTTP 504", err: errors.New("[HTTP 504] response body: \"gateway timeout\""), expected: true},
+		{name: "HTTP 500", err: errors.New("[HTTP 500] response body: \"internal\""), expected: false},
+		{name: "dial error", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, expected: true},
+		{name: "connection reset", err: errors.New("read tcp: connection reset by peer"), expected: true},
+		{name: "context canceled", err: context.Canceled, expected: false},
+		{name: "deadline exceeded", err: fmt.Errorf("query: %w", context.DeadlineExceeded), expected: false},
+		{name: "auth failure", err: &clickhouse.Exception{Code: 516}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isRetryableQueryError(tt.err))
+		})
+	}
+}
+
+func TestIsReadOnlyStatement(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{sql: "SELECT 1", expected: true},
+		{sql: "  select * from t", expected: true},
+		{sql: "WITH x AS (SELECT 1) SELECT * FROM x", expected: true},
+		{sql: "(SELECT 1) UNION ALL (SELECT 2)", expected: true},
+		{sql: "-- comment\nSELECT 1", expected: true},
+		{sql: "/* INSERT */ SELECT 1", expected: true},
+		{sql: "SHOW TABLES", expected: true},
+		{sql: "DESCRIBE TABLE t", expected: true},
+		{sql: "EXPLAIN SELECT 1", expected: true},
+		{sql: "$__columns(ts, key, value) FROM t", expected: true},
+		{sql: "INSERT INTO t VALUES (1)", expected: false},
+		{sql: "ALTER TABLE t DELETE WHERE 1", expected: false},
+		{sql: "/* SELECT */ DROP TABLE t", expected: false},
+		{sql: "-- SELECT", expected: false},
+		{sql: "/* SELECT", expected: false},
+		{sql: "`SELECT` FROM t", expected: false},
+		{sql: "", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isReadOnlyStatement(tt.sql))
+		})
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	t.Run("disabled by default", func(t *testing.T) {
+		assert.Equal(t, retryPolicy{}, newRetryPolicy(Settings{}))
+	})
+
+	t.Run("defaults when enabled", func(t *testing.T) {
+		p := newRetryPolicy(Settings{EnableQueryRetry: true})
+		assert.Equal(t, retryPolicy{maxAttempts: 3, initialBackoff: 200 * time.Millisecond, maxBackoff: 5 * time.Second}, p)
+	})
+
+	t.Run("configured values", func(t *testing.T) {
+		p := newRetryPolicy(Settings{EnableQueryRetry: true, QueryRetryMaxAttempts: 5, QueryRetryInitialBackoffMs: 50, QueryRetryMaxBackoffMs: 10})
+		assert.Equal(t, retryPolicy{maxAttempts: 5, initialBackoff: 50 * time.Millisecond, maxBackoff: 50 * time.Millisecond}, p)
+	})
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := retryPolicy{maxAttempts: 10, initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for n, ceiling := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 5: time.Second, 9: time.Second} {
+		for i := 0; i < 20; i++ {
+			d := p.backoff(n)
+			assert.GreaterOrEqual(t, d, ceiling/2, "retry %d", n)
+			assert.LessOrEqual(t, d, ceiling, "retry %d", n)
+		}
+	}
+}
+
+func TestRetryPolicyRun(t *testing.T) {
+	p := retryPolicy{maxAttempts: 3, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+	transient := backend.DataResponse{Error: &clickhouse.Exception{Code: 202}}
+	ok := backend.DataResponse{Frames: data.Frames{data.NewFrame("A")}}
+
+	sequence := func(responses ...backend.DataResponse) (func(context.Context) backend.DataResponse, *int) {
+		calls := 0
+		return func(context.Context) backend.DataResponse {
+			res := responses[min(calls, len(responses)-1)]
+			calls++
+			return res
+		}, &calls
+	}
+
+	t.Run("succeeds after a transient failure and records a notice", func(t *testing.T) {
+		attempt, calls := sequence(transient, ok)
+		res := p.run(context.Background(), "A", "SELECT 1", attempt)
+		require.NoError(t, res.Error)
+		assert.Equal(t, 2, *calls)
+		require.NotNil(t, res.Frames[0].Meta)
+		require.Len(t, res.Frames[0].Meta.Notices, 1)
+		assert.Equal(t, data.NoticeSeverityInfo, res.Frames[0].Meta.Notices[0].Severity)
+		assert.Equal(t, "Query succeeded after 1 retry (exception code 202)", res.Frames[0].Meta.Notices[0].Text)
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		attempt, calls := sequence(transient)
+		res := p.run(context.Background(), "A", "SELECT 1", attempt)
+		require.Error(t, res.Error)
+		assert.Equal(t, 3, *calls)
+		require.Len(t, res.Frames, 1)
+		assert.Equal(t, "A", res.Frames[0].RefID)
+		assert.Equal(t, "Query failed after 2 retries (exception code 202, exception code 202)", res.Frames[0].Meta.Notices[0].Text)
+	})
+
+	t.Run("does not retry non-retryable errors", func(t *testing.T) {
+		attempt, calls := sequence(backend.DataResponse{Error: &clickhouse.Exception{Code: 62}})
+		res := p.run(context.Background(), "A", "SELECT 1", attempt)
+		require.Error(t, res.Error)
+		assert.Equal(t, 1, *calls)
+		assert.Empty(t, res.Frames)
+	})
+
+	t.Run("never retries statements that modify data", func(t *testing.T) {
+		attempt, calls := sequence(transient, ok)
+		res := p.run(context.Background(), "A", "INSERT INTO t SELECT 1", attempt)
+		require.Error(t, res.Error)
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("stops when the backoff does not fit before the deadline", func(t *testing.T) {
+		slow := retryPolicy{maxAttempts: 3, initialBackoff: time.Minute, maxBackoff: time.Minute}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		attempt, calls := sequence(transient, ok)
+		res := slow.run(ctx, "A", "SELECT 1", attempt)
+		require.Error(t, res.Error)
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("zero policy runs once", func(t *testing.T) {
+		attempt, calls := sequence(transient, ok)
+		res := retryPolicy{}.run(context.Background(), "A", "SELECT 1", attempt)
+		require.Error(t, res.Error)
+		assert.Equal(t, 1, *calls)
+	})
+}
@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/clickhouse-datasource/pkg/macros"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+const defaultAutoSampleTargetRows = 10_000_000
+
+type querySampleKeyType struct{}
+
+var querySampleKey = querySampleKeyType{}
+
+// sampleFactorMacro is replaced by the sample factor of the query, 1 when it
+// is not sampled, so that queries can scale counts and sums back.
+const sampleFactorMacro = "$__sampleFactor"
+
+// querySample is the SAMPLE clause added to a query: it reads about one row
+// in factor, out of an estimated rows.
+type querySample struct {
+	factor uint64
+	rows   uint64
+}
+
+// querySampler adds a SAMPLE clause to queries that read a table with a
+// sampling key and are estimated to read more rows than the target, so that
+// they read about the target instead. Only queries reading a single table
+// are sampled: sampling the sides of a join independently would drop most
+// of the matching rows.
+//
+// The sample is decided once per query, over its whole time range, before
+// the query is split into chunks or narrowed to what is new since the last
+// refresh, so that every part of the result is sampled alike.
+type querySampler struct {
+	enabled    bool
+	targetRows uint64
+	// db returns the connection the query will run on.
+	db func(context.Context, *sqlutil.Query) (*sql.DB, error)
+	// limiter gives the lookups deciding the sample a slot, as it does the
+	// executions of the query.
+	limiter *queryLimiter
+}
+
+// newQuerySampler builds the sampling configured on the datasource.
+func newQuerySampler(settings Settings, db func(context.Context, *sqlutil.Query) (*sql.DB, error), limiter *queryLimiter) querySampler {
+	s := querySampler{
+		enabled:    settings.EnableAutoSampling,
+		targetRows: defaultAutoSampleTargetRows,
+		db:         db,
+		limiter:    limiter,
+	}
+	if settings.AutoSampleTargetRows > 0 {
+		s.targetRows = uint64(settings.AutoSampleTargetRows)
+	}
+	return s
+}
+
+// decide decides the sample of q, and arranges for interpolateMacros to
+// apply it to every execution of q run with the returned context. It returns
+// nil when q is not sampled: alert rules are not, since they would evaluate
+// approximations, and neither are queries that cannot be sampled, whose size
+// cannot be estimated, or that read a table the table policy denies, which
+// are rejected when they run.
+func (s querySampler) decide(ctx context.Context, tier queryTier, q backend.DataQuery) (context.Context, *querySample) {
+	if !s.enabled || tier == queryTierAlert {
+		return ctx, nil
+	}
+	query, err := sqlutil.GetQuery(q)
+	if err != nil {
+		return ctx, nil
+	}
+	sql, err := macros.Interpolate(withSampleFactor(query.RawSQL, 1), query)
+	if err != nil || !isEstimable(sql) {
+		return ctx, nil
+	}
+	ref, _, ok := sampleTarget(sql)
+	if !ok || checkQueryTables(ctx, sql) != nil {
+		return ctx, nil
+	}
+	sample, err := s.sample(ctx, tier, query, ref, sql)
+	if err != nil {
+		backend.Logger.FromContext(ctx).Debug("Could not sample query", "error", err)
+		return ctx, nil
+	}
+	if sample.factor <= 1 {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, querySampleKey, sample), &sample
+}
+
+// sampleFactorFromContext returns the sample factor decided for the query
+// run with ctx, 1 when it is not sampled.
+func sampleFactorFromContext(ctx context.Context) uint64 {
+	if sample, ok := ctx.Value(querySampleKey).(querySample); ok {
+		return sample.factor
+	}
+	return 1
+}
+
+// withSampleFactor replaces the sampleFactorMacro references of rawSQL,
+// outside of strings and comments, with factor.
+func withSampleFactor(rawSQL string, factor uint64) string {
+	var b strings.Builder
+	last := 0
+	for _, token := range tokenizeSQL(rawSQL) {
+		if token.kind == sqlIdent && token.text == sampleFactorMacro {
+			b.WriteString(rawSQL[last:token.pos])
+			b.WriteString(strconv.FormatUint(factor, 10))
+			last = token.end
+		}
+	}
+	if last == 0 {
+		return rawSQL
+	}
+	b.WriteString(rawSQL[last:])
+	return b.String()
+}
+
+// sampleQuery is called by interpolateMacros with the interpolated SQL, and
+// returns it with the SAMPLE clause decided for the query, if any. Chunks
+// and incremental deltas of a sampled query read the same table, so the
+// clause goes at the same place in each.
+func sampleQuery(ctx context.Context, sql string) string {
+	sample, ok := ctx.Value(querySampleKey).(querySample)
+	if !ok {
+		return sql
+	}
+	_, at, ok := sampleTarget(sql)
+	if !ok {
+		return sql
+	}
+	return fmt.Sprintf("%s SAMPLE 1/%d%s", sql[:at], sample.factor, sql[at:])
+}
+
+// sample decides the sample of sql, which reads ref: none when ref has no
+// sampling key or sql is estimated to read no more than the target. The
+// lookups run in a slot of the limiter, given back before the query waits
+// for its own.
+func (s querySampler) sample(ctx context.Context, tier queryTier, query *sqlutil.Query, ref tableRef, sql string) (querySample, error) {
+	release, _, err := s.limiter.acquire(ctx, tier)
+	if err != nil {
+		return querySample{}, err
+	}
+	defer release()
+	db, err := s.db(ctx, query)
+	if err != nil {
+		return querySample{}, err
+	}
+	sampled, err := hasSamplingKey(ctx, db, ref)
+	if err != nil || !sampled {
+		return querySample{}, err
+	}
+	estimate, err := explainEstimate(ctx, db, sql)
+	if err != nil {
+		return querySample{}, err
+	}
+	return querySample{factor: sampleFactor(estimate.rows, s.targetRows), rows: estimate.rows}, nil
+}
+
+// hasSamplingKey reports whether the table ref was created with SAMPLE BY.
+func hasSamplingKey(ctx context.Context, db *sql.DB, ref tableRef) (bool, error) {
+	query := "SELECT sampling_key FROM system.tables WHERE database = currentDatabase() AND name = ?"
+	args := []any{ref.table}
+	if ref.database != "" {
+		query = "SELECT sampling_key FROM system.tables WHERE database = ? AND name = ?"
+		args = []any{ref.database, ref.table}
+	}
+	var key string
+	err := db.QueryRowContext(auxiliaryQueryContext(ctx), query, args...).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return key != "", err
+}
+
+// sampleFactor returns n such that reading one row in n of rows reads no
+// more than target rows.
+func sampleFactor(rows, target uint64) uint64 {
+	if target == 0 || rows <= target {
+		return 1
+	}
+	return (rows + target - 1) / target
+}
+
+// sampleTarget returns the table sql reads, and the offset at which a SAMPLE
+// clause for it goes: after the table name, its alias and FINAL. ok is false
+// unless sql is a single statement reading one table, directly rather than
+// through a subquery or table function, and not sampled already.
+func sampleTarget(sql string) (ref tableRef, at int, ok bool) {
+	tokens := tokenizeSQL(sql)
+	var (
+		funcParens []bool
+		found      *tableRef
+	)
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		inFunction := len(funcParens) > 0 && funcParens[len(funcParens)-1]
+		switch {
+		case t.isPunct('('):
+			funcParens = append(funcParens, i > 0 && tokens[i-1].isName())
+		case t.isPunct(')'):
+			if len(funcParens) > 0 {
+				funcParens = funcParens[:len(funcParens)-1]
+			}
+		case t.isPunct(';') && i < len(tokens)-1:
+			return tableRef{}, 0, false
+		case t.is("SAMPLE") || t.is("UNION") || (t.is("JOIN") && !(i > 0 && tokens[i-1].is("ARRAY"))):
+			return tableRef{}, 0, false
+		case t.is("FROM") && !inFunction:
+			if found != nil || i+1 >= len(tokens) || tokens[i+1].isPunct('(') {
+				return tableRef{}, 0, false
+			}
+			parsed, next := parseTableRef(tokens, i+1)
+			if parsed == nil || parsed.function != "" {
+				return tableRef{}, 0, false
+			}
+			if next < len(tokens) && tokens[next].is("FINAL") {
+				next++
+			}
+			found, at = parsed, tokens[next-1].end
+			i = next - 1
+		}
+	}
+	if found == nil {
+		return tableRef{}, 0, false
+	}
+	return *found, at, true
+}
+
+// withSampleNotice tells the user that the result of a sampled query is
+// approximate, and how to scale it back, in the frames of res.
+func withSampleNotice(res backend.DataResponse, refID string, sample *querySample) backend.DataResponse {
+	if sample == nil || res.Error != nil {
+		return res
+	}
+	res.Frames = appendQueryStats(res.Frames, refID, data.QueryStat{
+		FieldConfig: data.FieldConfig{DisplayName: "Sample factor"},
+		Value:       float64(sample.factor),
+	})
+	res.Frames = appendNotice(res.Frames, refID, data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text: fmt.Sprintf("Result is sampled: the query was estimated to read %d rows, so it read about 1 in %d of them (SAMPLE 1/%d). "+
+			"Scale counts and sums by %s, as in count() * %s.", sample.rows, sample.factor, sample.factor, sampleFactorMacro, sampleFactorMacro),
+	})
+	return res
+}
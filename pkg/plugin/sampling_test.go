@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleTarget(t *testing.T) {
+	for sql, want := range map[string]string{
+		"SELECT count() FROM hits WHERE ts > now()":                       "SELECT count() FROM hits SAMPLE 1/7 WHERE ts > now()",
+		"SELECT count() FROM web.hits AS h PREWHERE h.ok":                 "SELECT count() FROM web.hits AS h SAMPLE 1/7 PREWHERE h.ok",
+		"SELECT count() FROM hits h FINAL":                                "SELECT count() FROM hits h FINAL SAMPLE 1/7",
+		"SELECT extract(DAY FROM ts) AS d, count() FROM hits GROUP BY d;": "SELECT extract(DAY FROM ts) AS d, count() FROM hits SAMPLE 1/7 GROUP BY d;",
+		"SELECT arr FROM hits ARRAY JOIN tags AS arr":                     "SELECT arr FROM hits SAMPLE 1/7 ARRAY JOIN tags AS arr",
+		"SELECT count() FROM hits SAMPLE 0.1":                             "",
+		"SELECT count() FROM (SELECT * FROM hits)":                        "",
+		"SELECT count() FROM hits JOIN users ON hits.uid = users.id":      "",
+		"SELECT count() FROM hits WHERE uid IN (SELECT id FROM users)":    "",
+		"SELECT count() FROM a UNION ALL SELECT count() FROM b":           "",
+		"SELECT number FROM numbers(10)":                                  "",
+		"SELECT 1":                                                        "",
+		"SELECT count() FROM hits; SELECT count() FROM users":             "",
+	} {
+		t.Run(sql, func(t *testing.T) {
+			ref, at, ok := sampleTarget(sql)
+			if want == "" {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, want, sql[:at]+" SAMPLE 1/7"+sql[at:])
+			assert.Equal(t, "hits", ref.table)
+		})
+	}
+}
+
+func TestSampleTargetDatabase(t *testing.T) {
+	ref, _, ok := sampleTarget("SELECT count() FROM web.hits")
+	require.True(t, ok)
+	assert.Equal(t, tableRef{database: "web", table: "hits"}, ref)
+}
+
+func TestSampleFactor(t *testing.T) {
+	assert.Equal(t, uint64(1), sampleFactor(100, 1000))
+	assert.Equal(t, uint64(1), sampleFactor(1000, 1000))
+	assert.Equal(t, uint64(2), sampleFactor(1001, 1000))
+	assert.Equal(t, uint64(37), sampleFactor(37_000_000, 1_000_000))
+	assert.Equal(t, uint64(1), sampleFactor(1<<40, 0))
+}
+
+func TestQuerySamplerDecide(t *testing.T) {
+	s := newQuerySampler(Settings{EnableAutoSampling: true}, nil, nil)
+	assert.Equal(t, uint64(defaultAutoSampleTargetRows), s.targetRows)
+	assert.Equal(t, uint64(500), newQuerySampler(Settings{AutoSampleTargetRows: 500}, nil, nil).targetRows)
+
+	calls := 0
+	limiter := newQueryLimiter(Settings{MaxConcurrentQueries: 1})
+	s = querySampler{enabled: true, targetRows: 1, limiter: limiter, db: func(context.Context, *sqlutil.Query) (*sql.DB, error) {
+		calls++
+		assert.Equal(t, 1, limiter.running, "the lookups run in a slot")
+		return nil, errors.New("no connection")
+	}}
+	query := func(sql string) backend.DataQuery {
+		return backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "` + sql + `"}`)}
+	}
+	hits := query("SELECT count() * $__sampleFactor FROM hits WHERE $__timeFilter(ts)")
+
+	ctx, sample := s.decide(context.Background(), queryTierDashboard, hits)
+	assert.Nil(t, sample, "a query that cannot be estimated is not sampled")
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, uint64(1), sampleFactorFromContext(ctx))
+	assert.Zero(t, limiter.running, "the slot is given back before the query runs")
+
+	release, _, err := limiter.acquire(context.Background(), queryTierDashboard)
+	require.NoError(t, err)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	_, sample = s.decide(canceled, queryTierDashboard, hits)
+	assert.Nil(t, sample)
+	assert.Zero(t, calls, "the lookups wait for a slot")
+	release()
+
+	for name, tt := range map[string]struct {
+		sampler querySampler
+		ctx     context.Context
+		tier    queryTier
+		q       backend.DataQuery
+	}{
+		"disabled":       {sampler: querySampler{}, ctx: context.Background(), tier: queryTierDashboard, q: hits},
+		"alert":          {sampler: s, ctx: context.Background(), tier: queryTierAlert, q: hits},
+		"not samplable":  {sampler: s, ctx: context.Background(), tier: queryTierDashboard, q: query("SELECT 1")},
+		"join":           {sampler: s, ctx: context.Background(), tier: queryTierDashboard, q: query("SELECT count() FROM a JOIN b ON a.id = b.id")},
+		"table denied":   {sampler: s, ctx: newTablePolicy(Settings{DeniedTables: []string{"default.hits"}}).attach(context.Background()), tier: queryTierDashboard, q: hits},
+		"unparsable SQL": {sampler: s, ctx: context.Background(), tier: queryTierDashboard, q: backend.DataQuery{JSON: []byte(`{`)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			calls = 0
+			_, sample := tt.sampler.decide(tt.ctx, tt.tier, tt.q)
+			assert.Nil(t, sample)
+			assert.Zero(t, calls, "no lookups are made for queries that are not sampled")
+		})
+	}
+}
+
+func TestSampleQuery(t *testing.T) {
+	const hits = "SELECT count() FROM hits WHERE ts > now()"
+	assert.Equal(t, hits, sampleQuery(context.Background(), hits), "query without sample")
+
+	ctx := context.WithValue(context.Background(), querySampleKey, querySample{factor: 7, rows: 70})
+	assert.Equal(t, uint64(7), sampleFactorFromContext(ctx))
+	assert.Equal(t, "SELECT count() FROM hits SAMPLE 1/7 WHERE ts > now()", sampleQuery(ctx, hits))
+	assert.Equal(t, "SELECT 1", sampleQuery(ctx, "SELECT 1"))
+}
+
+func TestWithSampleFactor(t *testing.T) {
+	assert.Equal(t, "SELECT count() * 7 AS c, sum(v) * 7 FROM t WHERE s = '$__sampleFactor' -- $__sampleFactor",
+		withSampleFactor("SELECT count() * $__sampleFactor AS c, sum(v) * $__sampleFactor FROM t WHERE s = '$__sampleFactor' -- $__sampleFactor", 7))
+	assert.Equal(t, "SELECT 1", withSampleFactor("SELECT 1", 7))
+}
+
+func TestWithSampleNotice(t *testing.T) {
+	res := withSampleNotice(backend.DataResponse{}, "A", nil)
+	assert.Empty(t, res.Frames)
+
+	res = withSampleNotice(backend.DataResponse{}, "A", &querySample{factor: 37, rows: 370_000_000})
+	require.Len(t, res.Frames, 1)
+	meta := res.Frames[0].Meta
+	assert.Equal(t, []data.QueryStat{{FieldConfig: data.FieldConfig{DisplayName: "Sample factor"}, Value: 37}}, meta.Stats)
+	require.Len(t, meta.Notices, 1)
+	assert.Equal(t, data.NoticeSeverityInfo, meta.Notices[0].Severity)
+	assert.Contains(t, meta.Notices[0].Text, "SAMPLE 1/37")
+	assert.Contains(t, meta.Notices[0].Text, "$__sampleFactor")
+
+	res = withSampleNotice(backend.DataResponse{Error: errors.New("boom")}, "A", &querySample{factor: 2})
+	assert.Empty(t, res.Frames)
+}
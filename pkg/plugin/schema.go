@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// schemaQueryType is the query type of schema queries.
+const schemaQueryType = "schema"
+
+// Schema query kinds.
+const (
+	schemaKindDatabases = "databases"
+	schemaKindTables    = "tables"
+	schemaKindColumns   = "columns"
+)
+
+// schemaQuery is the model of a schema query, under the schema key of the
+// query JSON. Database restricts tables and columns to a database, and
+// Table columns to a table; either may be empty to list every one.
+type schemaQuery struct {
+	Kind     string `json:"kind"`
+	Database string `json:"database"`
+	Table    string `json:"table"`
+}
+
+// schemaQueries answers schema queries, which list the databases, tables or
+// columns of the server as typed table frames, for dashboard variables and
+// tools that would otherwise query the system tables by hand. They run as
+// SQL over system.databases, system.tables and system.columns through the
+// rest of the query pipeline, so the table restrictions of the datasource
+// filter them as they do the lookups of the query editor. Their results are
+// kept in the schema cache.
+type schemaQueries struct {
+	cache   *resultCache
+	perUser bool
+}
+
+// newSchemaQueries builds the schema queries configured on the datasource.
+func newSchemaQueries(settings Settings) schemaQueries {
+	ttl := time.Duration(settings.SchemaCacheTTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultResultCacheTTL
+	}
+	return schemaQueries{
+		cache: &resultCache{
+			enabled: settings.EnableSchemaCache,
+			ttl:     ttl,
+			maxSize: defaultResultCacheMaxSize,
+			lru:     list.New(),
+			entries: map[string]*list.Element{},
+		},
+		perUser: isolatesUsers(settings),
+	}
+}
+
+// run answers the schema query q, running the SQL it translates to through
+// execute unless the schema cache has its result.
+func (s schemaQueries) run(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model struct {
+		Schema schemaQuery `json:"schema"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("schema", err)
+	}
+	sql, err := model.Schema.sql()
+	if err != nil {
+		return invalidQuery("schema", err)
+	}
+
+	var user string
+	if u := backend.UserFromContext(ctx); s.perUser && u != nil {
+		user = u.Login
+	}
+	key := hashKey(schemaQueryType, user, sql)
+	if s.cache.enabled {
+		if frames, _, ok := s.cache.get(key, q.RefID); ok {
+			return backend.DataResponse{Frames: frames}
+		}
+	}
+
+	res := execute(ctx, tableQuery(q, sql))
+	if failed(res) {
+		return res
+	}
+	for _, frame := range res.Frames {
+		frame.Name = model.Schema.Kind
+	}
+	if s.cache.enabled {
+		if err := s.cache.put(key, res.Frames, s.cache.ttl); err != nil {
+			backend.Logger.FromContext(ctx).Debug("Could not cache schema", "error", err)
+		}
+	}
+	return res
+}
+
+// tableQuery returns q as a table query running sql, for the query types
+// that translate to SQL and run it through the rest of the query pipeline.
+func tableQuery(q backend.DataQuery, sql string) backend.DataQuery {
+	q.QueryType = ""
+	q.JSON, _ = json.Marshal(map[string]any{"rawSql": sql, "format": 1})
+	return q
+}
+
+// failed reports whether res is the response of a query that failed.
+func failed(res backend.DataResponse) bool {
+	return res.Error != nil || (res.Status != 0 && res.Status != backend.StatusOK)
+}
+
+// invalidQuery returns the response to a query of the given type that is
+// not valid, which is the user's to fix.
+func invalidQuery(queryType string, err error) backend.DataResponse {
+	return backend.DataResponse{Error: backend.DownstreamError(fmt.Errorf("invalid %s query: %w", queryType, err)), Status: backend.StatusBadRequest}
+}
+
+// sql returns the query over the system tables that answers q.
+func (q schemaQuery) sql() (string, error) {
+	var filters []string
+	if q.Database != "" {
+		filters = append(filters, "database = "+quoteSQLString(q.Database))
+	}
+	switch q.Kind {
+	case schemaKindDatabases:
+		return "SELECT name, engine, comment FROM system.databases ORDER BY name", nil
+	case schemaKindTables:
+		return "SELECT database, name, engine, partition_key, sorting_key, primary_key, sampling_key, " +
+			"total_rows, total_bytes, comment FROM system.tables" + whereClause(filters) + " ORDER BY database, name", nil
+	case schemaKindColumns:
+		if q.Table != "" {
+			filters = append(filters, "table = "+quoteSQLString(q.Table))
+		}
+		return "SELECT database, table, name, type, default_kind, default_expression, comment, " +
+			"toBool(is_in_partition_key) AS is_in_partition_key, toBool(is_in_sorting_key) AS is_in_sorting_key, " +
+			"toBool(is_in_primary_key) AS is_in_primary_key, toBool(is_in_sampling_key) AS is_in_sampling_key " +
+			"FROM system.columns" + whereClause(filters) + " ORDER BY database, table, position", nil
+	default:
+		return "", fmt.Errorf("kind must be %s, %s or %s", schemaKindDatabases, schemaKindTables, schemaKindColumns)
+	}
+}
+
+// whereClause returns the WHERE clause requiring every filter, if there are any.
+func whereClause(filters []string) string {
+	if len(filters) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(filters, " AND ")
+}
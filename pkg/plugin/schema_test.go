@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaQuerySQL(t *testing.T) {
+	for name, tt := range map[string]struct {
+		q    schemaQuery
+		want string
+	}{
+		"databases": {
+			q:    schemaQuery{Kind: "databases", Database: "ignored"},
+			want: "SELECT name, engine, comment FROM system.databases ORDER BY name",
+		},
+		"every table": {
+			q: schemaQuery{Kind: "tables"},
+			want: "SELECT database, name, engine, partition_key, sorting_key, primary_key, sampling_key, " +
+				"total_rows, total_bytes, comment FROM system.tables ORDER BY database, name",
+		},
+		"tables of a database": {
+			q: schemaQuery{Kind: "tables", Database: "it's"},
+			want: "SELECT database, name, engine, partition_key, sorting_key, primary_key, sampling_key, " +
+				"total_rows, total_bytes, comment FROM system.tables WHERE database = 'it\\'s' ORDER BY database, name",
+		},
+		"columns of a table": {
+			q: schemaQuery{Kind: "columns", Database: "default", Table: "logs"},
+			want: "SELECT database, table, name, type, default_kind, default_expression, comment, " +
+				"toBool(is_in_partition_key) AS is_in_partition_key, toBool(is_in_sorting_key) AS is_in_sorting_key, " +
+				"toBool(is_in_primary_key) AS is_in_primary_key, toBool(is_in_sampling_key) AS is_in_sampling_key " +
+				"FROM system.columns WHERE database = 'default' AND table = 'logs' ORDER BY database, table, position",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := tt.q.sql()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := schemaQuery{Kind: "views"}.sql()
+	assert.EqualError(t, err, "kind must be databases, tables or columns")
+}
+
+func TestSchemaQueriesRun(t *testing.T) {
+	s := newSchemaQueries(Settings{EnableSchemaCache: true, SchemaCacheTTLSeconds: 60})
+	q := backend.DataQuery{RefID: "A", QueryType: "schema", JSON: []byte(`{"schema": {"kind": "tables", "database": "default"}}`)}
+
+	var executed []backend.DataQuery
+	execute := func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		executed = append(executed, q)
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("name", nil, []string{"logs"}))}}
+	}
+
+	res := s.run(context.Background(), q, execute)
+	require.NoError(t, res.Error)
+	require.Len(t, executed, 1)
+	assert.Contains(t, executedSQL(t, executed[0]), "FROM system.tables WHERE database = 'default'")
+	assert.Equal(t, "tables", res.Frames[0].Name)
+
+	q.RefID = "B"
+	res = s.run(context.Background(), q, execute)
+	require.NoError(t, res.Error)
+	assert.Len(t, executed, 1, "the schema is cached")
+	assert.Equal(t, "B", res.Frames[0].RefID)
+	assert.Equal(t, "tables", res.Frames[0].Name)
+
+	uncached := newSchemaQueries(Settings{})
+	uncached.run(context.Background(), q, execute)
+	uncached.run(context.Background(), q, execute)
+	assert.Len(t, executed, 3)
+}
+
+func TestSchemaQueriesInvalid(t *testing.T) {
+	s := newSchemaQueries(Settings{})
+	for name, model := range map[string]string{
+		"unparsable":   `{`,
+		"unknown kind": `{"schema": {"kind": "views"}}`,
+		"no kind":      `{}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := s.run(context.Background(), backend.DataQuery{RefID: "A", JSON: []byte(model)}, func(context.Context, backend.DataQuery) backend.DataResponse {
+				t.Fatal("invalid schema queries do not run")
+				return backend.DataResponse{}
+			})
+			assert.True(t, backend.IsDownstreamError(res.Error))
+			assert.Equal(t, backend.StatusBadRequest, res.Status)
+		})
+	}
+}
+
+func TestTableQuery(t *testing.T) {
+	q := tableQuery(backend.DataQuery{
+		RefID:         "A",
+		QueryType:     "schema",
+		MaxDataPoints: 100,
+		JSON:          []byte(`{"schema": {"kind": "tables"}}`),
+	}, "SELECT 1")
+	assert.Equal(t, "A", q.RefID)
+	assert.Equal(t, int64(100), q.MaxDataPoints)
+	assert.Empty(t, q.QueryType)
+	assert.JSONEq(t, `{"rawSql": "SELECT 1", "format": 1}`, string(q.JSON))
+	assert.Equal(t, "SELECT 1", executedSQL(t, q))
+}
+
+func TestFailed(t *testing.T) {
+	assert.False(t, failed(backend.DataResponse{}))
+	assert.False(t, failed(backend.DataResponse{Status: backend.StatusOK}))
+	assert.True(t, failed(backend.DataResponse{Error: assert.AnError}))
+	assert.True(t, failed(backend.DataResponse{Status: backend.StatusBadRequest}))
+
+	res := invalidQuery("schema", assert.AnError)
+	assert.True(t, failed(res))
+	assert.True(t, backend.IsDownstreamError(res.Error))
+	assert.ErrorIs(t, res.Error, assert.AnError)
+	assert.EqualError(t, res.Error, "invalid schema query: "+assert.AnError.Error())
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+}
+
+// executedSQL returns the SQL of the table query q.
+func executedSQL(t *testing.T, q backend.DataQuery) string {
+	t.Helper()
+	var model struct {
+		RawSQL string `json:"rawSql"`
+	}
+	require.NoError(t, json.Unmarshal(q.JSON, &model))
+	return model.RawSQL
+}
@@ -0,0 +1,203 @@
+package plugin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// serviceMapQueryType is the query type of service map queries.
+const serviceMapQueryType = "serviceMap"
+
+// serviceMapOptions are the options of a service map query, under the
+// serviceMap key of the query JSON. The database and table default to those
+// of the traces configuration.
+type serviceMapOptions struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+}
+
+// serviceMapQueries answers service map queries, which draw the services of
+// the traces of the time range, and the calls between them, on the node
+// graph panel.
+type serviceMapQueries struct {
+	traces TracesConfig
+}
+
+// newServiceMapQueries builds the service map queries configured on the
+// datasource.
+func newServiceMapQueries(settings Settings) serviceMapQueries {
+	return serviceMapQueries{traces: settings.Traces}
+}
+
+// serviceStats are the requests, errors and 95th percentile latency of a
+// service or of the calls between two services.
+type serviceStats struct {
+	requests, errors float64
+	p95              float64
+}
+
+// serviceCall is the edge from the service source to the service target.
+type serviceCall struct {
+	source, target string
+}
+
+// run answers the service map query q. ClickHouse joins every span to its
+// parent, through execute, to find the spans whose parent is in another
+// service, or that have none: those are the requests a service serves, and
+// the calls from the service of the parent when there is one. Services and
+// calls are aggregated in the one pass of serviceMapSQL. The result is a
+// nodes frame with a row per service and an edges frame with a row per pair
+// of services calling one another, with their request rate, error rate and
+// 95th percentile latency.
+func (m serviceMapQueries) run(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model struct {
+		ServiceMap serviceMapOptions `json:"serviceMap"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("service map", err)
+	}
+	spans, err := m.traces.spanColumns(model.ServiceMap.Database, model.ServiceMap.Table)
+	if err == nil {
+		err = spans.require("traceIdColumn", "spanIdColumn", "parentSpanIdColumn", "serviceNameColumn", "durationColumn",
+			"startTimeColumn", "statusCodeColumn")
+	}
+	if err != nil {
+		return invalidQuery("service map", err)
+	}
+
+	res := execute(ctx, tableQuery(q, serviceMapSQL(spans)))
+	if failed(res) {
+		return res
+	}
+	services := map[string]serviceStats{}
+	edges := map[serviceCall]serviceStats{}
+	if len(res.Frames) > 0 {
+		frame := res.Frames[0]
+		for row := 0; row < frame.Rows(); row++ {
+			source, target := stringAt(frame, "source", row), stringAt(frame, "target", row)
+			if source == "" {
+				services[target] = readServiceStats(frame, row)
+			} else {
+				edges[serviceCall{source, target}] = readServiceStats(frame, row)
+			}
+		}
+	}
+
+	seconds := q.TimeRange.Duration().Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+	frames := serviceMapFrames(services, edges, seconds)
+	for _, frame := range frames {
+		frame.RefID = q.RefID
+	}
+	res.Frames = frames
+	return res
+}
+
+// serviceMapSQL returns the query of the serviceStats of every service and
+// of the calls between services. It joins the spans of the time range to
+// their parent, looking up only those with a parent, in a hash table of the
+// columns the join needs, and keeps the spans whose parent is in another
+// service, or not found. Each span counts as a request served by its
+// service, in a row with an empty source, and as a call from the service
+// of its parent, if there is one, in a row with that source.
+func serviceMapSQL(spans spanColumns) string {
+	return "SELECT arrayJoin(if(parent.service = '', [''], ['', parent.service])) AS source, child.service AS target, " +
+		"count() AS requests, countIf(child.is_error) AS errors, quantile(0.95)(child.duration_ms) AS p95_ms " +
+		"FROM (" + spans.spans() + ") AS child " +
+		"LEFT JOIN (SELECT trace_id, span_id, service FROM (" + spans.spans() + ")) AS parent " +
+		"ON child.trace_id = parent.trace_id AND child.parent_span_id = parent.span_id AND child.parent_span_id != '' " +
+		"WHERE parent.service != child.service GROUP BY source, target"
+}
+
+func readServiceStats(frame *data.Frame, row int) serviceStats {
+	var stats serviceStats
+	for name, dst := range map[string]*float64{"requests": &stats.requests, "errors": &stats.errors, "p95_ms": &stats.p95} {
+		if idx, ok := fieldIndex(frame, name); ok {
+			*dst, _ = frame.Fields[idx].FloatAt(row)
+		}
+	}
+	return stats
+}
+
+// errorRate returns the share of the requests that failed.
+func (s serviceStats) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return s.errors / s.requests
+}
+
+// serviceMapFrames returns the nodes and edges frames of the services and
+// the calls between them, over a time range of seconds. Services only seen
+// calling others have no requests of their own.
+func serviceMapFrames(services map[string]serviceStats, edges map[serviceCall]serviceStats, seconds float64) data.Frames {
+	for call := range edges {
+		for _, service := range []string{call.source, call.target} {
+			if _, ok := services[service]; !ok {
+				services[service] = serviceStats{}
+			}
+		}
+	}
+
+	nodes := data.NewFrame("nodes",
+		data.NewField("id", nil, []string{}),
+		data.NewField("title", nil, []string{}),
+		data.NewField("mainstat", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Requests", Unit: "reqps"}),
+		data.NewField("secondarystat", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "p95 latency", Unit: "ms"}),
+		data.NewField("arc__success", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Success", Color: fixedColor("green")}),
+		data.NewField("arc__errors", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Errors", Color: fixedColor("red")}),
+		data.NewField("detail__requests", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Total requests"}),
+		data.NewField("detail__error_rate", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Error rate", Unit: "percentunit"}),
+	)
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		stats := services[name]
+		success := 0.0
+		if stats.requests > 0 {
+			success = 1 - stats.errorRate()
+		}
+		nodes.AppendRow(name, name, stats.requests/seconds, stats.p95, success, stats.errorRate(), stats.requests, stats.errorRate())
+	}
+
+	edgeFrame := data.NewFrame("edges",
+		data.NewField("id", nil, []string{}),
+		data.NewField("source", nil, []string{}),
+		data.NewField("target", nil, []string{}),
+		data.NewField("mainstat", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Requests", Unit: "reqps"}),
+		data.NewField("secondarystat", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "p95 latency", Unit: "ms"}),
+		data.NewField("detail__requests", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Total requests"}),
+		data.NewField("detail__error_rate", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Error rate", Unit: "percentunit"}),
+	)
+	calls := make([]serviceCall, 0, len(edges))
+	for call := range edges {
+		calls = append(calls, call)
+	}
+	slices.SortFunc(calls, func(a, b serviceCall) int {
+		return cmp.Or(cmp.Compare(a.source, b.source), cmp.Compare(a.target, b.target))
+	})
+	for _, call := range calls {
+		stats := edges[call]
+		edgeFrame.AppendRow(call.source+"->"+call.target, call.source, call.target, stats.requests/seconds, stats.p95, stats.requests, stats.errorRate())
+	}
+
+	for _, frame := range []*data.Frame{nodes, edgeFrame} {
+		frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeNodeGraph}
+	}
+	return data.Frames{nodes, edgeFrame}
+}
+
+// fixedColor returns the field color config of the named color.
+func fixedColor(color string) map[string]any {
+	return map[string]any{"mode": "fixed", "fixedColor": color}
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunServiceMapQuery(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := backend.DataQuery{
+		RefID:     "A",
+		QueryType: "serviceMap",
+		TimeRange: backend.TimeRange{From: from, To: from.Add(100 * time.Second)},
+		JSON:      []byte(`{"serviceMap": {"table": "spans"}}`),
+	}
+	m := newServiceMapQueries(Settings{Traces: TracesConfig{DefaultDatabase: "otel", DefaultTable: "otel_traces", OtelEnabled: true}})
+
+	var sqls []string
+	res := m.run(context.Background(), q, func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		sqls = append(sqls, executedSQL(t, q))
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("A",
+			data.NewField("source", nil, []string{"", "", "frontend", "api"}),
+			data.NewField("target", nil, []string{"frontend", "api", "api", "db"}),
+			data.NewField("requests", nil, []uint64{200, 100, 100, 50}),
+			data.NewField("errors", nil, []uint64{0, 10, 10, 0}),
+			data.NewField("p95_ms", nil, []float64{120, 80, 80, 5}),
+		)}}
+	})
+	require.NoError(t, res.Error)
+	require.Len(t, sqls, 1, "services and calls are aggregated in one query")
+	sql := sqls[0]
+	assert.True(t, strings.HasPrefix(sql, "SELECT arrayJoin(if(parent.service = '', [''], ['', parent.service])) AS source, child.service AS target, "))
+	assert.Contains(t, sql, "FROM (SELECT `TraceId` AS trace_id")
+	assert.Contains(t, sql, "FROM `spans` WHERE $__timeFilter(`Timestamp`)) AS child LEFT JOIN (SELECT trace_id, span_id, service FROM (")
+	assert.Contains(t, sql, "ON child.trace_id = parent.trace_id AND child.parent_span_id = parent.span_id AND child.parent_span_id != '' ")
+	assert.True(t, strings.HasSuffix(sql, "WHERE parent.service != child.service GROUP BY source, target"))
+
+	require.Len(t, res.Frames, 2)
+	nodes, edges := res.Frames[0], res.Frames[1]
+	assert.Equal(t, "nodes", nodes.Name)
+	assert.Equal(t, "A", nodes.RefID)
+	assert.Equal(t, data.VisTypeNodeGraph, string(nodes.Meta.PreferredVisualization))
+	require.Equal(t, 3, nodes.Rows())
+	// Services are sorted, and db, only seen called, has no requests.
+	assert.Equal(t, []any{"api", "api", 1.0, 80.0, 0.9, 0.1, 100.0, 0.1}, roundRow(nodes.RowCopy(0)))
+	assert.Equal(t, []any{"db", "db", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0}, roundRow(nodes.RowCopy(1)))
+	assert.Equal(t, []any{"frontend", "frontend", 2.0, 120.0, 1.0, 0.0, 200.0, 0.0}, roundRow(nodes.RowCopy(2)))
+
+	assert.Equal(t, "edges", edges.Name)
+	require.Equal(t, 2, edges.Rows())
+	assert.Equal(t, []any{"api->db", "api", "db", 0.5, 5.0, 50.0, 0.0}, roundRow(edges.RowCopy(0)))
+	assert.Equal(t, []any{"frontend->api", "frontend", "api", 1.0, 80.0, 100.0, 0.1}, roundRow(edges.RowCopy(1)))
+
+	res = m.run(context.Background(), q, func(context.Context, backend.DataQuery) backend.DataResponse {
+		return backend.DataResponse{Error: errors.New("unknown table"), Status: backend.StatusBadRequest}
+	})
+	assert.EqualError(t, res.Error, "unknown table")
+
+	res = newServiceMapQueries(Settings{}).run(context.Background(), q, nil)
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+}
+
+// roundRow rounds the floats of row, so that rates compare equal.
+func roundRow(row []any) []any {
+	for i, v := range row {
+		if f, ok := v.(float64); ok {
+			row[i] = float64(int64(f*1000+0.5)) / 1000
+		}
+	}
+	return row
+}
@@ -69,12 +69,191 @@ type Settings struct {
 
 	// EnableSchemaCache gates the in-process cache that memoizes
 	// system.tables / system.columns / DISTINCT column-value lookups used
-	// by the query builder. Defaults to true.
+	// by the query builder, and the results of schema queries. Defaults to
+	// true.
 	EnableSchemaCache bool `json:"enableSchemaCache,omitempty"`
 	// SchemaCacheTTLSeconds controls how long schema-introspection results
 	// are considered fresh. Defaults to 60. Set lower if users commonly run
 	// ALTER TABLE and expect the builder to reflect changes immediately.
 	SchemaCacheTTLSeconds int `json:"schemaCacheTTLSeconds,omitempty"`
+
+	// EnableQueryRetry retries read-only queries that fail with a transient
+	// error (network failures, HTTP 502/503/504, or exception codes 202, 209
+	// and 210). Defaults to false.
+	EnableQueryRetry bool `json:"enableQueryRetry,omitempty"`
+	// QueryRetryMaxAttempts is the total number of attempts, including the
+	// first one. Zero uses the default of 3.
+	QueryRetryMaxAttempts int64 `json:"queryRetryMaxAttempts,omitempty"`
+	// QueryRetryInitialBackoffMs is the backoff before the first retry, which
+	// doubles on every further retry. Zero uses the default of 200.
+	QueryRetryInitialBackoffMs int64 `json:"queryRetryInitialBackoffMs,omitempty"`
+	// QueryRetryMaxBackoffMs caps the backoff between two attempts. Zero uses
+	// the default of 5000.
+	QueryRetryMaxBackoffMs int64 `json:"queryRetryMaxBackoffMs,omitempty"`
+
+	// EnableAuditLog emits a structured log line for every query with its
+	// SQL, duration, rows, bytes read and the Grafana user, dashboard, panel
+	// and alert rule it ran for. Defaults to false.
+	EnableAuditLog bool `json:"enableAuditLog,omitempty"`
+	// AuditLogSampleRate is the fraction of queries, between 0 and 1, that
+	// the audit log records. Zero uses the default of 1 (every query). Slow
+	// queries are always recorded.
+	AuditLogSampleRate float64 `json:"auditLogSampleRate,omitempty"`
+	// AuditLogSQLMode controls how SQL appears in audit and slow-query log
+	// lines: "full" (the default), "redacted" with literals replaced by ?,
+	// or "hashed" as a SHA-256 digest of the statement.
+	AuditLogSQLMode string `json:"auditLogSqlMode,omitempty"`
+	// SlowQueryThresholdMs logs every query that runs at least this long at
+	// warning level, whether or not the audit log is enabled. Zero disables
+	// slow-query logging.
+	SlowQueryThresholdMs int64 `json:"slowQueryThresholdMs,omitempty"`
+
+	// DashboardGuardrails, ExploreGuardrails and AlertGuardrails limit the
+	// queries run for dashboards, from Explore and by alert rules. The
+	// dashboard limits also apply to the connection as a whole, so that they
+	// cover schema lookups from the query editor.
+	DashboardGuardrails QueryGuardrails `json:"dashboardGuardrails"`
+	ExploreGuardrails   QueryGuardrails `json:"exploreGuardrails"`
+	AlertGuardrails     QueryGuardrails `json:"alertGuardrails"`
+
+	// EnableCostEstimation runs EXPLAIN ESTIMATE before every dashboard
+	// query, attaches the parts, rows and marks it will read to the response,
+	// and holds them against the thresholds below. Defaults to false.
+	EnableCostEstimation bool `json:"enableCostEstimation,omitempty"`
+	// CostEstimateMaxRows, CostEstimateMaxParts and CostEstimateMaxMarks are
+	// the thresholds for the estimate. Zero leaves a threshold unset.
+	CostEstimateMaxRows  int64 `json:"costEstimateMaxRows,omitempty"`
+	CostEstimateMaxParts int64 `json:"costEstimateMaxParts,omitempty"`
+	CostEstimateMaxMarks int64 `json:"costEstimateMaxMarks,omitempty"`
+	// CostEstimateAction is what happens to a query over a threshold: "warn"
+	// (the default) runs it with a warning, "reject" fails it unexecuted.
+	CostEstimateAction string `json:"costEstimateAction,omitempty"`
+
+	// AllowedTables and DeniedTables restrict the tables queries may read,
+	// independently of ClickHouse grants. Entries are database.table globs,
+	// and an entry without a dot covers a whole database. See tablePolicy for
+	// how the two lists combine.
+	AllowedTables []string `json:"allowedTables,omitempty"`
+	DeniedTables  []string `json:"deniedTables,omitempty"`
+
+	// MaxConcurrentQueries caps the queries of this datasource that run at
+	// once, and MaxConcurrentQueriesPerUser caps those of a single Grafana
+	// user. Queries over a cap wait in a queue, where alert rules go first
+	// and users take turns. Zero leaves a cap unset.
+	MaxConcurrentQueries        int64 `json:"maxConcurrentQueries,omitempty"`
+	MaxConcurrentQueriesPerUser int64 `json:"maxConcurrentQueriesPerUser,omitempty"`
+	// QueryQueueTimeoutMs is how long a query waits in the queue before it
+	// fails. Zero uses the default of 30 seconds.
+	QueryQueueTimeoutMs int64 `json:"queryQueueTimeoutMs,omitempty"`
+
+	// EnableQueryDeduplication lets identical read-only queries that run at
+	// the same time share one execution. With OAuth pass-through or
+	// forwarded Grafana headers, only queries of the same user are shared.
+	// Defaults to false.
+	EnableQueryDeduplication bool `json:"enableQueryDeduplication,omitempty"`
+
+	// EnableResultCache keeps the results of dashboard queries in memory
+	// and serves identical queries from there. Defaults to false.
+	EnableResultCache bool `json:"enableResultCache,omitempty"`
+	// ResultCacheTTLSeconds is how long results stay cached, unless the
+	// query sets cacheTtlSeconds. Zero uses the default of 60 seconds.
+	ResultCacheTTLSeconds int64 `json:"resultCacheTtlSeconds,omitempty"`
+	// ResultCacheMaxSizeMB bounds the memory held by cached results. Zero
+	// uses the default of 64 MB.
+	ResultCacheMaxSizeMB int64 `json:"resultCacheMaxSizeMb,omitempty"`
+	// AlignTimeRangeToInterval rounds the time range of dashboard queries
+	// out to multiples of their interval before macros expand, so that
+	// refreshes within the same interval run the same SQL and hit the result
+	// cache. Explore and alert queries keep their time range. Defaults to
+	// false.
+	AlignTimeRangeToInterval bool `json:"alignTimeRangeToInterval,omitempty"`
+
+	// EnableIncrementalQueries keeps the last result of every dashboard
+	// panel with a time series query, and only queries the time that is
+	// new since on its next refresh. Defaults to false.
+	EnableIncrementalQueries bool `json:"enableIncrementalQueries,omitempty"`
+
+	// EnableChunkedQueries splits queries over long time ranges into
+	// chunks of the range that run as separate queries, and merges their
+	// results. Only queries filtering on the time macros that either do not
+	// aggregate or aggregate by $__timeInterval are split. Defaults to
+	// false.
+	EnableChunkedQueries bool `json:"enableChunkedQueries,omitempty"`
+	// ChunkedQueryMinRangeHours is the shortest time range that is split.
+	// Zero uses the default of 24 hours.
+	ChunkedQueryMinRangeHours int64 `json:"chunkedQueryMinRangeHours,omitempty"`
+	// ChunkedQueryChunks is how many chunks a time range is split into.
+	// Zero uses the default of 4.
+	ChunkedQueryChunks int64 `json:"chunkedQueryChunks,omitempty"`
+	// ChunkedQueryParallelism is how many chunks of a query run at once.
+	// Zero uses the default of 2.
+	ChunkedQueryParallelism int64 `json:"chunkedQueryParallelism,omitempty"`
+
+	// EnableAutoSampling adds a SAMPLE clause to dashboard and Explore
+	// queries reading a single table with a sampling key, when EXPLAIN
+	// ESTIMATE says they read more than AutoSampleTargetRows rows. Defaults
+	// to false.
+	EnableAutoSampling bool `json:"enableAutoSampling,omitempty"`
+	// AutoSampleTargetRows is about how many rows a sampled query reads.
+	// Zero uses the default of 10 million.
+	AutoSampleTargetRows int64 `json:"autoSampleTargetRows,omitempty"`
+
+	// VariableMaxCardinality bounds the options a variable query returns.
+	// Zero uses the default of 10000.
+	VariableMaxCardinality int64 `json:"variableMaxCardinality,omitempty"`
+
+	// Logs is the logs configuration, whose table and columns log pattern
+	// queries default to.
+	Logs LogsConfig `json:"logs,omitempty"`
+
+	// Traces is the traces configuration, whose table and columns service
+	// map and span metrics queries default to.
+	Traces TracesConfig `json:"traces,omitempty"`
+}
+
+// LogsConfig is the logs configuration of the datasource, the defaults of
+// the logs query builder. Columns left empty default to those of the
+// OpenTelemetry exporter when OtelEnabled is set.
+type LogsConfig struct {
+	DefaultDatabase string `json:"defaultDatabase,omitempty"`
+	DefaultTable    string `json:"defaultTable,omitempty"`
+	OtelEnabled     bool   `json:"otelEnabled,omitempty"`
+	TimeColumn      string `json:"timeColumn,omitempty"`
+	MessageColumn   string `json:"messageColumn,omitempty"`
+}
+
+// TracesConfig is the traces configuration of the datasource, the defaults
+// of the traces query builder. Columns left empty default to those of the
+// OpenTelemetry exporter when OtelEnabled is set. DurationUnit is the unit of
+// the duration column: seconds, milliseconds, microseconds or nanoseconds,
+// the default.
+type TracesConfig struct {
+	DefaultDatabase     string `json:"defaultDatabase,omitempty"`
+	DefaultTable        string `json:"defaultTable,omitempty"`
+	OtelEnabled         bool   `json:"otelEnabled,omitempty"`
+	TraceIDColumn       string `json:"traceIdColumn,omitempty"`
+	SpanIDColumn        string `json:"spanIdColumn,omitempty"`
+	ParentSpanIDColumn  string `json:"parentSpanIdColumn,omitempty"`
+	ServiceNameColumn   string `json:"serviceNameColumn,omitempty"`
+	OperationNameColumn string `json:"operationNameColumn,omitempty"`
+	DurationColumn      string `json:"durationColumn,omitempty"`
+	DurationUnit        string `json:"durationUnit,omitempty"`
+	StartTimeColumn     string `json:"startTimeColumn,omitempty"`
+	StatusCodeColumn    string `json:"statusCodeColumn,omitempty"`
+}
+
+// QueryGuardrails are the resource limits ClickHouse enforces on a query.
+// Zero values leave the corresponding limit unset.
+type QueryGuardrails struct {
+	// MaxExecutionTime is the longest a query may run, in seconds.
+	MaxExecutionTime int64 `json:"maxExecutionTime,omitempty"`
+	MaxRowsToRead    int64 `json:"maxRowsToRead,omitempty"`
+	MaxBytesToRead   int64 `json:"maxBytesToRead,omitempty"`
+	MaxResultRows    int64 `json:"maxResultRows,omitempty"`
+	// OverflowMode is what ClickHouse does when a read or result limit is
+	// hit: "throw" (the default) fails the query, "break" returns the
+	// partial result.
+	OverflowMode string `json:"overflowMode,omitempty"`
 }
 
 type CustomSetting struct {
@@ -308,6 +487,59 @@ func LoadSettings(ctx context.Context, config backend.DataSourceInstanceSettings
 		settings.RowCapacityHint = 0
 	}
 
+	loadBoolSetting(jsonData, "enableQueryRetry", &settings.EnableQueryRetry)
+	loadIntSetting(jsonData, "queryRetryMaxAttempts", &settings.QueryRetryMaxAttempts)
+	loadIntSetting(jsonData, "queryRetryInitialBackoffMs", &settings.QueryRetryInitialBackoffMs)
+	loadIntSetting(jsonData, "queryRetryMaxBackoffMs", &settings.QueryRetryMaxBackoffMs)
+
+	loadBoolSetting(jsonData, "enableAuditLog", &settings.EnableAuditLog)
+	loadFloatSetting(jsonData, "auditLogSampleRate", &settings.AuditLogSampleRate)
+	if mode, ok := jsonData["auditLogSqlMode"].(string); ok {
+		settings.AuditLogSQLMode = mode
+	}
+	loadIntSetting(jsonData, "slowQueryThresholdMs", &settings.SlowQueryThresholdMs)
+
+	loadGuardrails(jsonData, "dashboardGuardrails", &settings.DashboardGuardrails)
+	loadGuardrails(jsonData, "exploreGuardrails", &settings.ExploreGuardrails)
+	loadGuardrails(jsonData, "alertGuardrails", &settings.AlertGuardrails)
+
+	loadBoolSetting(jsonData, "enableCostEstimation", &settings.EnableCostEstimation)
+	loadIntSetting(jsonData, "costEstimateMaxRows", &settings.CostEstimateMaxRows)
+	loadIntSetting(jsonData, "costEstimateMaxParts", &settings.CostEstimateMaxParts)
+	loadIntSetting(jsonData, "costEstimateMaxMarks", &settings.CostEstimateMaxMarks)
+	if action, ok := jsonData["costEstimateAction"].(string); ok {
+		settings.CostEstimateAction = action
+	}
+
+	settings.AllowedTables = loadStringListSetting(jsonData, "allowedTables")
+	settings.DeniedTables = loadStringListSetting(jsonData, "deniedTables")
+
+	loadIntSetting(jsonData, "maxConcurrentQueries", &settings.MaxConcurrentQueries)
+	loadIntSetting(jsonData, "maxConcurrentQueriesPerUser", &settings.MaxConcurrentQueriesPerUser)
+	loadIntSetting(jsonData, "queryQueueTimeoutMs", &settings.QueryQueueTimeoutMs)
+
+	loadBoolSetting(jsonData, "enableQueryDeduplication", &settings.EnableQueryDeduplication)
+
+	loadBoolSetting(jsonData, "enableResultCache", &settings.EnableResultCache)
+	loadIntSetting(jsonData, "resultCacheTtlSeconds", &settings.ResultCacheTTLSeconds)
+	loadIntSetting(jsonData, "resultCacheMaxSizeMb", &settings.ResultCacheMaxSizeMB)
+	loadBoolSetting(jsonData, "alignTimeRangeToInterval", &settings.AlignTimeRangeToInterval)
+
+	loadBoolSetting(jsonData, "enableIncrementalQueries", &settings.EnableIncrementalQueries)
+
+	loadBoolSetting(jsonData, "enableChunkedQueries", &settings.EnableChunkedQueries)
+	loadIntSetting(jsonData, "chunkedQueryMinRangeHours", &settings.ChunkedQueryMinRangeHours)
+	loadIntSetting(jsonData, "chunkedQueryChunks", &settings.ChunkedQueryChunks)
+	loadIntSetting(jsonData, "chunkedQueryParallelism", &settings.ChunkedQueryParallelism)
+
+	loadBoolSetting(jsonData, "enableAutoSampling", &settings.EnableAutoSampling)
+	loadIntSetting(jsonData, "autoSampleTargetRows", &settings.AutoSampleTargetRows)
+
+	loadIntSetting(jsonData, "variableMaxCardinality", &settings.VariableMaxCardinality)
+
+	loadLogsConfig(jsonData, "logs", &settings.Logs)
+	loadTracesConfig(jsonData, "traces", &settings.Traces)
+
 	// Set default values
 	if strings.TrimSpace(settings.DialTimeout) == "" {
 		settings.DialTimeout = "10"
@@ -373,6 +605,149 @@ func LoadSettings(ctx context.Context, config backend.DataSourceInstanceSettings
 	return settings, settings.isValid()
 }
 
+// loadBoolSetting reads an optional boolean stored either as a JSON bool or as
+// a string. An unparsable value is logged and dst keeps its current value.
+func loadBoolSetting(jsonData map[string]interface{}, key string, dst *bool) {
+	switch v := jsonData[key].(type) {
+	case bool:
+		*dst = v
+	case string:
+		if parsed, err := strconv.ParseBool(v); err == nil {
+			*dst = parsed
+		} else {
+			backend.Logger.Warn(fmt.Sprintf("Failed to parse %s value, using default", key), "error", err)
+		}
+	}
+}
+
+// loadIntSetting reads an optional integer stored either as a JSON number or
+// as a string. An unparsable value is logged and dst keeps its current value;
+// negative values are clamped to 0, which every caller treats as "default".
+func loadIntSetting(jsonData map[string]interface{}, key string, dst *int64) {
+	switch v := jsonData[key].(type) {
+	case float64:
+		*dst = int64(v)
+	case string:
+		if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
+			*dst = parsed
+		} else {
+			backend.Logger.Warn(fmt.Sprintf("Failed to parse %s value, using default", key), "error", err)
+		}
+	}
+	if *dst < 0 {
+		*dst = 0
+	}
+}
+
+// loadFloatSetting reads an optional number stored either as a JSON number or
+// as a string. An unparsable value is logged and dst keeps its current value;
+// negative values are clamped to 0, which every caller treats as "default".
+func loadFloatSetting(jsonData map[string]interface{}, key string, dst *float64) {
+	switch v := jsonData[key].(type) {
+	case float64:
+		*dst = v
+	case string:
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+			*dst = parsed
+		} else {
+			backend.Logger.Warn(fmt.Sprintf("Failed to parse %s value, using default", key), "error", err)
+		}
+	}
+	if *dst < 0 {
+		*dst = 0
+	}
+}
+
+// loadStringListSetting reads an optional list of strings stored either as a
+// JSON array or as a comma-separated string. Blank entries are dropped.
+func loadStringListSetting(jsonData map[string]interface{}, key string) []string {
+	var raw []string
+	switch v := jsonData[key].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				raw = append(raw, str)
+			}
+		}
+	case string:
+		raw = strings.Split(v, ",")
+	}
+	var list []string
+	for _, item := range raw {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// loadGuardrails reads an optional guardrails object. An unknown overflow
+// mode is logged and ignored.
+func loadGuardrails(jsonData map[string]interface{}, key string, dst *QueryGuardrails) {
+	raw, ok := jsonData[key].(map[string]interface{})
+	if !ok {
+		return
+	}
+	loadIntSetting(raw, "maxExecutionTime", &dst.MaxExecutionTime)
+	loadIntSetting(raw, "maxRowsToRead", &dst.MaxRowsToRead)
+	loadIntSetting(raw, "maxBytesToRead", &dst.MaxBytesToRead)
+	loadIntSetting(raw, "maxResultRows", &dst.MaxResultRows)
+	if mode, ok := raw["overflowMode"].(string); ok {
+		switch mode {
+		case "throw", "break":
+			dst.OverflowMode = mode
+		default:
+			backend.Logger.Warn(fmt.Sprintf("Unknown %s.overflowMode value %q, using throw", key, mode))
+		}
+	}
+}
+
+// loadLogsConfig reads the logs configuration object under key, if present.
+func loadLogsConfig(jsonData map[string]interface{}, key string, dst *LogsConfig) {
+	raw, ok := jsonData[key].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for name, field := range map[string]*string{
+		"defaultDatabase": &dst.DefaultDatabase,
+		"defaultTable":    &dst.DefaultTable,
+		"timeColumn":      &dst.TimeColumn,
+		"messageColumn":   &dst.MessageColumn,
+	} {
+		if v, ok := raw[name].(string); ok {
+			*field = strings.TrimSpace(v)
+		}
+	}
+	loadBoolSetting(raw, "otelEnabled", &dst.OtelEnabled)
+}
+
+// loadTracesConfig reads the traces configuration object under key, if
+// present.
+func loadTracesConfig(jsonData map[string]interface{}, key string, dst *TracesConfig) {
+	raw, ok := jsonData[key].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for name, field := range map[string]*string{
+		"defaultDatabase":     &dst.DefaultDatabase,
+		"defaultTable":        &dst.DefaultTable,
+		"traceIdColumn":       &dst.TraceIDColumn,
+		"spanIdColumn":        &dst.SpanIDColumn,
+		"parentSpanIdColumn":  &dst.ParentSpanIDColumn,
+		"serviceNameColumn":   &dst.ServiceNameColumn,
+		"operationNameColumn": &dst.OperationNameColumn,
+		"durationColumn":      &dst.DurationColumn,
+		"durationUnit":        &dst.DurationUnit,
+		"startTimeColumn":     &dst.StartTimeColumn,
+		"statusCodeColumn":    &dst.StatusCodeColumn,
+	} {
+		if v, ok := raw[name].(string); ok {
+			*field = strings.TrimSpace(v)
+		}
+	}
+	loadBoolSetting(raw, "otelEnabled", &dst.OtelEnabled)
+}
+
 // loadHttpHeaders loads secure and plain text headers from the config
 func loadHttpHeaders(jsonData map[string]interface{}, secureJsonData map[string]string) map[string]string {
 	httpHeaders := make(map[string]string)
@@ -406,6 +406,162 @@ func TestLoadSettings(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("should parse query retry settings", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{"host": "foo", "port": 443, "enableQueryRetry": "true", "queryRetryMaxAttempts": 4,
+				"queryRetryInitialBackoffMs": "100", "queryRetryMaxBackoffMs": -5}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.True(t, got.EnableQueryRetry)
+		assert.Equal(t, int64(4), got.QueryRetryMaxAttempts)
+		assert.Equal(t, int64(100), got.QueryRetryInitialBackoffMs)
+		assert.Equal(t, int64(0), got.QueryRetryMaxBackoffMs)
+	})
+
+	t.Run("should parse audit log settings", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{"host": "foo", "port": 443, "enableAuditLog": true, "auditLogSampleRate": "0.25",
+				"auditLogSqlMode": "hashed", "slowQueryThresholdMs": 1500}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.True(t, got.EnableAuditLog)
+		assert.Equal(t, 0.25, got.AuditLogSampleRate)
+		assert.Equal(t, "hashed", got.AuditLogSQLMode)
+		assert.Equal(t, int64(1500), got.SlowQueryThresholdMs)
+	})
+
+	t.Run("should parse guardrail settings", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{"host": "foo", "port": 443,
+				"dashboardGuardrails": {"maxExecutionTime": 60, "maxRowsToRead": "1000000", "overflowMode": "break"},
+				"alertGuardrails": {"maxBytesToRead": 1e9, "maxResultRows": 100, "overflowMode": "drop"}}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, QueryGuardrails{MaxExecutionTime: 60, MaxRowsToRead: 1000000, OverflowMode: "break"}, got.DashboardGuardrails)
+		assert.Equal(t, QueryGuardrails{}, got.ExploreGuardrails)
+		assert.Equal(t, QueryGuardrails{MaxBytesToRead: 1000000000, MaxResultRows: 100}, got.AlertGuardrails)
+	})
+
+	t.Run("should parse cost estimation settings", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{"host": "foo", "port": 443, "enableCostEstimation": true, "costEstimateMaxRows": "1000000000",
+				"costEstimateMaxParts": 500, "costEstimateAction": "reject"}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.True(t, got.EnableCostEstimation)
+		assert.Equal(t, int64(1000000000), got.CostEstimateMaxRows)
+		assert.Equal(t, int64(500), got.CostEstimateMaxParts)
+		assert.Equal(t, int64(0), got.CostEstimateMaxMarks)
+		assert.Equal(t, "reject", got.CostEstimateAction)
+	})
+
+	t.Run("should parse table restrictions", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData:                []byte(`{"host": "foo", "port": 443, "allowedTables": ["team_x.*", " system.query_log ", ""], "deniedTables": "system.*, secret"}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"team_x.*", "system.query_log"}, got.AllowedTables)
+		assert.Equal(t, []string{"system.*", "secret"}, got.DeniedTables)
+	})
+
+	t.Run("should parse concurrency limits", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData:                []byte(`{"host": "foo", "port": 443, "maxConcurrentQueries": 20, "maxConcurrentQueriesPerUser": "4", "queryQueueTimeoutMs": -1}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(20), got.MaxConcurrentQueries)
+		assert.Equal(t, int64(4), got.MaxConcurrentQueriesPerUser)
+		assert.Equal(t, int64(0), got.QueryQueueTimeoutMs)
+	})
+
+	t.Run("should parse query deduplication", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData:                []byte(`{"host": "foo", "port": 443, "enableQueryDeduplication": true}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.True(t, got.EnableQueryDeduplication)
+	})
+
+	t.Run("should parse result cache", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData:                []byte(`{"host": "foo", "port": 443, "enableResultCache": true, "resultCacheTtlSeconds": 300, "resultCacheMaxSizeMb": "128", "alignTimeRangeToInterval": true}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.True(t, got.EnableResultCache)
+		assert.Equal(t, int64(300), got.ResultCacheTTLSeconds)
+		assert.Equal(t, int64(128), got.ResultCacheMaxSizeMB)
+		assert.True(t, got.AlignTimeRangeToInterval)
+	})
+
+	t.Run("should parse incremental queries", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData:                []byte(`{"host": "foo", "port": 443, "enableIncrementalQueries": "true"}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.True(t, got.EnableIncrementalQueries)
+	})
+
+	t.Run("should parse chunked queries", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData:                []byte(`{"host": "foo", "port": 443, "enableChunkedQueries": true, "chunkedQueryMinRangeHours": 168, "chunkedQueryChunks": "8", "chunkedQueryParallelism": 3}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.True(t, got.EnableChunkedQueries)
+		assert.Equal(t, int64(168), got.ChunkedQueryMinRangeHours)
+		assert.Equal(t, int64(8), got.ChunkedQueryChunks)
+		assert.Equal(t, int64(3), got.ChunkedQueryParallelism)
+	})
+
+	t.Run("should parse auto sampling", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData:                []byte(`{"host": "foo", "port": 443, "enableAutoSampling": "true", "autoSampleTargetRows": 1000000}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.True(t, got.EnableAutoSampling)
+		assert.Equal(t, int64(1000000), got.AutoSampleTargetRows)
+	})
+
+	t.Run("should parse variable max cardinality", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData:                []byte(`{"host": "foo", "port": 443, "variableMaxCardinality": "500"}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(500), got.VariableMaxCardinality)
+	})
+
+	t.Run("should parse the logs configuration", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{"host": "foo", "port": 443, "logs": {"defaultDatabase": "otel", "defaultTable": "otel_logs",
+				"otelEnabled": true, "timeColumn": "Timestamp", "messageColumn": " Body "}}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, LogsConfig{DefaultDatabase: "otel", DefaultTable: "otel_logs", OtelEnabled: true, TimeColumn: "Timestamp", MessageColumn: "Body"}, got.Logs)
+	})
+	t.Run("should parse the traces configuration", func(t *testing.T) {
+		got, err := LoadSettings(context.Background(), backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{"host": "foo", "port": 443, "traces": {"defaultDatabase": "otel", "defaultTable": "otel_traces",
+				"otelEnabled": false, "serviceNameColumn": " service ", "operationNameColumn": "name", "spanIdColumn": "span_id", "parentSpanIdColumn": "parent_id",
+				"durationColumn": "duration", "durationUnit": "milliseconds", "statusCodeColumn": "status"}}`),
+			DecryptedSecureJSONData: map[string]string{},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, TracesConfig{DefaultDatabase: "otel", DefaultTable: "otel_traces", ServiceNameColumn: "service", OperationNameColumn: "name", SpanIDColumn: "span_id",
+			ParentSpanIDColumn: "parent_id", DurationColumn: "duration", DurationUnit: "milliseconds", StatusCodeColumn: "status"}, got.Traces)
+	})
 }
 
 func TestLoadSettingsOAuthPassThru(t *testing.T) {
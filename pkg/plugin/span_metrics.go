@@ -0,0 +1,238 @@
+package plugin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// spanMetricsQueryType is the query type of span metrics queries.
+const spanMetricsQueryType = "spanMetrics"
+
+// maxSpanMetricsPercentiles bounds the duration percentiles of a span
+// metrics query.
+const maxSpanMetricsPercentiles = 10
+
+// maxSpanMetricsSeries bounds the services and operations of a span metrics
+// query that get series, those with the most requests.
+const maxSpanMetricsSeries = 50
+
+// defaultSpanMetricsPercentiles are the duration percentiles of a span
+// metrics query that asks for none.
+var defaultSpanMetricsPercentiles = []float64{0.5, 0.95, 0.99}
+
+// spanMetricsOptions are the options of a span metrics query, under the
+// spanMetrics key of the query JSON. The database and table default to those
+// of the traces configuration. Service and Operation, when set, select the
+// spans of that service and operation. Percentiles are the duration
+// percentiles computed, as fractions, by default 0.5, 0.95 and 0.99.
+type spanMetricsOptions struct {
+	Database    string    `json:"database"`
+	Table       string    `json:"table"`
+	Service     string    `json:"service"`
+	Operation   string    `json:"operation"`
+	Percentiles []float64 `json:"percentiles"`
+}
+
+// spanMetricsQueries answers span metrics queries, which derive the RED
+// metrics of the services of the traces of the time range, their request
+// rate, error rate and duration, from their spans.
+type spanMetricsQueries struct {
+	traces TracesConfig
+}
+
+// newSpanMetricsQueries builds the span metrics queries configured on the
+// datasource.
+func newSpanMetricsQueries(settings Settings) spanMetricsQueries {
+	return spanMetricsQueries{traces: settings.Traces}
+}
+
+// spanSeries is a service and operation of the spans of a span metrics
+// query.
+type spanSeries struct {
+	service, operation string
+}
+
+// run answers the span metrics query q. ClickHouse buckets the spans by
+// interval, service and operation, through execute. The result is a
+// multi-frame time series per service, operation and metric: request_rate in
+// requests per second, error_rate as the share of the requests that failed,
+// and duration in milliseconds, a series per percentile labeled with its
+// quantile. Only the maxSpanMetricsSeries services and operations with the
+// most requests get series, with a notice when others are dropped. Alerts
+// can run on them as on any time series.
+func (m spanMetricsQueries) run(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model struct {
+		SpanMetrics spanMetricsOptions `json:"spanMetrics"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("span metrics", err)
+	}
+	opts := model.SpanMetrics
+	if len(opts.Percentiles) == 0 {
+		opts.Percentiles = defaultSpanMetricsPercentiles
+	}
+	spans, err := m.traces.spanColumns(opts.Database, opts.Table)
+	if err == nil {
+		err = spans.require("serviceNameColumn", "operationNameColumn", "durationColumn", "startTimeColumn", "statusCodeColumn")
+	}
+	if err != nil {
+		return invalidQuery("span metrics", err)
+	}
+	sql, err := opts.sql(spans)
+	if err != nil {
+		return invalidQuery("span metrics", err)
+	}
+
+	res := execute(ctx, tableQuery(q, sql))
+	if failed(res) || len(res.Frames) == 0 {
+		return res
+	}
+	frames, dropped, err := opts.frames(res.Frames[0])
+	if err != nil {
+		return backend.DataResponse{Error: fmt.Errorf("could not read span metrics: %w", err)}
+	}
+	for _, frame := range frames {
+		frame.RefID = q.RefID
+	}
+	if len(frames) > 0 && res.Frames[0].Meta != nil {
+		frames[0].Meta.ExecutedQueryString = res.Frames[0].Meta.ExecutedQueryString
+	}
+	if dropped > 0 {
+		frames = appendNotice(frames, q.RefID, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text: fmt.Sprintf("Showing the %d services and operations with the most requests; %d others were dropped. "+
+				"Set a service or operation to see them.", maxSpanMetricsSeries, dropped),
+		})
+	}
+	res.Frames = frames
+	return res
+}
+
+// sql returns the query computing the metrics of the spans by interval,
+// service and operation, the duration percentiles as duration_0,
+// duration_1 and so on.
+func (o spanMetricsOptions) sql(spans spanColumns) (string, error) {
+	if len(o.Percentiles) > maxSpanMetricsPercentiles {
+		return "", fmt.Errorf("at most %d percentiles are allowed", maxSpanMetricsPercentiles)
+	}
+	duration, err := spans.durationMillis()
+	if err != nil {
+		return "", err
+	}
+	startTime := quoteSQLIdentifier(spans.startTime)
+	columns := []string{
+		"$__timeInterval(" + startTime + ") AS time",
+		quoteSQLIdentifier(spans.serviceName) + " AS service",
+		quoteSQLIdentifier(spans.operationName) + " AS operation",
+		"count() / $__interval_s AS request_rate",
+		"countIf(" + spans.isError() + ") / count() AS error_rate",
+	}
+	for i, p := range o.Percentiles {
+		if p <= 0 || p >= 1 {
+			return "", errors.New("percentiles must be between 0 and 1")
+		}
+		columns = append(columns, fmt.Sprintf("quantile(%s)(%s) AS duration_%d", strconv.FormatFloat(p, 'f', -1, 64), duration, i))
+	}
+	filters := []string{"$__timeFilter(" + startTime + ")"}
+	if o.Service != "" {
+		filters = append(filters, quoteSQLIdentifier(spans.serviceName)+" = "+quoteSQLString(o.Service))
+	}
+	if o.Operation != "" {
+		filters = append(filters, quoteSQLIdentifier(spans.operationName)+" = "+quoteSQLString(o.Operation))
+	}
+	return "SELECT " + strings.Join(columns, ", ") + " FROM " + spans.from() + " WHERE " + strings.Join(filters, " AND ") +
+		" GROUP BY time, service, operation ORDER BY time", nil
+}
+
+// frames returns the time series frames of the result of
+// spanMetricsOptions.sql, by service, operation and metric, for the
+// maxSpanMetricsSeries services and operations with the most requests.
+// dropped counts the others.
+func (o spanMetricsOptions) frames(result *data.Frame) (frames data.Frames, dropped int, err error) {
+	metrics := []string{"request_rate", "error_rate"}
+	for i := range o.Percentiles {
+		metrics = append(metrics, fmt.Sprintf("duration_%d", i))
+	}
+	indexes := map[string]int{}
+	for _, name := range append([]string{"time", "service", "operation"}, metrics...) {
+		idx, ok := fieldIndex(result, name)
+		if !ok {
+			return nil, 0, fmt.Errorf("no %s column", name)
+		}
+		indexes[name] = idx
+	}
+
+	type point struct {
+		time   time.Time
+		values []float64
+	}
+	points := map[spanSeries][]point{}
+	// Every bucket spans the same interval, so the sum of the request
+	// rates of a series ranks it by request count.
+	requests := map[spanSeries]float64{}
+	for row := 0; row < result.Rows(); row++ {
+		t, ok := rowTime(result.Fields[indexes["time"]], row)
+		if !ok {
+			continue
+		}
+		p := point{time: t, values: make([]float64, len(metrics))}
+		for i, metric := range metrics {
+			p.values[i], _ = result.Fields[indexes[metric]].FloatAt(row)
+		}
+		key := spanSeries{valueString(result.Fields[indexes["service"]], row), valueString(result.Fields[indexes["operation"]], row)}
+		points[key] = append(points[key], p)
+		requests[key] += p.values[0]
+	}
+
+	keys := make([]spanSeries, 0, len(points))
+	for key := range points {
+		keys = append(keys, key)
+	}
+	byService := func(a, b spanSeries) int {
+		return cmp.Or(cmp.Compare(a.service, b.service), cmp.Compare(a.operation, b.operation))
+	}
+	if len(keys) > maxSpanMetricsSeries {
+		slices.SortFunc(keys, func(a, b spanSeries) int {
+			return cmp.Or(cmp.Compare(requests[b], requests[a]), byService(a, b))
+		})
+		keys, dropped = keys[:maxSpanMetricsSeries], len(keys)-maxSpanMetricsSeries
+	}
+	slices.SortFunc(keys, byService)
+	for _, key := range keys {
+		for i, metric := range metrics {
+			name, unit := metric, ""
+			labels := data.Labels{"service": key.service, "operation": key.operation}
+			switch {
+			case metric == "request_rate":
+				unit = "reqps"
+			case metric == "error_rate":
+				unit = "percentunit"
+			default:
+				name, unit = "duration", "ms"
+				labels["quantile"] = strconv.FormatFloat(o.Percentiles[i-2], 'f', -1, 64)
+			}
+			times := make([]time.Time, len(points[key]))
+			values := make([]float64, len(points[key]))
+			for j, p := range points[key] {
+				times[j], values[j] = p.time, p.values[i]
+			}
+			frame := data.NewFrame(name,
+				data.NewField("time", nil, times),
+				data.NewField(name, labels, values).SetConfig(&data.FieldConfig{Unit: unit}),
+			)
+			frame.Meta = &data.FrameMeta{Type: data.FrameTypeTimeSeriesMulti, TypeVersion: data.FrameTypeVersion{0, 1}}
+			frames = append(frames, frame)
+		}
+	}
+	return frames, dropped, nil
+}
@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanMetricsSQL(t *testing.T) {
+	spans, err := TracesConfig{DefaultDatabase: "otel", DefaultTable: "otel_traces", OtelEnabled: true}.spanColumns("", "")
+	require.NoError(t, err)
+	sql, err := spanMetricsOptions{Service: "api", Percentiles: []float64{0.5, 0.999}}.sql(spans)
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT $__timeInterval(`Timestamp`) AS time, `ServiceName` AS service, `SpanName` AS operation, "+
+		"count() / $__interval_s AS request_rate, "+
+		"countIf(toString(`StatusCode`) IN ('Error', 'STATUS_CODE_ERROR', '2')) / count() AS error_rate, "+
+		"quantile(0.5)(toFloat64(`Duration`) / 1000000) AS duration_0, quantile(0.999)(toFloat64(`Duration`) / 1000000) AS duration_1 "+
+		"FROM `otel`.`otel_traces` WHERE $__timeFilter(`Timestamp`) AND `ServiceName` = 'api' GROUP BY time, service, operation ORDER BY time", sql)
+
+	sql, err = spanMetricsOptions{Operation: "GET /users", Percentiles: []float64{0.9}}.sql(spans)
+	require.NoError(t, err)
+	assert.Contains(t, sql, "WHERE $__timeFilter(`Timestamp`) AND `SpanName` = 'GET /users' GROUP BY")
+
+	_, err = spanMetricsOptions{Percentiles: []float64{95}}.sql(spans)
+	assert.Error(t, err)
+	_, err = spanMetricsOptions{Percentiles: make([]float64, 11)}.sql(spans)
+	assert.Error(t, err)
+}
+
+func TestRunSpanMetricsQuery(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := data.NewFrame("A",
+		data.NewField("time", nil, []time.Time{t0, t0, t0.Add(time.Minute)}),
+		data.NewField("service", nil, []string{"api", "web", "api"}),
+		data.NewField("operation", nil, []string{"GET", "render", "GET"}),
+		data.NewField("request_rate", nil, []float64{2, 1, 3}),
+		data.NewField("error_rate", nil, []float64{0.5, 0, 0}),
+		data.NewField("duration_0", nil, []float64{120, 40, 80}),
+	)
+	result.Meta = &data.FrameMeta{ExecutedQueryString: "SELECT ..."}
+
+	var got backend.DataQuery
+	m := newSpanMetricsQueries(Settings{Traces: TracesConfig{DefaultTable: "otel_traces", OtelEnabled: true}})
+	res := m.run(context.Background(), backend.DataQuery{
+		RefID:     "A",
+		QueryType: "spanMetrics",
+		JSON:      []byte(`{"spanMetrics": {"percentiles": [0.95]}}`),
+	}, func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+		got = q
+		return backend.DataResponse{Frames: data.Frames{result}}
+	})
+	require.NoError(t, res.Error)
+	assert.Contains(t, executedSQL(t, got), "quantile(0.95)(")
+
+	// A frame per service, operation and metric, services sorted.
+	require.Len(t, res.Frames, 6)
+	for _, frame := range res.Frames {
+		assert.Equal(t, "A", frame.RefID)
+		assert.Equal(t, data.FrameTypeTimeSeriesMulti, frame.Meta.Type)
+	}
+	assert.Equal(t, "SELECT ...", res.Frames[0].Meta.ExecutedQueryString)
+
+	rate := res.Frames[0]
+	assert.Equal(t, "request_rate", rate.Fields[1].Name)
+	assert.Equal(t, data.Labels{"service": "api", "operation": "GET"}, rate.Fields[1].Labels)
+	assert.Equal(t, "reqps", rate.Fields[1].Config.Unit)
+	require.Equal(t, 2, rate.Rows())
+	assert.Equal(t, []any{t0.Add(time.Minute), 3.0}, rate.RowCopy(1))
+
+	errorRate := res.Frames[1]
+	assert.Equal(t, "error_rate", errorRate.Fields[1].Name)
+	assert.Equal(t, []any{t0, 0.5}, errorRate.RowCopy(0))
+
+	duration := res.Frames[2]
+	assert.Equal(t, "duration", duration.Fields[1].Name)
+	assert.Equal(t, data.Labels{"service": "api", "operation": "GET", "quantile": "0.95"}, duration.Fields[1].Labels)
+	assert.Equal(t, "ms", duration.Fields[1].Config.Unit)
+	assert.Equal(t, []any{t0, 120.0}, duration.RowCopy(0))
+
+	assert.Equal(t, data.Labels{"service": "web", "operation": "render"}, res.Frames[3].Fields[1].Labels)
+
+	res = newSpanMetricsQueries(Settings{Traces: TracesConfig{DefaultTable: "spans"}}).run(context.Background(), backend.DataQuery{JSON: []byte(`{}`)}, nil)
+	assert.Equal(t, backend.StatusBadRequest, res.Status)
+	assert.ErrorContains(t, res.Error, "operationNameColumn")
+}
+
+func TestSpanMetricsFramesLimit(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n := maxSpanMetricsSeries + 2
+	times := make([]time.Time, n)
+	operations := make([]string, n)
+	rates := make([]float64, n)
+	for i := range n {
+		times[i] = t0
+		operations[i] = fmt.Sprintf("op%03d", i)
+		rates[i] = float64(i)
+	}
+	result := data.NewFrame("A",
+		data.NewField("time", nil, times),
+		data.NewField("service", nil, make([]string, n)),
+		data.NewField("operation", nil, operations),
+		data.NewField("request_rate", nil, rates),
+		data.NewField("error_rate", nil, make([]float64, n)),
+		data.NewField("duration_0", nil, make([]float64, n)),
+	)
+
+	frames, dropped, err := spanMetricsOptions{Percentiles: []float64{0.5}}.frames(result)
+	require.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+	require.Len(t, frames, 3*maxSpanMetricsSeries)
+	assert.Equal(t, "op002", frames[0].Fields[1].Labels["operation"], "the series with the fewest requests are dropped")
+
+	m := newSpanMetricsQueries(Settings{Traces: TracesConfig{DefaultTable: "otel_traces", OtelEnabled: true}})
+	res := m.run(context.Background(), backend.DataQuery{RefID: "A", JSON: []byte(`{"spanMetrics": {"percentiles": [0.5]}}`)},
+		func(context.Context, backend.DataQuery) backend.DataResponse {
+			return backend.DataResponse{Frames: data.Frames{result}}
+		})
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames[0].Meta.Notices, 1)
+	assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "2 others were dropped")
+}
@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// OpenTelemetry exporter columns of the traces table.
+const (
+	otelTracesTraceIDColumn       = "TraceId"
+	otelTracesSpanIDColumn        = "SpanId"
+	otelTracesParentSpanIDColumn  = "ParentSpanId"
+	otelTracesServiceNameColumn   = "ServiceName"
+	otelTracesOperationNameColumn = "SpanName"
+	otelTracesDurationColumn      = "Duration"
+	otelTracesStartTimeColumn     = "Timestamp"
+	otelTracesStatusCodeColumn    = "StatusCode"
+)
+
+// spanErrorStatuses are the status codes of failed spans, as the OpenTelemetry
+// exporter and the traces query builder write them.
+var spanErrorStatuses = []string{"Error", "STATUS_CODE_ERROR", "2"}
+
+// spanColumns are the columns of a spans table, as the traces configuration
+// names them.
+type spanColumns struct {
+	database      string
+	table         string
+	traceID       string
+	spanID        string
+	parentSpanID  string
+	serviceName   string
+	operationName string
+	duration      string
+	durationUnit  string
+	startTime     string
+	statusCode    string
+}
+
+// spanColumns returns the spans table and columns of the traces
+// configuration. database and table, when set, override its table. Columns
+// left empty default to those of the OpenTelemetry exporter when OtelEnabled
+// is set.
+func (c TracesConfig) spanColumns(database, table string) (spanColumns, error) {
+	if database == "" && table == "" {
+		database, table = c.DefaultDatabase, c.DefaultTable
+	}
+	if table == "" {
+		return spanColumns{}, errors.New("a table is required; set it on the query or in the traces configuration")
+	}
+	s := spanColumns{
+		database:      database,
+		table:         table,
+		traceID:       c.TraceIDColumn,
+		spanID:        c.SpanIDColumn,
+		parentSpanID:  c.ParentSpanIDColumn,
+		serviceName:   c.ServiceNameColumn,
+		operationName: c.OperationNameColumn,
+		duration:      c.DurationColumn,
+		durationUnit:  c.DurationUnit,
+		startTime:     c.StartTimeColumn,
+		statusCode:    c.StatusCodeColumn,
+	}
+	if c.OtelEnabled {
+		for column, otel := range map[*string]string{
+			&s.traceID:       otelTracesTraceIDColumn,
+			&s.spanID:        otelTracesSpanIDColumn,
+			&s.parentSpanID:  otelTracesParentSpanIDColumn,
+			&s.serviceName:   otelTracesServiceNameColumn,
+			&s.operationName: otelTracesOperationNameColumn,
+			&s.duration:      otelTracesDurationColumn,
+			&s.startTime:     otelTracesStartTimeColumn,
+			&s.statusCode:    otelTracesStatusCodeColumn,
+		} {
+			if *column == "" {
+				*column = otel
+			}
+		}
+	}
+	if _, err := s.durationMillis(); err != nil {
+		return spanColumns{}, err
+	}
+	return s, nil
+}
+
+// require returns an error naming the columns of names, as the traces
+// configuration names them, that are not set.
+func (s spanColumns) require(names ...string) error {
+	columns := map[string]string{
+		"traceIdColumn":       s.traceID,
+		"spanIdColumn":        s.spanID,
+		"parentSpanIdColumn":  s.parentSpanID,
+		"serviceNameColumn":   s.serviceName,
+		"operationNameColumn": s.operationName,
+		"durationColumn":      s.duration,
+		"startTimeColumn":     s.startTime,
+		"statusCodeColumn":    s.statusCode,
+	}
+	var missing []string
+	for _, name := range names {
+		if columns[name] == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return fmt.Errorf("the traces configuration has no %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// from returns the spans table, quoted.
+func (s spanColumns) from() string {
+	if s.database == "" {
+		return quoteSQLIdentifier(s.table)
+	}
+	return quoteSQLIdentifier(s.database) + "." + quoteSQLIdentifier(s.table)
+}
+
+// durationMillis returns the expression of the span duration in
+// milliseconds.
+func (s spanColumns) durationMillis() (string, error) {
+	duration := "toFloat64(" + quoteSQLIdentifier(s.duration) + ")"
+	switch s.durationUnit {
+	case "", "nanoseconds":
+		return duration + " / 1000000", nil
+	case "microseconds":
+		return duration + " / 1000", nil
+	case "milliseconds":
+		return duration, nil
+	case "seconds":
+		return duration + " * 1000", nil
+	default:
+		return "", fmt.Errorf("unknown duration unit %q", s.durationUnit)
+	}
+}
+
+// isError returns the expression of whether a span failed.
+func (s spanColumns) isError() string {
+	statuses := make([]string, len(spanErrorStatuses))
+	for i, status := range spanErrorStatuses {
+		statuses[i] = quoteSQLString(status)
+	}
+	return "toString(" + quoteSQLIdentifier(s.statusCode) + ") IN (" + strings.Join(statuses, ", ") + ")"
+}
+
+// spans returns the query selecting the spans started over the time range,
+// as trace_id, span_id, parent_span_id, service, duration_ms and is_error.
+func (s spanColumns) spans() string {
+	duration, _ := s.durationMillis()
+	return fmt.Sprintf("SELECT %s AS trace_id, %s AS span_id, %s AS parent_span_id, %s AS service, %s AS duration_ms, %s AS is_error "+
+		"FROM %s WHERE $__timeFilter(%s)",
+		quoteSQLIdentifier(s.traceID), quoteSQLIdentifier(s.spanID), quoteSQLIdentifier(s.parentSpanID),
+		quoteSQLIdentifier(s.serviceName), duration, s.isError(), s.from(), quoteSQLIdentifier(s.startTime))
+}
@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanColumns(t *testing.T) {
+	otel := TracesConfig{DefaultDatabase: "otel", DefaultTable: "otel_traces", OtelEnabled: true, ServiceNameColumn: "service"}
+	spans, err := otel.spanColumns("", "")
+	require.NoError(t, err)
+	assert.Equal(t, "`otel`.`otel_traces`", spans.from())
+	assert.Equal(t, "SELECT `TraceId` AS trace_id, `SpanId` AS span_id, `ParentSpanId` AS parent_span_id, `service` AS service, "+
+		"toFloat64(`Duration`) / 1000000 AS duration_ms, toString(`StatusCode`) IN ('Error', 'STATUS_CODE_ERROR', '2') AS is_error "+
+		"FROM `otel`.`otel_traces` WHERE $__timeFilter(`Timestamp`)", spans.spans())
+
+	spans, err = otel.spanColumns("", "spans")
+	require.NoError(t, err)
+	assert.Equal(t, "`spans`", spans.from())
+
+	spans, err = TracesConfig{DefaultTable: "spans", ServiceNameColumn: "service"}.spanColumns("", "")
+	require.NoError(t, err)
+	assert.NoError(t, spans.require("serviceNameColumn"))
+	assert.EqualError(t, spans.require("traceIdColumn", "serviceNameColumn", "durationColumn", "operationNameColumn"),
+		"the traces configuration has no durationColumn, operationNameColumn, traceIdColumn")
+	_, err = TracesConfig{OtelEnabled: true}.spanColumns("", "")
+	assert.Error(t, err)
+	_, err = TracesConfig{DefaultTable: "spans", OtelEnabled: true, DurationUnit: "minutes"}.spanColumns("", "")
+	assert.Error(t, err)
+}
+
+func TestSpanDurationMillis(t *testing.T) {
+	tests := []struct {
+		unit, want string
+	}{
+		{"", "toFloat64(`d`) / 1000000"},
+		{"nanoseconds", "toFloat64(`d`) / 1000000"},
+		{"microseconds", "toFloat64(`d`) / 1000"},
+		{"milliseconds", "toFloat64(`d`)"},
+		{"seconds", "toFloat64(`d`) * 1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.unit, func(t *testing.T) {
+			got, err := spanColumns{duration: "d", durationUnit: tt.unit}.durationMillis()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package plugin
+
+import (
+	"errors"
+	"strings"
+)
+
+// sqlTokenKind classifies the tokens produced by tokenizeSQL.
+type sqlTokenKind int
+
+const (
+	// sqlIdent is a keyword or unquoted identifier.
+	sqlIdent sqlTokenKind = iota
+	// sqlQuotedIdent is an identifier in double quotes or backticks; its
+	// text is unquoted.
+	sqlQuotedIdent
+	sqlString
+	sqlNumber
+	// sqlPunct is any other single character, such as ( ) , . or ;.
+	sqlPunct
+)
+
+// sqlToken is a lexical token of a ClickHouse statement. pos and end are the
+// byte offsets of the token in the statement, quotes included.
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	pos  int
+	end  int
+}
+
+// is reports whether t is the keyword kw, which must be upper case.
+func (t sqlToken) is(kw string) bool {
+	return t.kind == sqlIdent && strings.EqualFold(t.text, kw)
+}
+
+// isPunct reports whether t is the punctuation character c.
+func (t sqlToken) isPunct(c byte) bool {
+	return t.kind == sqlPunct && t.text[0] == c
+}
+
+// isName reports whether t can name a database, table or alias.
+func (t sqlToken) isName() bool {
+	return t.kind == sqlQuotedIdent || (t.kind == sqlIdent && !sqlKeywords[strings.ToUpper(t.text)])
+}
+
+// sqlKeywords are the reserved words that never name a table, function or
+// alias in the statements the plugin inspects.
+var sqlKeywords = map[string]bool{
+	"ALL": true, "AND": true, "ANTI": true, "ANY": true, "ARRAY": true, "AS": true, "ASC": true, "ASOF": true,
+	"BETWEEN": true, "BY": true, "CASE": true, "CROSS": true, "DESC": true, "DISTINCT": true, "ELSE": true,
+	"END": true, "EXCEPT": true, "EXISTS": true, "FINAL": true, "FORMAT": true, "FROM": true, "FULL": true,
+	"GLOBAL": true, "GROUP": true, "HAVING": true, "IN": true, "INNER": true, "INTERSECT": true, "INTO": true,
+	"IS": true, "JOIN": true, "LEFT": true, "LIKE": true, "LIMIT": true, "NOT": true, "OFFSET": true, "ON": true,
+	"OR": true, "ORDER": true, "OUTER": true, "PASTE": true, "PREWHERE": true, "QUALIFY": true, "RIGHT": true,
+	"SAMPLE": true, "SELECT": true, "SEMI": true, "SETTINGS": true, "THEN": true, "UNION": true, "USING": true,
+	"WHEN": true, "WHERE": true, "WINDOW": true, "WITH": true,
+}
+
+// tokenizeSQL splits a ClickHouse statement into tokens, dropping whitespace
+// and comments. Quoting follows ClickHouse: backslash escapes and doubled
+// quote characters inside quotes. An unterminated quote runs to the end.
+func tokenizeSQL(sql string) []sqlToken {
+	var tokens []sqlToken
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				return tokens
+			}
+			i += end + 1
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case c == '\'':
+			end := skipQuoted(sql, i)
+			tokens = append(tokens, sqlToken{kind: sqlString, text: unquoteSQL(sql[i:end]), pos: i, end: end})
+			i = end
+		case c == '"' || c == '`':
+			end := skipQuoted(sql, i)
+			tokens = append(tokens, sqlToken{kind: sqlQuotedIdent, text: unquoteSQL(sql[i:end]), pos: i, end: end})
+			i = end
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(sql) && (isIdentByte(sql[end]) || sql[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlNumber, text: sql[i:end], pos: i, end: end})
+			i = end
+		case isIdentByte(c) || c == '$' || c >= 0x80:
+			end := i
+			for end < len(sql) && (isIdentByte(sql[end]) || sql[end] == '$' || sql[end] >= 0x80) {
+				end++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlIdent, text: sql[i:end], pos: i, end: end})
+			i = end
+		default:
+			tokens = append(tokens, sqlToken{kind: sqlPunct, text: sql[i : i+1], pos: i, end: i + 1})
+			i++
+		}
+	}
+	return tokens
+}
+
+// skipQuoted returns the index just past the quoted region opening at pos,
+// honouring backslash escapes and doubled quote characters the way ClickHouse
+// does. An unterminated region runs to the end of s.
+func skipQuoted(s string, pos int) int {
+	quote := s[pos]
+	for i := pos + 1; i < len(s); {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i += 2
+		case s[i] == quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(s)
+}
+
+// isIdentByte reports whether b can appear in an unquoted identifier.
+func isIdentByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// wrapSQL returns the query that outer builds around sql as a subquery. The
+// subquery ends at its last token, so a trailing semicolon or comment does
+// not cut the outer query short, and a SETTINGS clause of sql moves to the
+// end of the outer query, where ClickHouse applies it to the whole. A FORMAT
+// clause is rejected, since the plugin reads results in its own format.
+func wrapSQL(sql string, outer func(subquery string) string) (string, error) {
+	tokens := tokenizeSQL(sql)
+	for len(tokens) > 0 && tokens[len(tokens)-1].isPunct(';') {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) == 0 {
+		return "", errors.New("the query is empty")
+	}
+	end := tokens[len(tokens)-1].end
+	settings := end
+	depth := 0
+	for i, t := range tokens {
+		switch {
+		case t.isPunct('('):
+			depth++
+		case t.isPunct(')'):
+			depth = max(depth-1, 0)
+		case depth > 0:
+		case t.isPunct(';'):
+			return "", errors.New("the query must hold a single statement")
+		case t.is("FORMAT") && i+1 < len(tokens) && (i+2 == len(tokens) || tokens[i+2].is("SETTINGS")):
+			return "", errors.New("the query must not set a FORMAT")
+		case t.is("SETTINGS") && i+2 < len(tokens) && tokens[i+1].kind == sqlIdent && tokens[i+2].isPunct('='):
+			settings = t.pos
+		}
+	}
+	wrapped := outer(strings.TrimSpace(sql[tokens[0].pos:settings]))
+	if settings < end {
+		wrapped += " " + sql[settings:end]
+	}
+	return wrapped, nil
+}
+
+// quoteSQLString quotes s as a ClickHouse string literal.
+func quoteSQLString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// quoteSQLIdentifier quotes s as a ClickHouse identifier.
+func quoteSQLIdentifier(s string) string {
+	return "`" + strings.NewReplacer(`\`, `\\`, "`", "\\`").Replace(s) + "`"
+}
+
+// unquoteSQL strips the quotes around a quoted string or identifier and
+// resolves its escapes.
+func unquoteSQL(quoted string) string {
+	quote := quoted[0]
+	body := quoted[1:]
+	if strings.HasSuffix(body, string(quote)) {
+		body = body[:len(body)-1]
+	}
+	if !strings.ContainsAny(body, "\\"+string(quote)) {
+		return body
+	}
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '\\' && i+1 < len(body):
+			i++
+			b.WriteByte(body[i])
+		case body[i] == quote && i+1 < len(body) && body[i+1] == quote:
+			i++
+			b.WriteByte(quote)
+		default:
+			b.WriteByte(body[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenizeSQL(t *testing.T) {
+	sql := "SELECT `a b`, \"c\"\"d\" -- comment\nFROM db.t /* block */ WHERE s = 'it\\'s' AND n >= 1.5;"
+	var got []string
+	var kinds []sqlTokenKind
+	for _, token := range tokenizeSQL(sql) {
+		got = append(got, token.text)
+		kinds = append(kinds, token.kind)
+	}
+	assert.Equal(t, []string{"SELECT", "a b", ",", `c"d`, "FROM", "db", ".", "t", "WHERE", "s", "=", "it's", "AND", "n", ">", "=", "1.5", ";"}, got)
+	assert.Equal(t, []sqlTokenKind{
+		sqlIdent, sqlQuotedIdent, sqlPunct, sqlQuotedIdent, sqlIdent, sqlIdent, sqlPunct, sqlIdent,
+		sqlIdent, sqlIdent, sqlPunct, sqlString, sqlIdent, sqlIdent, sqlPunct, sqlPunct, sqlNumber, sqlPunct,
+	}, kinds)
+}
+
+func TestTokenizeSQLPositions(t *testing.T) {
+	sql := "SELECT 'x' FROM t"
+	tokens := tokenizeSQL(sql)
+	assert.Len(t, tokens, 4)
+	assert.Equal(t, "'x'", sql[tokens[1].pos:tokens[1].end])
+	assert.Equal(t, "t", sql[tokens[3].pos:tokens[3].end])
+}
+
+func TestTokenizeSQLUnterminated(t *testing.T) {
+	assert.Len(t, tokenizeSQL("SELECT 'abc"), 2)
+	assert.Len(t, tokenizeSQL("SELECT 1 /* open"), 2)
+	assert.Len(t, tokenizeSQL("SELECT 1 -- trailing"), 2)
+}
+
+func TestWrapSQL(t *testing.T) {
+	outer := func(subquery string) string { return "SELECT * FROM (\n" + subquery + "\n) LIMIT 10" }
+	for _, tt := range []struct {
+		name string
+		sql  string
+		want string
+		err  string
+	}{
+		{name: "plain", sql: "SELECT a FROM t", want: "SELECT * FROM (\nSELECT a FROM t\n) LIMIT 10"},
+		{name: "trailing semicolon and comment", sql: "SELECT a FROM t; -- last\n", want: "SELECT * FROM (\nSELECT a FROM t\n) LIMIT 10"},
+		{name: "trailing line comment", sql: "SELECT a FROM t -- no newline", want: "SELECT * FROM (\nSELECT a FROM t\n) LIMIT 10"},
+		{name: "settings hoisted", sql: "SELECT a FROM t SETTINGS max_threads = 1, join_use_nulls = 1;",
+			want: "SELECT * FROM (\nSELECT a FROM t\n) LIMIT 10 SETTINGS max_threads = 1, join_use_nulls = 1"},
+		{name: "settings of a subquery", sql: "SELECT a FROM (SELECT a FROM t SETTINGS max_threads = 1)",
+			want: "SELECT * FROM (\nSELECT a FROM (SELECT a FROM t SETTINGS max_threads = 1)\n) LIMIT 10"},
+		{name: "settings column", sql: "SELECT Settings FROM system.query_log", want: "SELECT * FROM (\nSELECT Settings FROM system.query_log\n) LIMIT 10"},
+		{name: "format column", sql: "SELECT format FROM t", want: "SELECT * FROM (\nSELECT format FROM t\n) LIMIT 10"},
+		{name: "format", sql: "SELECT a FROM t FORMAT JSON", err: "the query must not set a FORMAT"},
+		{name: "format before settings", sql: "SELECT a FROM t FORMAT JSON SETTINGS max_threads = 1", err: "the query must not set a FORMAT"},
+		{name: "several statements", sql: "SELECT 1; SELECT 2", err: "the query must hold a single statement"},
+		{name: "empty", sql: " ; -- nothing", err: "the query is empty"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := wrapSQL(tt.sql, outer)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+type statementSettingsKeyType struct{}
+
+var statementSettingsKey = statementSettingsKeyType{}
+
+// splitStatements splits sql into its ;-separated statements, skipping the
+// semicolons in quotes, comments and parentheses. Statements holding nothing
+// but comments are dropped, so a trailing ; does not make a statement.
+func splitStatements(sql string) []string {
+	var (
+		statements []string
+		depth      int
+		start      = -1
+	)
+	for _, t := range tokenizeSQL(sql) {
+		switch {
+		case t.isPunct('('):
+			depth++
+		case t.isPunct(')'):
+			if depth > 0 {
+				depth--
+			}
+		case t.isPunct(';') && depth == 0:
+			if start >= 0 {
+				statements = append(statements, strings.TrimSpace(sql[start:t.pos]))
+			}
+			start = -1
+			continue
+		}
+		if start < 0 {
+			start = t.pos
+		}
+	}
+	if start >= 0 {
+		statements = append(statements, strings.TrimSpace(sql[start:]))
+	}
+	return statements
+}
+
+// runStatements runs a query of several statements, in order, and returns
+// the result of each statement as its own frames, named after the statement
+// position: "statement 2" for the second one.
+//
+// The statements do not share a ClickHouse session: each runs through run,
+// with the rawSql of q replaced by the statement, on whichever pooled
+// connection it gets, and its chunks may run at once. The session is
+// emulated instead. SET statements are not run but apply their settings to
+// the statements after them, as they would in a session, and statements
+// that only make sense in a session, such as CREATE TEMPORARY TABLE or USE,
+// are rejected before any statement runs. The first statement that fails
+// ends the query, with the frames of the statements before it.
+func runStatements(ctx context.Context, q backend.DataQuery, statements []string, run func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model map[string]json.RawMessage
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return backend.DataResponse{Error: backend.DownstreamError(fmt.Errorf("invalid query: %w", err)), Status: backend.StatusBadRequest}
+	}
+
+	sets := make([]clickhouse.Settings, len(statements))
+	for i, statement := range statements {
+		settings, _, err := parseSetStatement(statement)
+		if err == nil {
+			err = checkSessionStatement(statement)
+		}
+		if err != nil {
+			return backend.DataResponse{Error: backend.DownstreamError(fmt.Errorf("statement %d: %w", i+1, err)), Status: backend.StatusBadRequest}
+		}
+		sets[i] = settings
+	}
+
+	var res backend.DataResponse
+	for i, statement := range statements {
+		name := fmt.Sprintf("statement %d", i+1)
+		if settings := sets[i]; settings != nil {
+			ctx = withStatementSettings(ctx, settings)
+			continue
+		}
+
+		model["rawSql"], _ = json.Marshal(statement)
+		statementQuery := q
+		statementQuery.JSON, _ = json.Marshal(model)
+		statementRes := run(ctx, statementQuery)
+		for _, frame := range statementRes.Frames {
+			frame.Name = name
+		}
+		res.Frames = append(res.Frames, statementRes.Frames...)
+		if statementRes.Error != nil {
+			res.Error = fmt.Errorf("%s: %w", name, statementRes.Error)
+			res.Status = statementRes.Status
+			res.ErrorSource = statementRes.ErrorSource
+			return res
+		}
+		if statementRes.Status != 0 && statementRes.Status != backend.StatusOK {
+			res.Status = statementRes.Status
+		}
+	}
+	return res
+}
+
+// parseSetStatement returns the settings of statement when it is a SET
+// statement: SET name = value, with further assignments separated by
+// commas. Values are literals: numbers, strings and words such as true.
+func parseSetStatement(statement string) (clickhouse.Settings, bool, error) {
+	tokens := tokenizeSQL(statement)
+	if len(tokens) == 0 || !tokens[0].is("SET") {
+		return nil, false, nil
+	}
+	settings := clickhouse.Settings{}
+	for i := 1; ; i++ {
+		if i+2 >= len(tokens) || tokens[i].kind != sqlIdent || !tokens[i+1].isPunct('=') {
+			return nil, true, fmt.Errorf("invalid SET statement %q; expected SET name = value", statement)
+		}
+		name, value := tokens[i].text, tokens[i+2]
+		i += 3
+		sign := ""
+		if value.isPunct('-') && i < len(tokens) && tokens[i].kind == sqlNumber {
+			sign, value = "-", tokens[i]
+			i++
+		}
+		if value.kind != sqlNumber && value.kind != sqlString && value.kind != sqlIdent {
+			return nil, true, fmt.Errorf("invalid SET statement %q; the value of %s must be a literal", statement, name)
+		}
+		settings[name] = sign + value.text
+		if i == len(tokens) {
+			return settings, true, nil
+		}
+		if !tokens[i].isPunct(',') {
+			return nil, true, fmt.Errorf("invalid SET statement %q; expected , after the value of %s", statement, name)
+		}
+	}
+}
+
+// checkSessionStatement returns an error when statement needs the state of
+// a ClickHouse session, which the statements of a query do not share: a
+// temporary table, or the current database of USE.
+func checkSessionStatement(statement string) error {
+	tokens := tokenizeSQL(statement)
+	if len(tokens) == 0 {
+		return nil
+	}
+	if tokens[0].is("USE") {
+		return errors.New("USE is not supported, since the statements of a query do not share a session; qualify table names with their database instead")
+	}
+	if !tokens[0].is("CREATE") && !tokens[0].is("DROP") {
+		return nil
+	}
+	for _, t := range tokens[1:min(len(tokens), 4)] {
+		if t.is("TEMPORARY") {
+			return fmt.Errorf("%s TEMPORARY TABLE is not supported, since the statements of a query do not share a session; use a subquery or a WITH clause instead", strings.ToUpper(tokens[0].text))
+		}
+	}
+	return nil
+}
+
+// withStatementSettings adds the settings of a SET statement to the queries
+// run with ctx. They are also recorded on ctx for queryResultKey, since the
+// same SQL may have another result under other settings.
+func withStatementSettings(ctx context.Context, settings clickhouse.Settings) context.Context {
+	merged := clickhouse.Settings{}
+	maps.Copy(merged, statementSettingsFromContext(ctx))
+	maps.Copy(merged, settings)
+	ctx = context.WithValue(ctx, statementSettingsKey, merged)
+	return withQuerySettings(ctx, settings)
+}
+
+// statementSettingsFromContext returns the settings added by
+// withStatementSettings, or nil.
+func statementSettingsFromContext(ctx context.Context) clickhouse.Settings {
+	settings, _ := ctx.Value(statementSettingsKey).(clickhouse.Settings)
+	return settings
+}
+
+// querySQLStatements returns the statements of the SQL of q.
+func querySQLStatements(q backend.DataQuery) []string {
+	var model struct {
+		RawSQL string `json:"rawSql"`
+	}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return nil
+	}
+	return splitStatements(model.RawSQL)
+}
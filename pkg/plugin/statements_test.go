@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitStatements(t *testing.T) {
+	for sql, want := range map[string][]string{
+		"SELECT 1":                               {"SELECT 1"},
+		"SELECT 1;\n":                            {"SELECT 1"},
+		"SET a = 1; SELECT 1;SELECT 2":           {"SET a = 1", "SELECT 1", "SELECT 2"},
+		"SELECT ';' AS s; SELECT 2 -- ; comment": {"SELECT ';' AS s", "SELECT 2 -- ; comment"},
+		"SELECT 1; /* SELECT 2; */":              {"SELECT 1"},
+		"SELECT f(';', `a;b`); ;; SELECT 2":      {"SELECT f(';', `a;b`)", "SELECT 2"},
+		"":                                       nil,
+	} {
+		t.Run(sql, func(t *testing.T) {
+			assert.Equal(t, want, splitStatements(sql))
+		})
+	}
+}
+
+func TestParseSetStatement(t *testing.T) {
+	settings, ok, err := parseSetStatement("set max_threads = 4, join_algorithm = 'hash', use_query_cache = true, offset = -2")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, clickhouse.Settings{"max_threads": "4", "join_algorithm": "hash", "use_query_cache": "true", "offset": "-2"}, settings)
+
+	_, ok, err = parseSetStatement("SELECT 1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	for _, statement := range []string{"SET", "SET a", "SET a = ", "SET a = 1 b = 2", "SET a = (1)", "SET a = 1,"} {
+		_, ok, err := parseSetStatement(statement)
+		assert.True(t, ok, statement)
+		assert.Error(t, err, statement)
+	}
+}
+
+func TestRunStatements(t *testing.T) {
+	q := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "ignored", "format": 1}`)}
+	statements := []string{"SET max_threads = 1", "SELECT 1", "SET max_threads = 2", "SELECT 2"}
+
+	var (
+		sqls     []string
+		settings []clickhouse.Settings
+	)
+	run := func(ctx context.Context, q backend.DataQuery) backend.DataResponse {
+		var model struct {
+			RawSQL string `json:"rawSql"`
+			Format int    `json:"format"`
+		}
+		require.NoError(t, json.Unmarshal(q.JSON, &model))
+		assert.Equal(t, 1, model.Format)
+		sqls = append(sqls, model.RawSQL)
+		settings = append(settings, statementSettingsFromContext(ctx))
+		if model.RawSQL == "SELECT 3" {
+			return backend.DataResponse{Error: backend.DownstreamError(assert.AnError), Status: backend.StatusBadRequest}
+		}
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("A", data.NewField("v", nil, []int64{1}))}}
+	}
+
+	res := runStatements(context.Background(), q, statements, run)
+	require.NoError(t, res.Error)
+	assert.Equal(t, []string{"SELECT 1", "SELECT 2"}, sqls)
+	assert.Equal(t, []clickhouse.Settings{{"max_threads": "1"}, {"max_threads": "2"}}, settings)
+	require.Len(t, res.Frames, 2)
+	assert.Equal(t, "statement 2", res.Frames[0].Name)
+	assert.Equal(t, "statement 4", res.Frames[1].Name)
+
+	t.Run("first error ends the query", func(t *testing.T) {
+		sqls = nil
+		res := runStatements(context.Background(), q, []string{"SELECT 1", "SELECT 3", "SELECT 4"}, run)
+		assert.ErrorIs(t, res.Error, assert.AnError)
+		assert.ErrorContains(t, res.Error, "statement 2: ")
+		assert.True(t, backend.IsDownstreamError(res.Error))
+		assert.Equal(t, backend.StatusBadRequest, res.Status)
+		assert.Equal(t, []string{"SELECT 1", "SELECT 3"}, sqls)
+		assert.Len(t, res.Frames, 1)
+	})
+
+	t.Run("invalid SET", func(t *testing.T) {
+		sqls = nil
+		res := runStatements(context.Background(), q, []string{"SELECT 1", "SET a = now()"}, run)
+		assert.ErrorContains(t, res.Error, "statement 2: invalid SET statement")
+		assert.Empty(t, sqls, "no statement runs")
+	})
+
+	t.Run("session statements", func(t *testing.T) {
+		for _, statement := range []string{
+			"CREATE TEMPORARY TABLE t (v UInt8)",
+			"create or replace temporary table t AS SELECT 1",
+			"DROP TEMPORARY TABLE IF EXISTS t",
+			"USE other",
+		} {
+			sqls = nil
+			res := runStatements(context.Background(), q, []string{"SELECT 1", statement, "SELECT * FROM t"}, run)
+			assert.ErrorContains(t, res.Error, "statement 2: ", statement)
+			assert.ErrorContains(t, res.Error, "do not share a session", statement)
+			assert.Equal(t, backend.StatusBadRequest, res.Status)
+			assert.Empty(t, sqls, "no statement runs")
+		}
+		assert.NoError(t, checkSessionStatement("CREATE TABLE t (v UInt8) ENGINE = Memory"))
+		assert.NoError(t, checkSessionStatement("SELECT 'CREATE TEMPORARY TABLE'"))
+	})
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v5"
+)
+
+// statusServiceUnavailable has no named backend.Status constant.
+const statusServiceUnavailable = backend.Status(http.StatusServiceUnavailable)
+
+// statusClientClosedRequest is reported for a query whose caller went away,
+// such as a dashboard closed or refreshed, which is neither the fault of the
+// query nor of ClickHouse. 499 is the de facto status for it.
+const statusClientClosedRequest = backend.Status(499)
+
+// exceptionStatuses maps ClickHouse exception codes to the status reported
+// for the query, so that alerting and SLO tooling can tell a rejected query
+// from a ClickHouse outage. Codes not listed here are reported as
+// backend.StatusBadGateway: ClickHouse failed the query for a reason the
+// plugin does not recognize.
+var exceptionStatuses = map[int32]backend.Status{
+	// Quotas and concurrency limits.
+	201: backend.StatusTooManyRequests, // QUOTA_EXCEEDED
+	202: backend.StatusTooManyRequests, // TOO_MANY_SIMULTANEOUS_QUERIES
+	203: backend.StatusTooManyRequests, // NO_FREE_CONNECTION
+
+	// Timeouts.
+	159: backend.StatusTimeout, // TIMEOUT_EXCEEDED
+	160: backend.StatusTimeout, // TOO_SLOW
+	209: backend.StatusTimeout, // SOCKET_TIMEOUT
+
+	// Authentication and authorization.
+	192: backend.StatusUnauthorized, // UNKNOWN_USER
+	193: backend.StatusUnauthorized, // WRONG_PASSWORD
+	194: backend.StatusUnauthorized, // REQUIRED_PASSWORD
+	516: backend.StatusUnauthorized, // AUTHENTICATION_FAILED
+	164: backend.StatusForbidden,    // READONLY
+	291: backend.StatusForbidden,    // DATABASE_ACCESS_DENIED
+	497: backend.StatusForbidden,    // NOT_ENOUGH_PRIVILEGES
+
+	// Invalid queries.
+	6:   backend.StatusBadRequest, // CANNOT_PARSE_TEXT
+	16:  backend.StatusBadRequest, // NO_SUCH_COLUMN_IN_TABLE
+	36:  backend.StatusBadRequest, // BAD_ARGUMENTS
+	42:  backend.StatusBadRequest, // NUMBER_OF_ARGUMENTS_DOESNT_MATCH
+	43:  backend.StatusBadRequest, // ILLEGAL_TYPE_OF_ARGUMENT
+	46:  backend.StatusBadRequest, // UNKNOWN_FUNCTION
+	47:  backend.StatusBadRequest, // UNKNOWN_IDENTIFIER
+	53:  backend.StatusBadRequest, // TYPE_MISMATCH
+	60:  backend.StatusBadRequest, // UNKNOWN_TABLE
+	62:  backend.StatusBadRequest, // SYNTAX_ERROR
+	81:  backend.StatusBadRequest, // UNKNOWN_DATABASE
+	115: backend.StatusBadRequest, // UNKNOWN_SETTING
+	184: backend.StatusBadRequest, // ILLEGAL_AGGREGATION
+	215: backend.StatusBadRequest, // NOT_AN_AGGREGATE
+	352: backend.StatusBadRequest, // AMBIGUOUS_COLUMN_NAME
+
+	// Query complexity limits, such as the datasource guardrails.
+	158: backend.StatusBadRequest, // TOO_MANY_ROWS
+	307: backend.StatusBadRequest, // TOO_MANY_BYTES
+	396: backend.StatusBadRequest, // TOO_MANY_ROWS_OR_BYTES
+
+	// Cluster unavailability.
+	210: statusServiceUnavailable, // NETWORK_ERROR
+	225: statusServiceUnavailable, // NO_ZOOKEEPER
+	242: statusServiceUnavailable, // TABLE_IS_READ_ONLY
+	279: statusServiceUnavailable, // ALL_CONNECTION_TRIES_FAILED
+	999: statusServiceUnavailable, // KEEPER_EXCEPTION
+}
+
+// httpStatuses maps the status of a failed ClickHouse HTTP response, for
+// bodies that carry no exception code, to the status reported for the query.
+var httpStatuses = map[int]backend.Status{
+	http.StatusBadRequest:         backend.StatusBadRequest,
+	http.StatusUnauthorized:       backend.StatusUnauthorized,
+	http.StatusForbidden:          backend.StatusForbidden,
+	http.StatusNotFound:           backend.StatusNotFound,
+	http.StatusRequestTimeout:     backend.StatusTimeout,
+	http.StatusTooManyRequests:    backend.StatusTooManyRequests,
+	http.StatusBadGateway:         backend.StatusBadGateway,
+	http.StatusServiceUnavailable: statusServiceUnavailable,
+	http.StatusGatewayTimeout:     backend.StatusTimeout,
+}
+
+// categoryStatuses is the fallback for errors carrying neither an exception
+// code nor an HTTP status.
+var categoryStatuses = map[ConnectionErrorCategory]backend.Status{
+	ConnectionErrorCategoryAuth:    backend.StatusUnauthorized,
+	ConnectionErrorCategoryNetwork: statusServiceUnavailable,
+	ConnectionErrorCategoryTLS:     backend.StatusBadGateway,
+	ConnectionErrorCategoryTimeout: backend.StatusTimeout,
+	ConnectionErrorCategoryConfig:  backend.StatusBadRequest,
+	ConnectionErrorCategoryServer:  backend.StatusBadGateway,
+}
+
+// queryErrorStatus returns the status reported for a query that failed with
+// err. Errors the plugin cannot attribute to the query or to ClickHouse are
+// backend.StatusInternal, which makes plugin bugs stand out.
+func queryErrorStatus(err error) backend.Status {
+	if err == nil {
+		return backend.StatusOK
+	}
+	if code, ok := exceptionCode(err); ok {
+		if status, ok := exceptionStatuses[code]; ok {
+			return status
+		}
+		return backend.StatusBadGateway
+	}
+	if status, ok := httpStatuses[httpStatusCode(err.Error())]; ok {
+		return status
+	}
+	if isInvalidQueryError(err) {
+		return backend.StatusBadRequest
+	}
+	// CategorizeConnectionError files cancellations under timeouts.
+	if errors.Is(err, context.Canceled) {
+		return statusClientClosedRequest
+	}
+	if status, ok := categoryStatuses[CategorizeConnectionError(err)]; ok {
+		return status
+	}
+	return backend.StatusInternal
+}
+
+// isInvalidQueryError reports whether err was raised before the query reached
+// ClickHouse because the query itself is malformed: an unparsable query model
+// or a macro that could not be expanded. sqlds reports every interpolation
+// failure under the same prefix, so macro errors the plugin marked as its own
+// fault are excluded.
+func isInvalidQueryError(err error) bool {
+	if errors.Is(err, sqlds.ErrorJSON) ||
+		errors.Is(err, sqlutil.ErrorBadArgumentCount) ||
+		errors.Is(err, sqlds.ErrorParsingMacroBrackets) {
+		return true
+	}
+	return strings.HasPrefix(err.Error(), "Could not apply macros") && !backend.IsPluginError(err)
+}
+
+// withQueryStatus sets the status of res from its error, unless an earlier
+// stage of the pipeline already chose one.
+func withQueryStatus(res backend.DataResponse) backend.DataResponse {
+	if res.Status == 0 {
+		res.Status = queryErrorStatus(res.Error)
+	}
+	return res
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/grafana/sqlds/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryErrorStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected backend.Status
+	}{
+		{name: "success", err: nil, expected: backend.StatusOK},
+		{name: "quota exceeded", err: &clickhouse.Exception{Code: 201}, expected: backend.StatusTooManyRequests},
+		{name: "too many simultaneous queries", err: &clickhouse.Exception{Code: 202}, expected: backend.StatusTooManyRequests},
+		{name: "timeout exceeded", err: &clickhouse.Exception{Code: 159}, expected: backend.StatusTimeout},
+		{name: "authentication failed", err: &clickhouse.Exception{Code: 516}, expected: backend.StatusUnauthorized},
+		{name: "not enough privileges", err: &clickhouse.Exception{Code: 497}, expected: backend.StatusForbidden},
+		{name: "syntax error", err: &clickhouse.Exception{Code: 62}, expected: backend.StatusBadRequest},
+		{name: "unknown identifier", err: &clickhouse.Exception{Code: 47}, expected: backend.StatusBadRequest},
+		{name: "all connection tries failed", err: &clickhouse.Exception{Code: 279}, expected: http.StatusServiceUnavailable},
+		{name: "unrecognized exception", err: &clickhouse.Exception{Code: 241}, expected: backend.StatusBadGateway},
+		{name: "wrapped exception", err: fmt.Errorf("error querying the database: %w", &clickhouse.Exception{Code: 60}), expected: backend.StatusBadRequest},
+		{name: "HTTP body exception", err: errors.New(`[HTTP 404] response body: "Code: 60. DB::Exception: Table default.foo does not exist"`), expected: backend.StatusBadRequest},
+		{name: "HTTP body quota exception", err: errors.New(`[HTTP 500] response body: "Code: 201. DB::Exception: Quota for user exceeded"`), expected: backend.StatusTooManyRequests},
+		{name: "HTTP 401", err: errors.New(`[HTTP 401] response body: "unauthorized"`), expected: backend.StatusUnauthorized},
+		{name: "HTTP 403", err: errors.New(`[HTTP 403] response body: "forbidden"`), expected: backend.StatusForbidden},
+		{name: "HTTP 429", err: errors.New(`[HTTP 429] response body: "slow down"`), expected: backend.StatusTooManyRequests},
+		{name: "HTTP 503", err: errors.New(`[HTTP 503] response body: "unavailable"`), expected: http.StatusServiceUnavailable},
+		{name: "HTTP 504", err: errors.New(`[HTTP 504] response body: "gateway timeout"`), expected: backend.StatusTimeout},
+		{name: "HTTP 500", err: errors.New(`[HTTP 500] response body: "internal"`), expected: backend.StatusBadGateway},
+		{name: "deadline exceeded", err: fmt.Errorf("query: %w", context.DeadlineExceeded), expected: backend.StatusTimeout},
+		{name: "canceled", err: fmt.Errorf("query: %w", context.Canceled), expected: 499},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, expected: http.StatusServiceUnavailable},
+		{name: "invalid query JSON", err: sqlds.ErrorJSON, expected: backend.StatusBadRequest},
+		{name: "macro argument count", err: fmt.Errorf("Could not apply macros: %w", backend.DownstreamError(sqlutil.ErrorBadArgumentCount)), expected: backend.StatusBadRequest},
+		{name: "macro error", err: fmt.Errorf("Could not apply macros: %w", backend.DownstreamError(errors.New("$__timeGroup: interval must be positive"))), expected: backend.StatusBadRequest},
+		{name: "macro plugin bug", err: fmt.Errorf("Could not apply macros: %w", backend.PluginError(errors.New("comment stripping changed the query length"))), expected: backend.StatusInternal},
+		{name: "unknown error", err: errors.New("something went wrong"), expected: backend.StatusInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, queryErrorStatus(tt.err))
+		})
+	}
+}
+
+func TestWithQueryStatus(t *testing.T) {
+	t.Run("derives the status from the error", func(t *testing.T) {
+		res := withQueryStatus(backend.DataResponse{Error: &clickhouse.Exception{Code: 62}})
+		assert.Equal(t, backend.StatusBadRequest, res.Status)
+	})
+
+	t.Run("keeps a status set earlier", func(t *testing.T) {
+		res := withQueryStatus(backend.DataResponse{Error: errors.New("rejected"), Status: backend.StatusTooManyRequests})
+		assert.Equal(t, backend.StatusTooManyRequests, res.Status)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		assert.Equal(t, backend.StatusOK, withQueryStatus(backend.DataResponse{}).Status)
+	})
+}
@@ -0,0 +1,597 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+type tablePolicyKeyType struct{}
+
+var tablePolicyKey = tablePolicyKeyType{}
+
+// safeTableFunctions are the table functions that generate data rather than
+// read it, and so are allowed when the datasource restricts tables. Every
+// other table function can read tables or remote sources the patterns do not
+// see, such as remote() or merge().
+var safeTableFunctions = map[string]bool{
+	"numbers": true, "numbers_mt": true, "zeros": true, "zeros_mt": true,
+	"generateRandom": true, "generate_series": true, "values": true, "null": true,
+}
+
+// schemaTables are the system tables the query editor reads to list
+// databases, tables, columns and functions. Queries may read them whatever
+// the patterns say, and their results are filtered instead.
+var schemaTables = map[string]bool{
+	"databases": true, "tables": true, "columns": true, "functions": true,
+}
+
+// tablePattern is a database.table glob as accepted by path.Match.
+type tablePattern struct {
+	database, table string
+	// specificity is the number of literal characters, which decides
+	// between an allow and a deny pattern matching the same table.
+	specificity int
+}
+
+// parseTablePattern parses a pattern from the settings. A pattern without a
+// dot matches every table of the databases it matches.
+func parseTablePattern(pattern string) tablePattern {
+	database, table, ok := strings.Cut(pattern, ".")
+	if !ok {
+		table = "*"
+	}
+	return tablePattern{
+		database:    database,
+		table:       table,
+		specificity: len(strings.NewReplacer("*", "", "?", "").Replace(database + table)),
+	}
+}
+
+func (p tablePattern) match(database, table string) bool {
+	dbOK, _ := path.Match(p.database, database)
+	tableOK, _ := path.Match(p.table, table)
+	return dbOK && tableOK
+}
+
+// tablePolicy is the allowlist and denylist of tables configured on the
+// datasource. A table matching only allow patterns is allowed, one matching
+// only deny patterns is denied, and when both match the more specific
+// pattern wins, ties going to deny. A table matching neither is allowed
+// unless there is an allowlist.
+type tablePolicy struct {
+	allow, deny     []tablePattern
+	defaultDatabase string
+}
+
+// newTablePolicy builds the table policy configured on the datasource.
+func newTablePolicy(settings Settings) tablePolicy {
+	p := tablePolicy{defaultDatabase: settings.DefaultDatabase}
+	if p.defaultDatabase == "" {
+		p.defaultDatabase = "default"
+	}
+	for _, pattern := range settings.AllowedTables {
+		p.allow = append(p.allow, parseTablePattern(pattern))
+	}
+	for _, pattern := range settings.DeniedTables {
+		p.deny = append(p.deny, parseTablePattern(pattern))
+	}
+	return p
+}
+
+func (p tablePolicy) enabled() bool {
+	return len(p.allow) > 0 || len(p.deny) > 0
+}
+
+// allowed reports whether database.table may be queried.
+func (p tablePolicy) allowed(database, table string) bool {
+	allow, deny := -1, -1
+	for _, pattern := range p.allow {
+		if pattern.match(database, table) {
+			allow = max(allow, pattern.specificity)
+		}
+	}
+	for _, pattern := range p.deny {
+		if pattern.match(database, table) {
+			deny = max(deny, pattern.specificity)
+		}
+	}
+	switch {
+	case allow < 0 && deny < 0:
+		return len(p.allow) == 0
+	default:
+		return allow > deny
+	}
+}
+
+// databaseVisible reports whether some table of database may be queried, in
+// which case the database is listed by the query editor.
+func (p tablePolicy) databaseVisible(database string) bool {
+	for _, pattern := range p.allow {
+		if ok, _ := path.Match(pattern.database, database); ok {
+			return true
+		}
+	}
+	return p.allowed(database, "*")
+}
+
+// attach arranges for interpolateMacros to check the tables read by the
+// query run with ctx.
+func (p tablePolicy) attach(ctx context.Context) context.Context {
+	if !p.enabled() {
+		return ctx
+	}
+	return context.WithValue(ctx, tablePolicyKey, p)
+}
+
+// checkQueryTables is called by interpolateMacros with the interpolated SQL
+// and fails if it reads a table the datasource does not allow.
+func checkQueryTables(ctx context.Context, sql string) error {
+	p, ok := ctx.Value(tablePolicyKey).(tablePolicy)
+	if !ok {
+		return nil
+	}
+	for _, ref := range referencedTables(withIdentifierParameters(ctx, sql)) {
+		if ref.function != "" {
+			if !safeTableFunctions[ref.function] {
+				return &tableDeniedError{function: ref.function}
+			}
+			continue
+		}
+		database := ref.database
+		if database == "" {
+			database = p.defaultDatabase
+		}
+		if database == "system" && schemaTables[ref.table] {
+			continue
+		}
+		if !p.allowed(database, ref.table) {
+			return &tableDeniedError{database: database, table: ref.table}
+		}
+	}
+	return nil
+}
+
+// withIdentifierParameters returns sql with its Identifier query parameters,
+// {name:Identifier}, replaced by the names bound to them with ctx, so that
+// a table named by a parameter is checked like any other. A name with dots
+// is a compound identifier, as database.table.
+func withIdentifierParameters(ctx context.Context, sql string) string {
+	params := queryParametersFromContext(ctx)
+	if len(params) == 0 {
+		return sql
+	}
+	var b strings.Builder
+	last := 0
+	tokens := tokenizeSQL(sql)
+	for i := 0; i+4 < len(tokens); i++ {
+		open, name, colon, typ, end := tokens[i], tokens[i+1], tokens[i+2], tokens[i+3], tokens[i+4]
+		if !open.isPunct('{') || name.kind != sqlIdent || !colon.isPunct(':') || !typ.is("Identifier") || !end.isPunct('}') {
+			continue
+		}
+		value, ok := params[name.text]
+		if !ok {
+			continue
+		}
+		parts := strings.Split(value, ".")
+		for j, part := range parts {
+			parts[j] = quoteSQLIdentifier(part)
+		}
+		b.WriteString(sql[last:open.pos])
+		b.WriteString(strings.Join(parts, "."))
+		last = end.end
+		i += 4
+	}
+	if last == 0 {
+		return sql
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
+
+// tableRef is a table, or table function, a statement reads.
+type tableRef struct {
+	database, table string
+	function        string
+}
+
+// referencedTables returns the tables sql reads: those after FROM and JOIN,
+// those on the right side of IN, as in x GLOBAL IN db.t, those named by
+// DESCRIBE, EXISTS and SHOW CREATE or SHOW COLUMNS, and the dictionaries and
+// Join tables of lookup functions such as dictGet() and joinGet(). Names of
+// common table expressions are not tables, and FROM inside a function call,
+// as in EXTRACT(DAY FROM ts), does not introduce one. A lookup whose first argument is not a string literal is returned
+// as a function, since the name it reads is only known to ClickHouse.
+func referencedTables(sql string) []tableRef {
+	tokens := tokenizeSQL(sql)
+
+	ctes := map[string]bool{}
+	for i := 0; i+2 < len(tokens); i++ {
+		if tokens[i].isName() && tokens[i+1].is("AS") && tokens[i+2].isPunct('(') {
+			ctes[tokens[i].text] = true
+		}
+	}
+
+	var refs []tableRef
+	record := func(ref *tableRef) {
+		if ref != nil && (ref.database != "" || ref.function != "" || !ctes[ref.table]) {
+			refs = append(refs, *ref)
+		}
+	}
+	add := func(i int) int {
+		ref, next := parseTableRef(tokens, i)
+		record(ref)
+		return next
+	}
+
+	// funcParens holds, for each open parenthesis, the function it calls,
+	// or "" for a subquery or an expression.
+	var funcParens []string
+	statementStart := true
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		start := statementStart
+		statementStart = t.isPunct(';')
+		function := ""
+		if len(funcParens) > 0 {
+			function = funcParens[len(funcParens)-1]
+		}
+		inFunction := function != ""
+
+		if t.kind == sqlIdent && isLookupFunction(t.text) && i+2 < len(tokens) && tokens[i+1].isPunct('(') {
+			record(parseLookupRef(t.text, tokens[i+2]))
+		}
+		switch {
+		case t.isPunct('('):
+			name := ""
+			if i > 0 && tokens[i-1].isName() {
+				name = tokens[i-1].text
+			}
+			funcParens = append(funcParens, name)
+		case t.isPunct(')'):
+			if len(funcParens) > 0 {
+				funcParens = funcParens[:len(funcParens)-1]
+			}
+		case t.is("IN") && !strings.EqualFold(function, "position") && i+1 < len(tokens) && tokens[i+1].isName():
+			// The right side of IN names a table unless it calls a function,
+			// as in x IN tuple(1, 2). IN inside position(needle IN haystack)
+			// separates its arguments.
+			if ref, _ := parseTableRef(tokens, i+1); ref != nil && ref.function == "" {
+				record(ref)
+			}
+		case inFunction:
+		case start && (t.is("DESCRIBE") || t.is("DESC") || t.is("EXISTS")):
+			next := i + 1
+			if next < len(tokens) && tokens[next].is("TABLE") {
+				next++
+			}
+			i = add(next) - 1
+		case start && t.is("SHOW"):
+			ref, next := parseShowTableRef(tokens, i)
+			record(ref)
+			i = next - 1
+		case t.is("FROM"):
+			i = add(i+1) - 1
+			for i+1 < len(tokens) && tokens[i+1].isPunct(',') {
+				i = add(i+2) - 1
+			}
+		case t.is("JOIN") && !(i > 0 && tokens[i-1].is("ARRAY")):
+			i = add(i+1) - 1
+		}
+	}
+	return refs
+}
+
+// isLookupFunction reports whether name is a function reading a dictionary,
+// such as dictGet() or dictHas(), or a Join table, such as joinGet(), named
+// by its first argument.
+func isLookupFunction(name string) bool {
+	return strings.HasPrefix(name, "dictGet") || strings.HasPrefix(name, "dictHas") || strings.HasPrefix(name, "dictIsIn") ||
+		strings.HasPrefix(name, "joinGet")
+}
+
+// parseLookupRef returns the dictionary or Join table the lookup function
+// reads, named by arg, its first argument, as 'database.name' or 'name'.
+func parseLookupRef(function string, arg sqlToken) *tableRef {
+	if arg.kind != sqlString {
+		return &tableRef{function: function}
+	}
+	if database, table, ok := strings.Cut(arg.text, "."); ok {
+		return &tableRef{database: database, table: table}
+	}
+	return &tableRef{table: arg.text}
+}
+
+// parseShowTableRef parses the SHOW statement at tokens[i]: SHOW CREATE
+// [TABLE] name and SHOW COLUMNS FROM name [FROM database] read a table, the
+// SHOW statements that list objects read none, and are consumed up to the
+// end of the statement. It returns the index of the first token it did not
+// consume.
+func parseShowTableRef(tokens []sqlToken, i int) (*tableRef, int) {
+	i++
+	switch {
+	case i < len(tokens) && tokens[i].is("CREATE"):
+		i++
+		if i < len(tokens) && tokens[i].is("TABLE") {
+			i++
+		}
+		return parseTableRef(tokens, i)
+	case i < len(tokens) && (tokens[i].is("COLUMNS") || tokens[i].is("FIELDS")):
+		i++
+		if i >= len(tokens) || !(tokens[i].is("FROM") || tokens[i].is("IN")) {
+			return nil, i
+		}
+		ref, next := parseTableRef(tokens, i+1)
+		if ref != nil && next+1 < len(tokens) && (tokens[next].is("FROM") || tokens[next].is("IN")) && tokens[next+1].isName() {
+			ref.database = tokens[next+1].text
+			next += 2
+		}
+		return ref, next
+	}
+	for i < len(tokens) && !tokens[i].isPunct(';') {
+		i++
+	}
+	return nil, i
+}
+
+// parseTableRef parses the table reference starting at tokens[i]. It returns
+// nil for a subquery. The returned index is the first token after the
+// reference and its optional alias.
+func parseTableRef(tokens []sqlToken, i int) (*tableRef, int) {
+	if i >= len(tokens) || !tokens[i].isName() {
+		return nil, i
+	}
+	ref := &tableRef{table: tokens[i].text}
+	i++
+	if i+1 < len(tokens) && tokens[i].isPunct('.') && tokens[i+1].isName() {
+		ref.database, ref.table = ref.table, tokens[i+1].text
+		i += 2
+	}
+	if i < len(tokens) && tokens[i].isPunct('(') {
+		ref = &tableRef{function: ref.table}
+		for depth := 0; i < len(tokens); i++ {
+			if tokens[i].isPunct('(') {
+				depth++
+			} else if tokens[i].isPunct(')') {
+				depth--
+				if depth == 0 {
+					i++
+					break
+				}
+			}
+		}
+	}
+	if i < len(tokens) && tokens[i].is("FINAL") {
+		i++
+	}
+	if i < len(tokens) && tokens[i].is("AS") {
+		i++
+	}
+	if i < len(tokens) && tokens[i].isName() {
+		i++
+	}
+	return ref, i
+}
+
+// databaseFilterRe and tableFilterRe extract the database and table a
+// system.tables or system.columns lookup of the query editor is restricted
+// to, for results without a database or table column.
+var (
+	databaseFilterRe = regexp.MustCompile(`(?i)\bdatabase\s*(?:=\s*'([^']*)'|IN\s*\(\s*'([^']*)'\s*\))`)
+	tableFilterRe    = regexp.MustCompile(`(?i)\btable\s*=\s*'([^']*)'`)
+)
+
+// filterSchema removes the databases and tables the datasource does not
+// allow from the results of the query editor's schema lookups: SHOW
+// DATABASES, SHOW TABLES and reads of system.databases, system.tables and
+// system.columns. A read of a system table whose result lacks the columns
+// naming each row's database and table, and whose WHERE clause does not
+// pin them either, cannot be filtered and is denied.
+func (p tablePolicy) filterSchema(res backend.DataResponse, sql string) backend.DataResponse {
+	if !p.enabled() || res.Error != nil {
+		return res
+	}
+
+	var keep func(frame *data.Frame, row int) bool
+	tokens := tokenizeSQL(sql)
+	switch {
+	case len(tokens) >= 2 && tokens[0].is("SHOW") && tokens[1].is("DATABASES"):
+		keep = func(frame *data.Frame, row int) bool {
+			return p.databaseVisible(stringAt(frame, "name", row))
+		}
+	case len(tokens) >= 2 && tokens[0].is("SHOW") && tokens[1].is("TABLES"):
+		database := p.defaultDatabase
+		if len(tokens) >= 4 && (tokens[2].is("FROM") || tokens[2].is("IN")) && tokens[3].isName() {
+			database = tokens[3].text
+		}
+		keep = func(frame *data.Frame, row int) bool {
+			return p.allowed(database, stringAt(frame, "name", row))
+		}
+	default:
+		systemTable := ""
+		for _, ref := range referencedTables(sql) {
+			if ref.database == "system" && schemaTables[ref.table] {
+				systemTable = ref.table
+			}
+		}
+		switch systemTable {
+		case "databases":
+			if !schemaColumnsPresent(res, tokens, "name") {
+				return schemaDenied(systemTable)
+			}
+			keep = func(frame *data.Frame, row int) bool {
+				return p.databaseVisible(stringAt(frame, "name", row))
+			}
+		case "tables", "columns":
+			tableColumn := "table"
+			if systemTable == "tables" {
+				tableColumn = "name"
+			}
+			// A filter pins every row only when nothing is ORed with it.
+			var database, table string
+			if !containsKeyword(tokens, "OR") {
+				if m := databaseFilterRe.FindStringSubmatch(sql); m != nil {
+					database = m[1] + m[2]
+				}
+				if m := tableFilterRe.FindStringSubmatch(sql); m != nil && systemTable == "columns" {
+					table = m[1]
+				}
+			}
+			var required []string
+			if database == "" {
+				required = append(required, "database")
+			}
+			if table == "" {
+				required = append(required, tableColumn)
+			}
+			if !schemaColumnsPresent(res, tokens, required...) {
+				return schemaDenied(systemTable)
+			}
+			keep = func(frame *data.Frame, row int) bool {
+				db, tbl := database, table
+				if idx, ok := fieldIndex(frame, "database"); ok {
+					db = valueString(frame.Fields[idx], row)
+				}
+				if idx, ok := fieldIndex(frame, tableColumn); ok {
+					tbl = valueString(frame.Fields[idx], row)
+				}
+				return p.allowed(db, tbl)
+			}
+		default:
+			return res
+		}
+	}
+
+	for i, frame := range res.Frames {
+		res.Frames[i] = filterFrameRows(frame, keep)
+	}
+	return res
+}
+
+// schemaColumnsPresent reports whether every frame of res with fields has
+// the named columns, and whether the statement, tokenized as tokens, does
+// not alias an expression to one of them, as in SELECT 'x' AS database.
+func schemaColumnsPresent(res backend.DataResponse, tokens []sqlToken, names ...string) bool {
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i].is("AS") && tokens[i+1].isName() {
+			for _, name := range names {
+				if strings.EqualFold(tokens[i+1].text, name) {
+					return false
+				}
+			}
+		}
+	}
+	for _, frame := range res.Frames {
+		if len(frame.Fields) == 0 {
+			continue
+		}
+		for _, name := range names {
+			if _, ok := fieldIndex(frame, name); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// containsKeyword reports whether tokens hold the keyword kw.
+func containsKeyword(tokens []sqlToken, kw string) bool {
+	for _, t := range tokens {
+		if t.is(kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaDenied is the response to a read of system.<table> whose rows
+// filterSchema cannot tell the database and table of.
+func schemaDenied(table string) backend.DataResponse {
+	return withTablePolicy(backend.DataResponse{Error: &tableDeniedError{database: "system", table: table, schema: true}})
+}
+
+// filterFrameRows returns frame with only the rows keep accepts.
+func filterFrameRows(frame *data.Frame, keep func(frame *data.Frame, row int) bool) *data.Frame {
+	rows := frame.Rows()
+	kept := make([]int, 0, rows)
+	for row := 0; row < rows; row++ {
+		if keep(frame, row) {
+			kept = append(kept, row)
+		}
+	}
+	if len(kept) == rows {
+		return frame
+	}
+	filtered := frame.EmptyCopy()
+	for _, row := range kept {
+		filtered.AppendRow(frame.RowCopy(row)...)
+	}
+	return filtered
+}
+
+func fieldIndex(frame *data.Frame, name string) (int, bool) {
+	for i, field := range frame.Fields {
+		if field.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// stringAt returns the value of the named field at row as a string, or ""
+// if the frame has no such field.
+func stringAt(frame *data.Frame, name string, row int) string {
+	idx, ok := fieldIndex(frame, name)
+	if !ok {
+		return ""
+	}
+	return valueString(frame.Fields[idx], row)
+}
+
+func valueString(field *data.Field, row int) string {
+	v, ok := field.ConcreteAt(row)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// withTablePolicy unwraps the rejection of a query that reads a denied
+// table, which sqlds reports as a macro error.
+func withTablePolicy(res backend.DataResponse) backend.DataResponse {
+	var deniedErr *tableDeniedError
+	if errors.As(res.Error, &deniedErr) {
+		res.Error = backend.DownstreamError(deniedErr)
+		res.Status = backend.StatusForbidden
+	}
+	return res
+}
+
+// tableDeniedError reports a query reading a table, or using a table
+// function, the datasource does not allow.
+type tableDeniedError struct {
+	database, table string
+	function        string
+	// schema marks a read of a system table whose result cannot be
+	// filtered.
+	schema bool
+}
+
+func (e *tableDeniedError) Error() string {
+	if e.schema {
+		return fmt.Sprintf("reads of %s.%s must return the database and table of each row as unaliased columns, or pin them with a database = '...' filter: this data source restricts the tables queries may read", e.database, e.table)
+	}
+	if e.function != "" && isLookupFunction(e.function) {
+		return fmt.Sprintf("%s() is only allowed with a string literal name: this data source restricts the tables queries may read", e.function)
+	}
+	if e.function != "" {
+		return fmt.Sprintf("table function %s() is not allowed: this data source restricts the tables queries may read", e.function)
+	}
+	return fmt.Sprintf("table %s.%s is not allowed by the table restrictions of this data source", e.database, e.table)
+}
@@ -0,0 +1,215 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferencedTables(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected []tableRef
+	}{
+		{name: "qualified table", sql: "SELECT * FROM db.events WHERE x = 1", expected: []tableRef{{database: "db", table: "events"}}},
+		{name: "unqualified table", sql: "SELECT * FROM events", expected: []tableRef{{table: "events"}}},
+		{name: "quoted names", sql: "SELECT * FROM \"my db\".`my table`", expected: []tableRef{{database: "my db", table: "my table"}}},
+		{name: "joins", sql: "SELECT * FROM a AS x LEFT ANY JOIN b.c y ON x.id = y.id GLOBAL JOIN d USING id", expected: []tableRef{{table: "a"}, {database: "b", table: "c"}, {table: "d"}}},
+		{name: "comma join", sql: "SELECT * FROM a x, b.c FINAL, d WHERE 1", expected: []tableRef{{table: "a"}, {database: "b", table: "c"}, {table: "d"}}},
+		{name: "subqueries", sql: "SELECT * FROM (SELECT * FROM a) WHERE id IN (SELECT id FROM b.c)", expected: []tableRef{{table: "a"}, {database: "b", table: "c"}}},
+		{name: "subquery in function", sql: "SELECT has((SELECT groupArray(id) FROM a), 1)", expected: []tableRef{{table: "a"}}},
+		{name: "FROM in function call", sql: "SELECT EXTRACT(DAY FROM ts), substring(s FROM 2) FROM db.t", expected: []tableRef{{database: "db", table: "t"}}},
+		{name: "array join", sql: "SELECT * FROM t ARRAY JOIN arr LEFT ARRAY JOIN arr2", expected: []tableRef{{table: "t"}}},
+		{name: "common table expression", sql: "WITH recent AS (SELECT * FROM db.events) SELECT * FROM recent", expected: []tableRef{{database: "db", table: "events"}}},
+		{name: "table function", sql: "SELECT * FROM remote('host', system.users)", expected: []tableRef{{function: "remote"}}},
+		{name: "describe", sql: "DESC TABLE \"db\".\"t\"", expected: []tableRef{{database: "db", table: "t"}}},
+		{name: "order by desc", sql: "SELECT * FROM t ORDER BY ts DESC", expected: []tableRef{{table: "t"}}},
+		{name: "show tables", sql: "SHOW TABLES FROM db", expected: nil},
+		{name: "show create", sql: "SHOW CREATE TABLE db.t", expected: []tableRef{{database: "db", table: "t"}}},
+		{name: "show columns", sql: "SHOW COLUMNS FROM t FROM db", expected: []tableRef{{database: "db", table: "t"}}},
+		{name: "strings and comments", sql: "SELECT 'FROM x' /* FROM y */ FROM z -- JOIN w", expected: []tableRef{{table: "z"}}},
+		{name: "several statements", sql: "SELECT 1 FROM a; DESCRIBE b", expected: []tableRef{{table: "a"}, {table: "b"}}},
+		{name: "dictionary lookup", sql: "SELECT dictGetString('db.users', 'name', id) FROM t", expected: []tableRef{{database: "db", table: "users"}, {table: "t"}}},
+		{name: "nested lookups", sql: "SELECT if(dictHas('users', id), joinGet('db.names', 'name', id), '') FROM t", expected: []tableRef{{table: "users"}, {database: "db", table: "names"}, {table: "t"}}},
+		{name: "in table", sql: "SELECT * FROM t WHERE x IN db.a AND y GLOBAL IN b OR z NOT IN c", expected: []tableRef{{table: "t"}, {database: "db", table: "a"}, {table: "b"}, {table: "c"}}},
+		{name: "in table in function", sql: "SELECT countIf(x IN db.a) FROM t", expected: []tableRef{{database: "db", table: "a"}, {table: "t"}}},
+		{name: "in values", sql: "SELECT * FROM t WHERE x IN (1, 2) AND y IN tuple(1, 2) AND z IN (SELECT z FROM u)", expected: []tableRef{{table: "t"}, {table: "u"}}},
+		{name: "in position", sql: "SELECT position(needle IN haystack) FROM t", expected: []tableRef{{table: "t"}}},
+		{name: "lookup without a literal name", sql: "SELECT dictGet(concat('db.', 'users'), 'name', id) FROM t", expected: []tableRef{{function: "dictGet"}, {table: "t"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, referencedTables(tt.sql))
+		})
+	}
+}
+
+func TestTablePolicyAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    []string
+		deny     []string
+		database string
+		table    string
+		expected bool
+	}{
+		{name: "no restrictions", database: "db", table: "t", expected: true},
+		{name: "allowlisted database", allow: []string{"team_x.*"}, database: "team_x", table: "events", expected: true},
+		{name: "not allowlisted", allow: []string{"team_x.*"}, database: "team_y", table: "events", expected: false},
+		{name: "database-only pattern", allow: []string{"team_x"}, database: "team_x", table: "events", expected: true},
+		{name: "denylisted", deny: []string{"system.*"}, database: "system", table: "users", expected: false},
+		{name: "not denylisted", deny: []string{"system.*"}, database: "db", table: "t", expected: true},
+		{name: "approved exception", allow: []string{"system.query_log", "*"}, deny: []string{"system.*"}, database: "system", table: "query_log", expected: true},
+		{name: "denied despite wildcard allow", allow: []string{"system.query_log", "*"}, deny: []string{"system.*"}, database: "system", table: "users", expected: false},
+		{name: "wildcard allow", allow: []string{"system.query_log", "*"}, deny: []string{"system.*"}, database: "db", table: "t", expected: true},
+		{name: "tie goes to deny", allow: []string{"db.*"}, deny: []string{"db.*"}, database: "db", table: "t", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTablePolicy(Settings{AllowedTables: tt.allow, DeniedTables: tt.deny})
+			assert.Equal(t, tt.expected, p.allowed(tt.database, tt.table))
+		})
+	}
+}
+
+func TestTablePolicyDatabaseVisible(t *testing.T) {
+	p := newTablePolicy(Settings{AllowedTables: []string{"system.query_log", "team_x.*"}})
+	assert.True(t, p.databaseVisible("system"))
+	assert.True(t, p.databaseVisible("team_x"))
+	assert.False(t, p.databaseVisible("team_y"))
+
+	p = newTablePolicy(Settings{DeniedTables: []string{"secret"}})
+	assert.False(t, p.databaseVisible("secret"))
+	assert.True(t, p.databaseVisible("public"))
+}
+
+func TestCheckQueryTables(t *testing.T) {
+	p := newTablePolicy(Settings{DefaultDatabase: "team_x", AllowedTables: []string{"team_x.*"}})
+	ctx := p.attach(context.Background())
+
+	assert.NoError(t, checkQueryTables(ctx, "SELECT * FROM events JOIN team_x.users USING id"))
+	assert.NoError(t, checkQueryTables(ctx, "SELECT name FROM system.columns WHERE database = 'team_x'"))
+	assert.NoError(t, checkQueryTables(ctx, "SELECT number FROM numbers(10)"))
+	assert.NoError(t, checkQueryTables(context.Background(), "SELECT * FROM team_y.events"), "no policy attached")
+
+	err := checkQueryTables(ctx, "SELECT * FROM team_y.events")
+	assert.EqualError(t, err, "table team_y.events is not allowed by the table restrictions of this data source")
+
+	err = checkQueryTables(ctx, "SELECT * FROM remote('host', team_y.events)")
+	assert.EqualError(t, err, "table function remote() is not allowed: this data source restricts the tables queries may read")
+
+	assert.NoError(t, checkQueryTables(ctx, "SELECT dictGet('team_x.users', 'name', id) FROM events"))
+	err = checkQueryTables(ctx, "SELECT dictGet('team_y.users', 'name', id) FROM events")
+	assert.EqualError(t, err, "table team_y.users is not allowed by the table restrictions of this data source")
+	err = checkQueryTables(ctx, "SELECT * FROM events WHERE id GLOBAL IN team_y.users")
+	assert.EqualError(t, err, "table team_y.users is not allowed by the table restrictions of this data source")
+	err = checkQueryTables(ctx, "SELECT joinGet(concat('team_y', '.users'), 'name', id) FROM events")
+	assert.EqualError(t, err, "joinGet() is only allowed with a string literal name: this data source restricts the tables queries may read")
+
+	assert.Nil(t, newTablePolicy(Settings{}).attach(context.Background()).Value(tablePolicyKey))
+}
+
+func TestWithTablePolicy(t *testing.T) {
+	deniedErr := &tableDeniedError{database: "db", table: "t"}
+	res := withTablePolicy(backend.DataResponse{Error: fmt.Errorf("Could not apply macros: %w", backend.DownstreamError(deniedErr))})
+	assert.Equal(t, deniedErr.Error(), res.Error.Error())
+	assert.True(t, backend.IsDownstreamError(res.Error))
+	assert.Equal(t, backend.StatusForbidden, res.Status)
+}
+
+func TestTablePolicyFilterSchema(t *testing.T) {
+	p := newTablePolicy(Settings{AllowedTables: []string{"team_x.*", "system.query_log"}})
+	names := func(res backend.DataResponse, field string) []string {
+		require.Len(t, res.Frames, 1)
+		idx, ok := fieldIndex(res.Frames[0], field)
+		require.True(t, ok)
+		var out []string
+		for row := 0; row < res.Frames[0].Rows(); row++ {
+			out = append(out, valueString(res.Frames[0].Fields[idx], row))
+		}
+		return out
+	}
+	response := func(fields ...*data.Field) backend.DataResponse {
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("", fields...)}}
+	}
+
+	t.Run("show databases", func(t *testing.T) {
+		res := p.filterSchema(response(data.NewField("name", nil, []string{"default", "system", "team_x", "team_y"})), "SHOW DATABASES")
+		assert.Equal(t, []string{"system", "team_x"}, names(res, "name"))
+	})
+
+	t.Run("show tables", func(t *testing.T) {
+		res := p.filterSchema(response(data.NewField("name", nil, []string{"query_log", "users"})), `SHOW TABLES FROM "system"`)
+		assert.Equal(t, []string{"query_log"}, names(res, "name"))
+	})
+
+	t.Run("system columns with database column", func(t *testing.T) {
+		res := p.filterSchema(response(
+			data.NewField("database", nil, []string{"team_x", "team_y"}),
+			data.NewField("table", nil, []string{"events", "events"}),
+			data.NewField("name", nil, []string{"ts", "ts"}),
+		), "SELECT database, table, name FROM system.columns")
+		assert.Equal(t, []string{"team_x"}, names(res, "database"))
+	})
+
+	t.Run("system columns filtered by database", func(t *testing.T) {
+		res := p.filterSchema(response(
+			data.NewField("name", nil, []string{"ts", "event"}),
+			data.NewField("table", nil, []string{"events", "events"}),
+		), "SELECT name, type, table FROM system.columns WHERE database IN ('team_y')")
+		assert.Empty(t, names(res, "name"))
+	})
+
+	t.Run("system columns filtered by database and table", func(t *testing.T) {
+		res := p.filterSchema(response(data.NewField("name", nil, []string{"ts"})),
+			"SELECT name FROM system.columns WHERE database = 'team_x' AND table = 'events'")
+		assert.Equal(t, []string{"ts"}, names(res, "name"))
+	})
+
+	t.Run("system schema reads that cannot be filtered", func(t *testing.T) {
+		for _, tt := range []struct {
+			sql    string
+			fields []*data.Field
+		}{
+			{sql: "SELECT name AS t, database AS d FROM system.tables", fields: []*data.Field{
+				data.NewField("t", nil, []string{"secrets"}), data.NewField("d", nil, []string{"team_y"}),
+			}},
+			{sql: "SELECT groupArray(name) FROM system.tables WHERE database = 'team_y'", fields: []*data.Field{
+				data.NewField("groupArray(name)", nil, []string{"secrets"}),
+			}},
+			{sql: "SELECT name FROM system.tables", fields: []*data.Field{
+				data.NewField("name", nil, []string{"secrets"}),
+			}},
+			{sql: "SELECT 'team_x' AS database, name FROM system.tables", fields: []*data.Field{
+				data.NewField("database", nil, []string{"team_x"}), data.NewField("name", nil, []string{"secrets"}),
+			}},
+			{sql: "SELECT name, table FROM system.columns WHERE database = 'team_x' OR 1", fields: []*data.Field{
+				data.NewField("name", nil, []string{"ts"}), data.NewField("table", nil, []string{"secrets"}),
+			}},
+			{sql: "SELECT groupArray(name) FROM system.databases", fields: []*data.Field{
+				data.NewField("groupArray(name)", nil, []string{"team_y"}),
+			}},
+		} {
+			res := p.filterSchema(response(tt.fields...), tt.sql)
+			require.Error(t, res.Error, tt.sql)
+			assert.Equal(t, backend.StatusForbidden, res.Status, tt.sql)
+			assert.Empty(t, res.Frames, tt.sql)
+		}
+	})
+
+	t.Run("other queries are left alone", func(t *testing.T) {
+		res := p.filterSchema(response(data.NewField("name", nil, []string{"team_y"})), "SELECT name FROM team_x.events")
+		assert.Equal(t, []string{"team_y"}, names(res, "name"))
+	})
+
+	t.Run("no policy", func(t *testing.T) {
+		res := newTablePolicy(Settings{}).filterSchema(response(data.NewField("name", nil, []string{"team_y"})), "SHOW DATABASES")
+		assert.Equal(t, []string{"team_y"}, names(res, "name"))
+	})
+}
@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startQuerySpan starts the span covering one execution of a query. It is the
+// span MutateQuery hands to ClickHouse with clickhouse.WithSpan, so the
+// server-side spans in system.opentelemetry_span_log nest under it, and the
+// span interpolateMacros annotates with db.statement.
+func startQuerySpan(ctx context.Context, refID, queryID string) (context.Context, trace.Span) {
+	return tracing.DefaultTracer().Start(ctx, "clickhouse query", trace.WithAttributes(
+		attribute.String("db.system", "clickhouse"),
+		attribute.String("clickhouse.query_id", queryID),
+		attribute.String("grafana.ref_id", refID),
+	))
+}
+
+// endQuerySpan records the outcome of the query on span.
+func endQuerySpan(span trace.Span, res backend.DataResponse, stats *queryStats) {
+	span.SetAttributes(querySpanAttributes(res, stats)...)
+	if res.Error != nil {
+		span.RecordError(res.Error)
+		span.SetStatus(codes.Error, res.Error.Error())
+	}
+}
+
+// querySpanAttributes describes the outcome of a query: rows returned, rows
+// and bytes read as reported by ClickHouse, the time it queued for a
+// concurrency slot if any, and for failures the error category used across
+// the plugin's logs.
+func querySpanAttributes(res backend.DataResponse, stats *queryStats) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int64("clickhouse.rows_returned", frameRows(res.Frames)),
+		attribute.Int64("clickhouse.read_rows", int64(stats.rowsRead.Load())),
+		attribute.Int64("clickhouse.read_bytes", int64(stats.bytesRead.Load())),
+	}
+	if stats.queueWait > 0 {
+		attrs = append(attrs, attribute.Int64("clickhouse.queue_wait_ms", stats.queueWait.Milliseconds()))
+	}
+	if res.Error != nil {
+		attrs = append(attrs, attribute.String("clickhouse.error_category", string(CategorizeConnectionError(res.Error))))
+	}
+	return attrs
+}
@@ -0,0 +1,36 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestQuerySpanAttributes(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		stats := &queryStats{}
+		stats.rowsRead.Add(1000)
+		stats.bytesRead.Add(8000)
+		res := backend.DataResponse{Frames: data.Frames{
+			data.NewFrame("a", data.NewField("v", nil, []int64{1, 2, 3})),
+			data.NewFrame("b", data.NewField("v", nil, []int64{4})),
+		}}
+
+		assert.Equal(t, []attribute.KeyValue{
+			attribute.Int64("clickhouse.rows_returned", 4),
+			attribute.Int64("clickhouse.read_rows", 1000),
+			attribute.Int64("clickhouse.read_bytes", 8000),
+		}, querySpanAttributes(res, stats))
+	})
+
+	t.Run("failure carries the error category", func(t *testing.T) {
+		res := backend.DataResponse{Error: &clickhouse.Exception{Code: 516}}
+
+		attrs := querySpanAttributes(res, &queryStats{})
+		assert.Contains(t, attrs, attribute.String("clickhouse.error_category", "auth"))
+	})
+}
@@ -0,0 +1,206 @@
+package plugin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// variableQueryType is the query type of template variable queries.
+const variableQueryType = "variable"
+
+const defaultVariableMaxCardinality = 10_000
+
+// variableOptions are the options of a variable query, under the variable
+// key of the query JSON. Sort is "asc" or "desc" to sort the options by
+// text, numerically when all texts are numbers, and anything else to keep
+// them in the order of the result. Limit bounds the options, under the max
+// cardinality of the datasource. A variable depending on another one passes
+// its value as a query parameter, under the parameters key of the query JSON
+// as for any query; see bindQueryParameters.
+type variableOptions struct {
+	Sort  string `json:"sort"`
+	Limit int    `json:"limit"`
+}
+
+// variableQueries runs template variable queries and returns their result as
+// the options Grafana expects: a frame with a __text and a __value string
+// field, with one row per distinct value.
+type variableQueries struct {
+	maxCardinality int
+}
+
+// newVariableQueries builds the variable queries configured on the
+// datasource.
+func newVariableQueries(settings Settings) variableQueries {
+	v := variableQueries{maxCardinality: defaultVariableMaxCardinality}
+	if settings.VariableMaxCardinality > 0 {
+		v.maxCardinality = int(settings.VariableMaxCardinality)
+	}
+	return v
+}
+
+// run runs the variable query q through execute, as a table query, and turns its first frame into variable options. A
+// SELECT is wrapped in a query returning one row more than the max
+// cardinality, so that neither ClickHouse nor the plugin holds the rows
+// past it.
+func (v variableQueries) run(ctx context.Context, q backend.DataQuery, execute func(context.Context, backend.DataQuery) backend.DataResponse) backend.DataResponse {
+	var model map[string]json.RawMessage
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return invalidQuery("variable", err)
+	}
+	var opts variableOptions
+	if raw, ok := model["variable"]; ok {
+		if err := json.Unmarshal(raw, &opts); err != nil {
+			return invalidQuery("variable", err)
+		}
+	}
+
+	var rawSQL string
+	if raw, ok := model["rawSql"]; ok {
+		if err := json.Unmarshal(raw, &rawSQL); err != nil {
+			return invalidQuery("variable", err)
+		}
+	}
+	if isEstimable(rawSQL) {
+		sql, err := wrapSQL(rawSQL, func(subquery string) string {
+			return fmt.Sprintf("SELECT * FROM (\n%s\n) LIMIT %d", subquery, v.maxCardinality+1)
+		})
+		if err != nil {
+			return invalidQuery("variable", err)
+		}
+		model["rawSql"], _ = json.Marshal(sql)
+	}
+
+	model["format"] = json.RawMessage("1")
+	sqlQuery := q
+	sqlQuery.QueryType = ""
+	sqlQuery.JSON, _ = json.Marshal(model)
+	res := execute(ctx, sqlQuery)
+	if failed(res) {
+		return res
+	}
+
+	var source *data.Frame
+	if len(res.Frames) > 0 {
+		source = res.Frames[0]
+	}
+	limit := v.maxCardinality
+	if opts.Limit > 0 && opts.Limit < limit {
+		limit = opts.Limit
+	}
+	truncated := source != nil && source.Rows() > v.maxCardinality
+	frame, distinct := variableFrame(source, opts.Sort, limit)
+	frame.RefID = q.RefID
+	res.Frames = data.Frames{frame}
+	if (distinct > limit || truncated) && limit == v.maxCardinality {
+		res.Frames = appendNotice(res.Frames, q.RefID, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text: fmt.Sprintf("Variable query returned more than %d values; only the first %d are kept, the most this data source allows. "+
+				"Filter the query to return fewer values.", v.maxCardinality, v.maxCardinality),
+		})
+	}
+	return res
+}
+
+// variableOption is a text and value pair of a variable.
+type variableOption struct {
+	text, value string
+}
+
+// variableFrame returns the options in frame as a __text and __value frame of
+// at most limit rows, and the number of distinct values in frame. The value
+// and text are the fields named __value and __text, or value and text, or
+// else the first and second fields; without a text field the value is the
+// text. Rows with a null value are skipped, and only the first row of every
+// value is kept.
+func variableFrame(frame *data.Frame, order string, limit int) (*data.Frame, int) {
+	var options []variableOption
+	if frame != nil && len(frame.Fields) > 0 {
+		valueIdx, textIdx := variableFields(frame)
+		seen := map[string]bool{}
+		for row := 0; row < frame.Rows(); row++ {
+			if _, ok := frame.Fields[valueIdx].ConcreteAt(row); !ok {
+				continue
+			}
+			value := valueString(frame.Fields[valueIdx], row)
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+			text := value
+			if textIdx >= 0 {
+				if _, ok := frame.Fields[textIdx].ConcreteAt(row); ok {
+					text = valueString(frame.Fields[textIdx], row)
+				}
+			}
+			options = append(options, variableOption{text: text, value: value})
+		}
+	}
+
+	switch strings.ToLower(order) {
+	case "asc":
+		slices.SortStableFunc(options, variableTextOrder(options))
+	case "desc":
+		compare := variableTextOrder(options)
+		slices.SortStableFunc(options, func(a, b variableOption) int { return compare(b, a) })
+	}
+	distinct := len(options)
+	if len(options) > limit {
+		options = options[:limit]
+	}
+
+	texts := make([]string, len(options))
+	values := make([]string, len(options))
+	for i, o := range options {
+		texts[i], values[i] = o.text, o.value
+	}
+	out := data.NewFrame("", data.NewField("__text", nil, texts), data.NewField("__value", nil, values))
+	if frame != nil {
+		out.Meta = frame.Meta
+	}
+	return out, distinct
+}
+
+// variableFields returns the indexes of the value and text fields of frame,
+// the text being -1 when there is none.
+func variableFields(frame *data.Frame) (int, int) {
+	for _, names := range [][2]string{{"__value", "__text"}, {"value", "text"}} {
+		valueIdx, hasValue := fieldIndex(frame, names[0])
+		textIdx, hasText := fieldIndex(frame, names[1])
+		switch {
+		case hasValue && hasText:
+			return valueIdx, textIdx
+		case hasValue:
+			return valueIdx, -1
+		case hasText:
+			return textIdx, -1
+		}
+	}
+	if len(frame.Fields) > 1 {
+		return 0, 1
+	}
+	return 0, -1
+}
+
+// variableTextOrder returns the order of the texts of options: numeric when
+// all of them are numbers, and lexical otherwise, so that the order does not
+// depend on which texts are compared.
+func variableTextOrder(options []variableOption) func(a, b variableOption) int {
+	numbers := make(map[string]float64, len(options))
+	for _, o := range options {
+		n, err := strconv.ParseFloat(o.text, 64)
+		if err != nil {
+			return func(a, b variableOption) int { return strings.Compare(a.text, b.text) }
+		}
+		numbers[o.text] = n
+	}
+	return func(a, b variableOption) int { return cmp.Compare(numbers[a.text], numbers[b.text]) }
+}
@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func variableValues(t *testing.T, frame *data.Frame) ([]string, []string) {
+	t.Helper()
+	require.Len(t, frame.Fields, 2)
+	require.Equal(t, "__text", frame.Fields[0].Name)
+	require.Equal(t, "__value", frame.Fields[1].Name)
+	var texts, values []string
+	for row := 0; row < frame.Rows(); row++ {
+		texts = append(texts, frame.Fields[0].At(row).(string))
+		values = append(values, frame.Fields[1].At(row).(string))
+	}
+	return texts, values
+}
+
+func TestVariableFrame(t *testing.T) {
+	one := "one"
+	for name, tt := range map[string]struct {
+		frame  *data.Frame
+		order  string
+		limit  int
+		texts  []string
+		values []string
+	}{
+		"single column": {
+			frame:  data.NewFrame("", data.NewField("name", nil, []string{"b", "a", "b"})),
+			limit:  10,
+			texts:  []string{"b", "a"},
+			values: []string{"b", "a"},
+		},
+		"value then text": {
+			frame:  data.NewFrame("", data.NewField("id", nil, []int64{2, 1}), data.NewField("name", nil, []string{"two", "one"})),
+			order:  "asc",
+			limit:  10,
+			texts:  []string{"one", "two"},
+			values: []string{"1", "2"},
+		},
+		"named fields": {
+			frame:  data.NewFrame("", data.NewField("text", nil, []string{"x"}), data.NewField("extra", nil, []string{"y"}), data.NewField("value", nil, []string{"1"})),
+			limit:  10,
+			texts:  []string{"x"},
+			values: []string{"1"},
+		},
+		"numeric sort": {
+			frame:  data.NewFrame("", data.NewField("n", nil, []string{"10", "9", "100"})),
+			order:  "DESC",
+			limit:  10,
+			texts:  []string{"100", "10", "9"},
+			values: []string{"100", "10", "9"},
+		},
+		"mixed sort is lexical whatever the input order": {
+			frame:  data.NewFrame("", data.NewField("v", nil, []string{"b", "9", "10", "a"})),
+			order:  "asc",
+			limit:  10,
+			texts:  []string{"10", "9", "a", "b"},
+			values: []string{"10", "9", "a", "b"},
+		},
+		"nulls are skipped": {
+			frame:  data.NewFrame("", data.NewField("v", nil, []*string{nil, &one})),
+			limit:  10,
+			texts:  []string{"one"},
+			values: []string{"one"},
+		},
+		"limit": {
+			frame:  data.NewFrame("", data.NewField("v", nil, []string{"c", "a", "b"})),
+			order:  "asc",
+			limit:  2,
+			texts:  []string{"a", "b"},
+			values: []string{"a", "b"},
+		},
+		"no frame": {limit: 10},
+	} {
+		t.Run(name, func(t *testing.T) {
+			frame, _ := variableFrame(tt.frame, tt.order, tt.limit)
+			texts, values := variableValues(t, frame)
+			assert.Equal(t, tt.texts, texts)
+			assert.Equal(t, tt.values, values)
+		})
+	}
+}
+
+func TestVariableQueriesRun(t *testing.T) {
+	v := newVariableQueries(Settings{VariableMaxCardinality: 2})
+	q := backend.DataQuery{
+		RefID:     "A",
+		QueryType: "variable",
+		JSON: []byte(`{"rawSql": "SELECT name FROM t WHERE db = {db:String}", "format": 0, "variable": {"sort": "asc"},
+			"parameters": {"db": {"type": "String", "value": "prod"}}}`),
+	}
+	// Variable queries take their parameters in the model of any query.
+	ctx, err := bindQueryParameters(context.Background(), q)
+	require.NoError(t, err)
+
+	var got backend.DataQuery
+	var params map[string]string
+	res := v.run(ctx, q, func(ctx context.Context, q backend.DataQuery) backend.DataResponse {
+		got, params = q, queryParametersFromContext(ctx)
+		return backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("name", nil, []string{"c", "b", "a"}))}}
+	})
+	require.NoError(t, res.Error)
+	assert.Empty(t, got.QueryType)
+	var model map[string]any
+	require.NoError(t, json.Unmarshal(got.JSON, &model))
+	assert.Equal(t, "SELECT * FROM (\nSELECT name FROM t WHERE db = {db:String}\n) LIMIT 3", model["rawSql"])
+	assert.Equal(t, 1.0, model["format"], "variable queries run as table queries")
+	assert.Equal(t, map[string]string{"db": "prod"}, params)
+
+	require.Len(t, res.Frames, 1)
+	assert.Equal(t, "A", res.Frames[0].RefID)
+	texts, _ := variableValues(t, res.Frames[0])
+	assert.Equal(t, []string{"a", "b"}, texts)
+	require.Len(t, res.Frames[0].Meta.Notices, 1)
+	assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "returned more than 2 values; only the first 2 are kept")
+
+	t.Run("limit under the max cardinality does not warn", func(t *testing.T) {
+		q := q
+		q.JSON = []byte(`{"rawSql": "SELECT 1", "variable": {"limit": 1}}`)
+		res := v.run(context.Background(), q, func(context.Context, backend.DataQuery) backend.DataResponse {
+			return backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("v", nil, []string{"a", "b", "c"}))}}
+		})
+		assert.Equal(t, 1, res.Frames[0].Rows())
+		assert.Nil(t, res.Frames[0].Meta)
+	})
+
+	t.Run("rows past the max cardinality warn", func(t *testing.T) {
+		res := v.run(context.Background(), q, func(context.Context, backend.DataQuery) backend.DataResponse {
+			return backend.DataResponse{Frames: data.Frames{data.NewFrame("", data.NewField("v", nil, []string{"a", "a", "b"}))}}
+		})
+		assert.Equal(t, 2, res.Frames[0].Rows())
+		require.Len(t, res.Frames[0].Meta.Notices, 1)
+		assert.Contains(t, res.Frames[0].Meta.Notices[0].Text, "returned more than 2 values")
+	})
+
+	t.Run("statements other than SELECT are not wrapped", func(t *testing.T) {
+		q := q
+		q.JSON = []byte(`{"rawSql": "SHOW DATABASES"}`)
+		var got backend.DataQuery
+		v.run(context.Background(), q, func(_ context.Context, q backend.DataQuery) backend.DataResponse {
+			got = q
+			return backend.DataResponse{}
+		})
+		assert.Equal(t, "SHOW DATABASES", executedSQL(t, got))
+	})
+
+	t.Run("format", func(t *testing.T) {
+		q := q
+		q.JSON = []byte(`{"rawSql": "SELECT 1 FORMAT JSON"}`)
+		res := v.run(context.Background(), q, nil)
+		assert.ErrorContains(t, res.Error, "must not set a FORMAT")
+		assert.Equal(t, backend.StatusBadRequest, res.Status)
+	})
+
+	t.Run("failed query", func(t *testing.T) {
+		res := v.run(context.Background(), q, func(context.Context, backend.DataQuery) backend.DataResponse {
+			return backend.DataResponse{Error: assert.AnError}
+		})
+		assert.ErrorIs(t, res.Error, assert.AnError)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		q := q
+		q.JSON = []byte(`{"rawSql": "SELECT 1", "variable": {"limit": "ten"}}`)
+		res := v.run(context.Background(), q, nil)
+		assert.True(t, backend.IsDownstreamError(res.Error))
+		assert.Equal(t, backend.StatusBadRequest, res.Status)
+	})
+}
@@ -92,6 +92,14 @@ export const pluginMacros: PluginMacro[] = [
       'Replaced by the first parameter when the template variable in the second parameter does not select every value. Replaced by 1=1 when the template variable selects every value',
     example: 'condition or 1=1',
   },
+  {
+    name: '$__sampleFactor',
+    isFunction: false,
+    columnType: 'UInt64',
+    documentation:
+      'Replaced by the sample factor of the query when auto sampling reads 1 row in N of its table, otherwise 1. Multiply counts and sums by it to scale them back',
+    example: '10',
+  },
   {
     name: '$__columns',
     isFunction: true,
@@ -0,0 +1,64 @@
+import React from 'react';
+import { render, fireEvent } from '@testing-library/react';
+import { QueryPipelineConfig, hasQueryPipelineSettings } from './QueryPipelineConfig';
+import { mockConfigEditorProps } from '__mocks__/ConfigEditor';
+import { CHConfig } from 'types/config';
+import allLabels from 'labels';
+
+const labels = allLabels.components.Config.QueryPipelineConfig;
+
+describe('QueryPipelineConfig', () => {
+  it('should render', () => {
+    const result = render(<QueryPipelineConfig {...mockConfigEditorProps()} />);
+    expect(result.container.firstChild).not.toBeNull();
+    expect(result.getByText(labels.title)).toBeInTheDocument();
+  });
+
+  it('should enable retries', () => {
+    const props = mockConfigEditorProps();
+    const result = render(<QueryPipelineConfig {...props} />);
+    expect(result.queryByLabelText(labels.retry.queryRetryMaxAttempts.label)).not.toBeInTheDocument();
+
+    fireEvent.click(result.getByLabelText(labels.retry.enableQueryRetry.label));
+    expect(props.onOptionsChange).toHaveBeenCalledWith(
+      expect.objectContaining({ jsonData: expect.objectContaining({ enableQueryRetry: true }) })
+    );
+  });
+
+  it('should set numbers, and unset empty ones', () => {
+    const props = mockConfigEditorProps({ enableQueryRetry: true, queryRetryMaxAttempts: 3 });
+    const result = render(<QueryPipelineConfig {...props} />);
+    const input = result.getByLabelText(labels.retry.queryRetryMaxAttempts.label);
+
+    fireEvent.change(input, { target: { value: '5' } });
+    expect(props.onOptionsChange).toHaveBeenLastCalledWith(
+      expect.objectContaining({ jsonData: expect.objectContaining({ queryRetryMaxAttempts: 5 }) })
+    );
+    fireEvent.change(input, { target: { value: '' } });
+    expect(props.onOptionsChange).toHaveBeenLastCalledWith(
+      expect.objectContaining({ jsonData: expect.objectContaining({ queryRetryMaxAttempts: undefined }) })
+    );
+  });
+
+  it('should set the guardrails of each tier', () => {
+    const props = mockConfigEditorProps({ exploreGuardrails: { maxExecutionTime: 30 } });
+    const result = render(<QueryPipelineConfig {...props} />);
+
+    const label = `${labels.guardrails.tiers.exploreGuardrails} ${labels.guardrails.maxRowsToRead.label}`;
+    fireEvent.change(result.getByLabelText(label), { target: { value: '1000000' } });
+    const { jsonData } = (props.onOptionsChange as jest.Mock).mock.calls[0][0] as { jsonData: CHConfig };
+    expect(jsonData.exploreGuardrails).toEqual({ maxExecutionTime: 30, maxRowsToRead: 1000000 });
+    expect(jsonData.dashboardGuardrails).toBeUndefined();
+  });
+});
+
+describe('hasQueryPipelineSettings', () => {
+  it('should report settings that are set', () => {
+    const jsonData = mockConfigEditorProps().options.jsonData;
+    expect(hasQueryPipelineSettings(jsonData)).toBe(false);
+    expect(hasQueryPipelineSettings({ ...jsonData, enableQueryRetry: true })).toBe(true);
+    expect(hasQueryPipelineSettings({ ...jsonData, alertGuardrails: { maxResultRows: 10 } })).toBe(true);
+    expect(hasQueryPipelineSettings({ ...jsonData, allowedTables: ['team_x.*'] })).toBe(true);
+    expect(hasQueryPipelineSettings({ ...jsonData, allowedTables: [] })).toBe(false);
+  });
+});
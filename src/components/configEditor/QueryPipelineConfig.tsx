@@ -0,0 +1,232 @@
+import React from 'react';
+import { DataSourcePluginOptionsEditorProps, SelectableValue } from '@grafana/data';
+import { Field, Input, Select, Switch, TagsInput } from '@grafana/ui';
+import { ConfigSection, ConfigSubSection } from 'components/experimental/ConfigSection';
+import { AuditLogSqlMode, CHConfig, CHQueryGuardrails, CHSecureConfig, CostEstimateAction } from 'types/config';
+import allLabels from 'labels';
+
+type Props = Pick<DataSourcePluginOptionsEditorProps<CHConfig, CHSecureConfig>, 'options' | 'onOptionsChange'>;
+
+type BooleanKey = {
+  [K in keyof CHConfig]-?: NonNullable<CHConfig[K]> extends boolean ? K : never;
+}[keyof CHConfig];
+type NumberKey = {
+  [K in keyof CHConfig]-?: NonNullable<CHConfig[K]> extends number ? K : never;
+}[keyof CHConfig];
+type GuardrailsKey = 'dashboardGuardrails' | 'exploreGuardrails' | 'alertGuardrails';
+type GuardrailsLimit = 'maxExecutionTime' | 'maxRowsToRead' | 'maxBytesToRead' | 'maxResultRows';
+
+const guardrailsTiers: GuardrailsKey[] = ['dashboardGuardrails', 'exploreGuardrails', 'alertGuardrails'];
+const guardrailsLimits: GuardrailsLimit[] = ['maxExecutionTime', 'maxRowsToRead', 'maxBytesToRead', 'maxResultRows'];
+
+/**
+ * Parses a number input, an empty one leaving the setting unset so that the
+ * backend applies its default.
+ */
+const parseNumber = (value: string): number | undefined => (value === '' ? undefined : Number(value));
+
+/**
+ * Reports whether any setting of QueryPipelineConfig is set, so that the
+ * section holding it opens.
+ */
+export const hasQueryPipelineSettings = (jsonData: CHConfig): boolean =>
+  Boolean(
+    jsonData.enableQueryRetry ||
+      jsonData.enableAuditLog ||
+      jsonData.slowQueryThresholdMs ||
+      guardrailsTiers.some((tier) => Object.values(jsonData[tier] || {}).some(Boolean)) ||
+      jsonData.enableCostEstimation ||
+      jsonData.allowedTables?.length ||
+      jsonData.deniedTables?.length ||
+      jsonData.maxConcurrentQueries ||
+      jsonData.maxConcurrentQueriesPerUser ||
+      jsonData.enableQueryDeduplication ||
+      jsonData.enableResultCache ||
+      jsonData.alignTimeRangeToInterval ||
+      jsonData.enableIncrementalQueries ||
+      jsonData.enableChunkedQueries ||
+      jsonData.enableAutoSampling ||
+      jsonData.variableMaxCardinality
+  );
+
+/**
+ * Settings of how the backend runs queries. The options of a feature show
+ * once it is enabled.
+ */
+export const QueryPipelineConfig = (props: Props) => {
+  const { options, onOptionsChange } = props;
+  const { jsonData } = options;
+  const labels = allLabels.components.Config.QueryPipelineConfig;
+
+  const onChange = <K extends keyof CHConfig>(key: K, value: CHConfig[K]) => {
+    onOptionsChange({ ...options, jsonData: { ...options.jsonData, [key]: value } });
+  };
+
+  const switchField = (key: BooleanKey, label: { label: string; tooltip: string }) => (
+    <Field label={label.label} description={label.tooltip}>
+      <Switch
+        value={jsonData[key] || false}
+        onChange={(e) => onChange(key, e.currentTarget.checked)}
+        role="checkbox"
+        aria-label={label.label}
+      />
+    </Field>
+  );
+
+  const numberField = (key: NumberKey, label: { label: string; tooltip: string; placeholder?: string }) => (
+    <Field label={label.label} description={label.tooltip}>
+      <Input
+        name={key}
+        width={40}
+        type="number"
+        min={0}
+        value={jsonData[key] ?? ''}
+        placeholder={label.placeholder}
+        aria-label={label.label}
+        onChange={(e) => onChange(key, parseNumber(e.currentTarget.value))}
+      />
+    </Field>
+  );
+
+  const onGuardrailsChange = <K extends keyof CHQueryGuardrails>(
+    tier: GuardrailsKey,
+    key: K,
+    value: CHQueryGuardrails[K]
+  ) => {
+    onChange(tier, { ...jsonData[tier], [key]: value });
+  };
+
+  return (
+    <ConfigSection title={labels.title} description={labels.description}>
+      <ConfigSubSection title={labels.retry.title}>
+        {switchField('enableQueryRetry', labels.retry.enableQueryRetry)}
+        {jsonData.enableQueryRetry && (
+          <>
+            {numberField('queryRetryMaxAttempts', labels.retry.queryRetryMaxAttempts)}
+            {numberField('queryRetryInitialBackoffMs', labels.retry.queryRetryInitialBackoffMs)}
+            {numberField('queryRetryMaxBackoffMs', labels.retry.queryRetryMaxBackoffMs)}
+          </>
+        )}
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.audit.title}>
+        {switchField('enableAuditLog', labels.audit.enableAuditLog)}
+        {Boolean(jsonData.enableAuditLog) && numberField('auditLogSampleRate', labels.audit.auditLogSampleRate)}
+        {numberField('slowQueryThresholdMs', labels.audit.slowQueryThresholdMs)}
+        <Field label={labels.audit.auditLogSqlMode.label} description={labels.audit.auditLogSqlMode.tooltip}>
+          <Select
+            width={40}
+            aria-label={labels.audit.auditLogSqlMode.label}
+            options={labels.audit.auditLogSqlMode.options}
+            value={jsonData.auditLogSqlMode || 'full'}
+            onChange={(v: SelectableValue<string>) => onChange('auditLogSqlMode', v.value as AuditLogSqlMode)}
+          />
+        </Field>
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.guardrails.title} description={labels.guardrails.description}>
+        {guardrailsTiers.map((tier) => (
+          <ConfigSubSection key={tier} title={labels.guardrails.tiers[tier]}>
+            {guardrailsLimits.map((limit) => (
+              <Field key={limit} label={labels.guardrails[limit].label} description={labels.guardrails[limit].tooltip}>
+                <Input
+                  name={`${tier}.${limit}`}
+                  width={40}
+                  type="number"
+                  min={0}
+                  value={jsonData[tier]?.[limit] ?? ''}
+                  aria-label={`${labels.guardrails.tiers[tier]} ${labels.guardrails[limit].label}`}
+                  onChange={(e) => onGuardrailsChange(tier, limit, parseNumber(e.currentTarget.value))}
+                />
+              </Field>
+            ))}
+            <Field label={labels.guardrails.overflowMode.label} description={labels.guardrails.overflowMode.tooltip}>
+              <Select
+                width={40}
+                aria-label={`${labels.guardrails.tiers[tier]} ${labels.guardrails.overflowMode.label}`}
+                options={labels.guardrails.overflowMode.options}
+                value={jsonData[tier]?.overflowMode || 'throw'}
+                onChange={(v: SelectableValue<string>) =>
+                  onGuardrailsChange(tier, 'overflowMode', v.value as CHQueryGuardrails['overflowMode'])
+                }
+              />
+            </Field>
+          </ConfigSubSection>
+        ))}
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.cost.title}>
+        {switchField('enableCostEstimation', labels.cost.enableCostEstimation)}
+        {jsonData.enableCostEstimation && (
+          <>
+            {numberField('costEstimateMaxRows', labels.cost.costEstimateMaxRows)}
+            {numberField('costEstimateMaxParts', labels.cost.costEstimateMaxParts)}
+            {numberField('costEstimateMaxMarks', labels.cost.costEstimateMaxMarks)}
+            <Field label={labels.cost.costEstimateAction.label} description={labels.cost.costEstimateAction.tooltip}>
+              <Select
+                width={40}
+                aria-label={labels.cost.costEstimateAction.label}
+                options={labels.cost.costEstimateAction.options}
+                value={jsonData.costEstimateAction || 'warn'}
+                onChange={(v: SelectableValue<string>) => onChange('costEstimateAction', v.value as CostEstimateAction)}
+              />
+            </Field>
+          </>
+        )}
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.tables.title} description={labels.tables.description}>
+        {(['allowedTables', 'deniedTables'] as const).map((key) => (
+          <Field key={key} label={labels.tables[key].label} description={labels.tables[key].tooltip}>
+            <TagsInput
+              placeholder="database.table"
+              tags={jsonData[key] || []}
+              onChange={(tags) => onChange(key, tags.map((t) => t.trim()).filter(Boolean))}
+              width={60}
+            />
+          </Field>
+        ))}
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.concurrency.title}>
+        {numberField('maxConcurrentQueries', labels.concurrency.maxConcurrentQueries)}
+        {numberField('maxConcurrentQueriesPerUser', labels.concurrency.maxConcurrentQueriesPerUser)}
+        {Boolean(jsonData.maxConcurrentQueries || jsonData.maxConcurrentQueriesPerUser) &&
+          numberField('queryQueueTimeoutMs', labels.concurrency.queryQueueTimeoutMs)}
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.cache.title}>
+        {switchField('enableQueryDeduplication', labels.cache.enableQueryDeduplication)}
+        {switchField('enableResultCache', labels.cache.enableResultCache)}
+        {jsonData.enableResultCache && (
+          <>
+            {numberField('resultCacheTtlSeconds', labels.cache.resultCacheTtlSeconds)}
+            {numberField('resultCacheMaxSizeMb', labels.cache.resultCacheMaxSizeMb)}
+          </>
+        )}
+        {switchField('alignTimeRangeToInterval', labels.cache.alignTimeRangeToInterval)}
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.longRanges.title}>
+        {switchField('enableIncrementalQueries', labels.longRanges.enableIncrementalQueries)}
+        {switchField('enableChunkedQueries', labels.longRanges.enableChunkedQueries)}
+        {jsonData.enableChunkedQueries && (
+          <>
+            {numberField('chunkedQueryMinRangeHours', labels.longRanges.chunkedQueryMinRangeHours)}
+            {numberField('chunkedQueryChunks', labels.longRanges.chunkedQueryChunks)}
+            {numberField('chunkedQueryParallelism', labels.longRanges.chunkedQueryParallelism)}
+          </>
+        )}
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.sampling.title}>
+        {switchField('enableAutoSampling', labels.sampling.enableAutoSampling)}
+        {jsonData.enableAutoSampling && numberField('autoSampleTargetRows', labels.sampling.autoSampleTargetRows)}
+      </ConfigSubSection>
+
+      <ConfigSubSection title={labels.variables.title}>
+        {numberField('variableMaxCardinality', labels.variables.variableMaxCardinality)}
+      </ConfigSubSection>
+    </ConfigSection>
+  );
+};
@@ -3,6 +3,7 @@ import { fireEvent, render, waitFor } from '@testing-library/react';
 import { AnnotationQuery } from '@grafana/data';
 import {
   buildGroupByOptions,
+  buildTarget,
   createAnnotationSupport,
   generateChangeDetectionSQL,
   resolveTraceSchema,
@@ -205,7 +206,7 @@ describe('createAnnotationSupport: prepareAnnotation', () => {
     expect(migrated?.target?.refId).toBe('annotation');
   });
 
-  it('leaves a modern annotation untouched', () => {
+  it('routes a saved SQL annotation through the backend annotation query', () => {
     const modern: AnnotationQuery<CHQuery> = {
       name: 'modern',
       enable: true,
@@ -214,6 +215,24 @@ describe('createAnnotationSupport: prepareAnnotation', () => {
     };
     const result = support.prepareAnnotation?.(modern);
     expect(result?.target?.rawSql).toBe('SELECT 2 AS time');
+    expect(result?.target?.refId).toBe('a');
+    expect(result?.target?.queryType).toBe('annotation');
+  });
+
+  it('keeps the column roles and tag filter of a saved annotation', () => {
+    const saved: AnnotationQuery<CHQuery> = {
+      name: 'saved',
+      enable: true,
+      iconColor: 'red',
+      columns: { time: 'ts', text: 'message' },
+      tagFilter: { tags: ['deploy'] },
+      target: { refId: 'a', pluginVersion: '', editorType: EditorType.SQL, rawSql: 'SELECT ts, message FROM events' },
+    };
+    const result = support.prepareAnnotation?.(saved);
+    expect(result?.target).toMatchObject({
+      queryType: 'annotation',
+      annotation: { columns: { time: 'ts', text: 'message' }, tags: ['deploy'], matchAny: false },
+    });
   });
 
   it('does not invent a target when rawQuery is absent', () => {
@@ -339,7 +358,7 @@ describe('AnnotationQueryEditor', () => {
     const result = await renderEditor(buildDatasource(), annotationWith({ preset: 'custom' }));
     expect(result.getByText('Annotation Type')).toBeInTheDocument();
     expect(result.queryByText('Database')).not.toBeInTheDocument();
-    expect(result.getByRole('textbox')).toBeInTheDocument();
+    expect(result.getByPlaceholderText(/SELECT Timestamp AS time/)).toBeInTheDocument();
   });
 
   it('shows the schema picker for the change detection preset', async () => {
@@ -365,14 +384,17 @@ describe('AnnotationQueryEditor', () => {
   it('emits the edited SQL through onAnnotationChange', async () => {
     const onAnnotationChange = jest.fn();
     const result = await renderEditor(buildDatasource(), annotationWith({ preset: 'custom' }), onAnnotationChange);
-    fireEvent.change(result.getByRole('textbox'), { target: { value: 'SELECT 99 AS time' } });
+    fireEvent.change(result.getByPlaceholderText(/SELECT Timestamp AS time/), {
+      target: { value: 'SELECT 99 AS time' },
+    });
     expect(onAnnotationChange).toHaveBeenCalledTimes(1);
     expect(onAnnotationChange.mock.calls[0][0].target.rawSql).toBe('SELECT 99 AS time');
   });
 
   it('is a no-op when no onAnnotationChange handler is provided', async () => {
     const result = await renderEditor(buildDatasource(), annotationWith({ preset: 'custom' }));
-    expect(() => fireEvent.change(result.getByRole('textbox'), { target: { value: 'SELECT 1' } })).not.toThrow();
+    const sql = result.getByPlaceholderText(/SELECT Timestamp AS time/);
+    expect(() => fireEvent.change(sql, { target: { value: 'SELECT 1' } })).not.toThrow();
   });
 
   it('seeds a populated deployment query when switching to the change detection preset', async () => {
@@ -439,6 +461,82 @@ describe('AnnotationQueryEditor', () => {
     const result = await renderEditor(buildDatasource(), annotationWith({}));
     expect(result.getByText('Annotation Type')).toBeInTheDocument();
     expect(result.queryByText('Database')).not.toBeInTheDocument();
-    expect(result.getByRole('textbox')).toBeInTheDocument();
+    expect(result.getByPlaceholderText(/SELECT Timestamp AS time/)).toBeInTheDocument();
+  });
+
+  it('switches the tag filter on without tags, filtering nothing', async () => {
+    const onAnnotationChange = jest.fn();
+    const result = await renderEditor(
+      buildDatasource(),
+      annotationWith({ preset: 'custom', target: { ...baseQuery, rawSql: 'SELECT ts AS time, tags FROM events' } }),
+      onAnnotationChange
+    );
+    fireEvent.click(result.getByLabelText('Filter by tags'));
+    const emitted = onAnnotationChange.mock.calls[0][0];
+    expect(emitted.tagFilter).toEqual({ tags: [] });
+    expect(emitted.target.rawSql).toBe('SELECT ts AS time, tags FROM events');
+    expect(emitted.target.queryType).toBe('annotation');
+    expect(emitted.target.annotation).toEqual({});
+  });
+
+  it('maps a column role of the annotations', async () => {
+    const onAnnotationChange = jest.fn();
+    const result = await renderEditor(
+      buildDatasource(),
+      annotationWith({ preset: 'custom', target: { ...baseQuery, rawSql: 'SELECT ts, message FROM events' } }),
+      onAnnotationChange
+    );
+    fireEvent.change(result.getByLabelText('Time column'), { target: { value: 'ts' } });
+    const emitted = onAnnotationChange.mock.calls[0][0];
+    expect(emitted.columns).toEqual({ time: 'ts' });
+    expect(emitted.target.rawSql).toBe('SELECT ts, message FROM events');
+    expect(emitted.target.queryType).toBe('annotation');
+    expect(emitted.target.annotation).toEqual({ columns: { time: 'ts' } });
+  });
+
+  it('keeps the tag filter when the SQL is edited', async () => {
+    const onAnnotationChange = jest.fn();
+    const result = await renderEditor(
+      buildDatasource(),
+      annotationWith({ preset: 'custom', tagFilter: { tags: ['deploy'], matchAny: true } }),
+      onAnnotationChange
+    );
+    fireEvent.change(result.getByPlaceholderText(/SELECT Timestamp AS time/), {
+      target: { value: 'SELECT 1 AS time' },
+    });
+    const emitted = onAnnotationChange.mock.calls[0][0];
+    expect(emitted.target.queryType).toBe('annotation');
+    expect(emitted.target.annotation).toEqual({ tags: ['deploy'], matchAny: true, tagsFormat: undefined });
+  });
+});
+
+describe('buildTarget', () => {
+  it('builds a backend annotation query without tags to filter by', () => {
+    expect(buildTarget({ refId: 'A', pluginVersion: '4.0.0' }, 'SELECT 1', { tags: [] })).toEqual({
+      pluginVersion: '4.0.0',
+      editorType: EditorType.SQL,
+      rawSql: 'SELECT 1',
+      refId: 'A',
+      queryType: 'annotation',
+      annotation: {},
+    });
+  });
+
+  it('passes the mapped column roles, dropping the empty ones', () => {
+    expect(buildTarget(undefined, 'SELECT 1', undefined, { time: 'ts', timeEnd: '', id: 'event_id' })).toMatchObject({
+      queryType: 'annotation',
+      annotation: { columns: { time: 'ts', id: 'event_id' } },
+    });
+  });
+
+  it('builds a backend annotation query filtering by tags', () => {
+    expect(buildTarget(undefined, 'SELECT 1', { tags: ['deploy', 'prod'], tagsFormat: 'string' })).toEqual({
+      pluginVersion: '',
+      editorType: EditorType.SQL,
+      rawSql: 'SELECT 1',
+      refId: 'annotation',
+      queryType: 'annotation',
+      annotation: { tags: ['deploy', 'prod'], matchAny: false, tagsFormat: 'string' },
+    });
   });
 });
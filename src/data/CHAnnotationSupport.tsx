@@ -1,6 +1,17 @@
 import React, { useCallback, useMemo } from 'react';
 import { AnnotationQuery, AnnotationSupport, GrafanaTheme2, QueryEditorProps } from '@grafana/data';
-import { Box, InlineField, InlineFormLabel, Select, Text, TextArea, useStyles2 } from '@grafana/ui';
+import {
+  Box,
+  InlineField,
+  InlineFormLabel,
+  InlineSwitch,
+  Input,
+  Select,
+  TagsInput,
+  Text,
+  TextArea,
+  useStyles2,
+} from '@grafana/ui';
 import { css } from '@emotion/css';
 import { Datasource } from './CHDatasource';
 import { escapeIdentifier, getTableIdentifier } from './sqlGenerator';
@@ -20,10 +31,37 @@ type AnnotationPreset = 'custom' | 'change_detection';
  */
 type ChangeDetectionState = SchemaPickerValue & { groupBy?: string; columnType?: string };
 
+/**
+ * Tag filter of an annotation: only the annotations with all of the tags, or any of them with matchAny, are
+ * shown. The filter runs in ClickHouse, over the tags column of the query, an Array(String) or, with tagsFormat
+ * 'string', a comma-separated String.
+ */
+export interface TagFilterState {
+  tags?: string[];
+  matchAny?: boolean;
+  tagsFormat?: '' | 'string';
+}
+
+/**
+ * Columns of the query holding each role of the annotations. A role left empty is read from the column named
+ * after it, so a query returning time, text and tags needs no mapping.
+ */
+export interface AnnotationColumns {
+  time?: string;
+  timeEnd?: string;
+  title?: string;
+  text?: string;
+  tags?: string;
+  id?: string;
+}
+
 /** Annotation query extended with the builder state the editor needs to round-trip. */
 interface CHAnnotationQuery extends AnnotationQuery<CHQuery> {
   preset?: AnnotationPreset;
   changeDetection?: ChangeDetectionState;
+  // Present while the tag filter is switched on, even before it has tags.
+  tagFilter?: TagFilterState;
+  columns?: AnnotationColumns;
   // Custom SQL stashed when entering Change Detection, restored on return so a
   // hand-written query is not lost by the round trip.
   customSql?: string;
@@ -37,6 +75,23 @@ type AnnotationEditorProps = QueryEditorProps<Datasource, CHQuery, CHConfig> & {
 
 const ANNOTATION_REF_ID = 'annotation';
 
+/** Query type of the backend annotation queries, which map the column roles and filter annotations by tag. */
+const ANNOTATION_QUERY_TYPE = 'annotation';
+
+const COLUMN_ROLES: Array<{ role: keyof AnnotationColumns; label: string }> = [
+  { role: 'time', label: 'Time' },
+  { role: 'timeEnd', label: 'Time end' },
+  { role: 'title', label: 'Title' },
+  { role: 'text', label: 'Text' },
+  { role: 'tags', label: 'Tags' },
+  { role: 'id', label: 'ID' },
+];
+
+const TAGS_FORMAT_OPTIONS: Array<{ label: string; value: '' | 'string' }> = [
+  { label: 'Array(String)', value: '' },
+  { label: 'Comma-separated String', value: 'string' },
+];
+
 /** Minimal defaults used only when Grafana mounts the editor without an existing annotation. */
 const DEFAULT_ANNOTATION: CHAnnotationQuery = { name: '', enable: true, iconColor: 'red' };
 
@@ -52,13 +107,38 @@ const CHANGE_DETECTION_PLACEHOLDER = '-- Select a table and column above to gene
  */
 const escapeStringContent = (value: string): string => value.replace(/\\/g, '\\\\').replace(/'/g, "\\'");
 
-/** Build the SQL annotation target, preserving the existing refId and plugin version. */
-const buildTarget = (existing: Partial<CHQuery> | undefined, rawSql: string): CHSqlQuery => ({
-  pluginVersion: existing?.pluginVersion ?? '',
-  editorType: EditorType.SQL,
-  rawSql,
-  refId: existing?.refId || ANNOTATION_REF_ID,
-});
+/**
+ * Build the SQL annotation target, preserving the existing refId and plugin version. The target is a backend
+ * annotation query, which reads each role from its mapped column and, given tags, filters the annotations in
+ * ClickHouse.
+ */
+export const buildTarget = (
+  existing: Partial<CHQuery> | undefined,
+  rawSql: string,
+  tagFilter?: TagFilterState,
+  columns?: AnnotationColumns
+): CHSqlQuery => {
+  const mapped = Object.fromEntries(Object.entries(columns ?? {}).filter(([, column]) => column));
+  const tags = tagFilter?.tags?.length
+    ? {
+        tags: tagFilter.tags,
+        matchAny: Boolean(tagFilter.matchAny),
+        tagsFormat: tagFilter.tagsFormat || undefined,
+      }
+    : {};
+  // The query type is one of the backend, not of the query editor's QueryType.
+  return {
+    pluginVersion: existing?.pluginVersion ?? '',
+    editorType: EditorType.SQL,
+    rawSql,
+    refId: existing?.refId || ANNOTATION_REF_ID,
+    queryType: ANNOTATION_QUERY_TYPE,
+    annotation: {
+      ...(Object.keys(mapped).length ? { columns: mapped } : {}),
+      ...tags,
+    },
+  } as unknown as CHSqlQuery;
+};
 
 /**
  * Resolve the default database and table for the change-detection preset.
@@ -193,7 +273,7 @@ const AnnotationQueryEditor = (props: AnnotationEditorProps) => {
         ...anno,
         preset: 'change_detection',
         changeDetection: newCd,
-        target: buildTarget(anno.target, generateChangeDetectionSQL(newCd)),
+        target: buildTarget(anno.target, generateChangeDetectionSQL(newCd), anno.tagFilter, anno.columns),
       });
     },
     [anno, cd, onAnnotationChange]
@@ -232,14 +312,14 @@ const AnnotationQueryEditor = (props: AnnotationEditorProps) => {
           preset: value,
           customSql: anno.target?.rawSql ?? '',
           changeDetection: seeded,
-          target: buildTarget(anno.target, generateChangeDetectionSQL(seeded)),
+          target: buildTarget(anno.target, generateChangeDetectionSQL(seeded), anno.tagFilter, anno.columns),
         });
       } else {
         // Restore the Custom SQL stashed when Change Detection was entered.
         onAnnotationChange({
           ...anno,
           preset: value,
-          target: buildTarget(anno.target, anno.customSql ?? ''),
+          target: buildTarget(anno.target, anno.customSql ?? '', anno.tagFilter, anno.columns),
         });
       }
     },
@@ -253,11 +333,41 @@ const AnnotationQueryEditor = (props: AnnotationEditorProps) => {
       }
       onAnnotationChange({
         ...anno,
-        target: buildTarget(anno.target, e.currentTarget.value),
+        target: buildTarget(anno.target, e.currentTarget.value, anno.tagFilter, anno.columns),
+      });
+    },
+    [anno, onAnnotationChange]
+  );
+
+  const onTagFilterChange = useCallback(
+    (tagFilter: TagFilterState | undefined) => {
+      if (!onAnnotationChange) {
+        return;
+      }
+      onAnnotationChange({
+        ...anno,
+        tagFilter,
+        target: buildTarget(anno.target, anno.target?.rawSql ?? '', tagFilter, anno.columns),
+      });
+    },
+    [anno, onAnnotationChange]
+  );
+
+  const onColumnChange = useCallback(
+    (role: keyof AnnotationColumns, column: string) => {
+      if (!onAnnotationChange) {
+        return;
+      }
+      const columns = { ...anno.columns, [role]: column || undefined };
+      onAnnotationChange({
+        ...anno,
+        columns,
+        target: buildTarget(anno.target, anno.target?.rawSql ?? '', anno.tagFilter, columns),
       });
     },
     [anno, onAnnotationChange]
   );
+  const tagFilter = anno.tagFilter;
 
   const groupByOptions = buildGroupByOptions(columns, cd.column, cd.groupBy);
 
@@ -324,11 +434,80 @@ const AnnotationQueryEditor = (props: AnnotationEditorProps) => {
             <Text color="secondary" variant="bodySmall">
               {preset === 'change_detection'
                 ? 'Annotations appear when the watched value changes per group, including rollbacks.'
-                : 'Return columns: time (required), text, title, tags. Standard Grafana annotation mapping.'}
+                : 'Return columns: time (required), timeEnd, title, text, tags, id, or map them below.'}
             </Text>
           </Box>
         </Box>
       </InlineField>
+
+      {COLUMN_ROLES.map(({ role, label }) => (
+        <InlineField
+          key={role}
+          label={
+            <InlineFormLabel width={10} tooltip={`Column holding the ${label.toLowerCase()} of each annotation`}>
+              {`${label} column`}
+            </InlineFormLabel>
+          }
+        >
+          <Input
+            width={30}
+            value={anno.columns?.[role] ?? ''}
+            placeholder={role}
+            onChange={(e) => onColumnChange(role, e.currentTarget.value)}
+            aria-label={`${label} column`}
+          />
+        </InlineField>
+      ))}
+
+      <InlineField
+        label={
+          <InlineFormLabel
+            width={10}
+            tooltip="Show only the annotations with the tags below. ClickHouse filters the tags column of the query."
+          >
+            Filter by tags
+          </InlineFormLabel>
+        }
+      >
+        <InlineSwitch
+          value={Boolean(tagFilter)}
+          onChange={(e) => onTagFilterChange(e.currentTarget.checked ? { tags: [] } : undefined)}
+          aria-label="Filter by tags"
+        />
+      </InlineField>
+
+      {tagFilter && (
+        <>
+          <InlineField label={<InlineFormLabel width={10}>Tags</InlineFormLabel>}>
+            <TagsInput
+              tags={tagFilter.tags ?? []}
+              onChange={(tags) => onTagFilterChange({ ...tagFilter, tags })}
+              placeholder="New tag (enter key to add)"
+            />
+          </InlineField>
+          <InlineField
+            label={
+              <InlineFormLabel width={10} tooltip="Show annotations with any of the tags, rather than all of them.">
+                Match any
+              </InlineFormLabel>
+            }
+          >
+            <InlineSwitch
+              value={Boolean(tagFilter.matchAny)}
+              onChange={(e) => onTagFilterChange({ ...tagFilter, matchAny: e.currentTarget.checked })}
+              aria-label="Match any"
+            />
+          </InlineField>
+          <InlineField label={<InlineFormLabel width={10}>Tags format</InlineFormLabel>}>
+            <Select
+              width={30}
+              options={TAGS_FORMAT_OPTIONS}
+              value={tagFilter.tagsFormat || ''}
+              onChange={(v) => onTagFilterChange({ ...tagFilter, tagsFormat: v.value || '' })}
+            />
+          </InlineField>
+        </>
+      )}
     </div>
   );
 };
@@ -346,10 +525,16 @@ export function createAnnotationSupport(datasource: Datasource): AnnotationSuppo
     prepareAnnotation: (json: AnnotationQuery<CHQuery>): AnnotationQuery<CHQuery> => {
       // Legacy dashboards stored the SQL as a top-level `rawQuery` string. Migrate
       // it into the modern target shape once. `rawQuery` is read via the
-      // AnnotationQuery index signature, so no cast is needed.
+      // AnnotationQuery index signature, so no cast is needed. Annotations saved
+      // before every target was a backend annotation query are rebuilt as one.
       const legacyRawQuery: string | undefined = json?.rawQuery;
+      const annotation: CHAnnotationQuery = json;
+      const rawSql: string | undefined = json?.target?.rawSql || legacyRawQuery;
+      const queryType: string | undefined = json?.target?.queryType;
       const prepared: CHAnnotationQuery =
-        legacyRawQuery && !json?.target?.rawSql ? { ...json, target: buildTarget(json.target, legacyRawQuery) } : json;
+        rawSql !== undefined && queryType !== ANNOTATION_QUERY_TYPE
+          ? { ...json, target: buildTarget(json.target, rawSql, annotation.tagFilter, annotation.columns) }
+          : json;
 
       // Dashboards may carry a preset id unknown to this editor (early
       // bundled dashboards shipped 'deployment_detection'). Migrate it to
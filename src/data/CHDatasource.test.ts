@@ -153,6 +153,35 @@ describe('ClickHouseDatasource', () => {
       expect(spyOnReplace).toHaveBeenCalled();
       expect(val).toEqual({ rawSql, editorType: EditorType.SQL });
     });
+    it('interpolates query parameters', async () => {
+      const variables: Record<string, string | string[]> = { service: 'api', hosts: ['a', 'b'] };
+      jest.spyOn(templateSrvMock, 'replace').mockImplementation((value: string, _scoped, format) =>
+        value.replace(/\$\{?(\w+)\}?/g, (match: string, name: string) =>
+          name in variables ? (format ? format(variables[name]) : String(variables[name])) : match
+        )
+      );
+      jest.spyOn(templateSrvMock, 'getVariables').mockImplementation(() => []);
+      const query = {
+        rawSql: 'SELECT 1',
+        editorType: EditorType.SQL,
+        parameters: {
+          service: { type: 'String', value: '${service}' },
+          label: { type: 'String', value: 'host $hosts' },
+          hosts: { type: 'Array(String)', value: '$hosts' },
+          ids: { type: 'Array(String)', value: ['$hosts', 'c', 3] },
+          limit: { type: 'UInt32', value: 10 },
+        },
+      } as CHQuery;
+      const val = createInstance({}).applyTemplateVariables(query, {});
+      expect(val.parameters).toEqual({
+        service: { type: 'String', value: 'api' },
+        label: { type: 'String', value: 'host a,b' },
+        hosts: { type: 'Array(String)', value: ['a', 'b'] },
+        ids: { type: 'Array(String)', value: ['a', 'b', 'c', 3] },
+        limit: { type: 'UInt32', value: 10 },
+      });
+      expect(query.parameters?.service.value).toEqual('${service}');
+    });
     it('should handle $__conditionalAll and not replace', async () => {
       const query = { rawSql: '$__conditionalAll(foo, $fieldVal)', editorType: EditorType.SQL } as CHQuery;
       const vars = [{ current: { value: `'val1', 'val2'` }, name: 'fieldVal' }] as TypedVariableModel[];
@@ -51,7 +51,7 @@ import {
   TableColumn,
   TimeUnit,
 } from 'types/queryBuilder';
-import { CHQuery, EditorType } from 'types/sql';
+import { CHQuery, EditorType, QueryParameter, QueryParameterScalar } from 'types/sql';
 import { pluginVersion } from 'utils/version';
 import { AdHocFilter } from './adHocFilter';
 import {
@@ -552,12 +552,53 @@ export class Datasource
     }
     this.skipAdHocFilter = false;
 
+    if (query.parameters) {
+      return {
+        ...query,
+        rawSql: rawQuery,
+        parameters: this.applyParameterVariables(query.parameters, scoped),
+      };
+    }
     return {
       ...query,
       rawSql: rawQuery,
     };
   }
 
+  /**
+   * Interpolates the template variables in the string values of query parameters, which reach ClickHouse
+   * as values rather than SQL, so they are not quoted. A value that is a multi-value variable alone
+   * becomes an array of its values, which is what Array parameters take, and so does an array element.
+   */
+  private applyParameterVariables(
+    parameters: Record<string, QueryParameter>,
+    scoped: ScopedVars
+  ): Record<string, QueryParameter> {
+    const interpolate = (value: string): string | string[] => {
+      let values: string[] | undefined;
+      const replaced = getTemplateSrv().replace(value, scoped, (v: string | string[]) => {
+        if (Array.isArray(v)) {
+          values = v.map(String);
+          return values.join(',');
+        }
+        return v;
+      });
+      return values !== undefined && replaced === values.join(',') ? values : replaced;
+    };
+
+    const interpolated: Record<string, QueryParameter> = {};
+    for (const [name, parameter] of Object.entries(parameters)) {
+      let value = parameter.value;
+      if (typeof value === 'string') {
+        value = interpolate(value);
+      } else if (Array.isArray(value)) {
+        value = value.flatMap<QueryParameterScalar>((v) => (typeof v === 'string' ? interpolate(v) : [v]));
+      }
+      interpolated[name] = { ...parameter, value };
+    }
+    return interpolated;
+  }
+
   /**
    * When a user follows a span link ("View Linked Span") in the trace view, Grafana core
    * builds the navigation target by spreading the current trace query and overriding only the
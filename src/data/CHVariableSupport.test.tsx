@@ -1,7 +1,7 @@
 import React from 'react';
 import { fireEvent, render, waitFor } from '@testing-library/react';
-import { firstValueFrom } from 'rxjs';
-import { DataQueryRequest, DataQueryResponse, FieldType } from '@grafana/data';
+import { firstValueFrom, of } from 'rxjs';
+import { DataQueryRequest, DataQueryResponse, FieldType, toDataFrame } from '@grafana/data';
 import {
   CHVariableQuery,
   CHVariableQueryType,
@@ -12,6 +12,7 @@ import {
 } from './CHVariableSupport';
 import { Datasource } from './CHDatasource';
 import { TableColumn } from 'types/queryBuilder';
+import { EditorType } from 'types/sql';
 
 const baseQuery = (overrides: Partial<CHVariableQuery> = {}): CHVariableQuery => ({
   refId: 'v',
@@ -178,9 +179,18 @@ const buildDatasource = (overrides: Partial<Datasource> = {}): Datasource => {
   ];
   ds.fetchColumns = jest.fn(() => Promise.resolve(columns));
   ds.fetchUniqueMapKeys = jest.fn(() => Promise.resolve(['service.name', 'service.version']));
-  ds.metricFindQuery = jest.fn(() =>
-    Promise.resolve([{ text: 'foo' }, { text: 'bar' }])
-  ) as unknown as Datasource['metricFindQuery'];
+  ds.query = jest.fn(() =>
+    of({
+      data: [
+        toDataFrame({
+          fields: [
+            { name: '__text', type: FieldType.string, values: ['foo', 'bar'] },
+            { name: '__value', type: FieldType.string, values: ['foo', 'bar'] },
+          ],
+        }),
+      ],
+    })
+  ) as unknown as Datasource['query'];
   return Object.assign(ds, overrides);
 };
 
@@ -281,186 +291,111 @@ describe('VariableQueryEditor', () => {
 });
 
 describe('CHVariableSupport', () => {
-  type RawMetricValue = { text: unknown; value?: unknown };
-  const runWith = async (values: RawMetricValue[]): Promise<DataQueryResponse> => {
-    const datasource = buildDatasource({
-      metricFindQuery: jest.fn(() => Promise.resolve(values)) as unknown as Datasource['metricFindQuery'],
-    });
+  const run = async (targets: unknown[], scopedVars = {}) => {
+    const datasource = buildDatasource();
     const support = new CHVariableSupport(datasource);
-    const request = {
-      targets: [{ refId: 'v', queryType: 'sql' as CHVariableQueryType, rawSql: 'SELECT x' }],
-      range: { from: new Date(), to: new Date() },
-    };
-    return (await firstValueFrom(
+    const request = { targets, range: { from: new Date(), to: new Date() }, scopedVars };
+    const response = (await firstValueFrom(
       support.query(request as unknown as DataQueryRequest<CHVariableQuery>)
     )) as DataQueryResponse;
+    return { datasource, response };
   };
 
   it('returns an empty frame when no rawSql is present', async () => {
-    const datasource = buildDatasource();
-    const support = new CHVariableSupport(datasource);
-    const request = {
-      targets: [{ refId: 'v', queryType: 'sql' as CHVariableQueryType }],
-      range: { from: new Date(), to: new Date() },
-    };
-    const response = (await firstValueFrom(
-      support.query(request as unknown as DataQueryRequest<CHVariableQuery>)
-    )) as DataQueryResponse;
+    const { datasource, response } = await run([{ refId: 'v', queryType: 'sql' as CHVariableQueryType }]);
     expect(response.data).toEqual([]);
+    expect(datasource.query).not.toHaveBeenCalled();
   });
 
-  it('wraps metricFindQuery output into a DataFrame with text and value fields', async () => {
-    const datasource = buildDatasource();
-    const support = new CHVariableSupport(datasource);
-    const request = {
-      targets: [
-        {
-          refId: 'v',
-          queryType: 'databases' as CHVariableQueryType,
-          rawSql: 'SELECT name FROM system.databases ORDER BY name',
-        },
-      ],
-      range: { from: new Date(), to: new Date() },
-    };
-    const response = (await firstValueFrom(
-      support.query(request as unknown as DataQueryRequest<CHVariableQuery>)
-    )) as DataQueryResponse;
-    expect(datasource.metricFindQuery).toHaveBeenCalledWith(
-      'SELECT name FROM system.databases ORDER BY name',
-      expect.objectContaining({ range: expect.any(Object) })
+  it('runs the SQL as a backend variable query with its sort and limit', async () => {
+    const { datasource, response } = await run([
+      { refId: 'v', queryType: 'databases', rawSql: 'SELECT name FROM system.databases', sort: 'desc', limit: 10 },
+    ]);
+    expect(datasource.query).toHaveBeenCalledWith(
+      expect.objectContaining({
+        targets: [
+          {
+            refId: 'v',
+            editorType: EditorType.SQL,
+            rawSql: 'SELECT name FROM system.databases',
+            queryType: 'variable',
+            variable: { sort: 'desc', limit: 10 },
+          },
+        ],
+        range: expect.any(Object),
+      })
     );
-    expect(response.data).toHaveLength(1);
-    const frame = response.data[0];
-    expect(frame.fields).toHaveLength(2);
-    expect(frame.fields[0].name).toBe('text');
-    expect(frame.fields[0].type).toBe(FieldType.string);
-    expect(frame.fields[0].values).toEqual(['foo', 'bar']);
-    expect(frame.fields[1].name).toBe('value');
-    expect(frame.fields[1].type).toBe(FieldType.string);
-    expect(frame.fields[1].values).toEqual(['foo', 'bar']);
+    // The backend returns the options as __text and __value string fields.
+    expect(response.data[0].fields.map((f: { name: string }) => f.name)).toEqual(['__text', '__value']);
   });
 
-  it('keeps value distinct from text for value/text pairs', async () => {
-    const datasource = buildDatasource({
-      metricFindQuery: jest.fn(() =>
-        Promise.resolve([
-          { text: 'Label A', value: 'id-a' },
-          { text: 'Label B', value: 'id-b' },
-        ])
-      ) as unknown as Datasource['metricFindQuery'],
-    });
-    const support = new CHVariableSupport(datasource);
-    const request = {
-      targets: [{ refId: 'v', queryType: 'sql' as CHVariableQueryType, rawSql: 'SELECT id, label FROM t' }],
-      range: { from: new Date(), to: new Date() },
-    };
-    const response = (await firstValueFrom(
-      support.query(request as unknown as DataQueryRequest<CHVariableQuery>)
-    )) as DataQueryResponse;
-    const frame = response.data[0];
-    expect(frame.fields[0].values).toEqual(['Label A', 'Label B']);
-    expect(frame.fields[1].name).toBe('value');
-    expect(frame.fields[1].values).toEqual(['id-a', 'id-b']);
+  it('leaves sort and limit to the backend defaults when unset', async () => {
+    const { datasource } = await run([{ refId: 'v', queryType: 'sql', rawSql: 'SELECT x', sort: '' }]);
+    const request = (datasource.query as jest.Mock).mock.calls[0][0];
+    expect(request.targets[0].variable).toEqual({ sort: undefined, limit: undefined });
   });
 
-  it('forwards scopedVars from the request into metricFindQuery so scoped variables resolve', async () => {
-    const datasource = buildDatasource();
-    const support = new CHVariableSupport(datasource);
+  it('passes the query parameters of the variable', async () => {
+    const parameters = { database: { type: 'String', value: '$database' } };
+    const { datasource } = await run([
+      { refId: 'v', queryType: 'sql', rawSql: 'SELECT {database:String}', parameters },
+    ]);
+    const request = (datasource.query as jest.Mock).mock.calls[0][0];
+    expect(request.targets[0].parameters).toEqual(parameters);
+  });
+
+  it('forwards scopedVars so scoped variables resolve', async () => {
     const scopedVars = {
       namespace: { text: 'prod', value: 'prod' },
       __searchFilter: { text: 'foo', value: 'foo' },
     };
-    const request = {
-      targets: [
+    const { datasource } = await run(
+      [
         {
           refId: 'v',
-          queryType: 'sql' as CHVariableQueryType,
+          queryType: 'sql',
           rawSql: 'SELECT name FROM t WHERE ns = ${namespace} AND name LIKE $__searchFilter',
         },
       ],
-      range: { from: new Date(), to: new Date() },
-      scopedVars,
-    };
-    await firstValueFrom(support.query(request as unknown as DataQueryRequest<CHVariableQuery>));
-    expect(datasource.metricFindQuery).toHaveBeenCalledWith(
-      'SELECT name FROM t WHERE ns = ${namespace} AND name LIKE $__searchFilter',
-      expect.objectContaining({ scopedVars })
+      scopedVars
     );
+    expect(datasource.query).toHaveBeenCalledWith(expect.objectContaining({ scopedVars }));
   });
 
-  it('forwards scopedVars for a legacy string target', async () => {
-    const datasource = buildDatasource();
-    const support = new CHVariableSupport(datasource);
-    const scopedVars = { namespace: { text: 'prod', value: 'prod' } };
-    const request = {
-      targets: ['SELECT name FROM t WHERE ns = ${namespace}'],
-      range: { from: new Date(), to: new Date() },
-      scopedVars,
-    };
-    await firstValueFrom(support.query(request as unknown as DataQueryRequest<CHVariableQuery>));
-    expect(datasource.metricFindQuery).toHaveBeenCalledWith(
-      'SELECT name FROM t WHERE ns = ${namespace}',
-      expect.objectContaining({ scopedVars })
+  it('runs a legacy string target', async () => {
+    const { datasource } = await run(['SELECT name FROM system.databases']);
+    expect(datasource.query).toHaveBeenCalledWith(
+      expect.objectContaining({
+        targets: [
+          {
+            refId: 'var',
+            editorType: EditorType.SQL,
+            rawSql: 'SELECT name FROM system.databases',
+            queryType: 'variable',
+            variable: {},
+          },
+        ],
+      })
     );
   });
+});
 
-  it('resolves a legacy string target', async () => {
-    const datasource = buildDatasource();
-    const support = new CHVariableSupport(datasource);
-    const request = {
-      targets: ['SELECT name FROM system.databases'],
-      range: { from: new Date(), to: new Date() },
-    };
-    const response = (await firstValueFrom(
-      support.query(request as unknown as DataQueryRequest<CHVariableQuery>)
-    )) as DataQueryResponse;
-    expect(datasource.metricFindQuery).toHaveBeenCalledWith(
-      'SELECT name FROM system.databases',
-      expect.objectContaining({ range: expect.any(Object) })
+describe('VariableQueryEditor sort and limit', () => {
+  it('persists a limit, and clears it when emptied', async () => {
+    const onChange = jest.fn();
+    const result = await waitFor(() =>
+      render(
+        <VariableQueryEditor
+          datasource={buildDatasource()}
+          query={baseQuery({ rawSql: 'SELECT 1' })}
+          onChange={onChange}
+          onRunQuery={() => {}}
+        />
+      )
     );
-    expect(response.data[0].fields[0].values).toEqual(['foo', 'bar']);
-  });
-
-  it('types numeric-looking string values as string so the variable resolves', async () => {
-    const response = await runWith([{ text: '1783512125' }, { text: '1783511702' }]);
-    const frame = response.data[0];
-    expect(frame.fields[0].type).toBe(FieldType.string);
-    expect(frame.fields[1].type).toBe(FieldType.string);
-    expect(frame.fields[0].values).toEqual(['1783512125', '1783511702']);
-    expect(frame.fields[1].values).toEqual(['1783512125', '1783511702']);
-  });
-
-  it('stringifies numeric values and types them as string', async () => {
-    const response = await runWith([{ text: 200 }, { text: 404 }]);
-    const frame = response.data[0];
-    expect(frame.fields[0].type).toBe(FieldType.string);
-    expect(frame.fields[1].type).toBe(FieldType.string);
-    expect(frame.fields[0].values).toEqual(['200', '404']);
-    expect(frame.fields[1].values).toEqual(['200', '404']);
-  });
-
-  it('keeps ordinary string values string-typed', async () => {
-    const response = await runWith([{ text: 'foo' }, { text: 'bar' }]);
-    const frame = response.data[0];
-    expect(frame.fields[0].type).toBe(FieldType.string);
-    expect(frame.fields[1].type).toBe(FieldType.string);
-    expect(frame.fields[0].values).toEqual(['foo', 'bar']);
-    expect(frame.fields[1].values).toEqual(['foo', 'bar']);
-  });
-
-  it('preserves an explicit value of 0 (nullish fallback, not falsy) and stringifies it', async () => {
-    const response = await runWith([{ text: 'Zero', value: 0 }]);
-    const frame = response.data[0];
-    expect(frame.fields[0].values).toEqual(['Zero']);
-    expect(frame.fields[1].values).toEqual(['0']);
-  });
-
-  it('passes null values through without turning them into the string "null"', async () => {
-    const response = await runWith([{ text: null }]);
-    const frame = response.data[0];
-    expect(frame.fields[0].type).toBe(FieldType.string);
-    expect(frame.fields[0].values).toEqual([null]);
-    expect(frame.fields[1].values).toEqual([null]);
+    fireEvent.change(result.getByLabelText('Limit'), { target: { value: '25' } });
+    expect(onChange.mock.calls[0][0].limit).toBe(25);
+    fireEvent.change(result.getByLabelText('Limit'), { target: { value: '' } });
+    expect(onChange.mock.calls[1][0].limit).toBeUndefined();
   });
 });
-
@@ -1,18 +1,10 @@
 import React, { useCallback, useMemo } from 'react';
-import {
-  CustomVariableSupport,
-  DataQueryRequest,
-  DataQueryResponse,
-  FieldType,
-  MetricFindValue,
-  QueryEditorProps,
-  toDataFrame,
-} from '@grafana/data';
-import { InlineField, InlineFormLabel, Select, TextArea } from '@grafana/ui';
-import { Observable, from, of } from 'rxjs';
+import { CustomVariableSupport, DataQueryRequest, DataQueryResponse, QueryEditorProps } from '@grafana/data';
+import { InlineField, InlineFormLabel, Input, Select, TextArea } from '@grafana/ui';
+import { Observable, of } from 'rxjs';
 import { SchemaPicker, SchemaPickerLevel, SchemaPickerValue } from 'components/queryBuilder/SchemaPicker';
 import { CHConfig } from 'types/config';
-import { CHQuery } from 'types/sql';
+import { CHQuery, EditorType, QueryParameter } from 'types/sql';
 import { escapeIdentifier } from './sqlGenerator';
 import { Datasource, escapeCHStringLiteral } from './CHDatasource';
 
@@ -27,6 +19,9 @@ export type CHVariableQueryType =
   | 'columns'
   | 'columnValues';
 
+/** Order of the variable options: by text, or as the query returns them when empty. */
+export type CHVariableSort = '' | 'asc' | 'desc';
+
 /** Variable query model. Persisted as part of the dashboard JSON. */
 export interface CHVariableQuery {
   refId: string;
@@ -39,6 +34,12 @@ export interface CHVariableQuery {
   mapKey?: string;
   /** Captured at pick time so the runtime path doesn't need to refetch the column type. */
   columnIsMap?: boolean;
+  /** Sorts the options by text, numerically when every text is a number. */
+  sort?: CHVariableSort;
+  /** Most options to keep, under the max cardinality of the data source. */
+  limit?: number;
+  /** Server-side query parameters, by name, referenced in rawSql as {name:Type}. */
+  parameters?: Record<string, QueryParameter>;
 }
 
 const VARIABLE_TYPE_OPTIONS: Array<{ label: string; value: CHVariableQueryType; description?: string }> = [
@@ -49,6 +50,12 @@ const VARIABLE_TYPE_OPTIONS: Array<{ label: string; value: CHVariableQueryType;
   { label: 'Column values', value: 'columnValues', description: 'Distinct values of a column or Map key' },
 ];
 
+const VARIABLE_SORT_OPTIONS: Array<{ label: string; value: CHVariableSort }> = [
+  { label: 'Query order', value: '' },
+  { label: 'Ascending', value: 'asc' },
+  { label: 'Descending', value: 'desc' },
+];
+
 /** Returns the SchemaPicker depth for a query type, or null when no picker is needed. */
 export function pickerLevelFor(queryType: CHVariableQueryType): SchemaPickerLevel | null {
   switch (queryType) {
@@ -120,6 +127,8 @@ export const VariableQueryEditor = (props: EditorProps) => {
       column: query?.column,
       mapKey: query?.mapKey,
       columnIsMap: query?.columnIsMap,
+      sort: query?.sort,
+      limit: query?.limit,
     }),
     [
       legacyRawSql,
@@ -131,6 +140,8 @@ export const VariableQueryEditor = (props: EditorProps) => {
       query?.column,
       query?.mapKey,
       query?.columnIsMap,
+      query?.sort,
+      query?.limit,
     ]
   );
 
@@ -172,6 +183,21 @@ export const VariableQueryEditor = (props: EditorProps) => {
     [onChange, safeQuery]
   );
 
+  const onSortChange = useCallback(
+    (sort: CHVariableSort) => {
+      onChange({ ...safeQuery, sort });
+    },
+    [onChange, safeQuery]
+  );
+
+  const onLimitChange = useCallback(
+    (value: string) => {
+      const limit = parseInt(value, 10);
+      onChange({ ...safeQuery, limit: limit > 0 ? limit : undefined });
+    },
+    [onChange, safeQuery]
+  );
+
   const pickerValue: SchemaPickerValue = useMemo(
     () => ({
       database: safeQuery.database || '',
@@ -234,25 +260,55 @@ export const VariableQueryEditor = (props: EditorProps) => {
           aria-label="SQL Query"
         />
       </InlineField>
+
+      <InlineField
+        label={
+          <InlineFormLabel width={10} className="query-keyword" tooltip="Order of the options, by their text.">
+            Sort
+          </InlineFormLabel>
+        }
+      >
+        <Select
+          width={20}
+          options={VARIABLE_SORT_OPTIONS}
+          value={safeQuery.sort || ''}
+          onChange={(v) => onSortChange(v.value || '')}
+          aria-label="Sort"
+        />
+      </InlineField>
+
+      <InlineField
+        label={
+          <InlineFormLabel
+            width={10}
+            className="query-keyword"
+            tooltip="Most options to keep. The data source also caps options at its max cardinality."
+          >
+            Limit
+          </InlineFormLabel>
+        }
+      >
+        <Input
+          width={20}
+          type="number"
+          min={1}
+          value={safeQuery.limit ?? ''}
+          onChange={(e) => onLimitChange(e.currentTarget.value)}
+          placeholder="No limit"
+          aria-label="Limit"
+        />
+      </InlineField>
     </div>
   );
 };
 
-/**
- * Coerce a metric-find value into a string for a template variable option,
- * preserving null/undefined as null (not the literal string "null"). Variable
- * options are always strings, so this keeps the emitted DataFrame fields
- * string-typed whether the query returned numbers or numeric-looking strings.
- */
-function toVariableString(value: unknown): string | null {
-  return value == null ? null : String(value);
-}
-
 /**
  * CustomVariableSupport binding. Registers the guided editor and runs the
- * resolved `rawSql` through the existing `metricFindQuery` path so all the
- * macro expansion (template variables, time filter, ad-hoc filters) stays in
- * one place.
+ * resolved `rawSql` as a backend variable query, which picks the value and
+ * text columns, drops duplicate values, sorts and bounds the options, and
+ * returns them as `__text` and `__value` string fields that Grafana reads as
+ * variable options. The query goes through `query`, so template variables,
+ * scoped variables, the time range and ad-hoc filters apply as to any query.
  */
 export class CHVariableSupport extends CustomVariableSupport<Datasource, CHVariableQuery> {
   constructor(private readonly datasource: Datasource) {
@@ -265,34 +321,22 @@ export class CHVariableSupport extends CustomVariableSupport<Datasource, CHVaria
     const target = request.targets[0];
     // A saved variable query can be a legacy plain string instead of a
     // CHVariableQuery object, so accept both shapes.
-    const rawSql = typeof target === 'string' ? target : target?.rawSql;
+    const legacy = typeof target === 'string';
+    const rawSql = legacy ? target : target?.rawSql;
     if (!rawSql) {
       return of({ data: [] });
     }
-    // Pass rawSql as a string. metricFindQuery accepts (CHQuery | string) and
-    // wraps a string into a minimal SQL-mode CHQuery internally; that keeps
-    // pluginVersion / refId concerns where they already live. Forward
-    // scopedVars so scoped variables and __searchFilter resolve inside
-    // variable queries (they reach applyTemplateVariables via runQuery).
-    const promise = this.datasource
-      .metricFindQuery(rawSql, { range: request.range, scopedVars: request.scopedVars })
-      .then((values: MetricFindValue[]) => ({
-        // Emit text and value separately so a `SELECT value, label` query
-        // substitutes the value while displaying the label. Fall back to text
-        // when the query returns a single column. Force string typing:
-        // metricFindQuery yields raw column values (numbers, or numeric-looking
-        // strings like toString(toUnixTimestamp(...))), and an untyped
-        // toDataFrame would guess FieldType.number, which makes Grafana's
-        // toMetricFindValues fail to resolve the variable.
-        data: [
-          toDataFrame({
-            fields: [
-              { name: 'text', type: FieldType.string, values: values.map((v) => toVariableString(v.text)) },
-              { name: 'value', type: FieldType.string, values: values.map((v) => toVariableString(v.value ?? v.text)) },
-            ],
-          }),
-        ],
-      }));
-    return from(promise);
+    const query = {
+      refId: (!legacy && target?.refId) || 'var',
+      editorType: EditorType.SQL,
+      rawSql,
+      queryType: 'variable',
+      variable: legacy ? {} : { sort: target.sort || undefined, limit: target.limit || undefined },
+      ...(!legacy && target.parameters ? { parameters: target.parameters } : {}),
+    };
+    return this.datasource.query({
+      ...request,
+      targets: [query as unknown as CHQuery],
+    } as unknown as DataQueryRequest<CHQuery>);
   }
 }
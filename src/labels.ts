@@ -191,6 +191,228 @@ export default {
             'Disable to suppress the probe — operators can still type Map keys manually. Defaults to enabled.',
         },
       },
+      QueryPipelineConfig: {
+        title: 'Query execution',
+        description: 'How the data source runs queries. Empty numbers use the default.',
+        retry: {
+          title: 'Retries',
+          enableQueryRetry: {
+            label: 'Retry transient failures',
+            tooltip:
+              'Retry read-only queries that fail with a transient error, such as a network failure, HTTP 502/503/504 or ' +
+              'too many simultaneous queries.',
+          },
+          queryRetryMaxAttempts: {
+            label: 'Max attempts',
+            placeholder: '3',
+            tooltip: 'Total number of attempts, including the first one.',
+          },
+          queryRetryInitialBackoffMs: {
+            label: 'Initial backoff (ms)',
+            placeholder: '200',
+            tooltip: 'Wait before the first retry, doubled on every further retry.',
+          },
+          queryRetryMaxBackoffMs: {
+            label: 'Max backoff (ms)',
+            placeholder: '5000',
+            tooltip: 'Longest wait between two attempts.',
+          },
+        },
+        audit: {
+          title: 'Audit log',
+          enableAuditLog: {
+            label: 'Audit log',
+            tooltip:
+              'Log every query with its SQL, duration, rows and bytes read, and the user, dashboard, panel or alert rule it ran for.',
+          },
+          auditLogSampleRate: {
+            label: 'Sample rate',
+            placeholder: '1',
+            tooltip: 'Fraction of queries the audit log records, between 0 and 1. Slow queries are always recorded.',
+          },
+          auditLogSqlMode: {
+            label: 'SQL in logs',
+            tooltip: 'How SQL appears in audit and slow query log lines.',
+            options: [
+              { label: 'Full', value: 'full' },
+              { label: 'Redacted', value: 'redacted', description: 'Literals replaced by ?' },
+              { label: 'Hashed', value: 'hashed', description: 'SHA-256 digest of the statement' },
+            ],
+          },
+          slowQueryThresholdMs: {
+            label: 'Slow query threshold (ms)',
+            placeholder: '0',
+            tooltip: 'Log queries that run at least this long as warnings, even with the audit log off. 0 disables it.',
+          },
+        },
+        guardrails: {
+          title: 'Guardrails',
+          description: 'Resource limits ClickHouse enforces on queries. Empty fields leave a limit unset.',
+          tiers: {
+            dashboardGuardrails: 'Dashboards',
+            exploreGuardrails: 'Explore',
+            alertGuardrails: 'Alert rules',
+          },
+          maxExecutionTime: {
+            label: 'Max execution time (seconds)',
+            tooltip: 'Longest a query may run.',
+          },
+          maxRowsToRead: {
+            label: 'Max rows to read',
+            tooltip: 'Most rows a query may read.',
+          },
+          maxBytesToRead: {
+            label: 'Max bytes to read',
+            tooltip: 'Most bytes a query may read.',
+          },
+          maxResultRows: {
+            label: 'Max result rows',
+            tooltip: 'Most rows a query may return.',
+          },
+          overflowMode: {
+            label: 'Overflow mode',
+            tooltip: 'What happens when a read or result limit is hit.',
+            options: [
+              { label: 'Throw', value: 'throw', description: 'Fail the query' },
+              { label: 'Break', value: 'break', description: 'Return the partial result' },
+            ],
+          },
+        },
+        cost: {
+          title: 'Cost estimation',
+          enableCostEstimation: {
+            label: 'Estimate query cost',
+            tooltip:
+              'Run EXPLAIN ESTIMATE before dashboard queries, show the parts, rows and marks they will read, and hold them ' +
+              'against the thresholds below.',
+          },
+          costEstimateMaxRows: {
+            label: 'Max rows',
+            tooltip: 'Threshold on the estimated rows to read. Empty leaves it unset.',
+          },
+          costEstimateMaxParts: {
+            label: 'Max parts',
+            tooltip: 'Threshold on the estimated parts to read. Empty leaves it unset.',
+          },
+          costEstimateMaxMarks: {
+            label: 'Max marks',
+            tooltip: 'Threshold on the estimated marks to read. Empty leaves it unset.',
+          },
+          costEstimateAction: {
+            label: 'Over a threshold',
+            tooltip: 'What happens to a query over a threshold.',
+            options: [
+              { label: 'Warn', value: 'warn', description: 'Run the query with a warning' },
+              { label: 'Reject', value: 'reject', description: 'Fail the query without running it' },
+            ],
+          },
+        },
+        tables: {
+          title: 'Table restrictions',
+          description:
+            'Restrict the tables queries may read, on top of ClickHouse grants. Entries are database.table globs, such as ' +
+            'team_x.*; an entry without a dot covers a whole database. The more specific entry wins.',
+          allowedTables: {
+            label: 'Allowed tables',
+            tooltip: 'Tables queries may read. When set, every other table is denied.',
+          },
+          deniedTables: {
+            label: 'Denied tables',
+            tooltip: 'Tables queries may not read.',
+          },
+        },
+        concurrency: {
+          title: 'Concurrency',
+          maxConcurrentQueries: {
+            label: 'Max concurrent queries',
+            tooltip: 'Queries of this data source running at once; others wait in a queue. Empty is unlimited.',
+          },
+          maxConcurrentQueriesPerUser: {
+            label: 'Max concurrent queries per user',
+            tooltip: 'Queries of one user running at once. Empty is unlimited.',
+          },
+          queryQueueTimeoutMs: {
+            label: 'Queue timeout (ms)',
+            placeholder: '30000',
+            tooltip: 'How long a query may wait in the queue before it fails.',
+          },
+        },
+        cache: {
+          title: 'Caching',
+          enableQueryDeduplication: {
+            label: 'Deduplicate queries',
+            tooltip: 'Identical queries running at the same time share one execution.',
+          },
+          enableResultCache: {
+            label: 'Result cache',
+            tooltip: 'Keep the results of dashboard queries in memory. Explore and alert queries always run.',
+          },
+          resultCacheTtlSeconds: {
+            label: 'Cache TTL (seconds)',
+            placeholder: '60',
+            tooltip: 'How long results stay cached. A query can set its own TTL.',
+          },
+          resultCacheMaxSizeMb: {
+            label: 'Cache size (MB)',
+            placeholder: '64',
+            tooltip: 'Memory the cached results may hold.',
+          },
+          alignTimeRangeToInterval: {
+            label: 'Align time ranges to the interval',
+            tooltip:
+              'Round the time range of dashboard queries out to their interval, so that refreshes within an interval hit the cache.',
+          },
+        },
+        longRanges: {
+          title: 'Long time ranges',
+          enableIncrementalQueries: {
+            label: 'Incremental refresh',
+            tooltip:
+              'Refreshing time series panels bucketed by $__timeInterval only query the time that is new since the last refresh.',
+          },
+          enableChunkedQueries: {
+            label: 'Chunked queries',
+            tooltip: 'Split queries over long time ranges into chunks that run as separate queries.',
+          },
+          chunkedQueryMinRangeHours: {
+            label: 'Min range (hours)',
+            placeholder: '24',
+            tooltip: 'Shortest time range that is split.',
+          },
+          chunkedQueryChunks: {
+            label: 'Chunks',
+            placeholder: '4',
+            tooltip: 'Number of chunks a time range is split into.',
+          },
+          chunkedQueryParallelism: {
+            label: 'Parallelism',
+            placeholder: '2',
+            tooltip: 'Chunks of a query running at once.',
+          },
+        },
+        sampling: {
+          title: 'Sampling',
+          enableAutoSampling: {
+            label: 'Automatic sampling',
+            tooltip:
+              'Sample dashboard and Explore queries that read a single table with a sampling key when they would read more ' +
+              'than the target rows.',
+          },
+          autoSampleTargetRows: {
+            label: 'Target rows',
+            placeholder: '10000000',
+            tooltip: 'About how many rows a sampled query reads.',
+          },
+        },
+        variables: {
+          title: 'Variables',
+          variableMaxCardinality: {
+            label: 'Max variable values',
+            placeholder: '10000',
+            tooltip: 'Most values a variable query returns.',
+          },
+        },
+      },
       TracesConfig: {
         title: 'Traces configuration',
         description: '(Optional) Default settings for trace queries',
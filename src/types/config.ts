@@ -87,6 +87,70 @@ export interface CHConfig extends DataSourceJsonData {
    * Signal type for single-table mode. Declares what the configured table contains.
    */
   signalType?: SignalType;
+
+  /**
+   * Query execution settings, read by the backend. Numbers left unset, or 0,
+   * use the backend default; see QueryPipelineConfig.
+   */
+  enableQueryRetry?: boolean;
+  queryRetryMaxAttempts?: number;
+  queryRetryInitialBackoffMs?: number;
+  queryRetryMaxBackoffMs?: number;
+
+  enableAuditLog?: boolean;
+  auditLogSampleRate?: number;
+  auditLogSqlMode?: AuditLogSqlMode;
+  slowQueryThresholdMs?: number;
+
+  dashboardGuardrails?: CHQueryGuardrails;
+  exploreGuardrails?: CHQueryGuardrails;
+  alertGuardrails?: CHQueryGuardrails;
+
+  enableCostEstimation?: boolean;
+  costEstimateMaxRows?: number;
+  costEstimateMaxParts?: number;
+  costEstimateMaxMarks?: number;
+  costEstimateAction?: CostEstimateAction;
+
+  allowedTables?: string[];
+  deniedTables?: string[];
+
+  maxConcurrentQueries?: number;
+  maxConcurrentQueriesPerUser?: number;
+  queryQueueTimeoutMs?: number;
+
+  enableQueryDeduplication?: boolean;
+  enableResultCache?: boolean;
+  resultCacheTtlSeconds?: number;
+  resultCacheMaxSizeMb?: number;
+  alignTimeRangeToInterval?: boolean;
+
+  enableIncrementalQueries?: boolean;
+  enableChunkedQueries?: boolean;
+  chunkedQueryMinRangeHours?: number;
+  chunkedQueryChunks?: number;
+  chunkedQueryParallelism?: number;
+
+  enableAutoSampling?: boolean;
+  autoSampleTargetRows?: number;
+
+  variableMaxCardinality?: number;
+}
+
+export type AuditLogSqlMode = 'full' | 'redacted' | 'hashed';
+
+export type CostEstimateAction = 'warn' | 'reject';
+
+/**
+ * Resource limits ClickHouse enforces on the queries of one tier: dashboards,
+ * Explore or alert rules.
+ */
+export interface CHQueryGuardrails {
+  maxExecutionTime?: number;
+  maxRowsToRead?: number;
+  maxBytesToRead?: number;
+  maxResultRows?: number;
+  overflowMode?: 'throw' | 'break';
 }
 
 interface CHSecureConfigProperties {
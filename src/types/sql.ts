@@ -20,6 +20,22 @@ export interface CHQueryBase extends DataQuery {
    * src: https://github.com/grafana/sqlds/blob/dda2dc0a54b128961fc9f7885baabf555f3ddfdc/query.go#L36
    */
   format?: number;
+
+  /**
+   * Server-side query parameters, by name, referenced in rawSql as {name:Type}.
+   */
+  parameters?: Record<string, QueryParameter>;
+}
+
+export type QueryParameterScalar = string | number | boolean | null;
+
+/**
+ * QueryParameter is a server-side query parameter: its ClickHouse type, and its value, an array for an Array type.
+ * String values may hold template variables.
+ */
+export interface QueryParameter {
+  type: string;
+  value: QueryParameterScalar | QueryParameterScalar[];
 }
 
 export interface CHSqlQuery extends CHQueryBase {
@@ -36,6 +36,7 @@ import { Divider } from 'components/Divider';
 import { TimeUnit } from 'types/queryBuilder';
 import { DefaultDatabaseTableConfig } from 'components/configEditor/DefaultDatabaseTableConfig';
 import { QuerySettingsConfig } from 'components/configEditor/QuerySettingsConfig';
+import { QueryPipelineConfig, hasQueryPipelineSettings } from 'components/configEditor/QueryPipelineConfig';
 import { LogsConfig } from 'components/configEditor/LogsConfig';
 import { TracesConfig } from 'components/configEditor/TracesConfig';
 import { HttpHeadersConfig } from 'components/configEditor/HttpHeadersConfig';
@@ -267,7 +268,8 @@ export const ConfigEditor: React.FC<ConfigEditorProps> = (props) => {
     options.jsonData.enableSecureSocksProxy ||
     options.jsonData.customSettings ||
     options.jsonData.logs ||
-    options.jsonData.traces
+    options.jsonData.traces ||
+    hasQueryPipelineSettings(options.jsonData)
   );
   const configMode = jsonData.configMode || (jsonData.signalType ? 'single-table' : 'classic');
   const isSingleTableMode = configMode === 'single-table';
@@ -674,6 +676,8 @@ export const ConfigEditor: React.FC<ConfigEditorProps> = (props) => {
               onEnableMapKeysDiscoveryChange={(e) => onSwitchToggle('enableMapKeysDiscovery', e.currentTarget.checked)}
             />
           </ConfigSection>
+          <Divider />
+          <QueryPipelineConfig options={options} onOptionsChange={onOptionsChange} />
         </>
       )}
 
@@ -744,6 +748,9 @@ export const ConfigEditor: React.FC<ConfigEditorProps> = (props) => {
               }}
             />
 
+            <Divider />
+            <QueryPipelineConfig options={options} onOptionsChange={onOptionsChange} />
+
             <Divider />
             <LogsConfig
               logsConfig={jsonData.logs}
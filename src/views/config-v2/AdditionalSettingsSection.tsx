@@ -19,6 +19,7 @@ import { AliasTableConfig } from 'components/configEditor/AliasTableConfig';
 import { DefaultDatabaseTableConfig } from 'components/configEditor/DefaultDatabaseTableConfig';
 import { LogsConfig } from 'components/configEditor/LogsConfig';
 import { QuerySettingsConfig } from 'components/configEditor/QuerySettingsConfig';
+import { QueryPipelineConfig, hasQueryPipelineSettings } from 'components/configEditor/QueryPipelineConfig';
 import { TracesConfig } from 'components/configEditor/TracesConfig';
 import { config } from '@grafana/runtime';
 import { TimeUnit } from 'types/queryBuilder';
@@ -144,6 +145,7 @@ export const AdditionalSettingsSection = (props: Props) => {
             !isEqual(traces, defaultTraces)
           );
         })()) ||
+      hasQueryPipelineSettings(jsonData) ||
       (jsonData.aliasTables?.length ?? 0) > 0 ||
       !!jsonData.enableRowLimit ||
       !!jsonData.enableSecureSocksProxy ||
@@ -278,6 +280,8 @@ export const AdditionalSettingsSection = (props: Props) => {
             <Divider />
           </>
         )}
+        <QueryPipelineConfig options={options} onOptionsChange={onOptionsChange} />
+        <Divider />
         <AliasTableConfig aliasTables={jsonData.aliasTables} onAliasTablesChange={onAliasTableConfigChange} />
         <Divider />
         <Field label={labels.enableRowLimit.label} description={labels.enableRowLimit.tooltip}>